@@ -0,0 +1,251 @@
+package clients
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	goccy "github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+	echolog "github.com/labstack/gommon/log"
+	"github.com/sharify-labs/spine/config"
+)
+
+// Billing is the payment provider used for plan subscriptions.
+// It speaks the Stripe API, so pointing BILLING_API_URL at a fake server is enough for local testing.
+var Billing BillingProvider = &stripeClient{}
+
+var (
+	ErrBillingDisabled  = errors.New("billing is not configured")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+)
+
+// webhookTolerance is how old a signed webhook can be before it is rejected as a replay.
+const webhookTolerance = 5 * time.Minute
+
+// BillingProvider creates checkout sessions and verifies subscription webhooks.
+type BillingProvider interface {
+	Connect()
+	// Enabled reports whether the provider is configured. All other methods return ErrBillingDisabled if not.
+	Enabled() bool
+	CreateCheckoutSession(ctx context.Context, params *CheckoutParams) (*CheckoutSession, error)
+	// ParseWebhook verifies the signature header of a webhook and parses its payload.
+	ParseWebhook(payload []byte, signature string) (*BillingEvent, error)
+}
+
+// CheckoutParams describes the subscription a User wants to check out.
+type CheckoutParams struct {
+	UserID  string
+	Email   string
+	PlanID  uint
+	PriceID string // Plan.BillingPriceID
+}
+
+// CheckoutSession is a hosted checkout page the User is redirected to.
+type CheckoutSession struct {
+	ID  string
+	URL string
+}
+
+// BillingEventType is the normalized type of a billing webhook.
+type BillingEventType string
+
+const (
+	BillingEventIgnored               BillingEventType = ""
+	BillingEventSubscriptionCreated   BillingEventType = "subscription_created"
+	BillingEventSubscriptionRenewed   BillingEventType = "subscription_renewed"
+	BillingEventSubscriptionCancelled BillingEventType = "subscription_cancelled"
+	BillingEventPaymentFailed         BillingEventType = "payment_failed"
+)
+
+// BillingEvent is a verified subscription webhook.
+// UserID and PlanID come from the subscription metadata set at checkout. They are empty for events about
+// subscriptions that weren't created through checkout.
+type BillingEvent struct {
+	ID             string
+	Type           BillingEventType
+	SubscriptionID string
+	CustomerID     string
+	UserID         string
+	PlanID         uint
+	PeriodEnd      time.Time
+}
+
+var stripeEventTypes = map[string]BillingEventType{
+	"customer.subscription.created": BillingEventSubscriptionCreated,
+	"invoice.paid":                  BillingEventSubscriptionRenewed,
+	"customer.subscription.deleted": BillingEventSubscriptionCancelled,
+	"invoice.payment_failed":        BillingEventPaymentFailed,
+}
+
+type stripeClient struct {
+	client        *http.Client
+	apiURL        string
+	secretKey     string
+	webhookSecret string
+	returnURL     string
+}
+
+func (c *stripeClient) Connect() {
+	c.client = &http.Client{Timeout: 15 * time.Second}
+	c.apiURL = strings.TrimRight(config.GetOrDefault("BILLING_API_URL", "https://api.stripe.com"), "/")
+	c.secretKey = config.GetOrDefault("BILLING_SECRET_KEY", "")
+	if c.Enabled() {
+		c.webhookSecret = config.Get[string]("BILLING_WEBHOOK_SECRET")
+		c.returnURL = config.Get[string]("BILLING_RETURN_URL")
+	}
+}
+
+func (c *stripeClient) Enabled() bool {
+	return c.secretKey != ""
+}
+
+// CreateCheckoutSession creates a subscription checkout session for a plan's price.
+// The User and Plan IDs are attached as subscription metadata so that webhooks can be linked back to them.
+func (c *stripeClient) CreateCheckoutSession(ctx context.Context, params *CheckoutParams) (*CheckoutSession, error) {
+	if !c.Enabled() {
+		return nil, ErrBillingDisabled
+	}
+	planID := strconv.FormatUint(uint64(params.PlanID), 10)
+	form := url.Values{
+		"mode":                                 {"subscription"},
+		"line_items[0][price]":                 {params.PriceID},
+		"line_items[0][quantity]":              {"1"},
+		"client_reference_id":                  {params.UserID},
+		"customer_email":                       {params.Email},
+		"success_url":                          {c.returnURL},
+		"cancel_url":                           {c.returnURL},
+		"subscription_data[metadata][user_id]": {params.UserID},
+		"subscription_data[metadata][plan_id]": {planID},
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, c.apiURL+"/v1/checkout/sessions", strings.NewReader(form.Encode()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+c.secretKey)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	req.Header.Set("User-Agent", config.UserAgent)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			echolog.Errorf("failed to close billing response body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("billing provider returned status %d creating checkout session", resp.StatusCode)
+	}
+	var session struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	if err = goccy.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return nil, err
+	}
+	return &CheckoutSession{ID: session.ID, URL: session.URL}, nil
+}
+
+// ParseWebhook verifies a Stripe-style signature header (t=<unix>,v1=<hex hmac>[,v1=...])
+// and parses the event. Multiple v1 signatures are accepted to support rotating webhook secrets.
+func (c *stripeClient) ParseWebhook(payload []byte, signature string) (*BillingEvent, error) {
+	if !c.Enabled() {
+		return nil, ErrBillingDisabled
+	}
+	if err := verifyStripeSignature(payload, signature, c.webhookSecret, time.Now()); err != nil {
+		return nil, err
+	}
+
+	var event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object struct {
+				ID               string            `json:"id"`
+				Object           string            `json:"object"`
+				Customer         string            `json:"customer"`
+				Subscription     string            `json:"subscription"`
+				Metadata         map[string]string `json:"metadata"`
+				CurrentPeriodEnd int64             `json:"current_period_end"`
+				PeriodEnd        int64             `json:"period_end"`
+				// Invoices carry a copy of their subscription's metadata.
+				SubscriptionDetails struct {
+					Metadata map[string]string `json:"metadata"`
+				} `json:"subscription_details"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	if err := goccy.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+
+	obj := event.Data.Object
+	res := &BillingEvent{
+		ID:         event.ID,
+		Type:       stripeEventTypes[event.Type],
+		CustomerID: obj.Customer,
+	}
+	metadata := obj.Metadata
+	switch obj.Object {
+	case "subscription":
+		res.SubscriptionID = obj.ID
+		res.PeriodEnd = time.Unix(obj.CurrentPeriodEnd, 0).UTC()
+	case "invoice":
+		res.SubscriptionID = obj.Subscription
+		res.PeriodEnd = time.Unix(obj.PeriodEnd, 0).UTC()
+		metadata = obj.SubscriptionDetails.Metadata
+	}
+	res.UserID = metadata["user_id"]
+	if planID, err := strconv.ParseUint(metadata["plan_id"], 10, 0); err == nil {
+		res.PlanID = uint(planID)
+	}
+	return res, nil
+}
+
+// verifyStripeSignature checks that header contains a valid signature of payload made with secret within webhookTolerance of now.
+func verifyStripeSignature(payload []byte, header, secret string, now time.Time) error {
+	var timestamp string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			if sig, err := hex.DecodeString(value); err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > webhookTolerance || age < -webhookTolerance {
+		return ErrInvalidSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+	for _, sig := range signatures {
+		if hmac.Equal(sig, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
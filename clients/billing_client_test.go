@@ -0,0 +1,195 @@
+package clients
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testBillingKey     = "sk_test"
+	testWebhookSecret  = "whsec_test"
+	testBillingReturn  = "https://spine.test/dashboard"
+	testCheckoutURL    = "https://checkout.test/cs_123"
+	testSubscriptionID = "sub_123"
+)
+
+// newTestStripe returns a stripeClient connected to apiURL.
+func newTestStripe(t *testing.T, apiURL string) *stripeClient {
+	t.Helper()
+	t.Setenv("BILLING_API_URL", apiURL)
+	t.Setenv("BILLING_SECRET_KEY", testBillingKey)
+	t.Setenv("BILLING_WEBHOOK_SECRET", testWebhookSecret)
+	t.Setenv("BILLING_RETURN_URL", testBillingReturn)
+	c := &stripeClient{}
+	c.Connect()
+	return c
+}
+
+// signStripe returns a Stripe-Signature header for payload signed with secret at ts.
+func signStripe(payload []byte, secret string, ts time.Time) string {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestStripeCreateCheckoutSession(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/checkout/sessions" {
+			t.Errorf("request = %s %s, want POST /v1/checkout/sessions", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer "+testBillingKey {
+			t.Errorf("Authorization = %q", got)
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range map[string]string{
+			"mode":                                 "subscription",
+			"line_items[0][price]":                 "price_pro",
+			"line_items[0][quantity]":              "1",
+			"client_reference_id":                  "user1",
+			"customer_email":                       "user@example.com",
+			"success_url":                          testBillingReturn,
+			"subscription_data[metadata][user_id]": "user1",
+			"subscription_data[metadata][plan_id]": "7",
+		} {
+			if got := r.PostForm.Get(key); got != want {
+				t.Errorf("%s = %q, want %q", key, got, want)
+			}
+		}
+		_, _ = w.Write([]byte(`{"id":"cs_123","url":"` + testCheckoutURL + `"}`))
+	}))
+	defer srv.Close()
+
+	session, err := newTestStripe(t, srv.URL).CreateCheckoutSession(context.Background(), &CheckoutParams{
+		UserID:  "user1",
+		Email:   "user@example.com",
+		PlanID:  7,
+		PriceID: "price_pro",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.ID != "cs_123" || session.URL != testCheckoutURL {
+		t.Fatalf("session = %+v", session)
+	}
+}
+
+func TestStripeCreateCheckoutSessionError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":{"message":"No such price"}}`))
+	}))
+	defer srv.Close()
+
+	if _, err := newTestStripe(t, srv.URL).CreateCheckoutSession(context.Background(), &CheckoutParams{
+		UserID: "user1", PlanID: 7, PriceID: "price_missing",
+	}); err == nil {
+		t.Fatal("expected an error for a rejected checkout session")
+	}
+}
+
+func TestStripeParseWebhook(t *testing.T) {
+	c := newTestStripe(t, "http://billing.invalid")
+	periodEnd := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name    string
+		payload string
+		want    BillingEvent
+	}{
+		{
+			name: "subscription",
+			payload: `{"id":"evt_1","type":"customer.subscription.created","data":{"object":{"id":"` +
+				testSubscriptionID + `","object":"subscription","customer":"cus_1",` +
+				`"metadata":{"user_id":"user1","plan_id":"7"},"current_period_end":` +
+				strconv.FormatInt(periodEnd.Unix(), 10) + `}}}`,
+			want: BillingEvent{
+				ID: "evt_1", Type: BillingEventSubscriptionCreated, SubscriptionID: testSubscriptionID,
+				CustomerID: "cus_1", UserID: "user1", PlanID: 7, PeriodEnd: periodEnd,
+			},
+		},
+		{
+			name: "invoice",
+			payload: `{"id":"evt_2","type":"invoice.paid","data":{"object":{"id":"in_1","object":"invoice",` +
+				`"customer":"cus_1","subscription":"` + testSubscriptionID + `","period_end":` +
+				strconv.FormatInt(periodEnd.Unix(), 10) +
+				`,"subscription_details":{"metadata":{"user_id":"user1","plan_id":"7"}}}}}`,
+			want: BillingEvent{
+				ID: "evt_2", Type: BillingEventSubscriptionRenewed, SubscriptionID: testSubscriptionID,
+				CustomerID: "cus_1", UserID: "user1", PlanID: 7, PeriodEnd: periodEnd,
+			},
+		},
+		{
+			name:    "ignored",
+			payload: `{"id":"evt_3","type":"customer.created","data":{"object":{"id":"cus_1","object":"customer"}}}`,
+			want:    BillingEvent{ID: "evt_3", Type: BillingEventIgnored},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := []byte(tt.payload)
+			event, err := c.ParseWebhook(payload, signStripe(payload, testWebhookSecret, time.Now()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *event != tt.want {
+				t.Fatalf("event = %+v, want %+v", *event, tt.want)
+			}
+
+			tampered := []byte(strings.Replace(tt.payload, `"evt_`, `"evt_9`, 1))
+			_, err = c.ParseWebhook(tampered, signStripe(payload, testWebhookSecret, time.Now()))
+			if !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("tampered payload: err = %v, want ErrInvalidSignature", err)
+			}
+		})
+	}
+}
+
+func TestVerifyStripeSignature(t *testing.T) {
+	payload := []byte(`{"id":"evt_1"}`)
+	now := time.Unix(1700000000, 0)
+	valid := signStripe(payload, testWebhookSecret, now)
+	_, validSig, _ := strings.Cut(valid, ",v1=")
+	otherSig := strings.TrimPrefix(strings.Split(signStripe(payload, "whsec_old", now), ",")[1], "v1=")
+	ts := "t=" + strconv.FormatInt(now.Unix(), 10)
+
+	tests := []struct {
+		name   string
+		header string
+		now    time.Time
+		ok     bool
+	}{
+		{name: "valid", header: valid, now: now, ok: true},
+		{name: "within tolerance", header: valid, now: now.Add(webhookTolerance - time.Second), ok: true},
+		{name: "too old", header: valid, now: now.Add(webhookTolerance + time.Second)},
+		{name: "too far in the future", header: valid, now: now.Add(-webhookTolerance - time.Second)},
+		{name: "wrong secret", header: ts + ",v1=" + otherSig, now: now},
+		{name: "rotated secret", header: ts + ",v1=" + otherSig + ",v1=" + validSig, now: now, ok: true},
+		{name: "scheme v0 ignored", header: ts + ",v0=" + validSig, now: now},
+		{name: "not hex", header: ts + ",v1=zz,v1=" + validSig, now: now, ok: true},
+		{name: "missing timestamp", header: "v1=" + validSig, now: now},
+		{name: "missing signature", header: ts, now: now},
+		{name: "empty", header: "", now: now},
+		{name: "other timestamp", header: "t=1700000001,v1=" + validSig, now: now},
+	}
+	for _, tt := range tests {
+		err := verifyStripeSignature(payload, tt.header, testWebhookSecret, tt.now)
+		if tt.ok && err != nil {
+			t.Errorf("%s: err = %v, want nil", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: err = %v, want ErrInvalidSignature", tt.name, err)
+		}
+	}
+}
@@ -3,4 +3,7 @@ package clients
 func Setup() {
 	HTTP.Connect()
 	Sentry.Connect()
+	Billing.Connect()
+	DNSRecords.Connect()
+	Mail.Connect()
 }
@@ -0,0 +1,262 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goccy "github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+	echolog "github.com/labstack/gommon/log"
+	"github.com/sharify-labs/spine/config"
+)
+
+// DNSRecords provisions the DNS records that point hosts at Canvas.
+// It speaks the Cloudflare API, so pointing CLOUDFLARE_API_URL at a fake server is enough for local testing.
+var DNSRecords DNSProvider = &cloudflareClient{}
+
+// ErrZoneNotFound is returned when a root domain isn't managed by the DNS provider (ex: custom domains).
+var ErrZoneNotFound = errors.New("dns zone not found")
+
+// managedRecordComment marks records created by Spine. Records without it are never modified or deleted.
+const managedRecordComment = "managed by " + config.UserAgent
+
+// DNSProvider creates and deletes the DNS records for hosts.
+// Only records created by the provider itself are ever updated or deleted.
+type DNSProvider interface {
+	Connect()
+	// Enabled reports whether the provider is configured. When disabled, all other methods are no-ops.
+	Enabled() bool
+	// EnsureRecord creates the record for hostname under root, or fixes it if it has drifted.
+	EnsureRecord(ctx context.Context, root, hostname string) error
+	// DeleteRecord deletes the record for hostname under root.
+	DeleteRecord(ctx context.Context, root, hostname string) error
+	// ListRecords returns the hostnames of all records managed by the provider under root.
+	ListRecords(ctx context.Context, root string) ([]string, error)
+}
+
+type cloudflareClient struct {
+	client     *http.Client
+	apiURL     string
+	apiToken   string
+	recordType string
+	content    string
+	proxied    bool
+	zones      sync.Map // root domain -> zone ID
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	Proxied bool   `json:"proxied"`
+	TTL     int    `json:"ttl"`
+	Comment string `json:"comment"`
+}
+
+func (c *cloudflareClient) Connect() {
+	c.client = &http.Client{Timeout: 15 * time.Second}
+	c.apiURL = strings.TrimRight(config.GetOrDefault("CLOUDFLARE_API_URL", "https://api.cloudflare.com/client/v4"), "/")
+	c.apiToken = config.GetOrDefault("CLOUDFLARE_API_TOKEN", "")
+	if c.Enabled() {
+		c.recordType = strings.ToUpper(config.GetOrDefault("DNS_RECORD_TYPE", "CNAME"))
+		c.content = config.Get[string]("DNS_RECORD_CONTENT")
+		c.proxied = config.GetOrDefault("CLOUDFLARE_PROXIED", 1) == 1
+	}
+}
+
+func (c *cloudflareClient) Enabled() bool {
+	return c.apiToken != ""
+}
+
+func (c *cloudflareClient) EnsureRecord(ctx context.Context, root, hostname string) error {
+	if !c.Enabled() {
+		return nil
+	}
+	zoneID, err := c.zoneID(ctx, root)
+	if err != nil {
+		return err
+	}
+	records, err := c.listRecords(ctx, zoneID, url.Values{"name": {hostname}})
+	if err != nil {
+		return err
+	}
+
+	want := cloudflareRecord{
+		Type:    c.recordType,
+		Name:    hostname,
+		Content: c.content,
+		Proxied: c.proxied,
+		TTL:     1, // automatic
+		Comment: managedRecordComment,
+	}
+	for _, r := range records {
+		if r.Comment != managedRecordComment {
+			return nil // record was created manually, leave it alone
+		}
+		if r.Type == want.Type && r.Content == want.Content && r.Proxied == want.Proxied {
+			return nil
+		}
+		return c.do(ctx, http.MethodPut, "/zones/"+zoneID+"/dns_records/"+r.ID, nil, want, nil)
+	}
+	return c.do(ctx, http.MethodPost, "/zones/"+zoneID+"/dns_records", nil, want, nil)
+}
+
+func (c *cloudflareClient) DeleteRecord(ctx context.Context, root, hostname string) error {
+	if !c.Enabled() {
+		return nil
+	}
+	zoneID, err := c.zoneID(ctx, root)
+	if err != nil {
+		return err
+	}
+	records, err := c.listRecords(ctx, zoneID, url.Values{"name": {hostname}})
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.Comment != managedRecordComment {
+			continue
+		}
+		if err = c.do(ctx, http.MethodDelete, "/zones/"+zoneID+"/dns_records/"+r.ID, nil, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cloudflareClient) ListRecords(ctx context.Context, root string) ([]string, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	zoneID, err := c.zoneID(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	records, err := c.listRecords(ctx, zoneID, url.Values{"comment": {managedRecordComment}})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(records))
+	for _, r := range records {
+		if r.Comment == managedRecordComment {
+			names = append(names, r.Name)
+		}
+	}
+	return names, nil
+}
+
+// zoneID looks up (and remembers) the ID of the zone for a root domain.
+func (c *cloudflareClient) zoneID(ctx context.Context, root string) (string, error) {
+	if id, ok := c.zones.Load(root); ok {
+		return id.(string), nil //nolint:errcheck // only strings are stored
+	}
+	var zones []struct {
+		ID string `json:"id"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/zones", url.Values{"name": {root}}, nil, &zones); err != nil {
+		return "", err
+	}
+	if len(zones) == 0 {
+		return "", ErrZoneNotFound
+	}
+	c.zones.Store(root, zones[0].ID)
+	return zones[0].ID, nil
+}
+
+// listRecords returns all records in a zone matching the query, following pagination.
+func (c *cloudflareClient) listRecords(ctx context.Context, zoneID string, query url.Values) ([]cloudflareRecord, error) {
+	var all []cloudflareRecord
+	query.Set("per_page", "500")
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		var records []cloudflareRecord
+		info, err := c.doPage(ctx, http.MethodGet, "/zones/"+zoneID+"/dns_records", query, nil, &records)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, records...)
+		if page >= info.TotalPages {
+			return all, nil
+		}
+	}
+}
+
+func (c *cloudflareClient) do(ctx context.Context, method, path string, query url.Values, body, result any) error {
+	_, err := c.doPage(ctx, method, path, query, body, result)
+	return err
+}
+
+type cloudflareResultInfo struct {
+	TotalPages int `json:"total_pages"`
+}
+
+// doPage sends a request to the Cloudflare API and decodes the "result" of the response envelope into result.
+func (c *cloudflareClient) doPage(
+	ctx context.Context, method, path string, query url.Values, body, result any,
+) (*cloudflareResultInfo, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := goccy.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	reqURL := c.apiURL + path
+	if query != nil {
+		reqURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+c.apiToken)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("User-Agent", config.UserAgent)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			echolog.Errorf("failed to close cloudflare response body: %v", err)
+		}
+	}()
+
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result     goccy.RawMessage     `json:"result"`
+		ResultInfo cloudflareResultInfo `json:"result_info"`
+	}
+	if err = goccy.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return nil, fmt.Errorf("cloudflare %s %s returned status %d: %w", method, path, resp.StatusCode, err)
+	}
+	if !envelope.Success {
+		msgs := make([]string, 0, len(envelope.Errors))
+		for _, e := range envelope.Errors {
+			msgs = append(msgs, strconv.Itoa(e.Code)+": "+e.Message)
+		}
+		return nil, fmt.Errorf("cloudflare %s %s failed (%d): %s", method, path, resp.StatusCode, strings.Join(msgs, "; "))
+	}
+	if result != nil && len(envelope.Result) > 0 {
+		if err = goccy.Unmarshal(envelope.Result, result); err != nil {
+			return nil, err
+		}
+	}
+	return &envelope.ResultInfo, nil
+}
@@ -0,0 +1,305 @@
+package clients
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	goccy "github.com/goccy/go-json"
+)
+
+const (
+	testZoneRoot = "example.com"
+	testZoneID   = "zone1"
+	testToken    = "test-token"
+	testContent  = "canvas.example.net"
+)
+
+// fakeCloudflare is an in-memory Cloudflare API serving a single zone. It pages record listings two at a time.
+type fakeCloudflare struct {
+	mu       sync.Mutex
+	records  []cloudflareRecord
+	nextID   int
+	requests []string // "<method> <path>" of every request
+	fail     bool     // respond to every request with an API error
+}
+
+func (f *fakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if r.Header.Get("Authorization") != "Bearer "+testToken {
+		f.respondErr(w, http.StatusForbidden, 10000, "Authentication error")
+		return
+	}
+	if f.fail {
+		f.respondErr(w, http.StatusBadRequest, 81057, "Record already exists.")
+		return
+	}
+
+	recordsPath := "/zones/" + testZoneID + "/dns_records"
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/zones":
+		zones := []map[string]string{}
+		if r.URL.Query().Get("name") == testZoneRoot {
+			zones = append(zones, map[string]string{"id": testZoneID})
+		}
+		f.respond(w, zones, 1)
+	case r.Method == http.MethodGet && r.URL.Path == recordsPath:
+		var matched []cloudflareRecord
+		for _, rec := range f.records {
+			if name := r.URL.Query().Get("name"); name != "" && rec.Name != name {
+				continue
+			}
+			if comment := r.URL.Query().Get("comment"); comment != "" && rec.Comment != comment {
+				continue
+			}
+			matched = append(matched, rec)
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		start, end := min((page-1)*2, len(matched)), min(page*2, len(matched))
+		f.respond(w, matched[start:end], max((len(matched)+1)/2, 1))
+	case r.Method == http.MethodPost && r.URL.Path == recordsPath:
+		var rec cloudflareRecord
+		if err := goccy.NewDecoder(r.Body).Decode(&rec); err != nil {
+			f.respondErr(w, http.StatusBadRequest, 9207, err.Error())
+			return
+		}
+		f.nextID++
+		rec.ID = "rec" + strconv.Itoa(f.nextID)
+		f.records = append(f.records, rec)
+		f.respond(w, rec, 0)
+	case strings.HasPrefix(r.URL.Path, recordsPath+"/"):
+		id := strings.TrimPrefix(r.URL.Path, recordsPath+"/")
+		i := slices.IndexFunc(f.records, func(rec cloudflareRecord) bool { return rec.ID == id })
+		if i < 0 {
+			f.respondErr(w, http.StatusNotFound, 81044, "Record does not exist.")
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			var rec cloudflareRecord
+			if err := goccy.NewDecoder(r.Body).Decode(&rec); err != nil {
+				f.respondErr(w, http.StatusBadRequest, 9207, err.Error())
+				return
+			}
+			rec.ID = id
+			f.records[i] = rec
+			f.respond(w, rec, 0)
+		case http.MethodDelete:
+			f.records = slices.Delete(f.records, i, i+1)
+			f.respond(w, map[string]string{"id": id}, 0)
+		}
+	default:
+		f.respondErr(w, http.StatusNotFound, 7003, "No route for that URI")
+	}
+}
+
+func (f *fakeCloudflare) respond(w http.ResponseWriter, result any, totalPages int) {
+	_ = goccy.NewEncoder(w).Encode(map[string]any{
+		"success":     true,
+		"errors":      []any{},
+		"result":      result,
+		"result_info": map[string]int{"total_pages": totalPages},
+	})
+}
+
+func (f *fakeCloudflare) respondErr(w http.ResponseWriter, status, code int, message string) {
+	w.WriteHeader(status)
+	_ = goccy.NewEncoder(w).Encode(map[string]any{
+		"success": false,
+		"errors":  []map[string]any{{"code": code, "message": message}},
+	})
+}
+
+// addRecord stores a record in the fake as if it was created outside the client.
+func (f *fakeCloudflare) addRecord(rec cloudflareRecord) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	rec.ID = "rec" + strconv.Itoa(f.nextID)
+	f.records = append(f.records, rec)
+}
+
+// recordNamed returns the record named name, if any.
+func (f *fakeCloudflare) recordNamed(name string) (cloudflareRecord, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i := slices.IndexFunc(f.records, func(rec cloudflareRecord) bool { return rec.Name == name })
+	if i < 0 {
+		return cloudflareRecord{}, false
+	}
+	return f.records[i], true
+}
+
+// countRequests returns how many requests were sent with method.
+func (f *fakeCloudflare) countRequests(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, method+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+// newTestCloudflare starts a fakeCloudflare and returns a client configured to use it.
+func newTestCloudflare(t *testing.T) (*cloudflareClient, *fakeCloudflare) {
+	t.Helper()
+	fake := &fakeCloudflare{}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return &cloudflareClient{
+		client:     srv.Client(),
+		apiURL:     srv.URL,
+		apiToken:   testToken,
+		recordType: "CNAME",
+		content:    testContent,
+		proxied:    true,
+	}, fake
+}
+
+func TestCloudflareEnsureRecordCreates(t *testing.T) {
+	c, fake := newTestCloudflare(t)
+	ctx := context.Background()
+	if err := c.EnsureRecord(ctx, testZoneRoot, "img.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	rec, ok := fake.recordNamed("img.example.com")
+	if !ok {
+		t.Fatal("record was not created")
+	}
+	if rec.Type != "CNAME" || rec.Content != testContent || !rec.Proxied || rec.Comment != managedRecordComment {
+		t.Fatalf("record = %+v", rec)
+	}
+
+	// An up to date record is left as is.
+	if err := c.EnsureRecord(ctx, testZoneRoot, "img.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.countRequests(http.MethodPost); n != 1 {
+		t.Fatalf("%d records created, want 1", n)
+	}
+	if n := fake.countRequests(http.MethodPut); n != 0 {
+		t.Fatalf("%d records updated, want 0", n)
+	}
+}
+
+func TestCloudflareEnsureRecordFixesDrift(t *testing.T) {
+	c, fake := newTestCloudflare(t)
+	fake.addRecord(cloudflareRecord{
+		Type: "A", Name: "drift.example.com", Content: "192.0.2.1", Comment: managedRecordComment,
+	})
+	fake.addRecord(cloudflareRecord{Type: "A", Name: "manual.example.com", Content: "192.0.2.2"})
+
+	ctx := context.Background()
+	if err := c.EnsureRecord(ctx, testZoneRoot, "drift.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := fake.recordNamed("drift.example.com"); rec.Type != "CNAME" || rec.Content != testContent {
+		t.Fatalf("managed record was not fixed: %+v", rec)
+	}
+	if err := c.EnsureRecord(ctx, testZoneRoot, "manual.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := fake.recordNamed("manual.example.com"); rec.Type != "A" || rec.Content != "192.0.2.2" {
+		t.Fatalf("manual record was modified: %+v", rec)
+	}
+}
+
+func TestCloudflareDeleteRecord(t *testing.T) {
+	c, fake := newTestCloudflare(t)
+	fake.addRecord(cloudflareRecord{
+		Type: "CNAME", Name: "old.example.com", Content: testContent, Comment: managedRecordComment,
+	})
+	fake.addRecord(cloudflareRecord{Type: "A", Name: "manual.example.com", Content: "192.0.2.2"})
+
+	ctx := context.Background()
+	if err := c.DeleteRecord(ctx, testZoneRoot, "old.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.recordNamed("old.example.com"); ok {
+		t.Fatal("managed record was not deleted")
+	}
+	if err := c.DeleteRecord(ctx, testZoneRoot, "manual.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.recordNamed("manual.example.com"); !ok {
+		t.Fatal("manual record was deleted")
+	}
+}
+
+func TestCloudflareListRecordsPaginates(t *testing.T) {
+	c, fake := newTestCloudflare(t)
+	want := []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com", "e.example.com"}
+	for _, name := range want {
+		fake.addRecord(cloudflareRecord{Type: "CNAME", Name: name, Content: testContent, Comment: managedRecordComment})
+	}
+	fake.addRecord(cloudflareRecord{Type: "A", Name: "manual.example.com", Content: "192.0.2.2"})
+
+	names, err := c.ListRecords(context.Background(), testZoneRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(names, want) {
+		t.Fatalf("names = %v, want %v", names, want)
+	}
+}
+
+func TestCloudflareZoneNotFound(t *testing.T) {
+	c, _ := newTestCloudflare(t)
+	if err := c.EnsureRecord(context.Background(), "custom.example", "custom.example"); !errors.Is(err, ErrZoneNotFound) {
+		t.Fatalf("err = %v, want ErrZoneNotFound", err)
+	}
+}
+
+func TestCloudflareAPIError(t *testing.T) {
+	c, fake := newTestCloudflare(t)
+	fake.fail = true
+	err := c.EnsureRecord(context.Background(), testZoneRoot, "img.example.com")
+	if err == nil || !strings.Contains(err.Error(), "81057: Record already exists.") {
+		t.Fatalf("err = %v, want the API's error", err)
+	}
+
+	c.apiToken = "wrong-token"
+	fake.fail = false
+	if err = c.DeleteRecord(context.Background(), testZoneRoot, "img.example.com"); err == nil ||
+		!strings.Contains(err.Error(), "(403)") {
+		t.Fatalf("err = %v, want an authentication error", err)
+	}
+}
+
+func TestCloudflareNonJSONResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	t.Cleanup(srv.Close)
+	c := &cloudflareClient{client: srv.Client(), apiURL: srv.URL, apiToken: testToken}
+	err := c.EnsureRecord(context.Background(), testZoneRoot, "img.example.com")
+	if err == nil || !strings.Contains(err.Error(), "status 502") {
+		t.Fatalf("err = %v, want the response status", err)
+	}
+}
+
+func TestCloudflareDisabled(t *testing.T) {
+	c, fake := newTestCloudflare(t)
+	c.apiToken = ""
+	ctx := context.Background()
+	if err := c.EnsureRecord(ctx, testZoneRoot, "img.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteRecord(ctx, testZoneRoot, "img.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.requests) != 0 {
+		t.Fatalf("disabled client sent %d requests", len(fake.requests))
+	}
+}
@@ -0,0 +1,15 @@
+package clients
+
+import (
+	"context"
+	"net"
+)
+
+// DNS resolves records used for verifying domain ownership.
+// Replaceable with a fake resolver when testing.
+var DNS TXTResolver = net.DefaultResolver
+
+// TXTResolver looks up DNS TXT records. Satisfied by *net.Resolver.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
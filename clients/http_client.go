@@ -1,26 +1,132 @@
 package clients
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	goccy "github.com/goccy/go-json"
 	"github.com/labstack/echo/v4"
 	echolog "github.com/labstack/gommon/log"
 	"github.com/sharify-labs/spine/config"
-	"github.com/sharify-labs/spine/database"
+	"github.com/sharify-labs/spine/signing"
 )
 
 var HTTP = &httpClient{}
 
 type httpClient struct {
-	client *http.Client
+	client       *http.Client
+	zephyr       *http.Client
+	breaker      *circuitBreaker
+	maxRetries   int
+	retryBackoff time.Duration
+	signer       *signing.Signer
+	signedBodies int64 // largest request body hashed before being forwarded to Zephyr
+
+	// Deprecated: ZEPHYR_ADMIN_KEY, sent in config.HeaderSpineKey until legacyKeyUntil (see legacyKeyConfig).
+	legacyKey       string
+	legacyKeyUntil  time.Time
+	legacyKeyWarned atomic.Int64 // unix time of the last deprecation warning
+}
+
+// legacyKeyMaxWindow is how far ahead ZEPHYR_LEGACY_KEY_UNTIL may be, so the legacy key can't be left on for good.
+const legacyKeyMaxWindow = 30 * 24 * time.Hour
+
+// legacyKeyConfig returns ZEPHYR_ADMIN_KEY and the date (YYYY-MM-DD, UTC) in ZEPHYR_LEGACY_KEY_UNTIL before which it
+// is sent to Zephyr. The key is only sent during that migration window, which is off by default: without
+// ZEPHYR_LEGACY_KEY_UNTIL, the key is ignored. Panics if the date is invalid or more than legacyKeyMaxWindow ahead.
+func legacyKeyConfig(now time.Time) (string, time.Time) {
+	key := config.GetOrDefault("ZEPHYR_ADMIN_KEY", "")
+	until := config.GetOrDefault("ZEPHYR_LEGACY_KEY_UNTIL", "")
+	if key == "" {
+		return "", time.Time{}
+	}
+	if until == "" {
+		echolog.Warnf("ZEPHYR_ADMIN_KEY is ignored: set ZEPHYR_LEGACY_KEY_UNTIL to send it during the migration")
+		return "", time.Time{}
+	}
+	untilDate, err := time.Parse(time.DateOnly, until)
+	if err != nil {
+		panic("invalid ZEPHYR_LEGACY_KEY_UNTIL: " + err.Error())
+	}
+	if untilDate.After(now.Add(legacyKeyMaxWindow)) {
+		panic("ZEPHYR_LEGACY_KEY_UNTIL must be at most " + legacyKeyMaxWindow.String() + " away")
+	}
+	if !now.Before(untilDate) {
+		echolog.Warnf("ZEPHYR_ADMIN_KEY is ignored: ZEPHYR_LEGACY_KEY_UNTIL (%s) has passed, unset both", until)
+		return "", time.Time{}
+	}
+	return key, untilDate
+}
+
+// useLegacyKey returns the legacy key to send with a request made at now, or "" if there is none or its migration
+// window is over. Each use is counted in zephyrMetrics as "legacy_key_requests" and logged as deprecated, at most
+// once a minute so that busy instances don't flood the logs.
+func (c *httpClient) useLegacyKey(now time.Time) string {
+	if c.legacyKey == "" || !now.Before(c.legacyKeyUntil) {
+		return ""
+	}
+	zephyrMetrics.Add("legacy_key_requests", 1)
+	if last := c.legacyKeyWarned.Load(); now.Unix()-last >= 60 && c.legacyKeyWarned.CompareAndSwap(last, now.Unix()) {
+		echolog.Warnf(
+			"deprecated: sending ZEPHYR_ADMIN_KEY in %s to Zephyr until %s; unset it once Zephyr verifies signatures",
+			config.HeaderSpineKey, c.legacyKeyUntil.Format(time.DateOnly),
+		)
+	}
+	return c.legacyKey
 }
 
+// Connect sets up the clients. Requests to Zephyr use a dedicated transport that gives up on connecting after
+// ZEPHYR_DIAL_TIMEOUT and on waiting for response headers after ZEPHYR_RESPONSE_TIMEOUT.
+// There is no overall timeout, so large uploads and downloads can stream for as long as they need.
+// After ZEPHYR_BREAKER_THRESHOLD consecutive failures, requests to Zephyr fail fast for ZEPHYR_BREAKER_COOLDOWN
+// (see doZephyr). Requests are signed with the first key of ZEPHYR_SIGNING_KEYS.
+// Deprecated: During the migration window set by ZEPHYR_LEGACY_KEY_UNTIL, ZEPHYR_ADMIN_KEY is also sent as
+// config.HeaderSpineKey so that Zephyr versions that don't verify signatures yet keep working (see legacyKeyConfig).
+// It will be removed in the next release.
 func (c *httpClient) Connect() {
 	c.client = http.DefaultClient
+	keys, err := signing.ParseKeys(config.Get[string]("ZEPHYR_SIGNING_KEYS"))
+	if err != nil {
+		panic("invalid ZEPHYR_SIGNING_KEYS: " + err.Error())
+	}
+	c.signer = signing.NewSigner(keys[0])
+	c.signedBodies = int64(config.GetOrDefault("ZEPHYR_SIGNED_BODY_LIMIT", signing.DefaultMaxBodySize))
+	c.legacyKey, c.legacyKeyUntil = legacyKeyConfig(time.Now())
+	c.breaker = newCircuitBreaker(
+		config.GetOrDefault("ZEPHYR_BREAKER_THRESHOLD", 5),
+		config.GetOrDefault("ZEPHYR_BREAKER_COOLDOWN", 30*time.Second),
+	)
+	c.maxRetries = config.GetOrDefault("ZEPHYR_MAX_RETRIES", 2)
+	c.retryBackoff = config.GetOrDefault("ZEPHYR_RETRY_BACKOFF", 100*time.Millisecond)
+	c.zephyr = &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   config.GetOrDefault("ZEPHYR_DIAL_TIMEOUT", 5*time.Second),
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			ForceAttemptHTTP2:     true,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: config.GetOrDefault("ZEPHYR_RESPONSE_TIMEOUT", 30*time.Second),
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   32,
+		},
+		// Zephyr's redirects are passed on to the user rather than followed.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
 }
 
 func (c *httpClient) Do(req *http.Request) (*http.Response, error) {
@@ -28,24 +134,13 @@ func (c *httpClient) Do(req *http.Request) (*http.Response, error) {
 	return c.client.Do(req)
 }
 
-var githubResp struct {
-	Domains map[string]interface{} `json:"domains"`
-}
-
-// GetOrFetchAvailableDomains gets list of available domains from cache or fetches them from our GitHub repo.
-func (c *httpClient) GetOrFetchAvailableDomains(ctx echo.Context) (map[string]interface{}, error) {
-	const cacheKey string = "cache:available_domains"
-
-	domains := make(map[string]interface{})
-	database.GetFromCache(cacheKey, &domains)
-	echolog.Debugf("Retreived %d domains from cache", len(domains))
-	// TODO: do this in zephyr for list uploads endpoint
-	if len(domains) != 0 {
-		return domains, nil
-	}
-
-	const domainsURL = "https://gist.githubusercontent.com/xEricL/91d1a37fa70f0964a31c700f39416118/raw/d8dd06da809202bac5ff46f6e8ec0d34a0e484a6/domains.json"
-	req, err := http.NewRequestWithContext(ctx.Request().Context(), http.MethodGet, domainsURL, nil)
+// FetchDomainList downloads a domain list in the legacy gist format:
+//
+//	{"domains": {"example.com": <metadata>, ...}}
+//
+// Metadata values are returned raw since older lists don't have a consistent format.
+func (c *httpClient) FetchDomainList(ctx context.Context, listURL string) (map[string]goccy.RawMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, listURL, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -55,65 +150,246 @@ func (c *httpClient) GetOrFetchAvailableDomains(ctx echo.Context) (map[string]in
 	}
 	defer func() {
 		if err = resp.Body.Close(); err != nil {
-			Sentry.CaptureErr(ctx, err)
+			echolog.Errorf("failed to close domain list response body: %v", err)
 		}
 	}()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, err
+		return nil, fmt.Errorf("domain list returned status %d", resp.StatusCode)
+	}
+	var list struct {
+		Domains map[string]goccy.RawMessage `json:"domains"`
 	}
-	if err = goccy.NewDecoder(resp.Body).Decode(&githubResp); err != nil {
+	if err = goccy.NewDecoder(resp.Body).Decode(&list); err != nil {
 		return nil, err
 	}
+	return list.Domains, nil
+}
+
+// hopByHopHeaders only apply to a single connection, so proxies must not forward them (RFC 9110, section 7.6.1).
+var hopByHopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
 
-	database.AddToCache(cacheKey, githubResp.Domains, 12*time.Hour)
-	return githubResp.Domains, nil
+// zephyrRequestHeadersDropped are the user's request headers that are never forwarded to Zephyr,
+// either because they carry Spine credentials or because ForwardToZephyr sets them itself.
+// Headers starting with X-Spine- (used for signing) are dropped too.
+var zephyrRequestHeadersDropped = []string{
+	"Cookie", "Authorization", "Host", "Content-Length", "X-Forwarded-For", "X-Real-Ip",
+	config.HeaderJWTAuth, config.HeaderHostSettings,
 }
 
-func (c *httpClient) ForwardToZephyr(ctx echo.Context, userToken string) error {
+// zephyrResponseHeaders are the headers of Zephyr's responses that are passed on to the user.
+// Others (cookies, CORS, ...) are dropped so they can't conflict with Spine's.
+var zephyrResponseHeaders = []string{
+	"Content-Type", "Content-Length", "Content-Encoding", "Content-Disposition", "Content-Range", "Accept-Ranges",
+	"Cache-Control", "Expires", "ETag", "Last-Modified", "Vary", "Location", "Retry-After",
+}
+
+// zephyrRateLimitHeaders are Zephyr's rate limit headers. They are passed on as a group, and only when Zephyr has
+// fewer requests remaining than Spine's own limiter, so the user always sees the limit they will hit first.
+var zephyrRateLimitHeaders = []string{"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"}
+
+// removeHopByHopHeaders deletes hop-by-hop headers, including those listed in the Connection header.
+func removeHopByHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// ForwardToZephyr sends the request to path on Zephyr as the user and streams Zephyr's response back.
+// Request bodies larger than ZEPHYR_SIGNED_BODY_LIMIT and response bodies are never buffered,
+// so uploads and downloads of any size use constant memory. Smaller request bodies are buffered to be hashed for the
+// signature and retried (see zephyrRequestBody), so each request holds up to ZEPHYR_SIGNED_BODY_LIMIT bytes.
+// Zephyr's status code and zephyrResponseHeaders are preserved. The extra headers are added to the forwarded request.
+// escapedPath is sent as is, so values substituted into it must already be escaped.
+func (c *httpClient) ForwardToZephyr(ctx echo.Context, escapedPath, userToken string, extra http.Header) error {
+	path, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
 	zephyrURL := &url.URL{
 		Scheme:   "https",
 		Host:     config.ZephyrURL,
-		Path:     ctx.Path(),
+		Path:     path,
+		RawPath:  escapedPath,
 		RawQuery: ctx.QueryString(),
 	}
 
+	body, bodyHash, err := c.zephyrRequestBody(ctx.Request())
+	if err != nil {
+		return c.zephyrErrToHTTP(ctx, err)
+	}
 	req, err := http.NewRequestWithContext(
 		ctx.Request().Context(),
 		ctx.Request().Method,
 		zephyrURL.String(),
-		ctx.Request().Body,
+		body,
 	)
 	if err != nil {
 		Sentry.CaptureErr(ctx, err)
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
+	req.ContentLength = ctx.Request().ContentLength // -1 (unknown) is sent chunked
 
+	req.Header = ctx.Request().Header.Clone()
+	removeHopByHopHeaders(req.Header)
+	for _, name := range zephyrRequestHeadersDropped {
+		req.Header.Del(name)
+	}
+	for name := range req.Header {
+		if strings.HasPrefix(name, "X-Spine-") {
+			req.Header.Del(name)
+		}
+	}
 	req.Header.Set("User-Agent", config.UserAgent+" "+ctx.Request().UserAgent())
+	req.Header.Set("X-Forwarded-For", ctx.RealIP())
 	req.Header.Set(config.HeaderJWTAuth, userToken)
-	req.Header.Set(config.HeaderSpineKey, config.Get[string]("ZEPHYR_ADMIN_KEY"))
-	req.Header.Set(echo.HeaderContentType, ctx.Request().Header.Get(echo.HeaderContentType))
-	for name, values := range ctx.Request().Header {
+	for name, values := range extra {
 		for _, val := range values {
-			ctx.Logger().Debugf("Header %s: %s", name, val)
+			req.Header.Add(name, val)
 		}
 	}
-	resp, err := c.Do(req)
+
+	resp, err := c.doZephyr(req, bodyHash)
 	if err != nil {
-		Sentry.CaptureErr(ctx, err)
-		return echo.NewHTTPError(http.StatusInternalServerError)
+		return c.zephyrErrToHTTP(ctx, err)
 	}
 	defer func() {
 		if err = resp.Body.Close(); err != nil {
-			Sentry.CaptureErr(ctx, err)
+			ctx.Logger().Debugf("failed to close zephyr response body: %v", err)
 		}
 	}()
 
-	body, err := io.ReadAll(resp.Body)
+	removeHopByHopHeaders(resp.Header)
+	header := ctx.Response().Header()
+	for _, name := range zephyrResponseHeaders {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	if resp.ContentLength >= 0 {
+		header.Set(echo.HeaderContentLength, strconv.FormatInt(resp.ContentLength, 10))
+	}
+	if moreRestrictiveRateLimit(resp.Header, header) {
+		for _, name := range zephyrRateLimitHeaders {
+			header.Set(name, resp.Header.Get(name))
+		}
+	}
+
+	ctx.Response().WriteHeader(resp.StatusCode)
+	if _, err = io.Copy(ctx.Response(), resp.Body); err != nil {
+		// The status has already been sent, so the user just sees a truncated body.
+		if ctx.Request().Context().Err() == nil {
+			Sentry.CaptureErr(ctx, fmt.Errorf("failed to stream zephyr response: %w", err))
+		}
+	}
+	return nil
+}
+
+// zephyrRequestBody returns the body to forward to Zephyr and its hash for the request signature.
+// Bodies of up to ZEPHYR_SIGNED_BODY_LIMIT bytes are read into memory to be hashed, which also lets them be retried.
+// Larger and chunked bodies are streamed as signing.StreamingPayload, and signed in a trailer once sent.
+func (c *httpClient) zephyrRequestBody(r *http.Request) (io.Reader, string, error) {
+	switch {
+	case r.ContentLength == 0:
+		return nil, signing.HashBody(nil), nil
+	case r.ContentLength < 0 || r.ContentLength > c.signedBodies:
+		return r.Body, signing.StreamingPayload, nil
+	}
+	data, err := io.ReadAll(r.Body)
 	if err != nil {
-		Sentry.CaptureErr(ctx, err)
-		return echo.NewHTTPError(http.StatusInternalServerError)
+		return nil, "", err
+	}
+	return bytes.NewReader(data), signing.HashBody(data), nil
+}
+
+// moreRestrictiveRateLimit reports whether Zephyr's rate limit headers have fewer requests remaining than Spine's.
+func moreRestrictiveRateLimit(zephyr, spine http.Header) bool {
+	zephyrRemaining, err := strconv.Atoi(zephyr.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return false
 	}
+	spineRemaining, err := strconv.Atoi(spine.Get("X-RateLimit-Remaining"))
+	return err != nil || zephyrRemaining < spineRemaining
+}
+
+// zephyrErrToHTTP converts errors from requests to Zephyr into HTTP errors: 503 while the circuit breaker is open,
+// 504 if Zephyr timed out, 502 if it couldn't be reached, and nothing if the user went away.
+// HTTP errors raised while reading the request body (ex: 413 from a body limit) are returned as is.
+// Failures are only logged, since the circuit breaker reports to Sentry when Zephyr becomes unhealthy.
+func (c *httpClient) zephyrErrToHTTP(ctx echo.Context, err error) error {
+	if ctx.Request().Context().Err() != nil {
+		return nil
+	}
+	var httpErr *echo.HTTPError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &httpErr):
+		return httpErr
+	case errors.Is(err, ErrZephyrUnavailable):
+		retryAfter := int(c.breaker.retryAfter().Round(time.Second).Seconds())
+		ctx.Response().Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "uploads are temporarily unavailable")
+	case errors.As(err, &netErr) && netErr.Timeout():
+		ctx.Logger().Warnf("zephyr timed out: %v", err)
+		return echo.NewHTTPError(http.StatusGatewayTimeout)
+	default:
+		ctx.Logger().Warnf("zephyr unreachable: %v", err)
+		return echo.NewHTTPError(http.StatusBadGateway)
+	}
+}
 
-	return ctx.JSONBlob(resp.StatusCode, body)
+// DeleteUploads asks Zephyr to delete uploads (and their stored data) on behalf of their owner.
+func (c *httpClient) DeleteUploads(ctx context.Context, userToken string, ids []uint) error {
+	return c.callZephyr(ctx, http.MethodDelete, "/api/v1/uploads", userToken, map[string]interface{}{
+		"ids": ids,
+	})
+}
+
+// MoveUploads asks Zephyr to serve uploads from another of their owner's hostnames.
+// Zephyr re-keys the stored data, since storage keys are derived from the hostname.
+func (c *httpClient) MoveUploads(ctx context.Context, userToken string, ids []uint, hostname string) error {
+	return c.callZephyr(ctx, http.MethodPatch, "/api/v1/uploads", userToken, map[string]interface{}{
+		"ids":      ids,
+		"hostname": hostname,
+	})
+}
+
+// callZephyr sends a JSON request to Zephyr on behalf of a user and returns an error if it doesn't succeed.
+func (c *httpClient) callZephyr(ctx context.Context, method, path, userToken string, body interface{}) error {
+	data, err := goccy.Marshal(body)
+	if err != nil {
+		return err
+	}
+	zephyrURL := &url.URL{Scheme: "https", Host: config.ZephyrURL, Path: path}
+	req, err := http.NewRequestWithContext(ctx, method, zephyrURL.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(config.HeaderJWTAuth, userToken)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("User-Agent", config.UserAgent)
+	resp, err := c.doZephyr(req, signing.HashBody(data))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			echolog.Errorf("failed to close zephyr response body: %v", err)
+		}
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("zephyr %s %s returned status %d: %s", method, path, resp.StatusCode, msg)
+	}
+	return nil
 }
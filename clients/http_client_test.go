@@ -0,0 +1,319 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sharify-labs/spine/signing"
+)
+
+func TestLegacyKeyConfig(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		key       string
+		until     string
+		wantKey   string
+		wantPanic bool
+	}{
+		{name: "off by default", key: "admin", until: ""},
+		{name: "no key", key: "", until: "2026-10-20"},
+		{name: "within window", key: "admin", until: "2026-10-20", wantKey: "admin"},
+		{name: "window over", key: "admin", until: "2026-10-19"},
+		{name: "window too long", key: "admin", until: "2026-12-31", wantPanic: true},
+		{name: "invalid date", key: "admin", until: "next week", wantPanic: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ZEPHYR_ADMIN_KEY", tt.key)
+			t.Setenv("ZEPHYR_LEGACY_KEY_UNTIL", tt.until)
+			defer func() {
+				if r := recover(); (r != nil) != tt.wantPanic {
+					t.Fatalf("panic = %v, want panic: %v", r, tt.wantPanic)
+				}
+			}()
+			if key, _ := legacyKeyConfig(now); key != tt.wantKey {
+				t.Fatalf("key = %q, want %q", key, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestUseLegacyKeyStopsAfterWindow(t *testing.T) {
+	until := time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)
+	c := &httpClient{legacyKey: "admin", legacyKeyUntil: until}
+	uses := zephyrMetrics.Get("legacy_key_requests")
+	before := int64(0)
+	if uses != nil {
+		before = uses.(interface{ Value() int64 }).Value()
+	}
+
+	if got := c.useLegacyKey(until.Add(-time.Second)); got != "admin" {
+		t.Fatalf("before the deadline: key = %q, want it sent", got)
+	}
+	if got := c.useLegacyKey(until); got != "" {
+		t.Fatalf("at the deadline: key = %q, want it not sent", got)
+	}
+	if after := zephyrMetrics.Get("legacy_key_requests").(interface{ Value() int64 }).Value(); after != before+1 {
+		t.Fatalf("legacy_key_requests = %d, want %d", after, before+1)
+	}
+}
+
+// testSigningKey signs requests to the fake Zephyr servers of the tests.
+var testSigningKey = signing.Key{ID: "test", Secret: bytes.Repeat([]byte("k"), signing.MinKeySize)}
+
+// testSignedBodies is the ZEPHYR_SIGNED_BODY_LIMIT of test clients: larger bodies are streamed.
+const testSignedBodies = 1024
+
+// zephyrTestTransport sends requests meant for Zephyr to a test server. The first failDials attempts fail as if
+// Zephyr couldn't be dialed, without sending anything.
+type zephyrTestTransport struct {
+	addr      string
+	attempts  atomic.Int32
+	failDials atomic.Int32
+}
+
+func (z *zephyrTestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	z.attempts.Add(1)
+	if z.failDials.Add(-1) >= 0 {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	// A shallow copy keeps the trailer map that the signature of a streamed body is written to
+	sent, target := *req, *req.URL
+	target.Scheme, target.Host = "http", z.addr
+	sent.URL = &target
+	return http.DefaultTransport.RoundTrip(&sent)
+}
+
+// newTestZephyr returns a client whose Zephyr requests are served by handler. Its breaker opens after 3 failures.
+func newTestZephyr(t *testing.T, handler http.HandlerFunc) (*httpClient, *zephyrTestTransport) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	transport := &zephyrTestTransport{addr: srv.Listener.Addr().String()}
+	return &httpClient{
+		zephyr:       &http.Client{Transport: transport},
+		breaker:      newCircuitBreaker(3, time.Minute),
+		maxRetries:   2,
+		retryBackoff: time.Millisecond,
+		signer:       signing.NewSigner(testSigningKey),
+		signedBodies: testSignedBodies,
+	}, transport
+}
+
+// verifyZephyrRequest checks the signature of a request received by a fake Zephyr server and returns its body.
+func verifyZephyrRequest(t *testing.T, r *http.Request) []byte {
+	t.Helper()
+	verifier := signing.NewVerifier([]signing.Key{testSigningKey}, signing.NewMemoryNonceStore())
+	verifier.AllowStreamingPayload = true
+	if err := verifier.Verify(r); err != nil {
+		t.Errorf("Verify() = %v", err)
+		return nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Errorf("reading body: %v", err)
+	}
+	return body
+}
+
+// proxyStatus returns the status the user gets for a call to ForwardToZephyr that returned err.
+func proxyStatus(rec *httptest.ResponseRecorder, err error) int {
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code
+	}
+	return rec.Code
+}
+
+func TestForwardToZephyrPassesResponseThrough(t *testing.T) {
+	c, _ := newTestZephyr(t, func(w http.ResponseWriter, r *http.Request) {
+		if body := verifyZephyrRequest(t, r); string(body) != "hello" {
+			t.Errorf("body = %q, want hello", body)
+		}
+		for name, want := range map[string]string{
+			"Authorization":          "user-token",
+			"Cookie":                 "",
+			"X-Spine-Key":            "",
+			"X-Upload-Host":          "img.example.com",
+			"X-Forwarded-For":        "192.0.2.1",
+			"Content-Type":           "text/plain",
+			signing.HeaderKeyID:      testSigningKey.ID,
+			"X-Not-Hop-By-Hop":       "kept",
+			"X-Listed-In-Connection": "",
+		} {
+			if got := r.Header.Get(name); got != want {
+				t.Errorf("request header %s = %q, want %q", name, got, want)
+			}
+		}
+		h := w.Header()
+		h.Set("Content-Type", "image/png")
+		h.Set("Content-Range", "bytes 0-6/20")
+		h.Set("ETag", `"abc"`)
+		h.Set("Cache-Control", "public, max-age=60")
+		h.Set("Set-Cookie", "zephyr=1")
+		h.Set("Connection", "X-Private")
+		h.Set("X-Private", "1")
+		h.Set("X-Internal", "1")
+		h.Set("X-RateLimit-Limit", "5")
+		h.Set("X-RateLimit-Remaining", "3")
+		h.Set("X-RateLimit-Reset", "60")
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write([]byte("partial"))
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/upload", strings.NewReader("hello"))
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("Authorization", "Bearer spine-token")
+	req.Header.Set("X-Spine-Key", "forged")
+	req.Header.Set("Connection", "X-Listed-In-Connection")
+	req.Header.Set("X-Listed-In-Connection", "dropped")
+	req.Header.Set("X-Not-Hop-By-Hop", "kept")
+	rec := httptest.NewRecorder()
+	rec.Header().Set("X-RateLimit-Remaining", "10")
+	ctx := echo.New().NewContext(req, rec)
+
+	err := c.ForwardToZephyr(ctx, "/api/v1/upload", "user-token", http.Header{"X-Upload-Host": {"img.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "partial" {
+		t.Fatalf("response = %d %q, want 206 partial", rec.Code, rec.Body.String())
+	}
+	for name, want := range map[string]string{
+		"Content-Type":          "image/png",
+		"Content-Length":        "7",
+		"Content-Range":         "bytes 0-6/20",
+		"ETag":                  `"abc"`,
+		"Cache-Control":         "public, max-age=60",
+		"Set-Cookie":            "",
+		"X-Private":             "",
+		"X-Internal":            "",
+		"X-RateLimit-Limit":     "5",
+		"X-RateLimit-Remaining": "3",
+	} {
+		if got := rec.Header().Get(name); got != want {
+			t.Errorf("response header %s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// Bodies larger than ZEPHYR_SIGNED_BODY_LIMIT reach Zephyr before Spine has read all of them.
+func TestForwardToZephyrStreamsLargeBodies(t *testing.T) {
+	const size = 4 << 20
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	received := make(chan struct{})
+	c, _ := newTestZephyr(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get(signing.HeaderBodyHash); got != signing.StreamingPayload {
+			t.Errorf("body hash = %q, want %s", got, signing.StreamingPayload)
+		}
+		verifier := signing.NewVerifier([]signing.Key{testSigningKey}, signing.NewMemoryNonceStore())
+		verifier.AllowStreamingPayload = true
+		if err := verifier.Verify(r); err != nil {
+			t.Errorf("Verify() = %v", err)
+			return
+		}
+		first := make([]byte, 1)
+		if _, err := io.ReadFull(r.Body, first); err != nil {
+			t.Error(err)
+			return
+		}
+		close(received)
+		hash := sha256.New()
+		hash.Write(first)
+		if _, err := io.Copy(hash, r.Body); err != nil {
+			t.Errorf("reading streamed body: %v", err)
+		}
+		// Echo the body back, so the response is streamed too
+		_, _ = w.Write(hash.Sum(nil))
+		_, _ = w.Write(data)
+	})
+
+	// The second half of the body is only written once Zephyr has started receiving the first.
+	pr, pw := io.Pipe()
+	go func() {
+		_, _ = pw.Write(data[:size/2])
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			_ = pw.CloseWithError(errors.New("zephyr received nothing before the whole body was read"))
+			return
+		}
+		_, _ = pw.Write(data[size/2:])
+		_ = pw.Close()
+	}()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/upload", pr)
+	req.ContentLength = size
+	rec := httptest.NewRecorder()
+
+	if err := c.ForwardToZephyr(echo.New().NewContext(req, rec), "/api/v1/upload", "user-token", nil); err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256(data)
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes()[:sha256.Size], want[:]) {
+		t.Fatalf("response = %d, want 200 with the body's hash", rec.Code)
+	}
+	if !bytes.Equal(rec.Body.Bytes()[sha256.Size:], data) {
+		t.Fatal("streamed response body doesn't match")
+	}
+}
+
+// cancelOnWrite cancels the request once the first bytes of the response are written, like a user going away.
+type cancelOnWrite struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w *cancelOnWrite) Write(p []byte) (int, error) {
+	w.cancel()
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestForwardToZephyrClientCancel(t *testing.T) {
+	cancelled := make(chan struct{})
+	c, _ := newTestZephyr(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+			t.Error("zephyr's request wasn't cancelled with the user's")
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/f/abc", nil).WithContext(ctx)
+	rec := &cancelOnWrite{ResponseRecorder: httptest.NewRecorder(), cancel: cancel}
+
+	if err := c.ForwardToZephyr(echo.New().NewContext(req, rec), "/f/abc", "user-token", nil); err != nil {
+		t.Fatalf("err = %v, want nil once the user went away", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("zephyr's request wasn't cancelled")
+	}
+	if rec.Body.String() != "first" {
+		t.Fatalf("body = %q, want the part streamed before the user went away", rec.Body.String())
+	}
+	if c.breaker.failures != 0 || c.breaker.state != breakerClosed {
+		t.Fatalf("breaker = %s with %d failures, want cancelled requests not to count", c.breaker.state, c.breaker.failures)
+	}
+}
@@ -0,0 +1,63 @@
+package clients
+
+import (
+	"errors"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/sharify-labs/spine/config"
+)
+
+// Mail sends notification emails to users.
+var Mail MailProvider = &smtpClient{}
+
+var ErrMailDisabled = errors.New("mail is not configured")
+
+// MailProvider sends plain text emails.
+type MailProvider interface {
+	Connect()
+	// Enabled reports whether the provider is configured. Send returns ErrMailDisabled if not.
+	Enabled() bool
+	Send(to, subject, body string) error
+}
+
+type smtpClient struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func (c *smtpClient) Connect() {
+	c.addr = config.GetOrDefault("SMTP_ADDR", "")
+	if !c.Enabled() {
+		return
+	}
+	c.from = config.Get[string]("SMTP_FROM")
+	if username := config.GetOrDefault("SMTP_USERNAME", ""); username != "" {
+		host, _, _ := net.SplitHostPort(c.addr)
+		c.auth = smtp.PlainAuth("", username, config.Get[string]("SMTP_PASSWORD"), host)
+	}
+}
+
+func (c *smtpClient) Enabled() bool {
+	return c.addr != ""
+}
+
+// Send emails a plain text message to a single recipient.
+func (c *smtpClient) Send(to, subject, body string) error {
+	if !c.Enabled() {
+		return ErrMailDisabled
+	}
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return errors.New("invalid mail header")
+	}
+	msg := "From: " + c.from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+	return smtp.SendMail(c.addr, c.auth, c.from, []string{to}, []byte(msg))
+}
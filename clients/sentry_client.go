@@ -30,3 +30,9 @@ func (*sentryClient) CaptureErr(c echo.Context, err error) {
 		hub.CaptureException(err)
 	}
 }
+
+// Capture logs and reports an error that happened outside a request (ex: background jobs).
+func (*sentryClient) Capture(err error) {
+	echolog.Error(err)
+	sentry.CaptureException(err)
+}
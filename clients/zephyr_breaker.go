@@ -0,0 +1,198 @@
+package clients
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	echolog "github.com/labstack/gommon/log"
+	"github.com/sharify-labs/spine/config"
+)
+
+// ErrZephyrUnavailable is returned without contacting Zephyr while the circuit breaker is open.
+var ErrZephyrUnavailable = errors.New("zephyr is unavailable")
+
+// States of the Zephyr circuit breaker.
+const (
+	breakerClosed   = "closed"    // requests go through
+	breakerOpen     = "open"      // requests fail fast with ErrZephyrUnavailable
+	breakerHalfOpen = "half-open" // a single probe request decides whether to close or reopen
+)
+
+// zephyrMetrics are published with expvar as "zephyr": the breaker's state, how many times it entered each state,
+// and request counters (requests sent, failures, retries and requests rejected while open).
+var zephyrMetrics = expvar.NewMap("zephyr")
+
+// circuitBreaker stops sending requests to Zephyr after threshold consecutive failures,
+// then lets a probe request through once cooldown has passed.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	b := &circuitBreaker{threshold: threshold, cooldown: cooldown}
+	b.setState(breakerClosed)
+	return b
+}
+
+// setState moves the breaker to state and updates the metrics. Must be called with mu held.
+func (b *circuitBreaker) setState(state string) {
+	b.state = state
+	var s expvar.String
+	s.Set(state)
+	zephyrMetrics.Set("state", &s)
+	zephyrMetrics.Add(state, 1)
+}
+
+// allow returns ErrZephyrUnavailable if a request must not be sent to Zephyr.
+// Every allowed request must be followed by a call to record.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.state == breakerOpen && time.Since(b.openedAt) >= b.cooldown:
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return nil
+	case b.state == breakerOpen, b.state == breakerHalfOpen && b.probing:
+		zephyrMetrics.Add("rejected", 1)
+		return ErrZephyrUnavailable
+	}
+	if b.state == breakerHalfOpen {
+		b.probing = true
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of an allowed request. A nil failure is a success.
+// Requests cancelled by their caller don't count either way.
+func (b *circuitBreaker) record(ctx context.Context, failure error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasProbe := b.probing
+	b.probing = false
+	if ctx.Err() != nil {
+		return
+	}
+	zephyrMetrics.Add("requests", 1)
+	if failure == nil {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+			echolog.Infof("zephyr circuit breaker closed")
+		}
+		return
+	}
+	zephyrMetrics.Add("failures", 1)
+	b.failures++
+	if wasProbe || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		if b.state == breakerClosed {
+			Sentry.Capture(fmt.Errorf("zephyr circuit breaker opened after %d failures: %w", b.failures, failure))
+		}
+		b.setState(breakerOpen)
+	}
+}
+
+// retryAfter returns how long until the breaker lets a probe request through.
+func (b *circuitBreaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerOpen {
+		return 0
+	}
+	return max(b.cooldown-time.Since(b.openedAt), 0)
+}
+
+// zephyrFailure returns why the request failed in a way that indicates Zephyr is unhealthy, or nil.
+// HTTP errors raised while reading the request body (ex: 413 from a body limit) are the user's fault.
+func zephyrFailure(resp *http.Response, err error) error {
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return fmt.Errorf("zephyr returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// replayable reports whether req's body, if any, can be sent again (streamed uploads can't).
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// retryable reports whether a request with a replayable body that failed with err can safely be sent again:
+// its method must be idempotent, unless it never reached Zephyr because connecting failed.
+func retryable(method string, err error) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// doZephyr signs req and sends it to Zephyr through the circuit breaker. bodyHash is the body's hash for the
+// signature (see signing.Signer.Sign). Retryable requests that fail are signed again and retried up to
+// ZEPHYR_MAX_RETRIES times, waiting a random duration of up to ZEPHYR_RETRY_BACKOFF, doubled each attempt.
+// Requests are retryable if their body is replayable and, unless Zephyr couldn't be dialed, their method idempotent.
+func (c *httpClient) doZephyr(req *http.Request, bodyHash string) (*http.Response, error) {
+	canReplay := replayable(req)
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		if key := c.useLegacyKey(time.Now()); key != "" {
+			req.Header.Set(config.HeaderSpineKey, key)
+		}
+		if err := c.signer.Sign(req, bodyHash); err != nil {
+			return nil, err
+		}
+		if err := c.breaker.allow(); err != nil {
+			return nil, err
+		}
+		resp, err := c.zephyr.Do(req)
+		failure := zephyrFailure(resp, err)
+		c.breaker.record(req.Context(), failure)
+		if failure == nil || !canReplay || !retryable(req.Method, err) || attempt >= c.maxRetries ||
+			req.Context().Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			_ = resp.Body.Close()
+		}
+		zephyrMetrics.Add("retries", 1)
+		backoff := c.retryBackoff << attempt
+		timer := time.NewTimer(time.Duration(rand.Int64N(int64(backoff) + 1)))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// expectBreaker fails the test unless b is in state, as reported by zephyrMetrics too.
+func expectBreaker(t *testing.T, b *circuitBreaker, state string) {
+	t.Helper()
+	if b.state != state {
+		t.Fatalf("breaker state = %s, want %s", b.state, state)
+	}
+	if got := zephyrMetrics.Get("state").String(); got != `"`+state+`"` {
+		t.Fatalf("state metric = %s, want %q", got, state)
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	b := newCircuitBreaker(2, time.Minute)
+	ctx := context.Background()
+	failure := errors.New("zephyr returned status 503")
+	send := func(failure error) {
+		t.Helper()
+		if err := b.allow(); err != nil {
+			t.Fatalf("allow() = %v, want the request to go through", err)
+		}
+		b.record(ctx, failure)
+	}
+
+	// Closed: failures only open the breaker once they are consecutive
+	send(failure)
+	send(nil)
+	send(failure)
+	expectBreaker(t, b, breakerClosed)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := b.allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.record(cancelled, failure)
+	expectBreaker(t, b, breakerClosed)
+	send(failure)
+	expectBreaker(t, b, breakerOpen)
+
+	// Open: requests fail fast until the cooldown has passed
+	if err := b.allow(); !errors.Is(err, ErrZephyrUnavailable) {
+		t.Fatalf("allow() = %v, want ErrZephyrUnavailable", err)
+	}
+	if after := b.retryAfter(); after <= 0 || after > time.Minute {
+		t.Fatalf("retryAfter() = %s, want up to the cooldown", after)
+	}
+	b.openedAt = time.Now().Add(-time.Minute)
+
+	// Half-open: a single probe decides, and its failure reopens the breaker
+	send(failure)
+	expectBreaker(t, b, breakerOpen)
+	b.openedAt = time.Now().Add(-time.Minute)
+	if err := b.allow(); err != nil {
+		t.Fatal(err)
+	}
+	expectBreaker(t, b, breakerHalfOpen)
+	if err := b.allow(); !errors.Is(err, ErrZephyrUnavailable) {
+		t.Fatalf("second allow() while probing = %v, want ErrZephyrUnavailable", err)
+	}
+	b.record(ctx, nil)
+	expectBreaker(t, b, breakerClosed)
+	if b.retryAfter() != 0 {
+		t.Fatalf("retryAfter() = %s while closed, want 0", b.retryAfter())
+	}
+	send(failure)
+	expectBreaker(t, b, breakerClosed)
+}
+
+func TestForwardToZephyrFailsFastWhileBreakerOpen(t *testing.T) {
+	c, transport := newTestZephyr(t, func(w http.ResponseWriter, r *http.Request) {
+		verifyZephyrRequest(t, r)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	forward := func() (*httptest.ResponseRecorder, int) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/f/abc", nil)
+		err := c.ForwardToZephyr(echo.New().NewContext(req, rec), "/f/abc", "user-token", nil)
+		return rec, proxyStatus(rec, err)
+	}
+
+	// Retries count as failures, so one request (three attempts) opens the breaker
+	if _, status := forward(); status != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want Zephyr's 503", status)
+	}
+	expectBreaker(t, c.breaker, breakerOpen)
+	rec, status := forward()
+	if status != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "60" {
+		t.Fatalf("status = %d with Retry-After %q, want 503 with the cooldown", status, rec.Header().Get("Retry-After"))
+	}
+	if attempts := transport.attempts.Load(); attempts != 3 {
+		t.Fatalf("zephyr got %d attempts, want 3 and none while the breaker is open", attempts)
+	}
+}
+
+func TestForwardToZephyrRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		size         int
+		failStatuses int32 // 503s before Zephyr succeeds
+		failDials    int32 // attempts that fail to connect before any 503
+		wantAttempts int32
+		wantStatus   int
+	}{
+		{name: "idempotent", method: http.MethodGet, failStatuses: 2, wantAttempts: 3, wantStatus: http.StatusOK},
+		{name: "buffered body replayed", method: http.MethodPut, size: 10, failStatuses: 1,
+			wantAttempts: 2, wantStatus: http.StatusOK},
+		{name: "gives up", method: http.MethodDelete, failStatuses: 5, wantAttempts: 3,
+			wantStatus: http.StatusServiceUnavailable},
+		{name: "not idempotent", method: http.MethodPost, size: 10, failStatuses: 1, wantAttempts: 1,
+			wantStatus: http.StatusServiceUnavailable},
+		{name: "streamed body", method: http.MethodPut, size: 2 * testSignedBodies, failStatuses: 1, wantAttempts: 1,
+			wantStatus: http.StatusServiceUnavailable},
+		{name: "not sent", method: http.MethodPost, size: 10, failDials: 1, wantAttempts: 2, wantStatus: http.StatusOK},
+		{name: "streamed body not sent", method: http.MethodPost, size: 2 * testSignedBodies, failDials: 1,
+			wantAttempts: 1, wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := bytes.Repeat([]byte("b"), tt.size)
+			var served atomic.Int32
+			c, transport := newTestZephyr(t, func(w http.ResponseWriter, r *http.Request) {
+				if got := verifyZephyrRequest(t, r); !bytes.Equal(got, body) {
+					t.Errorf("attempt %d: body of %d bytes, want %d", served.Load()+1, len(got), len(body))
+				}
+				if served.Add(1) <= tt.failStatuses {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			})
+			c.breaker = newCircuitBreaker(10, time.Minute)
+			transport.failDials.Store(tt.failDials)
+
+			req := httptest.NewRequest(tt.method, "/api/v1/uploads", bytes.NewReader(body))
+			rec := httptest.NewRecorder()
+			err := c.ForwardToZephyr(echo.New().NewContext(req, rec), "/api/v1/uploads", "user-token", nil)
+			if status := proxyStatus(rec, err); status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if attempts := transport.attempts.Load(); attempts != tt.wantAttempts {
+				t.Fatalf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -12,11 +13,15 @@ import (
 )
 
 const (
-	HeaderJWTAuth  string = "Authorization" // Used for Zephyr Auth
-	HeaderSpineKey string = "X-Spine-Key"   // Used to verify HeaderJWTAuth is coming from spine (ZEPHYR_ADMIN_KEY)
-	HostDefault    string = "sharify.me"
-	ZephyrURL      string = "xericl.dev"
-	UserAgent      string = "sharify-labs/spine"
+	HeaderJWTAuth          string = "Authorization"    // Used for Zephyr Auth (requests are signed, see signing package)
+	HeaderSpineKey         string = "X-Spine-Key"      // Deprecated: ZEPHYR_ADMIN_KEY, for Zephyr versions without signing
+	HeaderBillingSignature string = "Stripe-Signature" // Signs billing webhooks (BILLING_WEBHOOK_SECRET)
+	HeaderHostSettings     string = "X-Host-Settings"  // Upload defaults of the target host, sent to Zephyr
+	HeaderCanvasKey        string = "X-Canvas-Key"     // Authenticates Canvas on the embed API (CANVAS_API_KEY)
+	HeaderUploadHost       string = "X-Upload-Host"    // Hostname a proxied upload is for, checked against plan limits
+	HostDefault            string = "sharify.me"
+	ZephyrURL              string = "xericl.dev"
+	UserAgent              string = "sharify-labs/spine"
 )
 
 const (
@@ -25,6 +30,9 @@ const (
 
 var JWTPrivateKey *ecdsa.PrivateKey
 
+// adminUserIDs holds the User.ID of every account allowed to use the admin API (ADMIN_USER_IDS).
+var adminUserIDs = make(map[string]struct{})
+
 // Setup reads .env and initializes values that aren't const but also shouldn't be read in from env more than once.
 func Setup() {
 	var err error
@@ -38,6 +46,17 @@ func Setup() {
 	if JWTPrivateKey, err = jwt.ParseECPrivateKeyFromPEM(jwtPem); err != nil {
 		panic("failed to ParseECPrivateKeyFromPEM(JWT_PRIVATE_KEY)")
 	}
+	for _, id := range strings.Split(GetOrDefault("ADMIN_USER_IDS", ""), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			adminUserIDs[id] = struct{}{}
+		}
+	}
+}
+
+// IsAdmin reports whether the given User.ID is listed in ADMIN_USER_IDS.
+func IsAdmin(userID string) bool {
+	_, ok := adminUserIDs[userID]
+	return ok
 }
 
 // Get reads in a value from environment variable and returns its value as specified type.
@@ -56,12 +75,26 @@ func Get[T any](key string) T {
 			panic("invalid integer value for " + key)
 		}
 		result = valueInt
+	case *time.Duration:
+		valueDuration, err := time.ParseDuration(value)
+		if err != nil {
+			panic("invalid duration value for " + key)
+		}
+		result = valueDuration
 	default:
 		panic("unsupported type")
 	}
 	return result.(T)
 }
 
+// GetOrDefault behaves like Get, but returns fallback instead of panicking when the value is not set.
+func GetOrDefault[T any](key string, fallback T) T {
+	if os.Getenv(key) == "" {
+		return fallback
+	}
+	return Get[T](key)
+}
+
 // DecodedB64 reads in a base64-encoded string from environment and decodes it.
 // Additionally, it validates that the result is the expected length.
 // Note: Panics if value is empty.
@@ -29,7 +29,7 @@ func Setup() {
 	var err error
 	cache = memory.New(memory.Config{GCInterval: time.Minute * 5})
 	db, err = gorm.Open(sqlite.New(sqlite.Config{
-		DSN: config.Get[string]("TURSO_DSN"),
+		DSN: sqliteDSN(config.Get[string]("TURSO_DSN")),
 	}), &gorm.Config{
 		TranslateError: true,
 		Logger: logger.New(
@@ -45,6 +45,42 @@ func Setup() {
 	if err != nil {
 		panic(err)
 	}
+	if err = db.AutoMigrate(
+		&Plan{}, &User{}, &Token{}, &Host{}, &Upload{}, &StorageKey{},
+		&Subscription{}, &CustomDomain{}, &Domain{}, &SubdomainOverride{},
+		&HostTransfer{}, &AuditEvent{}, &Team{}, &TeamMember{}, &TeamToken{},
+		&EmbedTemplate{}, &HostDeletion{}, &DomainSubmission{}, &HostRequest{}, &ProcessedBillingEvent{},
+	); err != nil {
+		panic(err)
+	}
+	if err = migrateHostIndex(); err != nil {
+		panic(err)
+	}
+	if err = setupDefaultPlan(); err != nil {
+		panic(err)
+	}
+}
+
+// sqliteDSN returns dsn with SQLite's locking defaults for local database files ("file:" DSNs).
+// Transactions take the write lock when they begin (_txlock=immediate) and wait up to 5s for it (_busy_timeout),
+// so concurrent writes queue up instead of failing with "database is locked" when a transaction that read first
+// tries to write. Options already in dsn are kept. Other DSNs (ex: remote Turso databases) are returned as is.
+func sqliteDSN(dsn string) string {
+	if !strings.HasPrefix(dsn, "file:") {
+		return dsn
+	}
+	for _, option := range []string{"_txlock=immediate", "_busy_timeout=5000"} {
+		name, _, _ := strings.Cut(option, "=")
+		if strings.Contains(dsn, name+"=") {
+			continue
+		}
+		if strings.Contains(dsn, "?") {
+			dsn += "&" + option
+		} else {
+			dsn += "?" + option
+		}
+	}
+	return dsn
 }
 
 // DB retrieves gorm connector for SQL Database.
@@ -52,6 +88,11 @@ func DB() *gorm.DB {
 	return db
 }
 
+// Cache retrieves the local memory storage connector.
+func Cache() *memory.Storage {
+	return cache
+}
+
 func AddToCache(key string, data interface{}, exp time.Duration) {
 	var serialized []byte
 	var err error
@@ -87,37 +128,43 @@ func GetFromCache(key string, output interface{}) {
 	}
 }
 
+// DeleteFromCache removes a key from the cache.
+func DeleteFromCache(key string) {
+	if err := cache.Delete(key); err != nil {
+		echolog.Errorf("unable to delete %s from cache: %v", key, err)
+	}
+}
+
+// GetAllHostnames returns the hostnames of a user's personal hosts. Team hosts are excluded (see GetTeamHostnames).
 func GetAllHostnames(userID string) ([]string, error) {
 	var hosts []*Host
-	if err := db.Clauses(clause.Locking{
-		Strength: clause.LockingStrengthShare,
-	}).Where(&Host{
+	if err := db.Where(&Host{
 		UserID: userID,
-	}).Find(&hosts).Error; err != nil {
+	}).Where("team_id IS NULL").Find(&hosts).Error; err != nil {
 		return nil, err
 	}
 
 	var names []string
 	for _, h := range hosts {
-		if h.Sub != "" {
-			names = append(names, h.Sub+"."+h.Root)
-		} else {
-			names = append(names, h.Root)
-		}
+		names = append(names, h.Hostname())
 	}
 	return names, nil
 }
 
 // GetOrCreateUser Retrieves a user by Discord ID from the database. If not found, creates a new record.
-// Also assigns the provided email to the record, regardless of if the record is found.
+// Also assigns the provided email and username to the record, regardless of if the record is found.
+// New users are placed on the default plan.
 func GetOrCreateUser(gothUser goth.User) (*User, error) {
 	var user User
 	err := db.Clauses(clause.Locking{
 		Strength: clause.LockingStrengthUpdate,
 	}).Where(User{
 		DiscordID: &gothUser.UserID,
+	}).Attrs(User{
+		PlanID: DefaultPlanID(),
 	}).Assign(User{
-		Email: strings.TrimSpace(strings.ToLower(gothUser.Email)),
+		Email:    strings.TrimSpace(strings.ToLower(gothUser.Email)),
+		Username: gothUser.Name,
 	}).FirstOrCreate(&user).Error
 	if err != nil {
 		return nil, err
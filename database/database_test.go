@@ -0,0 +1,20 @@
+package database
+
+import "testing"
+
+func TestSqliteDSN(t *testing.T) {
+	tests := []struct {
+		dsn  string
+		want string
+	}{
+		{dsn: "file:spine.db", want: "file:spine.db?_txlock=immediate&_busy_timeout=5000"},
+		{dsn: "file:spine.db?cache=shared", want: "file:spine.db?cache=shared&_txlock=immediate&_busy_timeout=5000"},
+		{dsn: "file:spine.db?_busy_timeout=100", want: "file:spine.db?_busy_timeout=100&_txlock=immediate"},
+		{dsn: "libsql://spine.turso.io", want: "libsql://spine.turso.io"},
+	}
+	for _, tt := range tests {
+		if got := sqliteDSN(tt.dsn); got != tt.want {
+			t.Errorf("sqliteDSN(%q) = %q, want %q", tt.dsn, got, tt.want)
+		}
+	}
+}
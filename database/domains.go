@@ -0,0 +1,82 @@
+package database
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ListDomains returns every domain in the catalog ordered by name.
+func ListDomains() ([]*Domain, error) {
+	var domains []*Domain
+	if err := db.Order("name").Find(&domains).Error; err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+// ListEnabledDomains returns every enabled domain in the catalog ordered by name.
+func ListEnabledDomains() ([]*Domain, error) {
+	var domains []*Domain
+	if err := db.Where(&Domain{Enabled: true}).Order("name").Find(&domains).Error; err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+// GetDomain retrieves a domain from the catalog by name, regardless of whether it's enabled.
+func GetDomain(name string) (*Domain, error) {
+	var domain Domain
+	if err := db.Where(&Domain{Name: name}).First(&domain).Error; err != nil {
+		return nil, err
+	}
+	return &domain, nil
+}
+
+// CreateDomain adds a domain to the catalog.
+func CreateDomain(domain *Domain) error {
+	domain.ID = 0
+	return db.Create(domain).Error
+}
+
+// UpdateDomain overwrites the metadata of an existing domain and reloads it. The name can't be changed.
+func UpdateDomain(domain *Domain) error {
+	res := db.Model(domain).Select(
+		"Description", "Public", "WildcardAllowed", "MultiLevelAllowed", "NSFW", "Enabled", "OwnerID", "ReservedSubdomains",
+		"RequireHostApproval", "MaxHostsPerUser", "MinPlanID",
+	).Updates(domain)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return db.First(domain, domain.ID).Error
+}
+
+// DeleteDomain permanently removes a domain from the catalog so that its name can be added again later.
+// Existing hosts on the domain are not deleted. Prefer disabling domains instead.
+func DeleteDomain(id uint) error {
+	res := db.Unscoped().Delete(&Domain{}, id)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// ImportDomains adds domains to the catalog, skipping any that already exist.
+func ImportDomains(domains []*Domain) error {
+	if len(domains) == 0 {
+		return nil
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(domains).Error
+}
+
+// CountDomains returns the number of domains in the catalog.
+func CountDomains() (int64, error) {
+	var count int64
+	err := db.Model(&Domain{}).Count(&count).Error
+	return count, err
+}
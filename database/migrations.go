@@ -0,0 +1,94 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	echolog "github.com/labstack/gommon/log"
+	"github.com/sharify-labs/spine/config"
+	"gorm.io/gorm"
+)
+
+// hostIndexName is the unique index that prevents two active hosts from sharing a hostname.
+// Soft-deleted hosts are excluded so that a deleted hostname can be registered again.
+const hostIndexName = "idx_hosts_sub_root"
+
+// ErrDuplicateHosts is returned by Setup when duplicate hosts prevent creating hostIndexName.
+var ErrDuplicateHosts = errors.New("duplicate hosts prevent creating the unique hostname index")
+
+// HostDuplicate is a hostname that is registered by more than one active host.
+// UserIDs: Comma-separated User.ID of every owner, in registration order.
+type HostDuplicate struct {
+	Sub     string
+	Root    string
+	Count   int64
+	UserIDs string
+}
+
+// FindDuplicateHosts returns every hostname that is registered by more than one active host.
+func FindDuplicateHosts() ([]HostDuplicate, error) {
+	var dups []HostDuplicate
+	err := db.Raw(`
+		SELECT sub, root, COUNT(*) AS count, GROUP_CONCAT(user_id) AS user_ids
+		FROM (SELECT sub, root, user_id FROM hosts WHERE deleted_at IS NULL ORDER BY id)
+		GROUP BY sub, root
+		HAVING COUNT(*) > 1
+		ORDER BY root, sub`,
+	).Scan(&dups).Error
+	return dups, err
+}
+
+// migrateHostIndex creates hostIndexName.
+// If duplicate hosts exist, creating the index would fail, so each duplicate is logged and ErrDuplicateHosts is
+// returned to stop startup until an admin resolves them. With DEDUPE_HOSTS=1, the oldest registration of each
+// duplicated hostname is kept and the others are soft-deleted instead (see dedupeHosts).
+func migrateHostIndex() error {
+	// Hosts created before Sub was always set would bypass the index since NULLs are never equal.
+	if err := db.Exec("UPDATE hosts SET sub = '' WHERE sub IS NULL").Error; err != nil {
+		return err
+	}
+	dups, err := FindDuplicateHosts()
+	if err != nil {
+		return err
+	}
+	if len(dups) > 0 {
+		for _, d := range dups {
+			hostname := (&Host{Sub: d.Sub, Root: d.Root}).Hostname()
+			echolog.Errorf("duplicate host %s is registered %d times (users: %s)", hostname, d.Count, d.UserIDs)
+		}
+		if config.GetOrDefault("DEDUPE_HOSTS", 0) != 1 {
+			return fmt.Errorf(
+				"%w: resolve the %d duplicates above, or set DEDUPE_HOSTS=1 to keep only the oldest of each",
+				ErrDuplicateHosts, len(dups),
+			)
+		}
+		if err = dedupeHosts(dups); err != nil {
+			return err
+		}
+	}
+	return db.Exec(fmt.Sprintf(
+		"CREATE UNIQUE INDEX IF NOT EXISTS %s ON hosts (sub, root) WHERE deleted_at IS NULL", hostIndexName,
+	)).Error
+}
+
+// dedupeHosts soft-deletes every host of dups except the oldest registration of each hostname.
+// Each deleted host is logged, so that its owner can be told.
+func dedupeHosts(dups []HostDuplicate) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, d := range dups {
+			var hosts []Host
+			if err := tx.Where(map[string]interface{}{"sub": d.Sub, "root": d.Root}).
+				Order("id").Find(&hosts).Error; err != nil {
+				return err
+			}
+			for i := 1; i < len(hosts); i++ {
+				if err := tx.Delete(&hosts[i]).Error; err != nil {
+					return err
+				}
+				echolog.Warnf("deleted duplicate host %s (id %d) of user %s, keeping the one of user %s",
+					hosts[i].Hostname(), hosts[i].ID, hosts[i].UserID, hosts[0].UserID)
+			}
+		}
+		return nil
+	})
+}
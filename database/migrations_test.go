@@ -0,0 +1,77 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// TestMain runs the tests against a temporary database.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "spine-database-test")
+	if err != nil {
+		panic(err)
+	}
+	_ = os.Setenv("TURSO_DSN", "file:"+filepath.Join(dir, "test.db"))
+	_ = os.Setenv("LOG_LEVEL", "1")
+	Setup()
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// createDuplicateHosts drops hostIndexName and registers img.dup.example for each of userIDs, in order.
+func createDuplicateHosts(t *testing.T, userIDs ...string) {
+	t.Helper()
+	if err := db.Exec("DROP INDEX IF EXISTS " + hostIndexName).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range userIDs {
+		if err := db.Create(&Host{UserID: userID, Sub: "img", Root: "dup.example"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		db.Unscoped().Where("root = ?", "dup.example").Delete(&Host{})
+		if err := migrateHostIndex(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestMigrateHostIndexRefusesDuplicates(t *testing.T) {
+	createDuplicateHosts(t, "first", "second")
+	if err := migrateHostIndex(); !errors.Is(err, ErrDuplicateHosts) {
+		t.Fatalf("migrateHostIndex() = %v, want ErrDuplicateHosts", err)
+	}
+	var hosts int64
+	if err := db.Model(&Host{}).Where("root = ?", "dup.example").Count(&hosts).Error; err != nil {
+		t.Fatal(err)
+	}
+	if hosts != 2 {
+		t.Fatalf("hosts = %d, want both duplicates left for an admin to resolve", hosts)
+	}
+}
+
+func TestMigrateHostIndexDedupes(t *testing.T) {
+	t.Setenv("DEDUPE_HOSTS", "1")
+	createDuplicateHosts(t, "first", "second", "third")
+	if err := migrateHostIndex(); err != nil {
+		t.Fatal(err)
+	}
+	var owners []string
+	if err := db.Model(&Host{}).Where("root = ?", "dup.example").Pluck("user_id", &owners).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(owners) != 1 || owners[0] != "first" {
+		t.Fatalf("owners = %q, want only the oldest registration kept", owners)
+	}
+	// The index now rejects new duplicates
+	err := db.Create(&Host{UserID: "fourth", Sub: "img", Root: "dup.example"}).Error
+	if !errors.Is(err, gorm.ErrDuplicatedKey) {
+		t.Fatalf("creating a duplicate host = %v, want gorm.ErrDuplicatedKey", err)
+	}
+}
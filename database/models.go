@@ -52,6 +52,12 @@ func (u *Upload) BeforeCreate(_ *gorm.DB) (_ error) {
 }
 
 // Host represents a FQDN that a User can upload to.
+// TeamID: Set for hosts owned by a Team, which every member can upload to. UserID is then the member who created it.
+// DefaultExpiryHours: Lifetime of uploads that don't set one. 0 for permanent.
+// SecretLength & SecretCharset: How Zephyr generates secrets for uploads that don't set one. Zero values use Zephyr's defaults.
+// AllowedTypes: Comma-separated upload categories (files, pastes, redirects) accepted by the host. Empty for all.
+// GalleryListed: Whether uploads to the host are listed in the gallery.
+// FlaggedInactiveAt: When the host was flagged for having no recent uploads (see services.ReclaimInactiveHosts).
 // Example:
 //
 //	"id": 1,
@@ -65,6 +71,26 @@ type Host struct {
 	Root   string `gorm:"not null;<-:create"` // cannot edit
 	UserID string `gorm:"index"`              // fk -> User.ID  (I don't know why but "index" tags required for fk to work)
 	User   User   // required for M-1 relationship (I think)
+	TeamID *uint  `gorm:"index"` // fk -> Team.ID
+	Team   *Team
+
+	DefaultExpiryHours int    `gorm:"not null;default:0"`
+	SecretLength       int    `gorm:"not null;default:0"`
+	SecretCharset      string `gorm:"not null;default:''"`
+	AllowedTypes       string `gorm:"not null;default:''"`
+	GalleryListed      bool   `gorm:"not null;default:true"`
+
+	FlaggedInactiveAt *time.Time `gorm:"index"`
+	// FlaggedIneligibleAt is set when the owner's plan no longer meets the minimum plan of the root.
+	FlaggedIneligibleAt *time.Time `gorm:"index"`
+}
+
+// Hostname returns the host's full hostname.
+func (h *Host) Hostname() string {
+	if h.Sub != "" {
+		return h.Sub + "." + h.Root
+	}
+	return h.Root
 }
 
 func (h *Host) BeforeCreate(_ *gorm.DB) (err error) {
@@ -73,6 +99,232 @@ func (h *Host) BeforeCreate(_ *gorm.DB) (err error) {
 	return
 }
 
+// Team represents a group of Users sharing hosts, an upload token and a plan.
+// PlanID: The plan whose limits apply to the team's hosts and uploads. Defaults to the default plan.
+type Team struct {
+	gorm.Model
+	ID      uint   `gorm:"primaryKey;autoincrement"`
+	Name    string `gorm:"not null"`
+	PlanID  *uint  `gorm:"index"` // fk -> Plan.ID
+	Plan    *Plan
+	Members []TeamMember
+	Hosts   []Host
+}
+
+// TeamMember represents a User's membership in a Team.
+// Role: owner, admin or member (see services.TeamRole).
+type TeamMember struct {
+	gorm.Model
+	ID     uint `gorm:"primaryKey;autoincrement"`
+	TeamID uint `gorm:"not null;uniqueIndex:idx_team_member"` // fk -> Team.ID
+	Team   Team
+	UserID string `gorm:"not null;uniqueIndex:idx_team_member;index"` // fk -> User.ID
+	User   User
+	Role   string `gorm:"not null"`
+}
+
+// TeamToken represents a team's upload token. It works like Token, but isn't tied to a single User,
+// and only uploads to the hosts owned by its Team.
+type TeamToken struct {
+	gorm.Model
+	ID     string `gorm:"primaryKey"`
+	Hash   string `gorm:"unique;not null"`
+	TeamID uint   `gorm:"unique;not null"` // fk -> Team.ID
+	Team   Team
+}
+
+// HostDeletion tracks the background job that handles the uploads of a deleted Host.
+// Action: move (to MoveTo) or delete. Uploads are only tracked when they're not kept.
+// Status: pending, running, completed or failed.
+// TeamID: Set if the Host belonged to a Team, in which case every member's uploads are handled.
+// Total & Processed: Number of uploads to handle and handled so far.
+// Attempts & NextAttemptAt: Number of failed runs, and when a pending job may be retried (nil for right away).
+// LeaseOwner & LeaseExpiresAt: The instance running the job, which other instances leave alone until the lease expires.
+type HostDeletion struct {
+	gorm.Model
+	ID             uint   `gorm:"primaryKey;autoincrement"`
+	UserID         string `gorm:"not null;index"` // fk -> User.ID
+	User           User
+	TeamID         *uint
+	Hostname       string `gorm:"not null"`
+	Action         string `gorm:"not null"`
+	MoveTo         string `gorm:"not null;default:''"`
+	Status         string `gorm:"not null;index"`
+	Total          int64  `gorm:"not null"`
+	Processed      int64  `gorm:"not null"`
+	Error          string `gorm:"not null;default:''"`
+	CompletedAt    *time.Time
+	Attempts       int `gorm:"not null;default:0"`
+	NextAttemptAt  *time.Time
+	LeaseOwner     string `gorm:"not null;default:''"`
+	LeaseExpiresAt *time.Time
+}
+
+// DomainSubmission represents a User offering one of their verified CustomDomains to the catalog.
+// Status: pending, approved, rejected or withdrawn. Only one submission per domain name can be pending.
+// Once approved, the domain is added to the catalog with the User as its contributor.
+type DomainSubmission struct {
+	gorm.Model
+	ID          uint   `gorm:"primaryKey;autoincrement"`
+	Name        string `gorm:"not null;index;<-:create"` // cannot edit
+	Description string `gorm:"not null"`
+	Public      bool   `gorm:"not null"`
+	NSFW        bool   `gorm:"not null"`
+	UserID      string `gorm:"not null;index"` // fk -> User.ID
+	User        User
+	Status      string `gorm:"not null;index"`
+	ReviewNote  string `gorm:"not null;default:''"`
+	ReviewedAt  *time.Time
+}
+
+// HostRequest represents a User asking to register a Host on a contributed Domain that requires approval.
+// Status: pending, approved or rejected. ResolvedAt: When the request stopped being pending.
+type HostRequest struct {
+	gorm.Model
+	ID         uint   `gorm:"primaryKey;autoincrement"`
+	Sub        string `gorm:"not null;<-:create"`       // cannot edit
+	Root       string `gorm:"not null;index;<-:create"` // cannot edit
+	UserID     string `gorm:"not null;index"`           // fk -> User.ID
+	User       User
+	Status     string `gorm:"not null;index"`
+	ResolvedAt *time.Time
+}
+
+// HostTransfer represents a request to hand a Host over to another User.
+// Status: pending, accepted, declined or cancelled. Only one transfer per Host can be pending.
+// ResolvedAt: When the transfer stopped being pending.
+type HostTransfer struct {
+	gorm.Model
+	ID         uint `gorm:"primaryKey;autoincrement"`
+	HostID     uint `gorm:"not null;index"` // fk -> Host.ID
+	Host       Host
+	FromUserID string `gorm:"not null;index"` // fk -> User.ID
+	FromUser   User
+	ToUserID   string `gorm:"not null;index"` // fk -> User.ID
+	ToUser     User
+	Status     string `gorm:"not null;index"`
+	ResolvedAt *time.Time
+}
+
+// AuditEvent records an action that affected a User's account, for their audit history.
+// Action: What happened (ex: host.transfer.accepted).
+// Target: What it happened to (ex: the hostname).
+// ActorID: The User.ID of whoever performed the action, which may be another User.
+type AuditEvent struct {
+	ID        uint      `gorm:"primaryKey;autoincrement"`
+	CreatedAt time.Time `gorm:"index"`
+	UserID    string    `gorm:"not null;index"` // fk -> User.ID
+	User      User
+	Action    string `gorm:"not null"`
+	Target    string `gorm:"not null"`
+	ActorID   string `gorm:"not null"`
+}
+
+// EmbedTemplate describes how a User's uploads are previewed when shared (Discord/OpenGraph embeds).
+// Hostname: The host the template applies to, or empty for the User's default template.
+// SiteName, Title, Description & Author may contain placeholders (see services.EmbedPlaceholders).
+// Color: Embed color as #rrggbb, or empty for none.
+type EmbedTemplate struct {
+	gorm.Model
+	ID          uint   `gorm:"primaryKey;autoincrement"`
+	UserID      string `gorm:"not null;uniqueIndex:idx_embed_template"` // fk -> User.ID
+	User        User
+	Hostname    string `gorm:"not null;uniqueIndex:idx_embed_template"`
+	SiteName    string `gorm:"not null"`
+	Title       string `gorm:"not null"`
+	Description string `gorm:"not null"`
+	Color       string `gorm:"not null"`
+	Author      string `gorm:"not null"`
+}
+
+// Domain represents a shared root domain in the catalog that users can create hosts under.
+// Public: Private domains are only available to their Owner.
+// WildcardAllowed: Whether users may register subdomains. If false, only the root itself can be used as a host.
+// MultiLevelAllowed: Whether subdomains may have more than one label (ex: a.b.example.com).
+// NSFW: Flags domains whose name isn't safe for work.
+// Enabled: Disabled domains are hidden and can't be used for new hosts. Existing hosts keep working.
+// OwnerID: The User.ID of the person who owns the domain. NULL for domains owned by Sharify.
+type Domain struct {
+	gorm.Model
+	ID                uint    `gorm:"primaryKey;autoincrement"`
+	Name              string  `gorm:"unique;not null;<-:create"` // cannot edit
+	Description       string  `gorm:"not null"`
+	Public            bool    `gorm:"not null"`
+	WildcardAllowed   bool    `gorm:"not null"`
+	MultiLevelAllowed bool    `gorm:"not null;default:false"`
+	NSFW              bool    `gorm:"not null"`
+	Enabled           bool    `gorm:"not null;index"`
+	OwnerID           *string `gorm:"index"` // fk -> User.ID
+	Owner             *User
+	// ReservedSubdomains is a comma-separated list of subdomains reserved on this domain only.
+	ReservedSubdomains string `gorm:"not null;default:''"`
+	// ContributorID is set for domains donated by a User through a DomainSubmission, who is credited for it.
+	ContributorID *string `gorm:"index"` // fk -> User.ID
+	Contributor   *User
+	// RequireHostApproval: Hosts on this domain must be approved by the contributor (see HostRequest).
+	RequireHostApproval bool `gorm:"not null;default:false"`
+	// MaxHostsPerUser limits how many hosts each User may have on this domain (0 = unlimited).
+	MaxHostsPerUser int `gorm:"not null;default:0"`
+	// MinPlanID: Hosts on this domain require this Plan or one that costs at least as much. Nil if free.
+	MinPlanID *uint `gorm:"index"` // fk -> Plan.ID
+	MinPlan   *Plan
+}
+
+// ReservedList returns the subdomains reserved on this domain only.
+func (d *Domain) ReservedList() []string {
+	var res []string
+	for _, r := range strings.Split(d.ReservedSubdomains, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// SubdomainOverride allows a User to register a subdomain that the subdomain policy would otherwise reject.
+// Root: The root domain the override applies to, or empty for every root.
+// Note: Overrides only lift the policy; the subdomain still has to be available.
+type SubdomainOverride struct {
+	gorm.Model
+	ID     uint   `gorm:"primaryKey;autoincrement"`
+	Sub    string `gorm:"not null;uniqueIndex:idx_subdomain_override"`
+	Root   string `gorm:"not null;uniqueIndex:idx_subdomain_override"`
+	UserID string `gorm:"not null;uniqueIndex:idx_subdomain_override"` // fk -> User.ID
+	User   User
+}
+
+func (d *Domain) BeforeCreate(_ *gorm.DB) (_ error) {
+	d.Name = strings.ToLower(strings.TrimSpace(d.Name))
+	return
+}
+
+// CustomDomain represents a root domain owned by a User, verified through a DNS TXT record.
+// Name: The root domain (ex: example.com).
+// Token: The value the User must publish in the verification TXT record.
+// Status: pending or verified.
+// Example:
+//
+//	"id": 1,
+//	"name": "example.com",
+//	"status": "verified",
+//	"user_id": "c99e9b2c-f04b-421e-b4a5-8120d2513b93"
+type CustomDomain struct {
+	gorm.Model
+	ID            uint   `gorm:"primaryKey;autoincrement"`
+	Name          string `gorm:"not null;uniqueIndex:idx_custom_domain_user;<-:create"` // cannot edit
+	Token         string `gorm:"not null;<-:create"`                                    // cannot edit
+	Status        string `gorm:"not null;index"`
+	VerifiedAt    *time.Time
+	LastCheckedAt *time.Time
+	UserID        string `gorm:"not null;uniqueIndex:idx_custom_domain_user;index"` // fk -> User.ID
+	User          User
+}
+
+func (d *CustomDomain) BeforeCreate(_ *gorm.DB) (_ error) {
+	d.Name = strings.ToLower(strings.TrimSpace(d.Name))
+	return
+}
+
 // Token represents a user's upload token.
 type Token struct {
 	gorm.Model
@@ -83,17 +335,21 @@ type Token struct {
 }
 
 // User represents a person registered on our platform.
+// Username: Their Discord username as of their last login.
 type User struct {
 	gorm.Model
 	ID        string  `gorm:"primaryKey"`
 	Email     string  `gorm:"unique;not null"`
+	Username  string  `gorm:"not null;default:''"`
 	DiscordID *string `gorm:"unique;index"`
 	TokenID   *string `gorm:"unique;index"`
 	Token     *Token  `gorm:"foreignKey:TokenID"`
-	PlanID    *uint   // temp nullable
-	Plan      *Plan   // temp nullable
-	Hosts     []Host
-	Uploads   []Upload
+	PlanID    *uint   `gorm:"index"` // nullable until backfilled with the default plan (see setupDefaultPlan)
+	Plan      *Plan
+	// PlanSource: Who assigned the Plan: PlanSourceBilling, PlanSourceAdmin, or empty for the default plan.
+	PlanSource string `gorm:"not null;default:''"`
+	Hosts      []Host
+	Uploads    []Upload
 }
 
 func (u *User) BeforeCreate(_ *gorm.DB) (_ error) {
@@ -103,11 +359,44 @@ func (u *User) BeforeCreate(_ *gorm.DB) (_ error) {
 }
 
 // Plan represents a User's plan and describes pricing & limits.
+// A limit of 0 means the plan is unlimited for that resource.
+// StorageQuota: Total bytes a User may store across all of their uploads.
+// MaxUploadSize: Largest single upload in bytes.
+// BillingPriceID: The billing provider's recurring price for this plan. NULL for plans that can't be purchased.
 type Plan struct {
 	gorm.Model
-	ID         uint    `gorm:"primaryKey;autoIncrement"`
-	Name       string  `gorm:"unique;not null"`
-	Price      float32 `gorm:"unique;not null"`
-	MaxHosts   int     `gorm:"not null"`
-	MaxUploads int     `gorm:"not null"`
+	ID             uint    `gorm:"primaryKey;autoIncrement"`
+	Name           string  `gorm:"unique;not null"`
+	Price          float32 `gorm:"unique;not null"`
+	MaxHosts       int     `gorm:"not null"`
+	MaxUploads     int     `gorm:"not null"`
+	StorageQuota   int64   `gorm:"not null;default:0"`
+	MaxUploadSize  int64   `gorm:"not null;default:0"`
+	BillingPriceID *string `gorm:"unique"`
+}
+
+// Subscription represents a User's paid subscription to a Plan with the billing provider.
+// ID: The billing provider's subscription ID.
+// Status: incomplete (created, first payment not confirmed yet), active, past_due (payment failed) or canceled.
+// GraceUntil: When a past_due subscription gets downgraded to the default plan.
+// NULL unless past_due, and cleared once the grace period is over.
+type Subscription struct {
+	gorm.Model
+	ID               string `gorm:"primaryKey"`
+	CustomerID       string `gorm:"not null"`
+	Status           string `gorm:"not null;index"`
+	CurrentPeriodEnd time.Time
+	GraceUntil       *time.Time
+	UserID           string `gorm:"index;not null"` // fk -> User.ID
+	User             User
+	PlanID           uint `gorm:"not null"` // fk -> Plan.ID
+	Plan             Plan
+}
+
+// ProcessedBillingEvent records a billing webhook that was applied, so that redelivered events are ignored.
+// ID: The billing provider's event ID.
+type ProcessedBillingEvent struct {
+	ID        string    `gorm:"primaryKey"`
+	Type      string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"index"`
 }
@@ -0,0 +1,39 @@
+package database
+
+import "gorm.io/gorm"
+
+// ListSubdomainOverrides returns every subdomain override ordered by sub and root.
+func ListSubdomainOverrides() ([]*SubdomainOverride, error) {
+	var overrides []*SubdomainOverride
+	if err := db.Order("sub, root").Find(&overrides).Error; err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+// HasSubdomainOverride reports whether a user has an override for sub under root or for sub under every root.
+func HasSubdomainOverride(userID, sub, root string) (bool, error) {
+	var count int64
+	err := db.Model(&SubdomainOverride{}).
+		Where("user_id = ? AND sub = ? AND root IN ?", userID, sub, []string{root, ""}).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// CreateSubdomainOverride adds a subdomain override.
+func CreateSubdomainOverride(override *SubdomainOverride) error {
+	override.ID = 0
+	return db.Create(override).Error
+}
+
+// DeleteSubdomainOverride permanently removes a subdomain override. Hosts registered through it are kept.
+func DeleteSubdomainOverride(id uint) error {
+	res := db.Unscoped().Delete(&SubdomainOverride{}, id)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/sharify-labs/spine/config"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrPlanIsDefault = errors.New("plan is the default plan")
+	ErrPlanInUse     = errors.New("plan is assigned to users")
+	ErrPlanRequired  = errors.New("plan is the minimum plan of a domain")
+)
+
+// User.PlanSource values.
+const (
+	PlanSourceBilling = "billing" // granted by a paid subscription, changed by billing events
+	PlanSourceAdmin   = "admin"   // assigned by an admin, never changed by billing
+)
+
+// defaultPlanID is the Plan.ID assigned to every new User.
+var defaultPlanID uint
+
+// setupDefaultPlan ensures the plan named by DEFAULT_PLAN exists and backfills it onto users without a plan.
+// If the plan doesn't exist yet, it is created as a free plan with conservative limits which can be
+// adjusted afterward through the admin API.
+func setupDefaultPlan() error {
+	plan := Plan{Name: config.GetOrDefault("DEFAULT_PLAN", "Free")}
+	if err := db.Where(Plan{Name: plan.Name}).Attrs(Plan{
+		Price:         0,
+		MaxHosts:      3,
+		MaxUploads:    0,
+		StorageQuota:  1 << 30,   // 1 GiB
+		MaxUploadSize: 100 << 20, // 100 MiB (matches router BodyLimit)
+	}).FirstOrCreate(&plan).Error; err != nil {
+		return err
+	}
+	defaultPlanID = plan.ID
+
+	// Backfill users created before plans were assigned.
+	if err := db.Model(&User{}).Where("plan_id IS NULL").Update("plan_id", defaultPlanID).Error; err != nil {
+		return err
+	}
+	// Backfill the source of plans assigned before it was recorded: users with a subscription got their plan
+	// through billing, and anyone else on another plan than the default got it from an admin.
+	subscribers := db.Model(&Subscription{}).Select("user_id")
+	unknown := db.Model(&User{}).Where("plan_source = '' AND plan_id <> ?", defaultPlanID)
+	if err := unknown.Session(&gorm.Session{}).Where("id IN (?)", subscribers).
+		Update("plan_source", PlanSourceBilling).Error; err != nil {
+		return err
+	}
+	return unknown.Session(&gorm.Session{}).Where("id NOT IN (?)", subscribers).
+		Update("plan_source", PlanSourceAdmin).Error
+}
+
+// DefaultPlanID returns a pointer to a copy of the default Plan.ID, ready to be assigned to User.PlanID.
+func DefaultPlanID() *uint {
+	id := defaultPlanID
+	return &id
+}
+
+// ListPlans returns all plans ordered by price.
+func ListPlans() ([]*Plan, error) {
+	var plans []*Plan
+	if err := db.Order("price").Find(&plans).Error; err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+// GetPlan retrieves a plan by ID.
+func GetPlan(id uint) (*Plan, error) {
+	var plan Plan
+	if err := db.First(&plan, id).Error; err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// GetUserPlan retrieves the plan assigned to a user, falling back to the default plan.
+func GetUserPlan(userID string) (*Plan, error) {
+	var user User
+	if err := db.Preload("Plan").Where(&User{ID: userID}).First(&user).Error; err != nil {
+		return nil, err
+	}
+	if user.Plan != nil {
+		return user.Plan, nil
+	}
+	return GetPlan(defaultPlanID)
+}
+
+// CreatePlan inserts a new plan.
+func CreatePlan(plan *Plan) error {
+	plan.ID = 0
+	return db.Create(plan).Error
+}
+
+// UpdatePlan overwrites the name, price, limits and billing price of an existing plan.
+func UpdatePlan(plan *Plan) error {
+	res := db.Model(plan).Select(
+		"Name", "Price", "MaxHosts", "MaxUploads", "StorageQuota", "MaxUploadSize", "BillingPriceID",
+	).Updates(plan)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// DeletePlan deletes a plan as long as it isn't the default plan, no users are assigned to it and no domain
+// requires it.
+func DeletePlan(id uint) error {
+	if id == defaultPlanID {
+		return ErrPlanIsDefault
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		var users int64
+		if err := tx.Model(&User{}).Where(&User{PlanID: &id}).Count(&users).Error; err != nil {
+			return err
+		}
+		if users > 0 {
+			return ErrPlanInUse
+		}
+		var domains int64
+		if err := tx.Model(&Domain{}).Where(&Domain{MinPlanID: &id}).Count(&domains).Error; err != nil {
+			return err
+		}
+		if domains > 0 {
+			return ErrPlanRequired
+		}
+		res := tx.Delete(&Plan{}, id)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+// SetUserPlan assigns a plan to a user as an admin: billing won't change it anymore (see User.PlanSource),
+// unless it is the default plan, which hands the user's plan back to billing.
+func SetUserPlan(userID string, planID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Select("id").First(&Plan{}, planID).Error; err != nil {
+			return err
+		}
+		res := tx.Clauses(clause.Locking{
+			Strength: clause.LockingStrengthUpdate,
+		}).Model(&User{}).Where(&User{ID: userID}).Updates(map[string]interface{}{
+			"plan_id":     planID,
+			"plan_source": planSource(planID),
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+// planSource returns the PlanSource of a plan assigned by an admin.
+func planSource(planID uint) string {
+	if planID == defaultPlanID {
+		return ""
+	}
+	return PlanSourceAdmin
+}
@@ -0,0 +1,45 @@
+package database
+
+import "gorm.io/gorm"
+
+// GetTeamHostnames returns the hostnames of the hosts owned by every team the user is a member of.
+func GetTeamHostnames(userID string) ([]string, error) {
+	var hosts []*Host
+	if err := db.Where(
+		"team_id IN (?)", db.Model(&TeamMember{}).Select("team_id").Where("user_id = ?", userID),
+	).Order("root, sub").Find(&hosts).Error; err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		names = append(names, h.Hostname())
+	}
+	return names, nil
+}
+
+// GetTeamPlan retrieves the plan of a team, or the default plan if it doesn't have one.
+func GetTeamPlan(teamID uint) (*Plan, error) {
+	var team Team
+	if err := db.Preload("Plan").First(&team, teamID).Error; err != nil {
+		return nil, err
+	}
+	if team.Plan != nil {
+		return team.Plan, nil
+	}
+	return GetPlan(defaultPlanID)
+}
+
+// SetTeamPlan assigns a plan to a team.
+func SetTeamPlan(teamID, planID uint) error {
+	if _, err := GetPlan(planID); err != nil {
+		return err
+	}
+	res := db.Model(&Team{}).Where("id = ?", teamID).Update("plan_id", planID)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
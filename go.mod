@@ -16,6 +16,8 @@ require (
 	github.com/markbates/goth v1.80.0
 	github.com/tursodatabase/libsql-client-go v0.0.0-20240416075003-747366ff79c4
 	github.com/ytsruh/gorm-libsql v0.1.3
+	golang.org/x/net v0.26.0
+	golang.org/x/text v0.16.0
 	gorm.io/gorm v1.25.10
 )
 
@@ -35,10 +37,8 @@ require (
 	github.com/valyala/fasttemplate v1.2.2 // indirect
 	golang.org/x/crypto v0.24.0 // indirect
 	golang.org/x/exp v0.0.0-20240613232115-7f521ea00fb8 // indirect
-	golang.org/x/net v0.26.0 // indirect
 	golang.org/x/oauth2 v0.21.0 // indirect
 	golang.org/x/sys v0.21.0 // indirect
-	golang.org/x/text v0.16.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
 	nhooyr.io/websocket v1.8.11 // indirect
 )
@@ -0,0 +1,450 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/database"
+	"github.com/sharify-labs/spine/models"
+	"github.com/sharify-labs/spine/services"
+	"github.com/sharify-labs/spine/validators"
+	"gorm.io/gorm"
+)
+
+// planForm is the request body accepted by CreatePlan and UpdatePlan.
+type planForm struct {
+	Name          string  `form:"name" json:"name"`
+	Price         float32 `form:"price" json:"price"`
+	MaxHosts      int     `form:"max_hosts" json:"max_hosts"`
+	MaxUploads    int     `form:"max_uploads" json:"max_uploads"`
+	StorageQuota  int64   `form:"storage_quota" json:"storage_quota"`
+	MaxUploadSize int64   `form:"max_upload_size" json:"max_upload_size"`
+	// BillingPriceID links the plan to a recurring price with the billing provider. Empty if not purchasable.
+	BillingPriceID string `form:"billing_price_id" json:"billing_price_id"`
+}
+
+func (f *planForm) toPlan(id uint) *database.Plan {
+	plan := &database.Plan{
+		ID:            id,
+		Name:          f.Name,
+		Price:         f.Price,
+		MaxHosts:      f.MaxHosts,
+		MaxUploads:    f.MaxUploads,
+		StorageQuota:  f.StorageQuota,
+		MaxUploadSize: f.MaxUploadSize,
+	}
+	if f.BillingPriceID != "" {
+		plan.BillingPriceID = &f.BillingPriceID
+	}
+	return plan
+}
+
+func (f *planForm) validate() error {
+	if f.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is required")
+	}
+	if f.Price < 0 || f.MaxHosts < 0 || f.MaxUploads < 0 || f.StorageQuota < 0 || f.MaxUploadSize < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "price and limits must not be negative")
+	}
+	return nil
+}
+
+func newPlanModel(p *database.Plan) models.Plan {
+	return models.Plan{
+		ID:            p.ID,
+		Name:          p.Name,
+		Price:         p.Price,
+		MaxHosts:      p.MaxHosts,
+		MaxUploads:    p.MaxUploads,
+		StorageQuota:  p.StorageQuota,
+		MaxUploadSize: p.MaxUploadSize,
+		Purchasable:   p.BillingPriceID != nil,
+	}
+}
+
+// paramID parses a numeric ID path parameter.
+func paramID(c echo.Context, name string) (uint, error) {
+	id, err := strconv.ParseUint(c.Param(name), 10, 0)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "invalid "+name)
+	}
+	return uint(id), nil
+}
+
+// planErrToHTTP converts errors returned from plan operations into HTTP errors.
+func planErrToHTTP(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return echo.NewHTTPError(http.StatusNotFound)
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return echo.NewHTTPError(http.StatusConflict, "a plan with that name, price or billing price already exists")
+	case errors.Is(err, database.ErrPlanIsDefault), errors.Is(err, database.ErrPlanInUse),
+		errors.Is(err, database.ErrPlanRequired):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	default:
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+}
+
+// ListPlans returns a JSON array of all plans.
+func ListPlans(c echo.Context) error {
+	plans, err := database.ListPlans()
+	if err != nil {
+		return planErrToHTTP(c, err)
+	}
+	res := make([]models.Plan, 0, len(plans))
+	for _, p := range plans {
+		res = append(res, newPlanModel(p))
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// CreatePlan creates a new plan. Admin only.
+func CreatePlan(c echo.Context) error {
+	var form planForm
+	if err := c.Bind(&form); err != nil {
+		return err
+	}
+	if err := form.validate(); err != nil {
+		return err
+	}
+	plan := form.toPlan(0)
+	if err := database.CreatePlan(plan); err != nil {
+		return planErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusCreated, newPlanModel(plan))
+}
+
+// UpdatePlan overwrites an existing plan's name, price and limits. Admin only.
+// Users already on the plan keep it, even if the new limits are below their usage.
+func UpdatePlan(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	var form planForm
+	if err = c.Bind(&form); err != nil {
+		return err
+	}
+	if err = form.validate(); err != nil {
+		return err
+	}
+	plan := form.toPlan(id)
+	if err = database.UpdatePlan(plan); err != nil {
+		return planErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, newPlanModel(plan))
+}
+
+// DeletePlan deletes a plan that no users are assigned to. Admin only.
+func DeletePlan(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	if err = database.DeletePlan(id); err != nil {
+		return planErrToHTTP(c, err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// AssignUserPlan moves a user onto a plan. Admin only.
+// The response lists any limits the user's current usage exceeds on the new plan.
+func AssignUserPlan(c echo.Context) error {
+	planID, err := strconv.ParseUint(c.FormValue("plan_id"), 10, 0)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid plan_id")
+	}
+	userID := c.Param("id")
+	exceeded, err := services.AssignPlan(userID, uint(planID))
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			err = fmt.Errorf("failed to assign plan %d to user %s: %w", planID, userID, err)
+		}
+		return planErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"plan_id":  planID,
+		"exceeded": exceeded,
+	})
+}
+
+// AssignTeamPlan moves a team onto a plan. Admin only.
+func AssignTeamPlan(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	planID, err := strconv.ParseUint(c.FormValue("plan_id"), 10, 0)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid plan_id")
+	}
+	if err = database.SetTeamPlan(id, uint(planID)); err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			err = fmt.Errorf("failed to assign plan %d to team %d: %w", planID, id, err)
+		}
+		return planErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"plan_id": planID,
+	})
+}
+
+// domainForm is the request body accepted by CreateDomain and UpdateDomain.
+// Public, WildcardAllowed and Enabled default to true when omitted.
+type domainForm struct {
+	Name              string `form:"name" json:"name"`
+	Description       string `form:"description" json:"description"`
+	Public            *bool  `form:"public" json:"public"`
+	WildcardAllowed   *bool  `form:"wildcard_allowed" json:"wildcard_allowed"`
+	MultiLevelAllowed bool   `form:"multi_level_allowed" json:"multi_level_allowed"`
+	NSFW              bool   `form:"nsfw" json:"nsfw"`
+	Enabled           *bool  `form:"enabled" json:"enabled"`
+	OwnerID           string `form:"owner_id" json:"owner_id"`
+	// ReservedSubdomains are reserved on this domain in addition to the global reserved list.
+	ReservedSubdomains  []string `form:"reserved_subdomains" json:"reserved_subdomains"`
+	RequireHostApproval bool     `form:"require_host_approval" json:"require_host_approval"`
+	MaxHostsPerUser     int      `form:"max_hosts_per_user" json:"max_hosts_per_user"`
+	// MinPlanID is the cheapest plan that can create hosts on the domain. 0 if it's free.
+	MinPlanID uint `form:"min_plan_id" json:"min_plan_id"`
+}
+
+func (f *domainForm) toDomain(id uint) *database.Domain {
+	orTrue := func(b *bool) bool { return b == nil || *b }
+	domain := &database.Domain{
+		ID:                  id,
+		Name:                f.Name,
+		Description:         f.Description,
+		Public:              orTrue(f.Public),
+		WildcardAllowed:     orTrue(f.WildcardAllowed),
+		MultiLevelAllowed:   f.MultiLevelAllowed,
+		NSFW:                f.NSFW,
+		Enabled:             orTrue(f.Enabled),
+		RequireHostApproval: f.RequireHostApproval,
+		MaxHostsPerUser:     f.MaxHostsPerUser,
+	}
+	reserved := make([]string, 0, len(f.ReservedSubdomains))
+	for _, r := range f.ReservedSubdomains {
+		if r = validators.SanitizeSubdomain(r); r != "" && !slices.Contains(reserved, r) {
+			reserved = append(reserved, r)
+		}
+	}
+	domain.ReservedSubdomains = strings.Join(reserved, ",")
+	if f.OwnerID != "" {
+		domain.OwnerID = &f.OwnerID
+	}
+	if f.MinPlanID != 0 {
+		domain.MinPlanID = &f.MinPlanID
+	}
+	return domain
+}
+
+func (f *domainForm) validate() error {
+	if f.MaxHostsPerUser < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "max_hosts_per_user must not be negative")
+	}
+	return nil
+}
+
+func newDomainModel(d *database.Domain) models.Domain {
+	return models.Domain{
+		ID:                d.ID,
+		Name:              d.Name,
+		Description:       d.Description,
+		Public:            d.Public,
+		WildcardAllowed:   d.WildcardAllowed,
+		MultiLevelAllowed: d.MultiLevelAllowed,
+		NSFW:              d.NSFW,
+		Enabled:           d.Enabled,
+		OwnerID:           d.OwnerID,
+		// Never null so that clients can always iterate
+		ReservedSubdomains:  append([]string{}, d.ReservedList()...),
+		ContributorID:       d.ContributorID,
+		RequireHostApproval: d.RequireHostApproval,
+		MaxHostsPerUser:     d.MaxHostsPerUser,
+		MinPlanID:           d.MinPlanID,
+	}
+}
+
+// domainErrToHTTP converts errors returned from catalog operations into HTTP errors.
+func domainErrToHTTP(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return echo.NewHTTPError(http.StatusNotFound)
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return echo.NewHTTPError(http.StatusConflict, "domain already exists")
+	case errors.Is(err, gorm.ErrForeignKeyViolated):
+		return echo.NewHTTPError(http.StatusBadRequest, "owner_id or min_plan_id does not exist")
+	default:
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+}
+
+// refreshCatalog reloads the domain catalog snapshot so that admin changes show up immediately.
+// Failures are only reported since the snapshot is refreshed in the background anyway.
+func refreshCatalog(c echo.Context) {
+	if err := services.RefreshCatalog(); err != nil {
+		clients.Sentry.CaptureErr(c, fmt.Errorf("failed to refresh domain catalog: %w", err))
+	}
+}
+
+// ListDomains returns a JSON array of every domain in the catalog. Admin only.
+func ListDomains(c echo.Context) error {
+	domains, err := database.ListDomains()
+	if err != nil {
+		return domainErrToHTTP(c, err)
+	}
+	res := make([]models.Domain, 0, len(domains))
+	for _, d := range domains {
+		res = append(res, newDomainModel(d))
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// CreateDomain adds a root domain to the catalog. Admin only.
+func CreateDomain(c echo.Context) error {
+	var form domainForm
+	if err := c.Bind(&form); err != nil {
+		return err
+	}
+	if form.Name = validators.SanitizeDomain(form.Name); form.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid domain name")
+	}
+	if err := form.validate(); err != nil {
+		return err
+	}
+	domain := form.toDomain(0)
+	if err := database.CreateDomain(domain); err != nil {
+		return domainErrToHTTP(c, err)
+	}
+	refreshCatalog(c)
+	return c.JSON(http.StatusCreated, newDomainModel(domain))
+}
+
+// UpdateDomain overwrites the metadata of a domain in the catalog. The name and contributor can't be changed.
+// Admin only.
+func UpdateDomain(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	var form domainForm
+	if err = c.Bind(&form); err != nil {
+		return err
+	}
+	if err = form.validate(); err != nil {
+		return err
+	}
+	domain := form.toDomain(id)
+	if err = database.UpdateDomain(domain); err != nil {
+		return domainErrToHTTP(c, err)
+	}
+	refreshCatalog(c)
+	return c.JSON(http.StatusOK, newDomainModel(domain))
+}
+
+// DeleteDomain removes a domain from the catalog. Existing hosts on it are kept. Admin only.
+func DeleteDomain(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	if err = database.DeleteDomain(id); err != nil {
+		return domainErrToHTTP(c, err)
+	}
+	refreshCatalog(c)
+	return c.NoContent(http.StatusOK)
+}
+
+// overrideForm is the request body accepted by CreateSubdomainOverride.
+// Root is optional: an empty root applies the override to every root.
+type overrideForm struct {
+	Sub    string `form:"sub" json:"sub"`
+	Root   string `form:"root" json:"root"`
+	UserID string `form:"user_id" json:"user_id"`
+}
+
+func newOverrideModel(o *database.SubdomainOverride) models.SubdomainOverride {
+	return models.SubdomainOverride{
+		ID:     o.ID,
+		Sub:    o.Sub,
+		Root:   o.Root,
+		UserID: o.UserID,
+	}
+}
+
+// overrideErrToHTTP converts errors returned from subdomain override operations into HTTP errors.
+func overrideErrToHTTP(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return echo.NewHTTPError(http.StatusNotFound)
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return echo.NewHTTPError(http.StatusConflict, "override already exists")
+	case errors.Is(err, gorm.ErrForeignKeyViolated):
+		return echo.NewHTTPError(http.StatusBadRequest, "user_id does not exist")
+	default:
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+}
+
+// ListSubdomainOverrides returns a JSON array of every subdomain policy override. Admin only.
+func ListSubdomainOverrides(c echo.Context) error {
+	overrides, err := database.ListSubdomainOverrides()
+	if err != nil {
+		return overrideErrToHTTP(c, err)
+	}
+	res := make([]models.SubdomainOverride, 0, len(overrides))
+	for _, o := range overrides {
+		res = append(res, newOverrideModel(o))
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// CreateSubdomainOverride lets a user register a subdomain that the subdomain policy rejects. Admin only.
+func CreateSubdomainOverride(c echo.Context) error {
+	var form overrideForm
+	if err := c.Bind(&form); err != nil {
+		return err
+	}
+	if form.Sub = validators.SanitizeSubdomains(form.Sub); form.Sub == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid sub")
+	}
+	if form.Root != "" {
+		if form.Root = validators.SanitizeDomain(form.Root); form.Root == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid root")
+		}
+	}
+	if form.UserID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user_id is required")
+	}
+	override := &database.SubdomainOverride{
+		Sub:    form.Sub,
+		Root:   form.Root,
+		UserID: form.UserID,
+	}
+	if err := database.CreateSubdomainOverride(override); err != nil {
+		return overrideErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusCreated, newOverrideModel(override))
+}
+
+// DeleteSubdomainOverride removes a subdomain policy override. Hosts already registered are kept. Admin only.
+func DeleteSubdomainOverride(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	if err = database.DeleteSubdomainOverride(id); err != nil {
+		return overrideErrToHTTP(c, err)
+	}
+	return c.NoContent(http.StatusOK)
+}
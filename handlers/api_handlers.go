@@ -1,8 +1,14 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"html"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
 
 	goccy "github.com/goccy/go-json"
@@ -24,12 +30,122 @@ func getUserFromCtx(c echo.Context) (*models.AuthorizedUser, error) {
 	return &user, nil
 }
 
-func ZephyrProxy(c echo.Context) error {
+// planLimitErrToHTTP converts a services.PlanLimitError into a 403 explaining which limit was reached.
+// Any other error is captured and returned as a 500.
+func planLimitErrToHTTP(c echo.Context, err error) error {
+	var limitErr *services.PlanLimitError
+	if errors.As(err, &limitErr) {
+		return echo.NewHTTPError(http.StatusForbidden, limitErr.Error())
+	}
+	clients.Sentry.CaptureErr(c, fmt.Errorf("failed to check plan limits: %w", err))
+	return echo.NewHTTPError(http.StatusInternalServerError)
+}
+
+// ZephyrProxy returns a handler that forwards requests to zephyrPath on Zephyr as the logged-in user.
+// The :params of zephyrPath are replaced with the route's path parameters.
+// If checkUploadLimits is set, the request must name the host it uploads to in config.HeaderUploadHost, and is
+// rejected first if its body would exceed the limits of the host owner's plan (the team's, for team hosts).
+// Uploads must declare their size in Content-Length; chunked bodies are rejected with 411 Length Required.
+// The host's upload defaults are then sent to Zephyr in config.HeaderHostSettings.
+// Zephyr must reject uploads to any other host than the one named in the header.
+func ZephyrProxy(zephyrPath string, checkUploadLimits bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := getUserFromCtx(c)
+		if err != nil {
+			return err
+		}
+		path, err := zephyrRoutePath(c, zephyrPath)
+		if err != nil {
+			return err
+		}
+		var extra http.Header
+		if checkUploadLimits {
+			hostname := c.Request().Header.Get(config.HeaderUploadHost)
+			if hostname == "" {
+				return echo.NewHTTPError(http.StatusBadRequest, config.HeaderUploadHost+" header is required")
+			}
+			// A body of unknown length (chunked) couldn't be checked against the plan's limits
+			if c.Request().ContentLength < 0 {
+				return echo.NewHTTPError(http.StatusLengthRequired, "uploads must set Content-Length")
+			}
+			release, err := services.ReserveHostUpload(user.ID, hostname, c.Request().ContentLength)
+			if errors.Is(err, services.ErrHostNotFound) {
+				return echo.NewHTTPError(http.StatusForbidden, "you can't upload to this host")
+			}
+			if err != nil {
+				return planLimitErrToHTTP(c, err)
+			}
+			defer release()
+			hostSettings, err := zephyrHostSettings(user.ID, hostname)
+			if err != nil {
+				clients.Sentry.CaptureErr(c, fmt.Errorf("failed to get host settings: %w", err))
+				return echo.NewHTTPError(http.StatusInternalServerError)
+			}
+			extra = http.Header{config.HeaderHostSettings: {hostSettings}}
+		}
+		if c.Request().Method != http.MethodGet {
+			defer services.InvalidateUsage(user.ID)
+		}
+		return clients.HTTP.ForwardToZephyr(c, path, user.ZephyrJWT, extra)
+	}
+}
+
+// zephyrRoutePath replaces each :param segment of zephyrPath with the value of the request's path parameter and
+// returns the escaped path. Each value is unescaped once, then must be a single path segment: values that are empty,
+// "." or "..", or that contain a slash or backslash (escaped or not), are rejected so they can't reach another
+// Zephyr endpoint.
+func zephyrRoutePath(c echo.Context, zephyrPath string) (string, error) {
+	segments := strings.Split(zephyrPath, "/")
+	for i, seg := range segments {
+		name, ok := strings.CutPrefix(seg, ":")
+		if !ok {
+			continue
+		}
+		value, err := url.PathUnescape(c.Param(name))
+		if err != nil || value == "" || value == "." || value == ".." || strings.ContainsAny(value, `/\`) {
+			return "", echo.NewHTTPError(http.StatusBadRequest, "invalid "+name)
+		}
+		segments[i] = url.PathEscape(value)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// zephyrHostSettings encodes the upload defaults of the host being uploaded to for Zephyr, as a JSON object keyed by
+// hostname. Only the target host is included so the header stays small, and it is left empty for default settings.
+func zephyrHostSettings(userID, hostname string) (string, error) {
+	s, err := services.GetHostSettings(userID, hostname)
+	if err != nil {
+		return "", err
+	}
+	custom := make(map[string]*services.HostSettings, 1)
+	if !s.IsDefault() {
+		custom[hostname] = s
+	}
+	data, err := goccy.Marshal(custom)
+	return string(data), err
+}
+
+// GetUsage returns the user's current usage, their plan, and any plan limits they exceed.
+func GetUsage(c echo.Context) error {
 	user, err := getUserFromCtx(c)
 	if err != nil {
 		return err
 	}
-	return clients.HTTP.ForwardToZephyr(c, user.ZephyrJWT)
+	usage, err := services.GetUsage(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, fmt.Errorf("failed to get usage for %s: %w", user.ID, err))
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	plan, err := database.GetUserPlan(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, fmt.Errorf("failed to get plan for %s: %w", user.ID, err))
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"usage":    usage,
+		"plan":     newPlanModel(plan),
+		"exceeded": services.ExceededLimits(plan, usage),
+	})
 }
 
 func ResetToken(c echo.Context) error {
@@ -55,14 +171,31 @@ func ResetToken(c echo.Context) error {
 	)
 }
 
-// ListAvailableDomains returns a JSON array of all available root domain names.
+// ListAvailableDomains returns a JSON array of all root domains the user can create hosts under.
+// Supports conditional requests: responds 304 if If-None-Match matches the list's ETag.
 func ListAvailableDomains(c echo.Context) error {
-	domains, err := clients.HTTP.GetOrFetchAvailableDomains(c)
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	domains, err := services.ListAvailableDomains(user.ID)
 	if err != nil {
 		clients.Sentry.CaptureErr(c, err)
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
-	return c.JSON(http.StatusOK, domains)
+
+	body, err := goccy.Marshal(domains)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	hash := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(hash[:16]) + `"`
+	c.Response().Header().Set(echo.HeaderCacheControl, "private, no-cache")
+	c.Response().Header().Set("ETag", etag)
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.JSONBlob(http.StatusOK, body)
 }
 
 // ListHosts returns a JSON array of all hosts registered by a given user.
@@ -80,9 +213,10 @@ func ListHosts(c echo.Context) error {
 }
 
 // CreateHost creates new hosts for a user.
-// Root domain must be registered first. This can be checked with ListDomainsHandler.
+// Root domain must be in the catalog (or be a verified custom domain). This can be checked with ListAvailableDomains.
+// Periods in the subdomain are kept if the root allows multi-level subdomains, otherwise they become hyphens.
+// On contributed domains that require approval, the host is requested from the contributor instead (202).
 func CreateHost(c echo.Context) error {
-	sub := validators.SanitizeSubdomain(c.FormValue("subDomain"))
 	root := c.FormValue("rootDomain")
 
 	user, err := getUserFromCtx(c)
@@ -90,35 +224,90 @@ func CreateHost(c echo.Context) error {
 		return err
 	}
 
-	host := services.NewHostFromParts(sub, root, user.ID)
-	if host == nil {
-		// Hostname does not meet format requirements. Should prob be validated on frontend too.
-		return echo.NewHTTPError(http.StatusBadRequest, "hostname format must be sub.root.tld")
+	host, err := services.NewHostFromInput(c.FormValue("subDomain"), root, user.ID)
+	if errors.Is(err, services.ErrInvalidSubdomain) || errors.Is(err, services.ErrHostnameTooLong) {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
-
-	// Check if root domain is in list of available domains
-	availableDomains, err := clients.HTTP.GetOrFetchAvailableDomains(c)
 	if err != nil {
-		clients.Sentry.CaptureErr(c, fmt.Errorf("failed to fetch available domains: %w", err))
+		clients.Sentry.CaptureErr(c, fmt.Errorf("failed to check root domain (%s) for (%s): %w", root, user.ID, err))
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
-	if _, ok := availableDomains[host.Root]; !ok {
-		clients.Sentry.CaptureErr(c, fmt.Errorf("(%s) tried create host (%s) but root missing", user.ID, host.Full))
+
+	if err = services.CheckHostLimit(user.ID); err != nil {
+		return planLimitErrToHTTP(c, err)
+	}
+
+	// Check if root domain is in the catalog or is one of the user's verified custom domains
+	if err = services.CheckHostAllowed(user.ID, host.Sub, host.Root); err != nil {
+		var rejectedErr *validators.SubdomainRejectedError
+		if errors.Is(err, services.ErrRootUnavailable) || errors.Is(err, services.ErrWildcardNotAllowed) ||
+			errors.Is(err, services.ErrMultiLevelNotAllowed) || errors.As(err, &rejectedErr) {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		var planErr *services.PlanRequiredError
+		if errors.Is(err, services.ErrDomainHostLimit) || errors.As(err, &planErr) {
+			return echo.NewHTTPError(http.StatusForbidden, err.Error())
+		}
+		clients.Sentry.CaptureErr(c, fmt.Errorf("failed to check root domain (%s) for (%s): %w", host.Root, user.ID, err))
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
+	if approval, err := services.RequiresHostApproval(user.ID, host.Root); err != nil {
+		return contributionErrToHTTP(c, err)
+	} else if approval {
+		request, err := services.RequestHost(host)
+		if err != nil {
+			return contributionErrToHTTP(c, err)
+		}
+		return c.JSON(http.StatusAccepted, request)
+	}
+
 	// Publish host (add to Database)
-	err = host.Register()
+	err = host.Register(c.Request().Context())
+	if errors.Is(err, services.ErrHostTaken) {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	var limitErr *services.PlanLimitError
+	if errors.As(err, &limitErr) {
+		return planLimitErrToHTTP(c, err)
+	}
 	if err != nil {
 		clients.Sentry.CaptureErr(c, fmt.Errorf("failed to register host(%s, %s, %s): %w", user.ID, host.Sub, host.Root, err))
 		return echo.NewHTTPError(http.StatusInternalServerError, err)
 	}
+	services.InvalidateUsage(user.ID)
 
 	return c.JSON(http.StatusCreated, echo.Map{
 		"success": true, // TODO: Replace this
 	})
 }
 
+// CheckHostAvailability reports whether the user can register ?sub= under ?root=, with suggestions if not.
+// Returns a short HTML message for HTMX requests (used by the dashboard as the user types), otherwise JSON.
+func CheckHostAvailability(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	availability, err := services.CheckAvailability(user.ID, c.QueryParam("sub"), c.QueryParam("root"))
+	if err != nil {
+		clients.Sentry.CaptureErr(c, fmt.Errorf("failed to check host availability for (%s): %w", user.ID, err))
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if c.Request().Header.Get("HX-Request") == "true" {
+		if c.QueryParam("root") == "" {
+			return c.HTML(http.StatusOK, "")
+		}
+		class := "warning"
+		if availability.Status == services.HostAvailable {
+			class = "success"
+		}
+		return c.HTML(http.StatusOK, `<span class="`+class+`">`+html.EscapeString(availability.String())+`</span>`)
+	}
+	return c.JSON(http.StatusOK, availability)
+}
+
+// DeleteHost deletes one of the user's hosts. Its uploads are kept unless ?uploads= is move (to ?move_to=) or delete.
 func DeleteHost(c echo.Context) error {
 	hostname := c.Param("name")
 
@@ -127,15 +316,77 @@ func DeleteHost(c echo.Context) error {
 		return err
 	}
 
-	if host := services.NewHostFromFull(hostname, user.ID); host != nil {
-		if err = host.Delete(); err != nil {
-			clients.Sentry.CaptureErr(c, err)
-			return echo.NewHTTPError(http.StatusInternalServerError)
-		}
-		return c.NoContent(http.StatusOK)
+	host, err := services.NewHostFromFull(hostname, user.ID)
+	if errors.Is(err, services.ErrInvalidHostname) {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return deleteHost(c, host)
+}
+
+// hostSettingsForm is the request body accepted by UpdateHostSettings. Omitted fields are left unchanged.
+// Empty allowed_types values are ignored, so forms can send an empty value to clear every type.
+type hostSettingsForm struct {
+	DefaultExpiryHours *int      `form:"default_expiry_hours" json:"default_expiry_hours"`
+	SecretLength       *int      `form:"secret_length" json:"secret_length"`
+	SecretCharset      *string   `form:"secret_charset" json:"secret_charset"`
+	AllowedTypes       *[]string `form:"allowed_types" json:"allowed_types"`
+	GalleryListed      *bool     `form:"gallery_listed" json:"gallery_listed"`
+}
+
+// hostSettingsErrToHTTP converts errors returned from host settings operations into HTTP errors.
+func hostSettingsErrToHTTP(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, services.ErrHostNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, services.ErrInvalidHostSettings):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, services.ErrTeamForbidden):
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	default:
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+}
+
+// GetHostSettings returns the upload defaults of one of the user's hosts (or one of their teams' hosts).
+func GetHostSettings(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	settings, err := services.GetHostSettings(user.ID, c.Param("name"))
+	if err != nil {
+		return hostSettingsErrToHTTP(c, err)
 	}
+	return c.JSON(http.StatusOK, settings)
+}
 
-	return echo.NewHTTPError(http.StatusBadRequest, "hostname format must be sub.root.tld")
+// UpdateHostSettings updates the upload defaults of one of the user's hosts. Team hosts require a team admin.
+func UpdateHostSettings(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	var form hostSettingsForm
+	if err = c.Bind(&form); err != nil {
+		return err
+	}
+	if form.AllowedTypes != nil {
+		*form.AllowedTypes = slices.DeleteFunc(*form.AllowedTypes, func(t string) bool { return t == "" })
+	}
+	update := services.HostSettingsUpdate(form)
+	settings, err := services.UpdateHostSettings(user.ID, c.Param("name"), &update)
+	if err != nil {
+		return hostSettingsErrToHTTP(c, err)
+	}
+	if c.Request().Header.Get("HX-Request") == "true" {
+		return c.HTML(http.StatusOK, `<span class="success">Saved</span>`)
+	}
+	return c.JSON(http.StatusOK, settings)
 }
 
 // ProvideConfig returns a ShareX config file for the user.
@@ -159,18 +410,40 @@ func ProvideConfig(c echo.Context) error {
 	cfg.Headers.Authorization = token.Value
 	// TODO: Prompt users when generating config if they want to be prompted for custom paths or upload lifetimes
 	cfg.Arguments.Secret = "{prompt:Enter custom secret or press OK to skip|}"
-	cfg.Arguments.Duration = "{prompt:Enter number of hours until upload expires or skip for permanent|}"
+	cfg.Arguments.Duration = "{prompt:Enter number of hours until upload expires or skip for the host's default|}"
 
 	hostnames, err := database.GetAllHostnames(user.ID)
 	if err != nil {
 		clients.Sentry.CaptureErr(c, err)
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
+	teamHostnames, err := database.GetTeamHostnames(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	hostSettings, err := services.ListHostSettings(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	// Only offer hosts that accept this type of upload.
+	category := strings.ToLower(c.Param("type"))
+	hostnames = slices.DeleteFunc(append(hostnames, teamHostnames...), func(h string) bool {
+		s, ok := hostSettings[h]
+		return ok && !s.Allows(category)
+	})
 	switch len(hostnames) {
 	case 0:
 		cfg.Arguments.Host = config.HostDefault
 	case 1:
 		cfg.Arguments.Host = hostnames[0]
+		// Zephyr applies the default expiry anyway, but showing it in the prompt makes it obvious.
+		if s, ok := hostSettings[hostnames[0]]; ok && s.DefaultExpiryHours > 0 {
+			cfg.Arguments.Duration = fmt.Sprintf(
+				"{prompt:Enter number of hours until upload expires|%d}", s.DefaultExpiryHours,
+			)
+		}
 	default:
 		// TODO: Make it optional for users to select "randomize" from the menu when generating config
 		// 		 In those cases, replace 'select' with 'random'
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sharify-labs/spine/config"
+	"github.com/sharify-labs/spine/database"
+	"github.com/sharify-labs/spine/models"
+)
+
+func TestZephyrRoutePath(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string // empty if the value must be rejected
+	}{
+		{id: "abc123", want: "/api/v1/uploads/abc123/raw"},
+		{id: "a b", want: "/api/v1/uploads/a%20b/raw"},
+		{id: "a%20b", want: "/api/v1/uploads/a%20b/raw"},
+		{id: "a?b#c", want: "/api/v1/uploads/a%3Fb%23c/raw"},
+		{id: ""},
+		{id: "."},
+		{id: ".."},
+		{id: "%2e%2e"},
+		{id: "../admin"},
+		{id: "..%2Fadmin"},
+		{id: "a%2fb"},
+		{id: `a\b`},
+		{id: "a%5Cb"},
+		{id: "%zz"},
+	}
+	e := echo.New()
+	for _, tt := range tests {
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+		c.SetParamNames("id")
+		c.SetParamValues(tt.id)
+		got, err := zephyrRoutePath(c, "/api/v1/uploads/:id/raw")
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("zephyrRoutePath(%q) = %q, want an error", tt.id, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("zephyrRoutePath(%q) = %q, %v, want %q", tt.id, got, err, tt.want)
+		}
+	}
+}
+
+func TestZephyrProxyRejectsChunkedUploads(t *testing.T) {
+	e := echo.New()
+	pr, pw := io.Pipe()
+	go func() {
+		_, _ = pw.Write(make([]byte, 1024))
+		_ = pw.Close()
+	}()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/uploads", pr)
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	req.Header.Set(config.HeaderUploadHost, "example.com")
+	c := e.NewContext(req, httptest.NewRecorder())
+	c.Set("user", models.AuthorizedUser{ID: "user"})
+
+	err := ZephyrProxy("/api/v1/uploads", true)(c)
+	var httpErr *echo.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Code != http.StatusLengthRequired {
+		t.Fatalf("err = %v, want %d", err, http.StatusLengthRequired)
+	}
+}
+
+func TestCreateHostConcurrentlyConflicts(t *testing.T) {
+	root := createTestDomain(t)
+	users := make([]*database.User, 8)
+	for i := range users {
+		users[i] = createTestUser(t)
+	}
+
+	e := echo.New()
+	start := make(chan struct{})
+	statuses := make(chan int, len(users))
+	for _, user := range users {
+		form := url.Values{"subDomain": {"img"}, "rootDomain": {root}}
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/hosts", strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user", models.AuthorizedUser{ID: user.ID})
+		go func() {
+			<-start
+			var httpErr *echo.HTTPError
+			if err := CreateHost(c); errors.As(err, &httpErr) {
+				statuses <- httpErr.Code
+			} else if err != nil {
+				t.Errorf("CreateHost() = %v", err)
+				statuses <- 0
+			} else {
+				statuses <- rec.Code
+			}
+		}()
+	}
+	close(start)
+	counts := make(map[int]int)
+	for range users {
+		counts[<-statuses]++
+	}
+	if counts[http.StatusCreated] != 1 || counts[http.StatusConflict] != len(users)-1 {
+		t.Fatalf("statuses = %v, want one 201 and %d 409", counts, len(users)-1)
+	}
+}
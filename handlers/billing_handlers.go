@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/config"
+	"github.com/sharify-labs/spine/services"
+	"gorm.io/gorm"
+)
+
+// StartCheckout creates a checkout session for the plan in the plan_id form value
+// and redirects the user (or HTMX) to the billing provider's hosted checkout page.
+func StartCheckout(c echo.Context) error {
+	planID, err := strconv.ParseUint(c.FormValue("plan_id"), 10, 0)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid plan_id")
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+
+	checkoutURL, err := services.StartCheckout(c.Request().Context(), user.ID, user.Discord.Email, uint(planID))
+	switch {
+	case errors.Is(err, clients.ErrBillingDisabled):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return echo.NewHTTPError(http.StatusNotFound)
+	case errors.Is(err, services.ErrPlanNotPurchasable):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, services.ErrAlreadySubscribed), errors.Is(err, services.ErrCheckoutPending):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case err != nil:
+		clients.Sentry.CaptureErr(c, fmt.Errorf("failed to create checkout for (%s, plan %d): %w", user.ID, planID, err))
+		return echo.NewHTTPError(http.StatusBadGateway)
+	}
+
+	c.Response().Header().Set("HX-Redirect", checkoutURL)
+	return c.JSON(http.StatusOK, echo.Map{
+		"url": checkoutURL,
+	})
+}
+
+// BillingWebhook receives signed subscription webhooks from the billing provider.
+// Returns a non-2xx status if the event couldn't be applied so that the provider retries it.
+func BillingWebhook(c echo.Context) error {
+	payload, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	event, err := clients.Billing.ParseWebhook(payload, c.Request().Header.Get(config.HeaderBillingSignature))
+	switch {
+	case errors.Is(err, clients.ErrBillingDisabled):
+		return echo.NewHTTPError(http.StatusNotFound)
+	case errors.Is(err, clients.ErrInvalidSignature):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case err != nil:
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid payload")
+	}
+
+	if err = services.HandleBillingEvent(event); err != nil {
+		clients.Sentry.CaptureErr(c, fmt.Errorf("failed to handle billing event %s (%s): %w", event.ID, event.Type, err))
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/services"
+	"github.com/sharify-labs/spine/validators"
+)
+
+// contributionErrToHTTP converts errors returned from domain submission and host request operations into HTTP errors.
+func contributionErrToHTTP(c echo.Context, err error) error {
+	var limitErr *services.PlanLimitError
+	var planErr *services.PlanRequiredError
+	var rejectedErr *validators.SubdomainRejectedError
+	switch {
+	case errors.Is(err, services.ErrSubmissionNotFound), errors.Is(err, services.ErrContributionNotFound),
+		errors.Is(err, services.ErrHostRequestNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.As(err, &limitErr), errors.As(err, &planErr), errors.Is(err, services.ErrDomainHostLimit):
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	case errors.Is(err, services.ErrSubmissionPending), errors.Is(err, services.ErrDomainInCatalog),
+		errors.Is(err, services.ErrHostRequestPending), errors.Is(err, services.ErrHostTaken):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case errors.Is(err, services.ErrDomainNotVerified), errors.Is(err, services.ErrDescriptionTooLong),
+		errors.Is(err, services.ErrInvalidHostLimit), errors.Is(err, services.ErrRootUnavailable),
+		errors.Is(err, services.ErrWildcardNotAllowed), errors.Is(err, services.ErrMultiLevelNotAllowed),
+		errors.As(err, &rejectedErr):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	default:
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+}
+
+// domainSubmissionForm is the request body accepted by SubmitDomain.
+type domainSubmissionForm struct {
+	Domain      string `form:"domain" json:"domain"`
+	Description string `form:"description" json:"description"`
+	Public      bool   `form:"public" json:"public"`
+	NSFW        bool   `form:"nsfw" json:"nsfw"`
+}
+
+// contributedDomainForm is the request body accepted by UpdateContributedDomain.
+type contributedDomainForm struct {
+	RequireHostApproval bool `form:"require_host_approval" json:"require_host_approval"`
+	MaxHostsPerUser     int  `form:"max_hosts_per_user" json:"max_hosts_per_user"`
+}
+
+// ListDomainSubmissions returns a JSON array of the user's domain submissions, newest first.
+func ListDomainSubmissions(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	submissions, err := services.ListDomainSubmissions(user.ID)
+	if err != nil {
+		return contributionErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, submissions)
+}
+
+// SubmitDomain offers one of the user's verified custom domains to the shared catalog, pending admin approval.
+func SubmitDomain(c echo.Context) error {
+	var form domainSubmissionForm
+	if err := c.Bind(&form); err != nil {
+		return err
+	}
+	name := validators.SanitizeDomain(form.Domain)
+	if name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid domain")
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	submission, err := services.SubmitDomain(user.ID, name, strings.TrimSpace(form.Description), form.Public, form.NSFW)
+	if err != nil {
+		return contributionErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusCreated, submission)
+}
+
+// WithdrawDomainSubmission cancels one of the user's pending domain submissions.
+func WithdrawDomainSubmission(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	submission, err := services.WithdrawSubmission(user.ID, id)
+	if err != nil {
+		return contributionErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, submission)
+}
+
+// ListContributedDomains returns a JSON array of the catalog domains the user contributed.
+func ListContributedDomains(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	domains, err := services.ListContributedDomains(user.ID)
+	if err != nil {
+		return contributionErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, domains)
+}
+
+// UpdateContributedDomain changes how users can register hosts on one of the user's contributed domains
+// (form: require_host_approval, max_hosts_per_user).
+func UpdateContributedDomain(c echo.Context) error {
+	var form contributedDomainForm
+	if err := c.Bind(&form); err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	name := validators.SanitizeDomain(c.Param("name"))
+	if err = services.UpdateContributedDomain(user.ID, name, form.RequireHostApproval, form.MaxHostsPerUser); err != nil {
+		return contributionErrToHTTP(c, err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// ListHostRequests returns a JSON array of the user's pending host requests and those awaiting their approval.
+func ListHostRequests(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	requests, err := services.ListHostRequests(user.ID)
+	if err != nil {
+		return contributionErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, requests)
+}
+
+// ApproveHostRequest registers the host requested on one of the user's contributed domains.
+func ApproveHostRequest(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	request, err := services.ApproveHostRequest(c.Request().Context(), user.ID, id)
+	if err != nil {
+		return contributionErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, request)
+}
+
+// RejectHostRequest declines a host requested on one of the user's contributed domains.
+func RejectHostRequest(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	request, err := services.RejectHostRequest(user.ID, id)
+	if err != nil {
+		return contributionErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, request)
+}
+
+// ListDomainSubmissionsForReview returns a JSON array of the domain submissions with ?status= (default pending),
+// oldest first. Admin only.
+func ListDomainSubmissionsForReview(c echo.Context) error {
+	status := c.QueryParam("status")
+	if status == "" {
+		status = services.SubmissionPending
+	}
+	submissions, err := services.ListDomainSubmissionsByStatus(status)
+	if err != nil {
+		return contributionErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, submissions)
+}
+
+// ApproveDomainSubmission adds a submitted domain to the catalog, crediting its contributor. Admin only.
+func ApproveDomainSubmission(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	submission, err := services.ApproveSubmission(user.ID, id)
+	if err != nil {
+		if !errors.Is(err, services.ErrSubmissionNotFound) {
+			err = fmt.Errorf("failed to approve domain submission %d: %w", id, err)
+		}
+		return contributionErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, submission)
+}
+
+// RejectDomainSubmission declines a domain submission (form: note, shown to the submitter). Admin only.
+func RejectDomainSubmission(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	submission, err := services.RejectSubmission(user.ID, id, strings.TrimSpace(c.FormValue("note")))
+	if err != nil {
+		return contributionErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, submission)
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/database"
+	"github.com/sharify-labs/spine/services"
+	"github.com/sharify-labs/spine/validators"
+	"gorm.io/gorm"
+)
+
+// customDomainErrToHTTP converts errors returned from custom domain operations into HTTP errors.
+func customDomainErrToHTTP(c echo.Context, err error) error {
+	var limitErr *services.PlanLimitError
+	switch {
+	case errors.Is(err, services.ErrDomainNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, services.ErrDomainTaken):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case errors.As(err, &limitErr):
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	default:
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+}
+
+// ListCustomDomains returns a JSON array of the user's custom domains and their verification records.
+func ListCustomDomains(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	domains, err := services.ListCustomDomains(user.ID)
+	if err != nil {
+		return customDomainErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, domains)
+}
+
+// AddCustomDomain adds a custom domain for the user in the pending state.
+// The response includes the TXT record the user must publish to verify ownership.
+func AddCustomDomain(c echo.Context) error {
+	name := validators.SanitizeDomain(c.FormValue("domain"))
+	if name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid domain")
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+
+	if _, err = database.GetDomain(name); err == nil {
+		return echo.NewHTTPError(http.StatusConflict, "domain is already a shared domain")
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		clients.Sentry.CaptureErr(c, fmt.Errorf("failed to check domain catalog: %w", err))
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	domain, err := services.AddCustomDomain(user.ID, name)
+	if err != nil {
+		return customDomainErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusCreated, domain)
+}
+
+// VerifyCustomDomain checks the verification TXT record of one of the user's custom domains now,
+// instead of waiting for the background job.
+func VerifyCustomDomain(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	domain, err := services.VerifyCustomDomain(c.Request().Context(), user.ID, c.Param("name"))
+	if err != nil {
+		return customDomainErrToHTTP(c, err)
+	}
+	services.InvalidateUsage(user.ID)
+	return c.JSON(http.StatusOK, domain)
+}
+
+// DeleteCustomDomain removes one of the user's custom domains and their hosts on it.
+func DeleteCustomDomain(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	if err = services.DeleteCustomDomain(user.ID, c.Param("name")); err != nil {
+		return customDomainErrToHTTP(c, err)
+	}
+	services.InvalidateUsage(user.ID)
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"errors"
+	"html"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/services"
+)
+
+// embedDefaultName is the hostname used in embed requests for the user's default template.
+const embedDefaultName = "default"
+
+// embedForm is the request body accepted by SaveEmbedTemplate and PreviewEmbed.
+type embedForm struct {
+	Hostname    string `form:"hostname" json:"hostname"`
+	SiteName    string `form:"site_name" json:"site_name"`
+	Title       string `form:"title" json:"title"`
+	Description string `form:"description" json:"description"`
+	Color       string `form:"color" json:"color"`
+	Author      string `form:"author" json:"author"`
+}
+
+func (f *embedForm) toTemplate() *services.EmbedTemplate {
+	t := services.EmbedTemplate(*f)
+	if t.Hostname == embedDefaultName {
+		t.Hostname = ""
+	}
+	return &t
+}
+
+// embedErrToHTTP converts errors returned from embed operations into HTTP errors.
+func embedErrToHTTP(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, services.ErrEmbedNotFound), errors.Is(err, services.ErrUploadNotFound),
+		errors.Is(err, services.ErrHostNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, services.ErrInvalidEmbedTemplate):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	default:
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+}
+
+// ListEmbedTemplates returns a JSON array of the user's embed templates and the placeholders they can use.
+func ListEmbedTemplates(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	templates, err := services.ListEmbedTemplates(user.ID)
+	if err != nil {
+		return embedErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"templates":    templates,
+		"placeholders": services.EmbedPlaceholders,
+	})
+}
+
+// SaveEmbedTemplate creates or replaces the embed template of one of the user's hosts (form: hostname), or their
+// default template if hostname is empty or "default".
+func SaveEmbedTemplate(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	var form embedForm
+	if err = c.Bind(&form); err != nil {
+		return err
+	}
+	t := form.toTemplate()
+	if err = services.SaveEmbedTemplate(user.ID, t); err != nil {
+		return embedErrToHTTP(c, err)
+	}
+	if c.Request().Header.Get("HX-Request") == "true" {
+		return c.HTML(http.StatusOK, `<span class="success">Saved</span>`)
+	}
+	return c.JSON(http.StatusOK, t)
+}
+
+// DeleteEmbedTemplate deletes the embed template of one of the user's hosts, or their default template if
+// :name is "default".
+func DeleteEmbedTemplate(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	hostname := c.Param("name")
+	if hostname == embedDefaultName {
+		hostname = ""
+	}
+	if err = services.DeleteEmbedTemplate(user.ID, hostname); err != nil {
+		return embedErrToHTTP(c, err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// PreviewEmbed renders an embed template with sample values without saving it.
+// Returns an HTML preview for HTMX requests (used by the dashboard as the user types), otherwise JSON.
+// Invalid templates are reported in the preview rather than as an error.
+func PreviewEmbed(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	var form embedForm
+	if err = c.Bind(&form); err != nil {
+		return err
+	}
+	t := form.toTemplate()
+	htmx := c.Request().Header.Get("HX-Request") == "true"
+	if err = t.Validate(); err != nil {
+		if htmx {
+			return c.HTML(http.StatusOK, `<span class="warning">`+html.EscapeString(err.Error())+`</span>`)
+		}
+		return embedErrToHTTP(c, err)
+	}
+	embed := services.PreviewEmbed(t, user.Discord.Username)
+	if !htmx {
+		return c.JSON(http.StatusOK, embed)
+	}
+	color := embed.Color
+	if color == "" {
+		color = "#202225"
+	}
+	return c.HTML(http.StatusOK, `<div class="embed" style="border-left-color: `+html.EscapeString(color)+`">`+
+		`<small>`+html.EscapeString(embed.SiteName)+`</small>`+
+		`<div>`+html.EscapeString(embed.Author)+`</div>`+
+		`<strong>`+html.EscapeString(embed.Title)+`</strong>`+
+		`<p>`+html.EscapeString(embed.Description)+`</p>`+
+		`</div>`)
+}
+
+// GetUploadEmbed returns the rendered embed for the upload at ?hostname= with ?secret=. Used by Canvas.
+func GetUploadEmbed(c echo.Context) error {
+	embed, err := services.RenderUploadEmbed(c.QueryParam("hostname"), c.QueryParam("secret"))
+	if err != nil {
+		return embedErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, embed)
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/database"
+	"github.com/sharify-labs/spine/services"
+	"github.com/sharify-labs/spine/validators"
+)
+
+// hostDeletionErrToHTTP converts errors returned from host deletion operations into HTTP errors.
+func hostDeletionErrToHTTP(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, services.ErrHostNotFound), errors.Is(err, services.ErrHostDeletionNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, services.ErrInvalidUploadAction), errors.Is(err, services.ErrInvalidMoveTarget):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, services.ErrHostDeletionNotRetryable):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	default:
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+}
+
+// deleteHost deletes a host and handles its uploads as requested (form or query: uploads, move_to).
+// Uploads are kept by default. Moving or deleting them starts a background job, which is returned with 202.
+func deleteHost(c echo.Context, host *services.Host) error {
+	action := services.UploadAction(c.FormValue("uploads"))
+	job, err := host.DeleteWithUploads(c.Request().Context(), action, c.FormValue("move_to"))
+	if err != nil {
+		return hostDeletionErrToHTTP(c, err)
+	}
+	services.InvalidateUsage(host.UserID)
+	if job == nil {
+		return c.NoContent(http.StatusOK)
+	}
+	if c.Request().Header.Get("HX-Request") == "true" {
+		return c.HTML(http.StatusAccepted, fmt.Sprintf(
+			`<div class="success">Deleted %s. Its %d uploads are being %s in the background.</div>`,
+			html.EscapeString(validators.ToUnicode(job.Hostname)), job.Total, map[string]string{
+				string(services.UploadActionMove):   "moved to " + html.EscapeString(validators.ToUnicode(job.MoveTo)),
+				string(services.UploadActionDelete): "deleted",
+			}[job.Action],
+		))
+	}
+	return c.JSON(http.StatusAccepted, job)
+}
+
+// GetHostImpact returns how many uploads (and how much storage) live on one of the user's hosts.
+// For HTMX requests, it returns the dashboard's delete confirmation with the options for those uploads.
+func GetHostImpact(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	hostname := c.Param("name")
+	impact, err := services.GetHostImpact(user.ID, hostname)
+	if err != nil {
+		return hostDeletionErrToHTTP(c, err)
+	}
+	if c.Request().Header.Get("HX-Request") != "true" {
+		return c.JSON(http.StatusOK, impact)
+	}
+
+	hostnames, err := database.GetAllHostnames(user.ID)
+	if err != nil {
+		return hostDeletionErrToHTTP(c, err)
+	}
+	teamHostnames, err := database.GetTeamHostnames(user.ID)
+	if err != nil {
+		return hostDeletionErrToHTTP(c, err)
+	}
+	var b strings.Builder
+	name := html.EscapeString(hostname)
+	_, _ = fmt.Fprintf(&b, `<form hx-delete="/api/v1/hosts/%s" hx-target="closest .host" hx-swap="outerHTML">`, name)
+	_, _ = fmt.Fprintf(&b, `<p class="warning">%d uploads (%s) are served from this host.</p>`,
+		impact.Uploads, services.FormatBytes(impact.StorageBytes))
+	if impact.Uploads > 0 {
+		b.WriteString(`<label><input type="radio" name="uploads" value="keep" checked> Keep them</label> `)
+		b.WriteString(`<label><input type="radio" name="uploads" value="move"> Move them to </label>`)
+		b.WriteString(`<select name="move_to">`)
+		for _, h := range append(hostnames, teamHostnames...) {
+			if h != hostname {
+				_, _ = fmt.Fprintf(&b, `<option value="%s">%s</option>`,
+					html.EscapeString(h), html.EscapeString(validators.ToUnicode(h)))
+			}
+		}
+		b.WriteString(`</select> `)
+		b.WriteString(`<label><input type="radio" name="uploads" value="delete"> Delete them</label> `)
+	}
+	b.WriteString(`<button class="button delete" type="submit">Delete Host</button></form>`)
+	return c.HTML(http.StatusOK, b.String())
+}
+
+// ListHostDeletions returns a JSON array of the user's host deletion jobs, newest first.
+func ListHostDeletions(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	jobs, err := services.ListHostDeletions(user.ID)
+	if err != nil {
+		return hostDeletionErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, jobs)
+}
+
+// GetHostDeletion returns the progress of one of the user's host deletion jobs.
+func GetHostDeletion(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	job, err := services.GetHostDeletion(user.ID, id)
+	if err != nil {
+		return hostDeletionErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+// RetryHostDeletion starts one of the user's failed host deletion jobs again and returns it with 202.
+func RetryHostDeletion(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	job, err := services.RetryHostDeletion(user.ID, id)
+	if err != nil {
+		return hostDeletionErrToHTTP(c, err)
+	}
+	if c.Request().Header.Get("HX-Request") == "true" {
+		return c.HTML(http.StatusAccepted, `<span class="success">Retrying</span>`)
+	}
+	return c.JSON(http.StatusAccepted, job)
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sharify-labs/spine/database"
+	"github.com/sharify-labs/spine/services"
+)
+
+// TestMain runs the tests against a temporary database.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "spine-handlers-test")
+	if err != nil {
+		panic(err)
+	}
+	_ = os.Setenv("TURSO_DSN", "file:"+filepath.Join(dir, "test.db"))
+	_ = os.Setenv("LOG_LEVEL", "1")
+	database.Setup()
+	services.SetupSubdomainPolicy()
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+var testSeq atomic.Int64
+
+// createTestUser creates a user on the default plan.
+func createTestUser(t *testing.T) *database.User {
+	t.Helper()
+	user := &database.User{Email: fmt.Sprintf("user%d@example.com", testSeq.Add(1)), PlanID: database.DefaultPlanID()}
+	if err := database.DB().Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// createTestDomain adds a public catalog domain that allows subdomains.
+func createTestDomain(t *testing.T) string {
+	t.Helper()
+	name := fmt.Sprintf("catalog%d.example", testSeq.Add(1))
+	domain := &database.Domain{Name: name, Public: true, WildcardAllowed: true, Enabled: true}
+	if err := database.DB().Create(domain).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := services.RefreshCatalog(); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
@@ -2,10 +2,14 @@ package handlers
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/sharify-labs/spine/clients"
 	"github.com/sharify-labs/spine/database"
+	"github.com/sharify-labs/spine/models"
+	"github.com/sharify-labs/spine/services"
+	"github.com/sharify-labs/spine/validators"
 )
 
 func Root(c echo.Context) error {
@@ -17,49 +21,223 @@ func Login(c echo.Context) error {
 }
 
 type DashboardData struct {
-	Username string
-	UserID   string
-	Domains  []string
-	Hosts    []HostData
+	Username      string
+	UserID        string
+	Domains       []*services.AvailableDomain
+	LockedDomains int // number of Domains that require a more expensive plan
+	CustomDomains []*services.CustomDomain
+	Hosts         []HostData
+	Usage         UsageData
+	Plans         []models.Plan // purchasable plans, empty if billing is disabled
+	Transfers     []*services.HostTransfer
+	AuditEvents   []*services.AuditEvent
+	// SecretCharsets are the options for the per-host secret charset setting.
+	SecretCharsets []string
+	EmbedTemplates []*services.EmbedTemplate
+	HostDeletions  []*services.HostDeletion
+	// DomainSubmissions, ContributedDomains and HostRequests are the user's contributions to the shared catalog.
+	DomainSubmissions  []*services.DomainSubmission
+	ContributedDomains []*services.ContributedDomain
+	HostRequests       []*services.HostRequest
 }
 type HostData struct {
-	Name string
+	Name        string
+	DisplayName string // Unicode form of Name
+	Settings    *services.HostSettings
+	Categories  []HostCategoryData
+	ReleaseAt   *time.Time // set if the host is flagged as inactive
+	// PlanReleaseAt is set if the host is flagged for being on a root above its owner's plan.
+	PlanReleaseAt *time.Time
+}
+type HostCategoryData struct {
+	Name    string
+	Allowed bool
+}
+type UsageData struct {
+	PlanName     string
+	StorageUsed  string
+	StorageQuota string // empty if unlimited
+	Uploads      int64
+	ByType       map[string]int64
+	ByHost       []HostUsageData
+	Exceeded     []services.LimitExceeded
+}
+type HostUsageData struct {
+	Hostname string // Unicode form
+	Uploads  int64
+	Storage  string
+}
+
+// newUsageData formats a user's usage and plan for displaying in the dashboard.
+func newUsageData(usage *services.Usage, plan *database.Plan) UsageData {
+	data := UsageData{
+		PlanName:    plan.Name,
+		StorageUsed: services.FormatBytes(usage.StorageBytes),
+		Uploads:     usage.Uploads,
+		ByType:      usage.ByType,
+		ByHost:      make([]HostUsageData, 0, len(usage.ByHost)),
+		Exceeded:    services.ExceededLimits(plan, usage),
+	}
+	if plan.StorageQuota > 0 {
+		data.StorageQuota = services.FormatBytes(plan.StorageQuota)
+	}
+	for _, h := range usage.ByHost {
+		data.ByHost = append(data.ByHost, HostUsageData{
+			Hostname: validators.ToUnicode(h.Hostname),
+			Uploads:  h.Uploads,
+			Storage:  services.FormatBytes(h.StorageBytes),
+		})
+	}
+	return data
 }
 
 func DisplayDashboard(c echo.Context) error {
-	availableDomains, err := clients.HTTP.GetOrFetchAvailableDomains(c)
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	domains, err := services.ListAvailableDomains(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	lockedDomains := 0
+	for _, d := range domains {
+		if d.Locked {
+			lockedDomains++
+		}
+	}
+	hostnames, err := database.GetAllHostnames(user.ID)
 	if err != nil {
 		clients.Sentry.CaptureErr(c, err)
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
-	user, err := getUserFromCtx(c)
+	usage, err := services.GetUsage(user.ID)
 	if err != nil {
-		return err
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
-	hostnames, err := database.GetAllHostnames(user.ID)
+	plan, err := database.GetUserPlan(user.ID)
 	if err != nil {
 		clients.Sentry.CaptureErr(c, err)
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
+	var plans []models.Plan
+	if clients.Billing.Enabled() {
+		allPlans, err := database.ListPlans()
+		if err != nil {
+			clients.Sentry.CaptureErr(c, err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		for _, p := range allPlans {
+			if p.BillingPriceID != nil && p.ID != plan.ID {
+				plans = append(plans, newPlanModel(p))
+			}
+		}
+	}
+
+	hostSettings, err := services.ListHostSettings(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	flaggedHosts, err := services.ListFlaggedHosts(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	ineligibleHosts, err := services.ListIneligibleHosts(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
 	hosts := make([]HostData, 0, len(hostnames))
 	for _, h := range hostnames {
-		hosts = append(hosts, HostData{Name: h})
+		settings, ok := hostSettings[h]
+		if !ok {
+			settings = services.DefaultHostSettings()
+		}
+		categories := make([]HostCategoryData, 0, len(services.UploadCategories))
+		for _, name := range services.UploadCategories {
+			categories = append(categories, HostCategoryData{Name: name, Allowed: settings.Allows(name)})
+		}
+		data := HostData{
+			Name:        h,
+			DisplayName: validators.ToUnicode(h),
+			Settings:    settings,
+			Categories:  categories,
+		}
+		if releaseAt, ok := flaggedHosts[h]; ok {
+			data.ReleaseAt = &releaseAt
+		}
+		if releaseAt, ok := ineligibleHosts[h]; ok {
+			data.PlanReleaseAt = &releaseAt
+		}
+		hosts = append(hosts, data)
 	}
 
-	domains := make([]string, 0, len(availableDomains))
-	for d := range availableDomains {
-		domains = append(domains, d)
+	customDomains, err := services.ListCustomDomains(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	transfers, err := services.ListPendingTransfers(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	auditEvents, err := services.ListAuditEvents(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	embedTemplates, err := services.ListEmbedTemplates(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	hostDeletions, err := services.ListHostDeletions(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	submissions, err := services.ListDomainSubmissions(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	contributions, err := services.ListContributedDomains(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	hostRequests, err := services.ListHostRequests(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
 	return c.Render(
 		http.StatusOK, "dashboard.html",
 		DashboardData{
-			Username: user.Discord.Username,
-			UserID:   user.ID,
-			Domains:  domains,
-			Hosts:    hosts,
+			Username:           user.Discord.Username,
+			UserID:             user.ID,
+			Domains:            domains,
+			LockedDomains:      lockedDomains,
+			CustomDomains:      customDomains,
+			Hosts:              hosts,
+			Usage:              newUsageData(usage, plan),
+			Plans:              plans,
+			Transfers:          transfers,
+			AuditEvents:        auditEvents,
+			SecretCharsets:     services.SecretCharsets,
+			EmbedTemplates:     embedTemplates,
+			HostDeletions:      hostDeletions,
+			DomainSubmissions:  submissions,
+			ContributedDomains: contributions,
+			HostRequests:       hostRequests,
 		},
 	)
 }
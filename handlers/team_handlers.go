@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/database"
+	"github.com/sharify-labs/spine/services"
+	"github.com/sharify-labs/spine/validators"
+)
+
+// teamErrToHTTP converts errors returned from team operations into HTTP errors.
+func teamErrToHTTP(c echo.Context, err error) error {
+	var limitErr *services.PlanLimitError
+	var planErr *services.PlanRequiredError
+	var rejectedErr *validators.SubdomainRejectedError
+	switch {
+	case errors.Is(err, services.ErrTeamNotFound), errors.Is(err, services.ErrTeamMemberNotFound),
+		errors.Is(err, services.ErrInvalidHostname):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, services.ErrTeamForbidden), errors.As(err, &limitErr), errors.As(err, &planErr),
+		errors.Is(err, services.ErrDomainHostLimit):
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	case errors.Is(err, services.ErrTeamMemberExists), errors.Is(err, services.ErrTeamOwnerRequired),
+		errors.Is(err, services.ErrHostTaken):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case errors.Is(err, services.ErrInvalidTeamRole), errors.Is(err, services.ErrInvalidTeamName),
+		errors.Is(err, services.ErrRecipientNotFound), errors.Is(err, services.ErrInvalidSubdomain),
+		errors.Is(err, services.ErrHostnameTooLong), errors.Is(err, services.ErrRootUnavailable),
+		errors.Is(err, services.ErrWildcardNotAllowed), errors.Is(err, services.ErrMultiLevelNotAllowed),
+		errors.Is(err, services.ErrHostApprovalRequired), errors.Is(err, services.ErrInvalidTeamUploadAction),
+		errors.As(err, &rejectedErr):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	default:
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+}
+
+// ListTeams returns a JSON array of the teams the user is a member of and their role in each.
+func ListTeams(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	teams, err := services.ListTeams(user.ID)
+	if err != nil {
+		return teamErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, teams)
+}
+
+// CreateTeam creates a team with the user as its owner (form: name).
+func CreateTeam(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	team, err := services.CreateTeam(user.ID, c.FormValue("name"))
+	if err != nil {
+		return teamErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusCreated, team)
+}
+
+// GetTeam returns a team with its members and hostnames. Members only.
+func GetTeam(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	team, err := services.GetTeam(user.ID, id)
+	if err != nil {
+		return teamErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, team)
+}
+
+// DeleteTeam deletes a team and its hosts, keeping or deleting their uploads (form or query: uploads). Owner only.
+// Deleting uploads starts a background job per host, which are returned with 202.
+func DeleteTeam(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	jobs, err := services.DeleteTeam(c.Request().Context(), user.ID, id, services.UploadAction(c.FormValue("uploads")))
+	if err != nil {
+		return teamErrToHTTP(c, err)
+	}
+	if len(jobs) == 0 {
+		return c.NoContent(http.StatusOK)
+	}
+	return c.JSON(http.StatusAccepted, jobs)
+}
+
+// AddTeamMember adds a user to a team (form: user_id, role). Admins can add members, the owner can add admins.
+func AddTeamMember(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	role := services.TeamRole(c.FormValue("role"))
+	if role == "" {
+		role = services.TeamRoleMember
+	}
+	if err = services.AddTeamMember(user.ID, id, c.FormValue("user_id"), role); err != nil {
+		return teamErrToHTTP(c, err)
+	}
+	return c.NoContent(http.StatusCreated)
+}
+
+// UpdateTeamMember changes a member's role (form: role). Owner only.
+func UpdateTeamMember(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	role := services.TeamRole(c.FormValue("role"))
+	if err = services.SetTeamMemberRole(user.ID, id, c.Param("user_id"), role); err != nil {
+		return teamErrToHTTP(c, err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// RemoveTeamMember removes a member from a team, or lets a member leave it.
+func RemoveTeamMember(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	if err = services.RemoveTeamMember(user.ID, id, c.Param("user_id")); err != nil {
+		return teamErrToHTTP(c, err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// CreateTeamHost creates a host owned by a team (form: subDomain, rootDomain). Admins only.
+// The root must be available to the admin creating the host, and the team's plan must meet its minimum plan.
+// The team's plan host limit applies.
+// Team hosts can't be created on contributed domains that require approval.
+func CreateTeamHost(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	if err = services.RequireTeamAdmin(user.ID, id); err != nil {
+		return teamErrToHTTP(c, err)
+	}
+	host, err := services.NewHostFromInput(c.FormValue("subDomain"), c.FormValue("rootDomain"), user.ID)
+	if err != nil {
+		return teamErrToHTTP(c, err)
+	}
+	if err = services.CheckTeamHostLimit(id); err != nil {
+		return teamErrToHTTP(c, err)
+	}
+	if err = services.CheckTeamHostAllowed(id, user.ID, host.Sub, host.Root); err != nil {
+		return teamErrToHTTP(c, err)
+	}
+	if approval, err := services.RequiresHostApproval(user.ID, host.Root); err != nil {
+		return teamErrToHTTP(c, err)
+	} else if approval {
+		return teamErrToHTTP(c, services.ErrHostApprovalRequired)
+	}
+	host.TeamID = &id
+	if err = host.Register(c.Request().Context()); err != nil {
+		var limitErr *services.PlanLimitError
+		if !errors.Is(err, services.ErrHostTaken) && !errors.As(err, &limitErr) {
+			err = fmt.Errorf("failed to register team host(%d, %s, %s): %w", id, host.Sub, host.Root, err)
+		}
+		return teamErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusCreated, echo.Map{
+		"hostname": host.Full,
+	})
+}
+
+// DeleteTeamHost deletes a host owned by a team, handling its uploads like DeleteHost. Admins only.
+func DeleteTeamHost(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	if err = services.RequireTeamAdmin(user.ID, id); err != nil {
+		return teamErrToHTTP(c, err)
+	}
+	host, err := services.NewHostFromFull(c.Param("name"), user.ID)
+	if err != nil {
+		return teamErrToHTTP(c, err)
+	}
+	host.TeamID = &id
+	return deleteHost(c, host)
+}
+
+// ResetTeamToken generates a new upload token for a team, replacing its previous one. Admins only.
+// The token can only upload to the team's hosts.
+func ResetTeamToken(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	if err = services.RequireTeamAdmin(user.ID, id); err != nil {
+		return teamErrToHTTP(c, err)
+	}
+	token, err := services.NewTeamToken(id)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, fmt.Errorf("failed to generate team token: %w", err))
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"token": token.Value,
+	})
+}
+
+// GetTeamUsage returns a team's usage, its plan, and any plan limits it exceeds. Members only.
+func GetTeamUsage(c echo.Context) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	if _, err = services.GetTeam(user.ID, id); err != nil {
+		return teamErrToHTTP(c, err)
+	}
+	usage, err := services.GetTeamUsage(id)
+	if err != nil {
+		return teamErrToHTTP(c, fmt.Errorf("failed to get usage for team %d: %w", id, err))
+	}
+	plan, err := database.GetTeamPlan(id)
+	if err != nil {
+		return teamErrToHTTP(c, fmt.Errorf("failed to get plan for team %d: %w", id, err))
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"usage":    usage,
+		"plan":     newPlanModel(plan),
+		"exceeded": services.ExceededLimits(plan, usage),
+	})
+}
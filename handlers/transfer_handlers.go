@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/services"
+)
+
+// transferErrToHTTP converts errors returned from host transfer operations into HTTP errors.
+func transferErrToHTTP(c echo.Context, err error) error {
+	var limitErr *services.PlanLimitError
+	var planErr *services.PlanRequiredError
+	switch {
+	case errors.Is(err, services.ErrHostNotFound), errors.Is(err, services.ErrTransferNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, services.ErrRecipientNotFound), errors.Is(err, services.ErrTransferToSelf),
+		errors.Is(err, services.ErrInvalidHostname):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, services.ErrTransferPending), errors.Is(err, services.ErrTransferNotPossible):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case errors.As(err, &limitErr), errors.As(err, &planErr), errors.Is(err, services.ErrRootUnavailable),
+		errors.Is(err, services.ErrHostApprovalRequired), errors.Is(err, services.ErrDomainHostLimit):
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	default:
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+}
+
+// ListTransfers returns a JSON array of the user's incoming and outgoing pending host transfers.
+func ListTransfers(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	transfers, err := services.ListPendingTransfers(user.ID)
+	if err != nil {
+		return transferErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, transfers)
+}
+
+// RequestTransfer offers one of the user's hosts to another user (form: to_user_id).
+// The host only changes owner once the recipient accepts.
+func RequestTransfer(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	host, err := services.NewHostFromFull(c.Param("name"), user.ID)
+	if err != nil {
+		return transferErrToHTTP(c, err)
+	}
+	transfer, err := services.RequestTransfer(host, c.FormValue("to_user_id"))
+	if err != nil {
+		return transferErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusCreated, transfer)
+}
+
+// AcceptTransfer moves the host of a pending transfer to the user.
+func AcceptTransfer(c echo.Context) error {
+	return resolveTransfer(c, services.AcceptTransfer)
+}
+
+// DeclineTransfer rejects a pending transfer to the user.
+func DeclineTransfer(c echo.Context) error {
+	return resolveTransfer(c, services.DeclineTransfer)
+}
+
+// CancelTransfer withdraws a pending transfer from the user.
+func CancelTransfer(c echo.Context) error {
+	return resolveTransfer(c, services.CancelTransfer)
+}
+
+func resolveTransfer(c echo.Context, resolve func(userID string, transferID uint) (*services.HostTransfer, error)) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	transfer, err := resolve(user.ID, id)
+	if err != nil {
+		if !errors.Is(err, services.ErrTransferNotFound) {
+			err = fmt.Errorf("failed to resolve transfer %d for %s: %w", id, user.ID, err)
+		}
+		return transferErrToHTTP(c, err)
+	}
+	return c.JSON(http.StatusOK, transfer)
+}
+
+// ListAuditEvents returns a JSON array of the user's most recent audit events.
+func ListAuditEvents(c echo.Context) error {
+	user, err := getUserFromCtx(c)
+	if err != nil {
+		return err
+	}
+	events, err := services.ListAuditEvents(user.ID)
+	if err != nil {
+		clients.Sentry.CaptureErr(c, err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, events)
+}
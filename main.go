@@ -19,6 +19,7 @@ import (
 	"github.com/sharify-labs/spine/config"
 	"github.com/sharify-labs/spine/database"
 	"github.com/sharify-labs/spine/router"
+	"github.com/sharify-labs/spine/services"
 )
 
 //go:embed assets/*
@@ -54,12 +55,28 @@ func main() {
 
 	clients.Setup()
 	database.Setup()
+	services.SetupSubdomainPolicy()
 	router.Setup(e, assets)
 
 	// Setup graceful shutdown
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
+	if err := services.ImportDomainCatalog(ctx); err != nil {
+		e.Logger.Errorf("failed to import domain catalog: %v", err)
+	}
+
+	// Start background jobs
+	go services.RunJob(ctx, "run host deletions", time.Minute, services.RunHostDeletions)
+	go services.RunJob(ctx, "expire billing grace periods", time.Hour, services.ExpireGracePeriods)
+	go services.RunJob(ctx, "verify pending custom domains",
+		config.GetOrDefault("CUSTOM_DOMAIN_CHECK_INTERVAL", 10*time.Minute), services.VerifyPendingDomains)
+	go services.RunJob(ctx, "reconcile dns records",
+		config.GetOrDefault("DNS_RECONCILE_INTERVAL", time.Hour), services.ReconcileDNS)
+	go services.RunJob(ctx, "reclaim inactive hosts",
+		config.GetOrDefault("HOST_RECLAIM_INTERVAL", time.Hour), services.ReclaimInactiveHosts)
+	go services.RunJob(ctx, "release hosts above plan", time.Hour, services.ReleaseIneligibleHosts)
+
 	// Start app
 	go func() {
 		e.Logger.Infof("Started Spine %s", version)
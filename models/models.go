@@ -71,3 +71,44 @@ func NewShareXConfig(t string) *ShareXConfig {
 		ErrorMessage:    "{json:message}",
 	}
 }
+
+// Plan represents a plan's pricing & limits as returned by the API.
+// A limit of 0 means the plan is unlimited for that resource.
+type Plan struct {
+	ID            uint    `json:"id"`
+	Name          string  `json:"name"`
+	Price         float32 `json:"price"`
+	MaxHosts      int     `json:"max_hosts"`
+	MaxUploads    int     `json:"max_uploads"`
+	StorageQuota  int64   `json:"storage_quota"`
+	MaxUploadSize int64   `json:"max_upload_size"`
+	Purchasable   bool    `json:"purchasable"`
+}
+
+// Domain represents a domain in the catalog as returned by the admin API.
+type Domain struct {
+	ID                uint    `json:"id"`
+	Name              string  `json:"name"`
+	Description       string  `json:"description"`
+	Public            bool    `json:"public"`
+	WildcardAllowed   bool    `json:"wildcard_allowed"`
+	MultiLevelAllowed bool    `json:"multi_level_allowed"`
+	NSFW              bool    `json:"nsfw"`
+	Enabled           bool    `json:"enabled"`
+	OwnerID           *string `json:"owner_id"`
+	// ReservedSubdomains are reserved on this domain only, in addition to the global reserved list.
+	ReservedSubdomains  []string `json:"reserved_subdomains"`
+	ContributorID       *string  `json:"contributor_id"`
+	RequireHostApproval bool     `json:"require_host_approval"`
+	MaxHostsPerUser     int      `json:"max_hosts_per_user"`
+	MinPlanID           *uint    `json:"min_plan_id"`
+}
+
+// SubdomainOverride lets a user register a subdomain the subdomain policy would otherwise reject.
+// Root is empty if the override applies to every root.
+type SubdomainOverride struct {
+	ID     uint   `json:"id"`
+	Sub    string `json:"sub"`
+	Root   string `json:"root"`
+	UserID string `json:"user_id"`
+}
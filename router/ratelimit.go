@@ -0,0 +1,146 @@
+package router
+
+import (
+	"encoding/binary"
+	"expvar"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sharify-labs/spine/config"
+	"github.com/sharify-labs/spine/models"
+)
+
+// RateLimitStore is the storage backend used to persist token buckets.
+// Any gofiber/storage driver (memory, redis, etc.) satisfies this interface.
+type RateLimitStore interface {
+	Get(key string) ([]byte, error)
+	Set(key string, val []byte, exp time.Duration) error
+}
+
+// rateLimitStoreErrors counts, per rate limiter, the requests let through because the store failed.
+// Published with expvar as "ratelimit_store_errors".
+var rateLimitStoreErrors = expvar.NewMap("ratelimit_store_errors")
+
+// rateLimiter is a token bucket rate limiter.
+// Each key gets a bucket holding up to burst tokens which refills completely over period.
+// Every request takes 1 token and is rejected with 429 when the bucket is empty.
+type rateLimiter struct {
+	name   string
+	burst  float64
+	period time.Duration
+	store  RateLimitStore
+	keyFn  func(c echo.Context) string
+	now    func() time.Time
+	mu     sync.Mutex // serializes read-modify-write of buckets within this process
+}
+
+// newRateLimiter creates a rate limiter configured from env key (format: "<burst>/<period>", ex: "10/1m").
+// If the env value is not set, fallback is used instead.
+func newRateLimiter(name, key, fallback string, store RateLimitStore, keyFn func(c echo.Context) string) *rateLimiter {
+	spec := config.GetOrDefault(key, fallback)
+	burstStr, periodStr, ok := strings.Cut(spec, "/")
+	burst, err := strconv.Atoi(burstStr)
+	if !ok || err != nil || burst <= 0 {
+		panic("invalid rate limit burst for " + key)
+	}
+	period, err := time.ParseDuration(periodStr)
+	if err != nil || period <= 0 {
+		panic("invalid rate limit period for " + key)
+	}
+	return &rateLimiter{
+		name:   name,
+		burst:  float64(burst),
+		period: period,
+		store:  store,
+		keyFn:  keyFn,
+		now:    time.Now,
+	}
+}
+
+// rateLimitByIP keys rate limits by the client's IP address.
+func rateLimitByIP(c echo.Context) string {
+	return "ip:" + c.RealIP()
+}
+
+// rateLimitByUser keys rate limits by the logged-in user's ID, falling back to the client's IP.
+// Must be used after requireSession.
+func rateLimitByUser(c echo.Context) string {
+	if user, ok := c.Get("user").(models.AuthorizedUser); ok {
+		return "user:" + user.ID
+	}
+	return rateLimitByIP(c)
+}
+
+// take removes a token from the bucket for key.
+// Returns whether the request is allowed, the tokens remaining, and how long until the next token is available.
+func (l *rateLimiter) take(key string) (allowed bool, remaining float64, retryAfter time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	tokens := l.burst
+	storeKey := "ratelimit:" + l.name + ":" + key
+	data, err := l.store.Get(storeKey)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	// Bucket is encoded as [tokens float64][last refill unix nano int64]
+	if len(data) == 16 {
+		tokens = math.Float64frombits(binary.BigEndian.Uint64(data[:8]))
+		last := time.Unix(0, int64(binary.BigEndian.Uint64(data[8:])))
+		tokens = min(l.burst, tokens+now.Sub(last).Seconds()*l.refillRate())
+	}
+
+	if tokens >= 1 {
+		tokens--
+		allowed = true
+	} else {
+		retryAfter = time.Duration((1 - tokens) / l.refillRate() * float64(time.Second))
+	}
+
+	data = make([]byte, 16)
+	binary.BigEndian.PutUint64(data[:8], math.Float64bits(tokens))
+	binary.BigEndian.PutUint64(data[8:], uint64(now.UnixNano()))
+	// A bucket that has expired from the store is the same as a full bucket.
+	if err = l.store.Set(storeKey, data, l.period); err != nil {
+		return false, 0, 0, err
+	}
+	return allowed, tokens, retryAfter, nil
+}
+
+// refillRate returns the number of tokens added to a bucket per second.
+func (l *rateLimiter) refillRate() float64 {
+	return l.burst / l.period.Seconds()
+}
+
+// Middleware rejects requests with 429 once the caller's bucket is empty.
+// Sets X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset (seconds until the bucket is full)
+// on every response, and Retry-After (seconds) on rejected requests.
+// Requests are let through if the store fails; failures are logged and counted in rateLimitStoreErrors.
+func (l *rateLimiter) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		allowed, remaining, retryAfter, err := l.take(l.keyFn(c))
+		if err != nil {
+			// Fail open: an unavailable store shouldn't take the whole app down.
+			rateLimitStoreErrors.Add(l.name, 1)
+			c.Logger().Errorf("rate limiter %s failed, letting the request through: %v", l.name, err)
+			return next(c)
+		}
+
+		reset := math.Ceil((l.burst - remaining) / l.refillRate())
+		header := c.Response().Header()
+		header.Set("X-RateLimit-Limit", strconv.Itoa(int(l.burst)))
+		header.Set("X-RateLimit-Remaining", strconv.Itoa(int(remaining)))
+		header.Set("X-RateLimit-Reset", strconv.Itoa(int(reset)))
+		if !allowed {
+			header.Set(echo.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			return echo.NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded")
+		}
+		return next(c)
+	}
+}
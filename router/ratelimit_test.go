@@ -0,0 +1,169 @@
+package router
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// memoryStore is a RateLimitStore that ignores expiry. Every call fails with err if it is set.
+type memoryStore struct {
+	mu   sync.Mutex
+	data map[string][]byte
+	err  error
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: make(map[string][]byte)}
+}
+
+func (s *memoryStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data[key], s.err
+}
+
+func (s *memoryStore) Set(key string, val []byte, _ time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.data[key] = val
+	return nil
+}
+
+// rateLimitTest runs requests through a rate limiter keyed by IP, on a fake clock and behind the same IP extractor
+// as the app (see main.go).
+type rateLimitTest struct {
+	t       *testing.T
+	e       *echo.Echo
+	limiter *rateLimiter
+	now     time.Time
+}
+
+// newRateLimitTest returns a rateLimitTest for a limiter configured as spec ("<burst>/<period>").
+func newRateLimitTest(t *testing.T, spec string, store RateLimitStore) *rateLimitTest {
+	t.Setenv("RATE_LIMIT_TEST", spec)
+	rt := &rateLimitTest{t: t, e: echo.New(), now: time.Unix(1700000000, 0)}
+	rt.e.IPExtractor = echo.ExtractIPFromXFFHeader()
+	rt.limiter = newRateLimiter("test", "RATE_LIMIT_TEST", "1/1s", store, rateLimitByIP)
+	rt.limiter.now = func() time.Time { return rt.now }
+	return rt
+}
+
+// request sends a request from remoteAddr, with X-Forwarded-For set to xff unless it's empty.
+func (rt *rateLimitTest) request(remoteAddr, xff string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = remoteAddr
+	if xff != "" {
+		req.Header.Set(echo.HeaderXForwardedFor, xff)
+	}
+	rec := httptest.NewRecorder()
+	c := rt.e.NewContext(req, rec)
+	err := rt.limiter.Middleware(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})(c)
+	if err != nil {
+		rt.e.HTTPErrorHandler(err, c)
+	}
+	return rec
+}
+
+// expect sends a request from remoteAddr and fails the test unless it gets status.
+func (rt *rateLimitTest) expect(remoteAddr, xff string, status int) *httptest.ResponseRecorder {
+	rt.t.Helper()
+	rec := rt.request(remoteAddr, xff)
+	if rec.Code != status {
+		rt.t.Fatalf("request from %s (X-Forwarded-For %q) = %d, want %d", remoteAddr, xff, rec.Code, status)
+	}
+	return rec
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	rt := newRateLimitTest(t, "3/1m", newMemoryStore())
+	for i, remaining := range []string{"2", "1", "0"} {
+		rec := rt.expect("198.51.100.1:1234", "", http.StatusOK)
+		if got := rec.Header().Get("X-RateLimit-Remaining"); got != remaining {
+			t.Fatalf("request %d: X-RateLimit-Remaining = %s, want %s", i+1, got, remaining)
+		}
+	}
+	rec := rt.expect("198.51.100.1:1234", "", http.StatusTooManyRequests)
+	for name, want := range map[string]string{
+		"X-RateLimit-Limit":     "3",
+		"X-RateLimit-Remaining": "0",
+		"X-RateLimit-Reset":     "60",
+		"Retry-After":           "20",
+	} {
+		if got := rec.Header().Get(name); got != want {
+			t.Errorf("%s = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	rt := newRateLimitTest(t, "3/1m", newMemoryStore())
+	for i := 0; i < 3; i++ {
+		rt.expect("198.51.100.1:1234", "", http.StatusOK)
+	}
+
+	// One token comes back every 20s
+	rt.now = rt.now.Add(19 * time.Second)
+	if rec := rt.expect("198.51.100.1:1234", "", http.StatusTooManyRequests); rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Retry-After = %s, want 1", rec.Header().Get("Retry-After"))
+	}
+	rt.now = rt.now.Add(time.Second)
+	rt.expect("198.51.100.1:1234", "", http.StatusOK)
+	rt.expect("198.51.100.1:1234", "", http.StatusTooManyRequests)
+
+	// Buckets never hold more than the burst
+	rt.now = rt.now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		rt.expect("198.51.100.1:1234", "", http.StatusOK)
+	}
+	rt.expect("198.51.100.1:1234", "", http.StatusTooManyRequests)
+}
+
+func TestRateLimiterKeysByClientIP(t *testing.T) {
+	rt := newRateLimitTest(t, "1/1m", newMemoryStore())
+
+	// Behind a trusted (internal) proxy, clients are told apart by X-Forwarded-For
+	rt.expect("10.0.0.2:1234", "203.0.113.1", http.StatusOK)
+	rt.expect("10.0.0.3:1234", "203.0.113.1, 10.0.0.2", http.StatusTooManyRequests)
+	rt.expect("10.0.0.2:1234", "203.0.113.2", http.StatusOK)
+
+	// Clients connecting directly can't get a new bucket by forging X-Forwarded-For
+	rt.expect("198.51.100.1:1234", "", http.StatusOK)
+	rt.expect("198.51.100.1:1234", "203.0.113.3", http.StatusTooManyRequests)
+	rt.expect("198.51.100.1:1234", "203.0.113.4, 198.51.100.1", http.StatusTooManyRequests)
+}
+
+// storeErrors returns how many store failures rateLimitStoreErrors counted for the test limiter.
+func storeErrors() int64 {
+	if count, ok := rateLimitStoreErrors.Get("test").(*expvar.Int); ok {
+		return count.Value()
+	}
+	return 0
+}
+
+func TestRateLimiterFailsOpenAndCountsStoreErrors(t *testing.T) {
+	store := newMemoryStore()
+	rt := newRateLimitTest(t, "1/1m", store)
+	rt.expect("198.51.100.1:1234", "", http.StatusOK)
+	before := storeErrors()
+
+	store.err = errors.New("cache unavailable")
+	rec := rt.expect("198.51.100.1:1234", "", http.StatusOK)
+	if rec.Header().Get("X-RateLimit-Limit") != "" {
+		t.Fatal("rate limit headers were set without a bucket")
+	}
+	if got := storeErrors(); got != before+1 {
+		t.Fatalf("ratelimit_store_errors[test] = %d, want %d", got, before+1)
+	}
+}
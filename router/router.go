@@ -1,8 +1,10 @@
 package router
 
 import (
+	"crypto/subtle"
 	"embed"
 	"encoding/gob"
+	"expvar"
 	"fmt"
 	"net/http"
 	"os"
@@ -17,6 +19,7 @@ import (
 	"github.com/markbates/goth/gothic"
 	"github.com/sharify-labs/spine/clients"
 	"github.com/sharify-labs/spine/config"
+	"github.com/sharify-labs/spine/database"
 	h "github.com/sharify-labs/spine/handlers"
 	"github.com/sharify-labs/spine/models"
 )
@@ -27,32 +30,102 @@ import (
 // - GET     /       -> handlers.Root
 // - GET     /login  -> handlers.Login
 //
-// Auth:
+// Auth (rate limited per IP):
 // - GET     /auth/discord           -> handlers.DiscordAuth
 // - GET     /auth/discord/callback  -> handlers.DiscordAuthCallback
 //
-// Protected:
+// Webhooks (verified by signature):
+// - POST    /webhooks/billing       -> handlers.BillingWebhook
+//
+// Canvas (verified by CANVAS_API_KEY, disabled if unset):
+// - GET     /canvas/v1/embeds       -> handlers.GetUploadEmbed
+//
+// Protected (rate limited per user on reset-token, config, POST hosts and uploads):
 // - GET     /dashboard       		-> handlers.DisplayDashboard
 // - GET     /api/v1/reset-token 	-> handlers.ResetToken
 // - GET	 /api/v1/config/:type 	-> handlers.ProvideConfig  // :type must be files/pastes/redirects
 // - GET	 /api/v1/domains      	-> handlers.ListAvailableDomains
 // - GET     /api/v1/hosts        	-> handlers.ListHosts
+// - GET     /api/v1/hosts/availability -> handlers.CheckHostAvailability
 // - POST    /api/v1/hosts        	-> handlers.CreateHost
 // - DELETE  /api/v1/hosts/:name  	-> handlers.DeleteHost
+// - GET     /api/v1/hosts/:name/impact   -> handlers.GetHostImpact
+// - GET     /api/v1/hosts/:name/settings -> handlers.GetHostSettings
+// - PATCH   /api/v1/hosts/:name/settings -> handlers.UpdateHostSettings
+// - POST    /api/v1/hosts/:name/transfer -> handlers.RequestTransfer
+// - GET     /api/v1/host-deletions       -> handlers.ListHostDeletions
+// - GET     /api/v1/host-deletions/:id   -> handlers.GetHostDeletion
+// - POST    /api/v1/host-deletions/:id/retry -> handlers.RetryHostDeletion
+// - GET     /api/v1/transfers            -> handlers.ListTransfers
+// - POST    /api/v1/transfers/:id/accept -> handlers.AcceptTransfer
+// - POST    /api/v1/transfers/:id/decline -> handlers.DeclineTransfer
+// - DELETE  /api/v1/transfers/:id        -> handlers.CancelTransfer
+// - GET     /api/v1/audit                -> handlers.ListAuditEvents
+// - GET     /api/v1/embeds               -> handlers.ListEmbedTemplates
+// - POST    /api/v1/embeds/preview       -> handlers.PreviewEmbed
+// - PUT     /api/v1/embeds               -> handlers.SaveEmbedTemplate
+// - DELETE  /api/v1/embeds/:name         -> handlers.DeleteEmbedTemplate  // :name is a hostname or "default"
+// - GET     /api/v1/teams                          -> handlers.ListTeams
+// - POST    /api/v1/teams                          -> handlers.CreateTeam
+// - GET     /api/v1/teams/:id                      -> handlers.GetTeam
+// - DELETE  /api/v1/teams/:id                      -> handlers.DeleteTeam
+// - POST    /api/v1/teams/:id/members              -> handlers.AddTeamMember
+// - PUT     /api/v1/teams/:id/members/:user_id     -> handlers.UpdateTeamMember
+// - DELETE  /api/v1/teams/:id/members/:user_id     -> handlers.RemoveTeamMember
+// - POST    /api/v1/teams/:id/hosts                -> handlers.CreateTeamHost
+// - DELETE  /api/v1/teams/:id/hosts/:name          -> handlers.DeleteTeamHost
+// - POST    /api/v1/teams/:id/token                -> handlers.ResetTeamToken
+// - GET     /api/v1/teams/:id/usage                -> handlers.GetTeamUsage
+// - GET     /api/v1/custom-domains               -> handlers.ListCustomDomains
+// - POST    /api/v1/custom-domains               -> handlers.AddCustomDomain
+// - POST    /api/v1/custom-domains/:name/verify  -> handlers.VerifyCustomDomain
+// - DELETE  /api/v1/custom-domains/:name         -> handlers.DeleteCustomDomain
+// - GET     /api/v1/domain-submissions           -> handlers.ListDomainSubmissions
+// - POST    /api/v1/domain-submissions           -> handlers.SubmitDomain
+// - DELETE  /api/v1/domain-submissions/:id       -> handlers.WithdrawDomainSubmission
+// - GET     /api/v1/contributions                -> handlers.ListContributedDomains
+// - PUT     /api/v1/contributions/:name          -> handlers.UpdateContributedDomain
+// - GET     /api/v1/host-requests                -> handlers.ListHostRequests
+// - POST    /api/v1/host-requests/:id/approve    -> handlers.ApproveHostRequest
+// - POST    /api/v1/host-requests/:id/reject     -> handlers.RejectHostRequest
+// - GET     /api/v1/plans        	-> handlers.ListPlans
+// - GET     /api/v1/usage        	-> handlers.GetUsage
+// - POST    /api/v1/billing/checkout -> handlers.StartCheckout
+//
+// Admin (ADMIN_USER_IDS only):
+// - GET     /api/v1/admin/plans          -> handlers.ListPlans
+// - POST    /api/v1/admin/plans          -> handlers.CreatePlan
+// - PUT     /api/v1/admin/plans/:id      -> handlers.UpdatePlan
+// - DELETE  /api/v1/admin/plans/:id      -> handlers.DeletePlan
+// - PUT     /api/v1/admin/users/:id/plan -> handlers.AssignUserPlan
+// - PUT     /api/v1/admin/teams/:id/plan -> handlers.AssignTeamPlan
+// - GET     /api/v1/admin/domains        -> handlers.ListDomains
+// - POST    /api/v1/admin/domains        -> handlers.CreateDomain
+// - PUT     /api/v1/admin/domains/:id    -> handlers.UpdateDomain
+// - DELETE  /api/v1/admin/domains/:id    -> handlers.DeleteDomain
+// - GET     /api/v1/admin/subdomain-overrides     -> handlers.ListSubdomainOverrides
+// - POST    /api/v1/admin/subdomain-overrides     -> handlers.CreateSubdomainOverride
+// - DELETE  /api/v1/admin/subdomain-overrides/:id -> handlers.DeleteSubdomainOverride
+// - GET     /api/v1/admin/domain-submissions             -> handlers.ListDomainSubmissionsForReview
+// - POST    /api/v1/admin/domain-submissions/:id/approve -> handlers.ApproveDomainSubmission
+// - POST    /api/v1/admin/domain-submissions/:id/reject  -> handlers.RejectDomainSubmission
+// - GET     /api/v1/admin/metrics        -> expvar.Handler ("zephyr", "catalog" and "ratelimit_store_errors")
 //
 // Zephyr Routes:
 //
 //   - These routes forward the body and query parameters directly to Zephyr.
 //
-//   - All paths must exactly match the paths in Zephyr (see clients.HTTP ForwardToZephyr method)
+//   - They are read from ZEPHYR_ROUTES_FILE (see zephyr_routes.go), which maps Spine paths to Zephyr paths.
+//
+//   - They are protected just like API routes and rate limited per user.
 //
-//   - They are protected just like API routes.
+//   - Defaults:
 //
-//   - GET /api/v1/uploads
+//   - GET /api/v1/uploads    -> /api/v1/uploads
 //
-//   - POST /api/v1/uploads
+//   - POST /api/v1/uploads   -> /api/v1/uploads (checks upload limits)
 //
-//   - DELETE /api/v1/uploads
+//   - DELETE /api/v1/uploads -> /api/v1/uploads
 func Setup(e *echo.Echo, assets embed.FS) {
 	// Init Gothic for oAuth2
 	sessStore := sessions.NewCookieStore(
@@ -86,32 +159,113 @@ func Setup(e *echo.Echo, assets embed.FS) {
 		session.Middleware(sessStore),
 	)
 
+	// Init rate limiters (see ratelimit.go for config format)
+	var store RateLimitStore = database.Cache()
+	authLimit := newRateLimiter("auth", "RATE_LIMIT_AUTH", "10/1m", store, rateLimitByIP).Middleware
+	hostsLimit := newRateLimiter("hosts", "RATE_LIMIT_HOSTS", "10/1m", store, rateLimitByUser).Middleware
+	availabilityLimit := newRateLimiter(
+		"availability", "RATE_LIMIT_AVAILABILITY", "30/1m", store, rateLimitByUser,
+	).Middleware
+	tokensLimit := newRateLimiter("tokens", "RATE_LIMIT_TOKENS", "5/1m", store, rateLimitByUser).Middleware
+	uploadsLimit := newRateLimiter("uploads", "RATE_LIMIT_UPLOADS", "60/1m", store, rateLimitByUser).Middleware
+
 	e.GET("", h.Root)
 	e.GET("/login", h.Login)
 
-	auth := e.Group("/auth")
+	auth := e.Group("/auth", authLimit)
 	{
 		auth.GET("/discord", h.DiscordAuth)
 		auth.GET("/discord/callback", h.DiscordAuthCallback)
 	}
 
+	e.POST("/webhooks/billing", h.BillingWebhook)
+	e.GET("/canvas/v1/embeds", h.GetUploadEmbed, requireCanvasKey)
+
 	// Protected routes
 	e.GET("/dashboard", h.DisplayDashboard, requireSession)
 	api := e.Group("/api", requireSession)
 	{
 		v1 := api.Group("/v1")
 		{
-			v1.GET("/reset-token", h.ResetToken)
-			v1.GET("/config/:type", h.ProvideConfig) // TODO: Make this 1 endpoint that downloads a zip with all configs
+			v1.GET("/reset-token", h.ResetToken, tokensLimit)
+			v1.GET("/config/:type", h.ProvideConfig, tokensLimit) // TODO: Make this 1 endpoint that downloads a zip with all configs
 			v1.GET("/domains", h.ListAvailableDomains)
 
 			v1.GET("/hosts", h.ListHosts)
-			v1.POST("/hosts", h.CreateHost)
+			v1.GET("/hosts/availability", h.CheckHostAvailability, availabilityLimit)
+			v1.POST("/hosts", h.CreateHost, hostsLimit)
 			v1.DELETE("/hosts/:name", h.DeleteHost)
+			v1.GET("/hosts/:name/impact", h.GetHostImpact)
+			v1.GET("/hosts/:name/settings", h.GetHostSettings)
+			v1.PATCH("/hosts/:name/settings", h.UpdateHostSettings)
+			v1.POST("/hosts/:name/transfer", h.RequestTransfer, hostsLimit)
+			v1.GET("/host-deletions", h.ListHostDeletions)
+			v1.GET("/host-deletions/:id", h.GetHostDeletion)
+			v1.POST("/host-deletions/:id/retry", h.RetryHostDeletion)
+
+			v1.GET("/transfers", h.ListTransfers)
+			v1.POST("/transfers/:id/accept", h.AcceptTransfer)
+			v1.POST("/transfers/:id/decline", h.DeclineTransfer)
+			v1.DELETE("/transfers/:id", h.CancelTransfer)
+			v1.GET("/audit", h.ListAuditEvents)
+
+			v1.GET("/embeds", h.ListEmbedTemplates)
+			v1.POST("/embeds/preview", h.PreviewEmbed)
+			v1.PUT("/embeds", h.SaveEmbedTemplate)
+			v1.DELETE("/embeds/:name", h.DeleteEmbedTemplate)
+
+			v1.GET("/teams", h.ListTeams)
+			v1.POST("/teams", h.CreateTeam)
+			v1.GET("/teams/:id", h.GetTeam)
+			v1.DELETE("/teams/:id", h.DeleteTeam)
+			v1.POST("/teams/:id/members", h.AddTeamMember)
+			v1.PUT("/teams/:id/members/:user_id", h.UpdateTeamMember)
+			v1.DELETE("/teams/:id/members/:user_id", h.RemoveTeamMember)
+			v1.POST("/teams/:id/hosts", h.CreateTeamHost, hostsLimit)
+			v1.DELETE("/teams/:id/hosts/:name", h.DeleteTeamHost)
+			v1.POST("/teams/:id/token", h.ResetTeamToken, tokensLimit)
+			v1.GET("/teams/:id/usage", h.GetTeamUsage)
+
+			v1.GET("/custom-domains", h.ListCustomDomains)
+			v1.POST("/custom-domains", h.AddCustomDomain, hostsLimit)
+			v1.POST("/custom-domains/:name/verify", h.VerifyCustomDomain, hostsLimit)
+			v1.DELETE("/custom-domains/:name", h.DeleteCustomDomain)
+
+			v1.GET("/domain-submissions", h.ListDomainSubmissions)
+			v1.POST("/domain-submissions", h.SubmitDomain, hostsLimit)
+			v1.DELETE("/domain-submissions/:id", h.WithdrawDomainSubmission)
+			v1.GET("/contributions", h.ListContributedDomains)
+			v1.PUT("/contributions/:name", h.UpdateContributedDomain)
+			v1.GET("/host-requests", h.ListHostRequests)
+			v1.POST("/host-requests/:id/approve", h.ApproveHostRequest)
+			v1.POST("/host-requests/:id/reject", h.RejectHostRequest)
+
+			v1.GET("/plans", h.ListPlans)
+			v1.GET("/usage", h.GetUsage)
+			v1.POST("/billing/checkout", h.StartCheckout)
+
+			admin := v1.Group("/admin", requireAdmin)
+			{
+				admin.GET("/plans", h.ListPlans)
+				admin.POST("/plans", h.CreatePlan)
+				admin.PUT("/plans/:id", h.UpdatePlan)
+				admin.DELETE("/plans/:id", h.DeletePlan)
+				admin.PUT("/users/:id/plan", h.AssignUserPlan)
+				admin.PUT("/teams/:id/plan", h.AssignTeamPlan)
+				admin.GET("/domains", h.ListDomains)
+				admin.POST("/domains", h.CreateDomain)
+				admin.PUT("/domains/:id", h.UpdateDomain)
+				admin.DELETE("/domains/:id", h.DeleteDomain)
+				admin.GET("/subdomain-overrides", h.ListSubdomainOverrides)
+				admin.POST("/subdomain-overrides", h.CreateSubdomainOverride)
+				admin.DELETE("/subdomain-overrides/:id", h.DeleteSubdomainOverride)
+				admin.GET("/domain-submissions", h.ListDomainSubmissionsForReview)
+				admin.POST("/domain-submissions/:id/approve", h.ApproveDomainSubmission)
+				admin.POST("/domain-submissions/:id/reject", h.RejectDomainSubmission)
+				admin.GET("/metrics", echo.WrapHandler(expvar.Handler()))
+			}
 
-			v1.GET("/uploads", h.ZephyrProxy)
-			v1.POST("/uploads", h.ZephyrProxy)
-			v1.DELETE("/uploads", h.ZephyrProxy)
+			registerZephyrRoutes(e, v1, loadZephyrRoutes(), uploadsLimit)
 		}
 	}
 }
@@ -131,3 +285,29 @@ func requireSession(next echo.HandlerFunc) echo.HandlerFunc {
 		return c.Redirect(http.StatusFound, "/login")
 	}
 }
+
+// requireAdmin is a middleware that checks if the logged-in user is an admin.
+// Must be used after requireSession.
+func requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if user, ok := c.Get("user").(models.AuthorizedUser); ok && config.IsAdmin(user.ID) {
+			return next(c)
+		}
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+}
+
+// requireCanvasKey is a middleware that checks the request comes from Canvas (config.HeaderCanvasKey).
+// Routes using it respond 404 if CANVAS_API_KEY isn't set.
+func requireCanvasKey(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := config.GetOrDefault("CANVAS_API_KEY", "")
+		if key == "" {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		if subtle.ConstantTimeCompare([]byte(c.Request().Header.Get(config.HeaderCanvasKey)), []byte(key)) != 1 {
+			return echo.NewHTTPError(http.StatusUnauthorized)
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,129 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	goccy "github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+	mw "github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/bytes"
+	"github.com/sharify-labs/spine/config"
+	h "github.com/sharify-labs/spine/handlers"
+)
+
+// Who can use a Zephyr route. Every route requires a session.
+const (
+	zephyrAuthUser  = "user"  // any logged-in user
+	zephyrAuthAdmin = "admin" // users listed in ADMIN_USER_IDS
+)
+
+// zephyrRoute maps a Spine API route to a Zephyr endpoint.
+type zephyrRoute struct {
+	Method string `json:"method"`
+	// Path is relative to /api/v1 and may contain :params (ex: "/uploads/:id").
+	Path string `json:"path"`
+	// ZephyrPath is the path requested on Zephyr. Its :params are replaced with those of Path.
+	ZephyrPath string `json:"zephyr_path"`
+	// Auth is zephyrAuthUser (default) or zephyrAuthAdmin.
+	Auth string `json:"auth"`
+	// BodyLimit is the maximum request body size (ex: "10M"). It can only lower the global 100M limit.
+	BodyLimit string `json:"body_limit"`
+	// UploadLimits checks the user's plan limits against the request body size before forwarding it.
+	UploadLimits bool `json:"upload_limits"`
+}
+
+// defaultZephyrRoutes are used when ZEPHYR_ROUTES_FILE isn't set.
+var defaultZephyrRoutes = []zephyrRoute{
+	{Method: http.MethodGet, Path: "/uploads", ZephyrPath: "/api/v1/uploads"},
+	{Method: http.MethodPost, Path: "/uploads", ZephyrPath: "/api/v1/uploads", UploadLimits: true},
+	{Method: http.MethodDelete, Path: "/uploads", ZephyrPath: "/api/v1/uploads"},
+}
+
+// loadZephyrRoutes reads the Zephyr route table from the JSON array in ZEPHYR_ROUTES_FILE,
+// or returns defaultZephyrRoutes if it isn't set. Panics if the table is invalid.
+func loadZephyrRoutes() []zephyrRoute {
+	path := config.GetOrDefault("ZEPHYR_ROUTES_FILE", "")
+	if path == "" {
+		return defaultZephyrRoutes
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		panic("failed to read ZEPHYR_ROUTES_FILE: " + err.Error())
+	}
+	var routes []zephyrRoute
+	dec := goccy.NewDecoder(strings.NewReader(string(data)))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&routes); err != nil {
+		panic("invalid ZEPHYR_ROUTES_FILE: " + err.Error())
+	}
+	for i, r := range routes {
+		if err = r.validate(); err != nil {
+			panic(fmt.Sprintf("invalid ZEPHYR_ROUTES_FILE route %d (%s %s): %v", i, r.Method, r.Path, err))
+		}
+	}
+	return routes
+}
+
+// validate checks that the route can be registered and that every :param of ZephyrPath is in Path.
+func (r *zephyrRoute) validate() error {
+	switch r.Method {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return fmt.Errorf("unsupported method")
+	}
+	if !strings.HasPrefix(r.Path, "/") || !strings.HasPrefix(r.ZephyrPath, "/") {
+		return fmt.Errorf("path and zephyr_path must start with /")
+	}
+	params := make(map[string]struct{})
+	for _, seg := range strings.Split(r.Path, "/") {
+		if strings.HasPrefix(seg, ":") {
+			params[seg] = struct{}{}
+		}
+	}
+	for _, seg := range strings.Split(r.ZephyrPath, "/") {
+		if seg == "." || seg == ".." || strings.Contains(seg, "%") {
+			return fmt.Errorf("zephyr_path must not contain dot segments or escapes")
+		}
+		if _, ok := params[seg]; strings.HasPrefix(seg, ":") && !ok {
+			return fmt.Errorf("zephyr_path parameter %s is not in path", seg)
+		}
+	}
+	switch r.Auth {
+	case "", zephyrAuthUser, zephyrAuthAdmin:
+	default:
+		return fmt.Errorf("auth must be %q or %q", zephyrAuthUser, zephyrAuthAdmin)
+	}
+	if r.BodyLimit != "" {
+		if _, err := bytes.Parse(r.BodyLimit); err != nil {
+			return fmt.Errorf("invalid body_limit: %w", err)
+		}
+	}
+	return nil
+}
+
+// registerZephyrRoutes adds the routes to v1 (/api/v1), after every other route so that a route shadowing one of
+// Spine's own can be detected. Panics if it does.
+func registerZephyrRoutes(e *echo.Echo, v1 *echo.Group, routes []zephyrRoute, middleware ...echo.MiddlewareFunc) {
+	existing := make(map[string]struct{})
+	for _, r := range e.Routes() {
+		existing[r.Method+" "+r.Path] = struct{}{}
+	}
+	for _, r := range routes {
+		if _, ok := existing[r.Method+" /api/v1"+r.Path]; ok {
+			panic(fmt.Sprintf("zephyr route %s %s conflicts with an existing route", r.Method, r.Path))
+		}
+		existing[r.Method+" /api/v1"+r.Path] = struct{}{}
+
+		m := append([]echo.MiddlewareFunc{}, middleware...)
+		if r.Auth == zephyrAuthAdmin {
+			m = append(m, requireAdmin)
+		}
+		if r.BodyLimit != "" {
+			m = append(m, mw.BodyLimit(r.BodyLimit))
+		}
+		v1.Add(r.Method, r.Path, h.ZephyrProxy(r.ZephyrPath, r.UploadLimits), m...)
+	}
+}
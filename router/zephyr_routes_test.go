@@ -0,0 +1,25 @@
+package router
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestZephyrRouteValidate(t *testing.T) {
+	tests := []struct {
+		route zephyrRoute
+		valid bool
+	}{
+		{route: zephyrRoute{Method: http.MethodGet, Path: "/files/:id", ZephyrPath: "/api/v1/uploads/:id"}, valid: true},
+		{route: zephyrRoute{Method: http.MethodGet, Path: "/files/:id", ZephyrPath: "/api/v1/uploads/:other"}},
+		{route: zephyrRoute{Method: http.MethodGet, Path: "/files", ZephyrPath: "/api/v1/../admin"}},
+		{route: zephyrRoute{Method: http.MethodGet, Path: "/files", ZephyrPath: "/api/v1/%2e%2e/admin"}},
+		{route: zephyrRoute{Method: "TRACE", Path: "/files", ZephyrPath: "/api/v1/uploads"}},
+		{route: zephyrRoute{Method: http.MethodGet, Path: "/files", ZephyrPath: "/api/v1/uploads", Auth: "root"}},
+	}
+	for _, tt := range tests {
+		if err := tt.route.validate(); (err == nil) != tt.valid {
+			t.Errorf("validate(%+v) = %v, want valid = %t", tt.route, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"time"
+
+	"github.com/sharify-labs/spine/database"
+	"gorm.io/gorm"
+)
+
+// Audit event actions (see database.AuditEvent).
+const (
+	AuditHostTransferRequested = "host.transfer.requested"
+	AuditHostTransferAccepted  = "host.transfer.accepted"
+	AuditHostTransferDeclined  = "host.transfer.declined"
+	AuditHostTransferCancelled = "host.transfer.cancelled"
+	AuditHostReclaimFlagged    = "host.reclaim.flagged"
+	AuditHostReclaimCleared    = "host.reclaim.cleared"
+	AuditHostReclaimed         = "host.reclaimed"
+	AuditHostPlanFlagged       = "host.plan.flagged"
+	AuditHostPlanCleared       = "host.plan.cleared"
+	AuditHostPlanReleased      = "host.plan.released"
+	AuditDomainSubmitted       = "domain.submission.created"
+	AuditDomainWithdrawn       = "domain.submission.withdrawn"
+	AuditDomainApproved        = "domain.submission.approved"
+	AuditDomainRejected        = "domain.submission.rejected"
+	AuditHostRequested         = "host.request.created"
+	AuditHostRequestApproved   = "host.request.approved"
+	AuditHostRequestRejected   = "host.request.rejected"
+)
+
+// auditActorSystem is the ActorID of events caused by Spine itself (ex: background jobs).
+const auditActorSystem = "system"
+
+// auditHistoryLimit is the maximum number of events returned by ListAuditEvents.
+const auditHistoryLimit = 100
+
+// AuditEvent is an entry in a User's audit history.
+type AuditEvent struct {
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	ActorID   string    `json:"actor_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// recordAuditEvent adds an event to the audit history of each of the given users.
+// Should be called within the transaction that performs the action, so that the history can't miss it.
+func recordAuditEvent(tx *gorm.DB, action, target, actorID string, userIDs ...string) error {
+	events := make([]*database.AuditEvent, 0, len(userIDs))
+	for _, userID := range userIDs {
+		events = append(events, &database.AuditEvent{
+			UserID:  userID,
+			Action:  action,
+			Target:  target,
+			ActorID: actorID,
+		})
+	}
+	return tx.Create(events).Error
+}
+
+// ListAuditEvents returns the user's most recent audit events, newest first.
+func ListAuditEvents(userID string) ([]*AuditEvent, error) {
+	var events []*database.AuditEvent
+	if err := database.DB().Where(&database.AuditEvent{
+		UserID: userID,
+	}).Order("created_at DESC, id DESC").Limit(auditHistoryLimit).Find(&events).Error; err != nil {
+		return nil, err
+	}
+	res := make([]*AuditEvent, 0, len(events))
+	for _, e := range events {
+		res = append(res, &AuditEvent{
+			Action:    e.Action,
+			Target:    e.Target,
+			ActorID:   e.ActorID,
+			CreatedAt: e.CreatedAt,
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/sharify-labs/spine/database"
+	"github.com/sharify-labs/spine/validators"
+)
+
+// Availability statuses returned by CheckAvailability.
+const (
+	HostAvailable = "available"
+	HostTaken     = "taken"
+	HostReserved  = "reserved"
+	HostInvalid   = "invalid"
+)
+
+// maxSuggestions is the maximum number of alternative subdomains suggested for unavailable hosts.
+const maxSuggestions = 3
+
+// Availability describes whether a user can register a hostname.
+// Sub: The sanitized subdomain that would be registered.
+// DisplayName: The Unicode form of Hostname.
+// Reason: Explains why the hostname isn't available. Empty if it is.
+// Suggestions: Available alternative subdomains for taken or reserved names.
+type Availability struct {
+	Sub         string   `json:"sub"`
+	Root        string   `json:"root"`
+	Hostname    string   `json:"hostname"`
+	DisplayName string   `json:"display_name"`
+	Status      string   `json:"status"`
+	Reason      string   `json:"reason,omitempty"`
+	Suggestions []string `json:"suggestions"`
+}
+
+// CheckAvailability runs the same checks as host creation (without plan limits) for sub under root.
+func CheckAvailability(userID, sub, root string) (*Availability, error) {
+	host, err := NewHostFromInput(sub, root, userID)
+	if errors.Is(err, ErrInvalidSubdomain) || errors.Is(err, ErrHostnameTooLong) {
+		return &Availability{
+			Root:        root,
+			Hostname:    root,
+			DisplayName: validators.ToUnicode(root),
+			Status:      HostInvalid,
+			Reason:      err.Error(),
+			Suggestions: []string{},
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := &Availability{
+		Sub:         host.Sub,
+		Root:        host.Root,
+		Hostname:    host.Full,
+		DisplayName: validators.ToUnicode(host.Full),
+		Status:      HostAvailable,
+		Suggestions: []string{},
+	}
+
+	var rejectedErr *validators.SubdomainRejectedError
+	var planErr *PlanRequiredError
+	err = CheckHostAllowed(userID, host.Sub, host.Root)
+	switch {
+	case errors.As(err, &rejectedErr):
+		res.Status, res.Reason = HostReserved, err.Error()
+	case errors.Is(err, ErrRootUnavailable), errors.Is(err, ErrWildcardNotAllowed), errors.Is(err, ErrMultiLevelNotAllowed),
+		errors.Is(err, ErrDomainHostLimit), errors.As(err, &planErr):
+		res.Status, res.Reason = HostInvalid, err.Error()
+		return res, nil
+	case err != nil:
+		return nil, err
+	default:
+		taken, err := isHostTaken(database.DB(), host.Sub, host.Root)
+		if err != nil {
+			return nil, err
+		}
+		if !taken {
+			return res, nil
+		}
+		res.Status, res.Reason = HostTaken, ErrHostTaken.Error()
+	}
+
+	if host.Sub != "" {
+		if res.Suggestions, err = suggestSubdomains(userID, host.Sub, host.Root); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// suggestSubdomains returns up to maxSuggestions available variations of sub (ex: "joe" -> "joe-1", "my-joe").
+// Only the first label of multi-level subdomains is changed. Variations of internationalized labels are made from
+// the Unicode form and then encoded (ex: "bücher" -> "my-bücher", rather than "xn--bcher-kva-1").
+func suggestSubdomains(userID, sub, root string) ([]string, error) {
+	label, rest, _ := strings.Cut(sub, ".")
+	if rest != "" {
+		rest = "." + rest
+	}
+	label = validators.ToUnicode(label)
+	var candidates []string
+	for _, variant := range []string{"my-" + label, label + "-1", label + "-2", label + "-3", "the-" + label, label + "-app"} {
+		// Variants may exceed the label length limit, or be rejected by the policy
+		candidate := validators.SanitizeSubdomain(variant)
+		if validators.ToUnicode(candidate) != variant || CheckHostAllowed(userID, candidate+rest, root) != nil {
+			continue
+		}
+		candidates = append(candidates, candidate+rest)
+	}
+	if len(candidates) == 0 {
+		return []string{}, nil
+	}
+
+	var taken []string
+	if err := database.DB().Model(&database.Host{}).
+		Where("root = ? AND sub IN ?", root, candidates).
+		Pluck("sub", &taken).Error; err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, maxSuggestions)
+	for _, c := range candidates {
+		if len(res) == maxSuggestions {
+			break
+		}
+		if !slices.Contains(taken, c) {
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
+
+// String formats the availability as a short sentence for displaying in the dashboard.
+func (a *Availability) String() string {
+	if a.Status == HostAvailable {
+		return a.DisplayName + " is available"
+	}
+	msg := a.DisplayName + ": " + a.Reason
+	if len(a.Suggestions) > 0 {
+		suggestions := make([]string, 0, len(a.Suggestions))
+		for _, sub := range a.Suggestions {
+			suggestions = append(suggestions, validators.ToUnicode(sub))
+		}
+		msg += ". Try " + strings.Join(suggestions, ", ")
+	}
+	return msg
+}
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/sharify-labs/spine/database"
+	"github.com/sharify-labs/spine/validators"
+)
+
+// createTestDomain adds a public catalog domain that allows subdomains.
+func createTestDomain(t *testing.T) string {
+	t.Helper()
+	name := fmt.Sprintf("catalog%d.example", testSeq.Add(1))
+	domain := &database.Domain{Name: name, Public: true, WildcardAllowed: true, Enabled: true}
+	if err := database.DB().Create(domain).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := RefreshCatalog(); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestCheckAvailabilitySuggestsUnicodeVariants(t *testing.T) {
+	user := createTestUser(t)
+	root := createTestDomain(t)
+	if err := database.DB().Create(&database.Host{UserID: user.ID, Sub: "xn--bcher-kva", Root: root}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := CheckAvailability(createTestUser(t).ID, "bücher", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != HostTaken {
+		t.Fatalf("status = %s, want %s", res.Status, HostTaken)
+	}
+	if len(res.Suggestions) != maxSuggestions {
+		t.Fatalf("suggestions = %q, want %d", res.Suggestions, maxSuggestions)
+	}
+	for _, sub := range res.Suggestions {
+		if display := validators.ToUnicode(sub); !strings.Contains(display, "bücher") {
+			t.Errorf("suggestion %q (%s) isn't a variation of the Unicode label", sub, display)
+		}
+	}
+	if msg := res.String(); strings.Contains(msg, "xn--") {
+		t.Errorf("message shows punycode: %s", msg)
+	}
+}
@@ -0,0 +1,229 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/config"
+	"github.com/sharify-labs/spine/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Subscription statuses (see database.Subscription).
+const (
+	SubscriptionIncomplete = "incomplete"
+	SubscriptionActive     = "active"
+	SubscriptionPastDue    = "past_due"
+	SubscriptionCanceled   = "canceled"
+)
+
+// processedBillingEventTTL is how long processed event IDs are kept. Providers stop redelivering long before.
+const processedBillingEventTTL = 30 * 24 * time.Hour
+
+// incompleteSubscriptionTTL is how long an unpaid subscription blocks new checkouts.
+// Stripe expires subscriptions whose first payment hasn't succeeded after 23 hours.
+const incompleteSubscriptionTTL = 24 * time.Hour
+
+var (
+	ErrPlanNotPurchasable = errors.New("plan is not purchasable")
+	ErrAlreadySubscribed  = errors.New("already subscribed to a plan, cancel it before subscribing to another")
+	ErrCheckoutPending    = errors.New("a subscription is waiting for its first payment, try again once it's paid")
+)
+
+// StartCheckout creates a checkout session for the user to subscribe to a plan and returns its URL.
+// Users with an active or past due subscription can't check out another one, nor can users with a subscription
+// that is still waiting for its first payment (incomplete), until it expires.
+func StartCheckout(ctx context.Context, userID, email string, planID uint) (string, error) {
+	plan, err := database.GetPlan(planID)
+	if err != nil {
+		return "", err
+	}
+	if plan.BillingPriceID == nil {
+		return "", ErrPlanNotPurchasable
+	}
+	var subscribed int64
+	if err = database.DB().Model(&database.Subscription{}).Where(
+		"user_id = ? AND status IN ?", userID, []string{SubscriptionActive, SubscriptionPastDue},
+	).Count(&subscribed).Error; err != nil {
+		return "", err
+	}
+	if subscribed > 0 {
+		return "", ErrAlreadySubscribed
+	}
+	var pending int64
+	if err = database.DB().Model(&database.Subscription{}).Where(
+		"user_id = ? AND status = ? AND created_at > ?",
+		userID, SubscriptionIncomplete, time.Now().UTC().Add(-incompleteSubscriptionTTL),
+	).Count(&pending).Error; err != nil {
+		return "", err
+	}
+	if pending > 0 {
+		return "", ErrCheckoutPending
+	}
+	session, err := clients.Billing.CreateCheckoutSession(ctx, &clients.CheckoutParams{
+		UserID:  userID,
+		Email:   email,
+		PlanID:  plan.ID,
+		PriceID: *plan.BillingPriceID,
+	})
+	if err != nil {
+		return "", err
+	}
+	return session.URL, nil
+}
+
+// HandleBillingEvent applies a verified billing webhook to the subscription and the User's plan.
+// Each event is applied at most once: its ID is recorded in the same transaction, so redelivered events are ignored
+// and events that fail can be redelivered. The plan is only granted once a payment is confirmed (renewed event),
+// and is always derived from all of the User's subscriptions (see syncSubscriptionPlan) since events arrive in
+// any order.
+func HandleBillingEvent(event *clients.BillingEvent) error {
+	if event.Type == clients.BillingEventIgnored {
+		return nil
+	}
+	return database.DB().Transaction(func(tx *gorm.DB) error {
+		if event.ID != "" {
+			res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&database.ProcessedBillingEvent{
+				ID:   event.ID,
+				Type: string(event.Type),
+			})
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				return nil // already processed
+			}
+		}
+		return applyBillingEvent(tx, event)
+	})
+}
+
+func applyBillingEvent(tx *gorm.DB, event *clients.BillingEvent) error {
+	if event.Type == clients.BillingEventSubscriptionCreated {
+		return createSubscription(tx, event, SubscriptionIncomplete)
+	}
+
+	var sub database.Subscription
+	err := tx.Where(&database.Subscription{ID: event.SubscriptionID}).First(&sub).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// The first invoice can be paid before the subscription's created event arrives.
+		if event.Type == clients.BillingEventSubscriptionRenewed && event.UserID != "" {
+			if err = createSubscription(tx, event, SubscriptionActive); err != nil {
+				return err
+			}
+			return syncSubscriptionPlan(tx, event.UserID)
+		}
+		return nil // not created through checkout
+	}
+	if err != nil {
+		return err
+	}
+
+	switch event.Type {
+	case clients.BillingEventSubscriptionRenewed:
+		if sub.Status == SubscriptionCanceled {
+			return nil // late or replayed payment of a cancelled subscription
+		}
+		sub.Status = SubscriptionActive
+		sub.GraceUntil = nil
+		if event.PeriodEnd.After(sub.CurrentPeriodEnd) {
+			sub.CurrentPeriodEnd = event.PeriodEnd
+		}
+		if err = saveSubscription(tx, &sub); err != nil {
+			return err
+		}
+		// Grants the plan, or restores it if the subscription was downgraded after its grace period.
+		return syncSubscriptionPlan(tx, sub.UserID)
+	case clients.BillingEventPaymentFailed:
+		if sub.Status != SubscriptionActive {
+			return nil // keep the original grace period
+		}
+		graceUntil := time.Now().UTC().Add(config.GetOrDefault("BILLING_GRACE_PERIOD", 72*time.Hour))
+		sub.Status = SubscriptionPastDue
+		sub.GraceUntil = &graceUntil
+		return saveSubscription(tx, &sub)
+	case clients.BillingEventSubscriptionCancelled:
+		if sub.Status == SubscriptionCanceled {
+			return nil
+		}
+		sub.Status = SubscriptionCanceled
+		sub.GraceUntil = nil
+		if err = saveSubscription(tx, &sub); err != nil {
+			return err
+		}
+		return syncSubscriptionPlan(tx, sub.UserID)
+	case clients.BillingEventIgnored, clients.BillingEventSubscriptionCreated:
+	}
+	return nil
+}
+
+// createSubscription records a subscription with the given status, unless it's already known
+// (its other events may have arrived first).
+func createSubscription(tx *gorm.DB, event *clients.BillingEvent, status string) error {
+	if event.UserID == "" || event.PlanID == 0 {
+		return errors.New("subscription " + event.SubscriptionID + " is missing user_id/plan_id metadata")
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&database.Subscription{
+		ID:               event.SubscriptionID,
+		CustomerID:       event.CustomerID,
+		Status:           status,
+		CurrentPeriodEnd: event.PeriodEnd,
+		UserID:           event.UserID,
+		PlanID:           event.PlanID,
+	}).Error
+}
+
+func saveSubscription(tx *gorm.DB, sub *database.Subscription) error {
+	return tx.Model(sub).Select("Status", "GraceUntil", "CurrentPeriodEnd").Updates(sub).Error
+}
+
+// syncSubscriptionPlan moves the user onto the most expensive plan among their subscriptions that are paid for
+// (active, or past due and still within their grace period), or onto the default plan if there are none.
+// Plans assigned by an admin are left alone (see database.User.PlanSource).
+func syncSubscriptionPlan(tx *gorm.DB, userID string) error {
+	planID, source := *database.DefaultPlanID(), ""
+	var plan database.Plan
+	err := tx.Joins("JOIN subscriptions ON subscriptions.plan_id = plans.id AND subscriptions.deleted_at IS NULL").
+		Where("subscriptions.user_id = ?", userID).
+		Where("subscriptions.status = ? OR (subscriptions.status = ? AND subscriptions.grace_until IS NOT NULL)",
+			SubscriptionActive, SubscriptionPastDue).
+		Order("plans.price DESC").First(&plan).Error
+	switch {
+	case err == nil:
+		planID, source = plan.ID, database.PlanSourceBilling
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return err
+	}
+	return tx.Model(&database.User{}).Where(&database.User{ID: userID}).
+		Where("plan_source <> ?", database.PlanSourceAdmin).
+		Updates(map[string]interface{}{"plan_id": planID, "plan_source": source}).Error
+}
+
+// ExpireGracePeriods moves users whose subscription payments failed and whose grace period has ended onto the plan
+// of their remaining paid subscriptions (or the default plan). The subscription stays past_due, so a later
+// successful payment (renewal) restores the paid plan. Processed billing events past their TTL are also pruned.
+func ExpireGracePeriods(_ context.Context) error {
+	var subs []*database.Subscription
+	if err := database.DB().Where(
+		"status = ? AND grace_until < ?", SubscriptionPastDue, time.Now().UTC(),
+	).Find(&subs).Error; err != nil {
+		return err
+	}
+	var errs []error
+	for _, sub := range subs {
+		errs = append(errs, database.DB().Transaction(func(tx *gorm.DB) error {
+			sub.GraceUntil = nil
+			if err := saveSubscription(tx, sub); err != nil {
+				return err
+			}
+			return syncSubscriptionPlan(tx, sub.UserID)
+		}))
+	}
+	errs = append(errs, database.DB().Where(
+		"created_at < ?", time.Now().UTC().Add(-processedBillingEventTTL),
+	).Delete(&database.ProcessedBillingEvent{}).Error)
+	return errors.Join(errs...)
+}
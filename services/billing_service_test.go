@@ -0,0 +1,278 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/database"
+)
+
+// fakeBilling is a BillingProvider that records checkout sessions instead of calling a provider.
+type fakeBilling struct {
+	sessions []*clients.CheckoutParams
+}
+
+func (*fakeBilling) Connect() {}
+
+func (*fakeBilling) Enabled() bool { return true }
+
+func (f *fakeBilling) CreateCheckoutSession(
+	_ context.Context, params *clients.CheckoutParams,
+) (*clients.CheckoutSession, error) {
+	f.sessions = append(f.sessions, params)
+	return &clients.CheckoutSession{ID: "cs_test", URL: "https://billing.test/cs_test"}, nil
+}
+
+func (*fakeBilling) ParseWebhook([]byte, string) (*clients.BillingEvent, error) {
+	return nil, errors.New("not implemented")
+}
+
+// useFakeBilling replaces clients.Billing for the duration of the test.
+func useFakeBilling(t *testing.T) *fakeBilling {
+	fake := &fakeBilling{}
+	previous := clients.Billing
+	clients.Billing = fake
+	t.Cleanup(func() { clients.Billing = previous })
+	return fake
+}
+
+// billingEvents builds webhook events for a subscription of user to plan, with unique event IDs.
+type billingEvents struct {
+	t      *testing.T
+	subID  string
+	userID string
+	planID uint
+}
+
+func newBillingEvents(t *testing.T, user *database.User, plan *database.Plan) *billingEvents {
+	return &billingEvents{t: t, subID: "sub_" + plan.Name, userID: user.ID, planID: plan.ID}
+}
+
+func (b *billingEvents) event(typ clients.BillingEventType) *clients.BillingEvent {
+	return &clients.BillingEvent{
+		ID:             fmt.Sprintf("evt_%d", testSeq.Add(1)),
+		Type:           typ,
+		SubscriptionID: b.subID,
+		CustomerID:     "cus_" + b.userID,
+		UserID:         b.userID,
+		PlanID:         b.planID,
+		PeriodEnd:      time.Now().Add(30 * 24 * time.Hour).UTC(),
+	}
+}
+
+// apply handles the event and fails the test if it returns an error.
+func (b *billingEvents) apply(event *clients.BillingEvent) *clients.BillingEvent {
+	b.t.Helper()
+	if err := HandleBillingEvent(event); err != nil {
+		b.t.Fatalf("HandleBillingEvent(%s): %v", event.Type, err)
+	}
+	return event
+}
+
+// subscribe creates the subscription and confirms its first payment.
+func (b *billingEvents) subscribe() {
+	b.apply(b.event(clients.BillingEventSubscriptionCreated))
+	b.apply(b.event(clients.BillingEventSubscriptionRenewed))
+}
+
+func (b *billingEvents) status() string {
+	b.t.Helper()
+	var sub database.Subscription
+	if err := database.DB().Where(&database.Subscription{ID: b.subID}).First(&sub).Error; err != nil {
+		b.t.Fatal(err)
+	}
+	return sub.Status
+}
+
+func TestStartCheckoutRejectsExistingSubscription(t *testing.T) {
+	fake := useFakeBilling(t)
+	user := createTestUser(t)
+	basic, pro := createTestPlan(t, 5), createTestPlan(t, 10)
+
+	if _, err := StartCheckout(context.Background(), user.ID, user.Email, basic.ID); err != nil {
+		t.Fatalf("first checkout: %v", err)
+	}
+	newBillingEvents(t, user, basic).subscribe()
+	if _, err := StartCheckout(context.Background(), user.ID, user.Email, pro.ID); !errors.Is(err, ErrAlreadySubscribed) {
+		t.Fatalf("checkout with an active subscription: got %v, want ErrAlreadySubscribed", err)
+	}
+	if len(fake.sessions) != 1 {
+		t.Fatalf("got %d checkout sessions, want 1", len(fake.sessions))
+	}
+}
+
+func TestBillingPlanGrantedOnPayment(t *testing.T) {
+	user := createTestUser(t)
+	plan := createTestPlan(t, 5)
+	events := newBillingEvents(t, user, plan)
+
+	events.apply(events.event(clients.BillingEventSubscriptionCreated))
+	if got := userPlanID(t, user.ID); got != *database.DefaultPlanID() {
+		t.Fatalf("plan granted before payment: got plan %d", got)
+	}
+	if got := events.status(); got != SubscriptionIncomplete {
+		t.Fatalf("status after created: got %s, want %s", got, SubscriptionIncomplete)
+	}
+	events.apply(events.event(clients.BillingEventSubscriptionRenewed))
+	if got := userPlanID(t, user.ID); got != plan.ID {
+		t.Fatalf("plan after payment: got %d, want %d", got, plan.ID)
+	}
+}
+
+func TestBillingPaymentBeforeCreated(t *testing.T) {
+	user := createTestUser(t)
+	plan := createTestPlan(t, 5)
+	events := newBillingEvents(t, user, plan)
+
+	events.apply(events.event(clients.BillingEventSubscriptionRenewed))
+	events.apply(events.event(clients.BillingEventSubscriptionCreated))
+	if got := events.status(); got != SubscriptionActive {
+		t.Fatalf("status: got %s, want %s", got, SubscriptionActive)
+	}
+	if got := userPlanID(t, user.ID); got != plan.ID {
+		t.Fatalf("plan: got %d, want %d", got, plan.ID)
+	}
+}
+
+func TestBillingDuplicateEventIgnored(t *testing.T) {
+	user := createTestUser(t)
+	plan := createTestPlan(t, 5)
+	events := newBillingEvents(t, user, plan)
+	events.subscribe()
+
+	failed := events.apply(events.event(clients.BillingEventPaymentFailed))
+	events.apply(events.event(clients.BillingEventSubscriptionRenewed))
+	events.apply(failed) // redelivered
+	if got := events.status(); got != SubscriptionActive {
+		t.Fatalf("status after redelivered payment failure: got %s, want %s", got, SubscriptionActive)
+	}
+}
+
+func TestBillingRenewalAfterCancelIgnored(t *testing.T) {
+	user := createTestUser(t)
+	plan := createTestPlan(t, 5)
+	events := newBillingEvents(t, user, plan)
+	events.subscribe()
+
+	events.apply(events.event(clients.BillingEventSubscriptionCancelled))
+	events.apply(events.event(clients.BillingEventSubscriptionRenewed))
+	if got := events.status(); got != SubscriptionCanceled {
+		t.Fatalf("status: got %s, want %s", got, SubscriptionCanceled)
+	}
+	if got := userPlanID(t, user.ID); got != *database.DefaultPlanID() {
+		t.Fatalf("plan restored by a renewal after cancel: got %d", got)
+	}
+}
+
+func TestBillingCancelKeepsOtherSubscription(t *testing.T) {
+	user := createTestUser(t)
+	basic, pro := createTestPlan(t, 5), createTestPlan(t, 10)
+	basicEvents, proEvents := newBillingEvents(t, user, basic), newBillingEvents(t, user, pro)
+	basicEvents.subscribe()
+	proEvents.subscribe()
+	if got := userPlanID(t, user.ID); got != pro.ID {
+		t.Fatalf("plan with both subscriptions: got %d, want %d", got, pro.ID)
+	}
+
+	proEvents.apply(proEvents.event(clients.BillingEventSubscriptionCancelled))
+	if got := userPlanID(t, user.ID); got != basic.ID {
+		t.Fatalf("plan after cancelling pro: got %d, want %d", got, basic.ID)
+	}
+	basicEvents.apply(basicEvents.event(clients.BillingEventSubscriptionCancelled))
+	if got := userPlanID(t, user.ID); got != *database.DefaultPlanID() {
+		t.Fatalf("plan after cancelling both: got %d, want the default plan", got)
+	}
+}
+
+func TestExpireGracePeriodsKeepsOtherSubscription(t *testing.T) {
+	user := createTestUser(t)
+	basic, pro := createTestPlan(t, 5), createTestPlan(t, 10)
+	basicEvents, proEvents := newBillingEvents(t, user, basic), newBillingEvents(t, user, pro)
+	basicEvents.subscribe()
+	proEvents.subscribe()
+
+	proEvents.apply(proEvents.event(clients.BillingEventPaymentFailed))
+	if got := userPlanID(t, user.ID); got != pro.ID {
+		t.Fatalf("plan within grace period: got %d, want %d", got, pro.ID)
+	}
+	if err := database.DB().Model(&database.Subscription{}).Where("id = ?", proEvents.subID).
+		Update("grace_until", time.Now().Add(-time.Minute).UTC()).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := ExpireGracePeriods(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := userPlanID(t, user.ID); got != basic.ID {
+		t.Fatalf("plan after grace period: got %d, want %d", got, basic.ID)
+	}
+
+	proEvents.apply(proEvents.event(clients.BillingEventSubscriptionRenewed))
+	if got := userPlanID(t, user.ID); got != pro.ID {
+		t.Fatalf("plan after late payment: got %d, want %d", got, pro.ID)
+	}
+}
+
+func TestBillingKeepsAdminAssignedPlan(t *testing.T) {
+	user := createTestUser(t)
+	paid, granted := createTestPlan(t, 5), createTestPlan(t, 20)
+	events := newBillingEvents(t, user, paid)
+	events.subscribe()
+
+	if _, err := AssignPlan(user.ID, granted.ID); err != nil {
+		t.Fatal(err)
+	}
+	events.apply(events.event(clients.BillingEventPaymentFailed))
+	if err := database.DB().Model(&database.Subscription{}).Where("id = ?", events.subID).
+		Update("grace_until", time.Now().Add(-time.Minute).UTC()).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := ExpireGracePeriods(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := userPlanID(t, user.ID); got != granted.ID {
+		t.Fatalf("plan after grace period: got %d, want the admin's %d", got, granted.ID)
+	}
+	events.apply(events.event(clients.BillingEventSubscriptionRenewed))
+	if got := userPlanID(t, user.ID); got != granted.ID {
+		t.Fatalf("plan after renewal: got %d, want the admin's %d", got, granted.ID)
+	}
+
+	// Assigning the default plan hands the plan back to billing
+	if _, err := AssignPlan(user.ID, *database.DefaultPlanID()); err != nil {
+		t.Fatal(err)
+	}
+	if got := userPlanID(t, user.ID); got != paid.ID {
+		t.Fatalf("plan after resetting to default: got %d, want the paid %d", got, paid.ID)
+	}
+	events.apply(events.event(clients.BillingEventSubscriptionCancelled))
+	if got := userPlanID(t, user.ID); got != *database.DefaultPlanID() {
+		t.Fatalf("plan after cancelling: got %d, want the default plan", got)
+	}
+}
+
+func TestStartCheckoutRejectsIncompleteSubscription(t *testing.T) {
+	fake := useFakeBilling(t)
+	user := createTestUser(t)
+	basic, pro := createTestPlan(t, 5), createTestPlan(t, 10)
+	events := newBillingEvents(t, user, basic)
+	events.apply(events.event(clients.BillingEventSubscriptionCreated))
+
+	if _, err := StartCheckout(context.Background(), user.ID, user.Email, pro.ID); !errors.Is(err, ErrCheckoutPending) {
+		t.Fatalf("checkout with an incomplete subscription: got %v, want ErrCheckoutPending", err)
+	}
+	// Unpaid subscriptions expire, so they stop blocking checkouts after a while
+	if err := database.DB().Model(&database.Subscription{}).Where("id = ?", events.subID).
+		Update("created_at", time.Now().Add(-incompleteSubscriptionTTL-time.Minute).UTC()).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := StartCheckout(context.Background(), user.ID, user.Email, pro.ID); err != nil {
+		t.Fatalf("checkout after the incomplete subscription expired: %v", err)
+	}
+	if len(fake.sessions) != 1 {
+		t.Fatalf("got %d checkout sessions, want 1", len(fake.sessions))
+	}
+}
@@ -0,0 +1,185 @@
+package services
+
+import (
+	"expvar"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	goccy "github.com/goccy/go-json"
+	echolog "github.com/labstack/gommon/log"
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/config"
+	"github.com/sharify-labs/spine/database"
+)
+
+// catalogSnapshot is a copy of the enabled domains in the catalog.
+type catalogSnapshot struct {
+	Domains   []*database.Domain `json:"domains"`
+	FetchedAt time.Time          `json:"fetched_at"`
+}
+
+// catalog holds the last good snapshot of the domain catalog.
+// Reads are always served from the snapshot, even when it's stale, so that the dashboard and host creation
+// keep working while the database is slow or unavailable. Stale snapshots are refreshed in the background,
+// and concurrent refreshes are coalesced into one database query.
+// The catalog lives in the database rather than a gist, so there is no upstream response to revalidate with
+// If-None-Match; the ETag is served to clients instead (see handlers.ListAvailableDomains).
+var catalog struct {
+	mu       sync.Mutex
+	snapshot *catalogSnapshot
+	loading  chan struct{} // non-nil while a refresh is in flight, closed when it finishes
+	loadErr  error         // error of the last refresh
+	alerted  bool          // whether the staleness alert was sent for the current snapshot
+}
+
+// listCatalogDomains loads the catalog. Replaced in tests to control when refreshes finish.
+var listCatalogDomains = database.ListEnabledDomains
+
+// catalogMetrics are published with expvar as "catalog": the age of the snapshot in seconds (-1 until there is one),
+// whether it is older than DOMAIN_CATALOG_MAX_AGE, and how many refreshes succeeded and failed.
+var catalogMetrics = func() *expvar.Map {
+	m := expvar.NewMap("catalog")
+	m.Set("age_seconds", expvar.Func(func() any {
+		age, ok := catalogAge()
+		if !ok {
+			return int64(-1)
+		}
+		return int64(age / time.Second)
+	}))
+	m.Set("stale", expvar.Func(func() any {
+		age, ok := catalogAge()
+		return ok && age > config.GetOrDefault("DOMAIN_CATALOG_MAX_AGE", time.Hour)
+	}))
+	return m
+}()
+
+// catalogAge returns how old the snapshot is, or false if there is no snapshot yet.
+func catalogAge() (time.Duration, bool) {
+	catalog.mu.Lock()
+	defer catalog.mu.Unlock()
+	if catalog.snapshot == nil {
+		return 0, false
+	}
+	return time.Since(catalog.snapshot.FetchedAt), true
+}
+
+// getCatalog returns the enabled catalog domains.
+// Only blocks if there is no snapshot yet (ex: right after startup).
+func getCatalog() ([]*database.Domain, error) {
+	catalog.mu.Lock()
+	snapshot := catalog.snapshot
+	if snapshot != nil && time.Since(snapshot.FetchedAt) < config.GetOrDefault("DOMAIN_CATALOG_TTL", 5*time.Minute) {
+		catalog.mu.Unlock()
+		return snapshot.Domains, nil
+	}
+	wait := refreshCatalogLocked()
+	catalog.mu.Unlock()
+
+	if snapshot != nil {
+		return snapshot.Domains, nil // stale-while-revalidate
+	}
+	<-wait
+	catalog.mu.Lock()
+	defer catalog.mu.Unlock()
+	if catalog.snapshot == nil {
+		return nil, catalog.loadErr
+	}
+	return catalog.snapshot.Domains, nil
+}
+
+// RefreshCatalog reloads the domain catalog snapshot and waits for it to finish.
+// Should be called after the catalog is modified so that changes show up immediately.
+func RefreshCatalog() error {
+	catalog.mu.Lock()
+	wait := refreshCatalogLocked()
+	catalog.mu.Unlock()
+	<-wait
+	catalog.mu.Lock()
+	defer catalog.mu.Unlock()
+	return catalog.loadErr
+}
+
+// refreshCatalogLocked starts a refresh unless one is already in flight and returns a channel
+// that is closed once it finishes. catalog.mu must be held.
+func refreshCatalogLocked() <-chan struct{} {
+	if catalog.loading != nil {
+		return catalog.loading
+	}
+	done := make(chan struct{})
+	catalog.loading = done
+	go func() {
+		domains, err := listCatalogDomains()
+
+		catalog.mu.Lock()
+		defer catalog.mu.Unlock()
+		defer close(done)
+		catalog.loading = nil
+		catalog.loadErr = err
+		if err == nil {
+			catalogMetrics.Add("refreshes", 1)
+			catalog.snapshot = &catalogSnapshot{Domains: domains, FetchedAt: time.Now()}
+			catalog.alerted = false
+			persistCatalogLocked()
+			return
+		}
+
+		catalogMetrics.Add("refresh_failures", 1)
+		clients.Sentry.Capture(fmt.Errorf("failed to refresh domain catalog: %w", err))
+		if catalog.snapshot == nil {
+			catalog.snapshot = loadPersistedCatalog()
+		}
+		alertStaleCatalogLocked()
+	}()
+	return done
+}
+
+// alertStaleCatalogLocked reports (once per snapshot) when the snapshot is older than DOMAIN_CATALOG_MAX_AGE.
+// catalog.mu must be held.
+func alertStaleCatalogLocked() {
+	if catalog.snapshot == nil || catalog.alerted {
+		return
+	}
+	age := time.Since(catalog.snapshot.FetchedAt)
+	if age > config.GetOrDefault("DOMAIN_CATALOG_MAX_AGE", time.Hour) {
+		catalog.alerted = true
+		clients.Sentry.Capture(fmt.Errorf("domain catalog is stale: last refreshed %s ago", age.Round(time.Second)))
+	}
+}
+
+// persistCatalogLocked writes the snapshot to DOMAIN_CATALOG_SNAPSHOT (if set) so that it survives restarts.
+// catalog.mu must be held.
+func persistCatalogLocked() {
+	path := config.GetOrDefault("DOMAIN_CATALOG_SNAPSHOT", "")
+	if path == "" {
+		return
+	}
+	data, err := goccy.Marshal(catalog.snapshot)
+	if err == nil {
+		err = os.WriteFile(path, data, 0o600)
+	}
+	if err != nil {
+		echolog.Errorf("unable to persist domain catalog snapshot: %v", err)
+	}
+}
+
+// loadPersistedCatalog reads the snapshot written by persistCatalogLocked. Returns nil if there isn't one.
+func loadPersistedCatalog() *catalogSnapshot {
+	path := config.GetOrDefault("DOMAIN_CATALOG_SNAPSHOT", "")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		echolog.Warnf("unable to read domain catalog snapshot: %v", err)
+		return nil
+	}
+	var snapshot catalogSnapshot
+	if err = goccy.Unmarshal(data, &snapshot); err != nil {
+		echolog.Warnf("unable to unmarshal domain catalog snapshot: %v", err)
+		return nil
+	}
+	echolog.Warnf("Serving domain catalog snapshot from %s", snapshot.FetchedAt)
+	return &snapshot
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sharify-labs/spine/database"
+)
+
+// fakeCatalogLoader replaces the catalog loader. Loads block until release is closed, then return domains and err.
+type fakeCatalogLoader struct {
+	calls   atomic.Int64
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+	domains []*database.Domain
+	err     error
+}
+
+// finish lets blocked and future loads return.
+func (f *fakeCatalogLoader) finish() {
+	f.once.Do(func() { close(f.release) })
+}
+
+// useFakeCatalogLoader replaces the catalog snapshot with snapshot (nil for none) and loads it with a fake loader.
+// The real catalog is reloaded once the test is done.
+func useFakeCatalogLoader(
+	t *testing.T, snapshot *catalogSnapshot, domains []*database.Domain, loadErr error,
+) *fakeCatalogLoader {
+	t.Helper()
+	if err := RefreshCatalog(); err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeCatalogLoader{
+		started: make(chan struct{}, 100),
+		release: make(chan struct{}),
+		domains: domains,
+		err:     loadErr,
+	}
+	catalog.mu.Lock()
+	catalog.snapshot = snapshot
+	catalog.alerted = true
+	catalog.mu.Unlock()
+	listCatalogDomains = func() ([]*database.Domain, error) {
+		fake.calls.Add(1)
+		fake.started <- struct{}{}
+		<-fake.release
+		return fake.domains, fake.err
+	}
+	t.Cleanup(func() {
+		fake.finish()
+		if wait := inFlightRefresh(); wait != nil {
+			<-wait
+		}
+		listCatalogDomains = database.ListEnabledDomains
+		if err := RefreshCatalog(); err != nil {
+			t.Error(err)
+		}
+	})
+	return fake
+}
+
+// inFlightRefresh returns the channel closed when the running refresh finishes, or nil if there is none.
+func inFlightRefresh() <-chan struct{} {
+	catalog.mu.Lock()
+	defer catalog.mu.Unlock()
+	return catalog.loading
+}
+
+// catalogMetric returns the current value of a "catalog" metric.
+func catalogMetric(name string) any {
+	switch v := catalogMetrics.Get(name).(type) {
+	case expvar.Func:
+		return v.Value()
+	case *expvar.Int:
+		return v.Value()
+	}
+	return int64(0)
+}
+
+// getCatalogConcurrently calls getCatalog from n goroutines and returns the root of the first domain each one got.
+// Fails the test if they don't all return within a few seconds.
+func getCatalogConcurrently(t *testing.T, n int) []string {
+	t.Helper()
+	roots := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range roots {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			domains, err := getCatalog()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(domains) > 0 {
+				roots[i] = domains[0].Name
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("getCatalog blocked")
+	}
+	return roots
+}
+
+func TestGetCatalogServesStaleSnapshotWhileRefreshing(t *testing.T) {
+	stale := &catalogSnapshot{
+		Domains:   []*database.Domain{{Name: "stale.example", Enabled: true}},
+		FetchedAt: time.Now().Add(-2 * time.Hour),
+	}
+	fake := useFakeCatalogLoader(t, stale, []*database.Domain{{Name: "fresh.example", Enabled: true}}, nil)
+	refreshes := catalogMetric("refreshes").(int64)
+
+	// The refresh is blocked, so every caller must be served the stale snapshot without waiting for it
+	for _, root := range getCatalogConcurrently(t, 10) {
+		if root != "stale.example" {
+			t.Fatalf("getCatalog returned %q while refreshing, want stale.example", root)
+		}
+	}
+	if stale, _ := catalogMetric("stale").(bool); !stale {
+		t.Error("catalog[stale] = false for a 2h old snapshot")
+	}
+	if age, _ := catalogMetric("age_seconds").(int64); age < 7200 {
+		t.Errorf("catalog[age_seconds] = %d, want at least 7200", age)
+	}
+
+	wait := inFlightRefresh()
+	if wait == nil {
+		t.Fatal("no refresh in flight")
+	}
+	fake.finish()
+	<-wait
+	if calls := fake.calls.Load(); calls != 1 {
+		t.Fatalf("catalog was loaded %d times, want 1", calls)
+	}
+	if roots := getCatalogConcurrently(t, 1); roots[0] != "fresh.example" {
+		t.Fatalf("getCatalog returned %q after refreshing, want fresh.example", roots[0])
+	}
+	if stale, _ := catalogMetric("stale").(bool); stale {
+		t.Error("catalog[stale] = true after refreshing")
+	}
+	if got := catalogMetric("refreshes").(int64); got != refreshes+1 {
+		t.Errorf("catalog[refreshes] = %d, want %d", got, refreshes+1)
+	}
+}
+
+func TestGetCatalogCoalescesInitialLoad(t *testing.T) {
+	fake := useFakeCatalogLoader(t, nil, []*database.Domain{{Name: "fresh.example", Enabled: true}}, nil)
+	if age := catalogMetric("age_seconds"); age != int64(-1) {
+		t.Errorf("catalog[age_seconds] = %v without a snapshot, want -1", age)
+	}
+
+	// Callers block until the first load finishes. Those arriving later find the fresh snapshot, so either way
+	// the catalog is only loaded once.
+	go func() {
+		<-fake.started
+		fake.finish()
+	}()
+	for _, root := range getCatalogConcurrently(t, 10) {
+		if root != "fresh.example" {
+			t.Fatalf("getCatalog returned %q, want fresh.example", root)
+		}
+	}
+	if calls := fake.calls.Load(); calls != 1 {
+		t.Fatalf("catalog was loaded %d times, want 1", calls)
+	}
+}
+
+func TestRefreshCatalogFailureKeepsStaleSnapshot(t *testing.T) {
+	stale := &catalogSnapshot{
+		Domains:   []*database.Domain{{Name: "stale.example", Enabled: true}},
+		FetchedAt: time.Now().Add(-2 * time.Hour),
+	}
+	loadErr := errors.New("database unavailable")
+	fake := useFakeCatalogLoader(t, stale, nil, loadErr)
+	fake.finish()
+	failures := catalogMetric("refresh_failures").(int64)
+
+	if err := RefreshCatalog(); !errors.Is(err, loadErr) {
+		t.Fatalf("RefreshCatalog() = %v, want %v", err, loadErr)
+	}
+	if got := catalogMetric("refresh_failures").(int64); got != failures+1 {
+		t.Errorf("catalog[refresh_failures] = %d, want %d", got, failures+1)
+	}
+	if stale, _ := catalogMetric("stale").(bool); !stale {
+		t.Error("catalog[stale] = false after a failed refresh")
+	}
+	if roots := getCatalogConcurrently(t, 1); roots[0] != "stale.example" {
+		t.Fatalf("getCatalog returned %q after a failed refresh, want stale.example", roots[0])
+	}
+}
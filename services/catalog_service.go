@@ -0,0 +1,314 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+
+	goccy "github.com/goccy/go-json"
+	echolog "github.com/labstack/gommon/log"
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/config"
+	"github.com/sharify-labs/spine/database"
+	"github.com/sharify-labs/spine/validators"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRootUnavailable      = errors.New("root domain is not available")
+	ErrWildcardNotAllowed   = errors.New("subdomains are not allowed on this root domain")
+	ErrMultiLevelNotAllowed = errors.New("multi-level subdomains are not allowed on this root domain")
+	ErrDomainHostLimit      = errors.New("you have reached the host limit of this root domain")
+)
+
+// AvailableDomain is a root domain a User can create hosts under.
+// DisplayName: The Unicode form of Name (same as Name for ASCII domains).
+// Custom is true for the User's own verified custom domains.
+// ContributedBy: The username of the User who contributed the domain, if it was contributed.
+// RequiresApproval is true if new hosts must be approved by the contributor (see RequestHost).
+// Locked is true if the domain requires a more expensive plan than the User's, named by RequiredPlan.
+type AvailableDomain struct {
+	Name              string `json:"name"`
+	DisplayName       string `json:"display_name"`
+	Description       string `json:"description"`
+	WildcardAllowed   bool   `json:"wildcard_allowed"`
+	MultiLevelAllowed bool   `json:"multi_level_allowed"`
+	NSFW              bool   `json:"nsfw"`
+	Custom            bool   `json:"custom"`
+	ContributedBy     string `json:"contributed_by,omitempty"`
+	RequiresApproval  bool   `json:"requires_approval"`
+	Locked            bool   `json:"locked"`
+	RequiredPlan      string `json:"required_plan,omitempty"`
+}
+
+// ListAvailableDomains returns the catalog domains available to a user followed by their verified custom domains.
+// Catalog domains that require a more expensive plan are included but locked.
+func ListAvailableDomains(userID string) ([]*AvailableDomain, error) {
+	domains, err := getCatalog()
+	if err != nil {
+		return nil, err
+	}
+	custom, err := GetVerifiedCustomDomains(userID)
+	if err != nil {
+		return nil, err
+	}
+	contributors, err := contributorNames(domains)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := lockedDomains(userID, domains)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*AvailableDomain, 0, len(domains)+len(custom))
+	for _, d := range domains {
+		if !isDomainAvailableTo(d, userID) {
+			continue
+		}
+		available := &AvailableDomain{
+			Name:              d.Name,
+			DisplayName:       validators.ToUnicode(d.Name),
+			Description:       d.Description,
+			WildcardAllowed:   d.WildcardAllowed,
+			MultiLevelAllowed: d.MultiLevelAllowed,
+			NSFW:              d.NSFW,
+			RequiresApproval:  requiresHostApproval(d, userID),
+		}
+		if d.ContributorID != nil {
+			available.ContributedBy = contributors[*d.ContributorID]
+		}
+		if plan, ok := locked[d.Name]; ok {
+			available.Locked, available.RequiredPlan = true, plan
+		}
+		res = append(res, available)
+	}
+	for _, name := range custom {
+		res = append(res, &AvailableDomain{
+			Name:              name,
+			DisplayName:       validators.ToUnicode(name),
+			WildcardAllowed:   true,
+			MultiLevelAllowed: true,
+			Custom:            true,
+		})
+	}
+	return res, nil
+}
+
+// contributorNames returns the usernames of the contributors of the given domains, keyed by User.ID.
+func contributorNames(domains []*database.Domain) (map[string]string, error) {
+	var ids []string
+	for _, d := range domains {
+		if d.ContributorID != nil {
+			ids = append(ids, *d.ContributorID)
+		}
+	}
+	res := make(map[string]string, len(ids))
+	if len(ids) == 0 {
+		return res, nil
+	}
+	var users []*database.User
+	if err := database.DB().Select("id", "username").Where("id IN ?", ids).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		res[u.ID] = u.Username
+	}
+	return res, nil
+}
+
+// CheckHostAllowed returns an error if the user can't create a host with the given sub under root.
+// The root must be an enabled catalog domain available to the user (that allows subdomains if sub is set, and
+// multi-level subdomains if sub has multiple labels), or one of the user's verified custom domains.
+// Subdomains on catalog domains must also pass the subdomain policy (see CheckSubdomainPolicy), and users
+// must be below the domain's per-user host limit, if any. Returns a PlanRequiredError if the domain requires a more
+// expensive plan than the user's.
+func CheckHostAllowed(userID, sub, root string) error {
+	return checkHostAllowed(userID, sub, root, func() (*database.Plan, error) {
+		return database.GetUserPlan(userID)
+	})
+}
+
+// CheckTeamHostAllowed is CheckHostAllowed for team hosts created by userID: premium roots are checked against the
+// team's plan rather than the user's.
+func CheckTeamHostAllowed(teamID uint, userID, sub, root string) error {
+	return checkHostAllowed(userID, sub, root, func() (*database.Plan, error) {
+		return database.GetTeamPlan(teamID)
+	})
+}
+
+// checkHostAllowed implements CheckHostAllowed, using ownerPlan to get the plan that premium roots are checked against.
+func checkHostAllowed(userID, sub, root string, ownerPlan func() (*database.Plan, error)) error {
+	domains, err := getCatalog()
+	if err != nil {
+		return err
+	}
+	for _, d := range domains {
+		if d.Name != root {
+			continue
+		}
+		if !isDomainAvailableTo(d, userID) {
+			return ErrRootUnavailable
+		}
+		if err = checkRootPlan(database.DB(), d, ownerPlan); err != nil {
+			return err
+		}
+		if sub != "" && !d.WildcardAllowed {
+			return ErrWildcardNotAllowed
+		}
+		if strings.Contains(sub, ".") && !d.MultiLevelAllowed {
+			return ErrMultiLevelNotAllowed
+		}
+		if err = checkDomainHostLimit(database.DB(), userID, d); err != nil {
+			return err
+		}
+		return CheckSubdomainPolicy(userID, sub, d)
+	}
+
+	custom, err := GetVerifiedCustomDomains(userID)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(custom, root) {
+		return nil
+	}
+	return ErrRootUnavailable
+}
+
+// AllowsMultiLevel reports whether hosts under root may have multi-level subdomains for the user.
+// This is the case for catalog domains that allow it and the user's verified custom domains.
+func AllowsMultiLevel(userID, root string) (bool, error) {
+	domains, err := getCatalog()
+	if err != nil {
+		return false, err
+	}
+	for _, d := range domains {
+		if d.Name == root {
+			return d.MultiLevelAllowed, nil
+		}
+	}
+	custom, err := GetVerifiedCustomDomains(userID)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(custom, root), nil
+}
+
+// checkDomainHostLimit returns ErrDomainHostLimit if the user already has MaxHostsPerUser hosts on the domain.
+// Contributors aren't limited on their own domains.
+func checkDomainHostLimit(tx *gorm.DB, userID string, d *database.Domain) error {
+	if d.MaxHostsPerUser <= 0 || isContributor(d, userID) {
+		return nil
+	}
+	var count int64
+	if err := tx.Model(&database.Host{}).Where(&database.Host{
+		UserID: userID,
+		Root:   d.Name,
+	}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count >= int64(d.MaxHostsPerUser) {
+		return ErrDomainHostLimit
+	}
+	return nil
+}
+
+// checkTransferRoot checks that the recipient of a transferred host could register a host on root themselves, like
+// CheckHostAllowed: catalog domains must be available to them, allowed by their plan, not require the contributor's
+// approval and be under their MaxHostsPerUser, and any other root must be one of their verified custom domains.
+// Everything is read as part of tx, so the checks still hold when the transfer is accepted.
+func checkTransferRoot(tx *gorm.DB, userID, root string) error {
+	var d database.Domain
+	err := tx.Where("name = ? AND enabled = ?", root, true).First(&d).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		var verified int64
+		if err = tx.Model(&database.CustomDomain{}).Where(&database.CustomDomain{
+			UserID: userID,
+			Name:   root,
+			Status: DomainVerified,
+		}).Count(&verified).Error; err != nil {
+			return err
+		}
+		if verified == 0 {
+			return ErrRootUnavailable
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !isDomainAvailableTo(&d, userID) {
+		return ErrRootUnavailable
+	}
+	if err = checkRootPlan(tx, &d, func() (*database.Plan, error) {
+		return getUserPlan(tx, userID)
+	}); err != nil {
+		return err
+	}
+	if requiresHostApproval(&d, userID) {
+		return ErrHostApprovalRequired
+	}
+	return checkDomainHostLimit(tx, userID, &d)
+}
+
+// isContributor reports whether the user contributed the domain.
+func isContributor(d *database.Domain, userID string) bool {
+	return d.ContributorID != nil && *d.ContributorID == userID
+}
+
+// requiresHostApproval reports whether the user's hosts on the domain must be approved by its contributor.
+func requiresHostApproval(d *database.Domain, userID string) bool {
+	return d.RequireHostApproval && d.ContributorID != nil && !isContributor(d, userID)
+}
+
+// isDomainAvailableTo reports whether a user can use an enabled catalog domain: it must be public or theirs.
+func isDomainAvailableTo(d *database.Domain, userID string) bool {
+	return d.Public || (d.OwnerID != nil && *d.OwnerID == userID)
+}
+
+// legacyDomainMetadata is the optional metadata of a domain in the legacy gist format.
+type legacyDomainMetadata struct {
+	Description string `json:"description"`
+	NSFW        bool   `json:"nsfw"`
+	Public      *bool  `json:"public"`
+	Wildcard    *bool  `json:"wildcard"`
+}
+
+// ImportDomainCatalog imports the domain list at DOMAINS_IMPORT_URL (legacy gist format) into the catalog.
+// This only happens once: the import is skipped if DOMAINS_IMPORT_URL isn't set or the catalog isn't empty.
+// Imported domains are public, enabled and allow subdomains unless their metadata says otherwise.
+func ImportDomainCatalog(ctx context.Context) error {
+	listURL := config.GetOrDefault("DOMAINS_IMPORT_URL", "")
+	if listURL == "" {
+		return nil
+	}
+	if count, err := database.CountDomains(); err != nil || count > 0 {
+		return err
+	}
+
+	list, err := clients.HTTP.FetchDomainList(ctx, listURL)
+	if err != nil {
+		return err
+	}
+	domains := make([]*database.Domain, 0, len(list))
+	for name, raw := range list {
+		var meta legacyDomainMetadata
+		_ = goccy.Unmarshal(raw, &meta) // metadata is optional and may be any JSON value
+		domains = append(domains, &database.Domain{
+			Name:            name,
+			Description:     meta.Description,
+			Public:          meta.Public == nil || *meta.Public,
+			WildcardAllowed: meta.Wildcard == nil || *meta.Wildcard,
+			NSFW:            meta.NSFW,
+			Enabled:         true,
+		})
+	}
+	if err = database.ImportDomains(domains); err != nil {
+		return err
+	}
+	if err = RefreshCatalog(); err != nil {
+		return err
+	}
+	echolog.Infof("Imported %d domains into the catalog from %s", len(domains), listURL)
+	return nil
+}
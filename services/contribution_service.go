@@ -0,0 +1,510 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sharify-labs/spine/database"
+	"gorm.io/gorm"
+)
+
+// Domain submission statuses (see database.DomainSubmission).
+const (
+	SubmissionPending   = "pending"
+	SubmissionApproved  = "approved"
+	SubmissionRejected  = "rejected"
+	SubmissionWithdrawn = "withdrawn"
+)
+
+// Host request statuses (see database.HostRequest).
+const (
+	HostRequestPending  = "pending"
+	HostRequestApproved = "approved"
+	HostRequestRejected = "rejected"
+)
+
+// maxDomainDescriptionLength is the maximum length (in characters) of a submitted domain's description.
+const maxDomainDescriptionLength = 200
+
+var (
+	ErrDescriptionTooLong   = errors.New("description must be at most 200 characters")
+	ErrSubmissionNotFound   = errors.New("domain submission not found")
+	ErrSubmissionPending    = errors.New("domain already has a pending submission")
+	ErrDomainNotVerified    = errors.New("only your verified custom domains can be submitted")
+	ErrDomainInCatalog      = errors.New("domain is already a shared domain")
+	ErrContributionNotFound = errors.New("contributed domain not found")
+	ErrInvalidHostLimit     = errors.New("host limit must not be negative")
+	ErrHostRequestNotFound  = errors.New("host request not found")
+	ErrHostRequestPending   = errors.New("you already requested this host")
+	ErrHostApprovalRequired = errors.New("hosts on this root domain must be requested from its contributor")
+)
+
+// DomainSubmission describes a User's offer of one of their custom domains to the catalog.
+type DomainSubmission struct {
+	ID          uint       `json:"id"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Public      bool       `json:"public"`
+	NSFW        bool       `json:"nsfw"`
+	UserID      string     `json:"user_id"`
+	Status      string     `json:"status"`
+	ReviewNote  string     `json:"review_note,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ReviewedAt  *time.Time `json:"reviewed_at,omitempty"`
+}
+
+func newDomainSubmission(s *database.DomainSubmission) *DomainSubmission {
+	return &DomainSubmission{
+		ID:          s.ID,
+		Name:        s.Name,
+		Description: s.Description,
+		Public:      s.Public,
+		NSFW:        s.NSFW,
+		UserID:      s.UserID,
+		Status:      s.Status,
+		ReviewNote:  s.ReviewNote,
+		CreatedAt:   s.CreatedAt,
+		ReviewedAt:  s.ReviewedAt,
+	}
+}
+
+// ContributedDomain describes a catalog domain contributed by a User and how they limit registrations on it.
+// Hosts: The number of hosts on the domain. PendingRequests: The number of host requests awaiting approval.
+type ContributedDomain struct {
+	Name                string `json:"name"`
+	Public              bool   `json:"public"`
+	Enabled             bool   `json:"enabled"`
+	RequireHostApproval bool   `json:"require_host_approval"`
+	MaxHostsPerUser     int    `json:"max_hosts_per_user"`
+	Hosts               int64  `json:"hosts"`
+	PendingRequests     int64  `json:"pending_requests"`
+}
+
+// HostRequest describes a request to register a host on a contributed domain that requires approval.
+// Incoming is true if the User viewing it is the domain's contributor.
+type HostRequest struct {
+	ID         uint       `json:"id"`
+	Hostname   string     `json:"hostname"`
+	UserID     string     `json:"user_id"`
+	Username   string     `json:"username"`
+	Status     string     `json:"status"`
+	Incoming   bool       `json:"incoming"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+func newHostRequest(r *database.HostRequest, userID string) *HostRequest {
+	return &HostRequest{
+		ID:         r.ID,
+		Hostname:   JoinHostname(r.Sub, r.Root),
+		UserID:     r.UserID,
+		Username:   r.User.Username,
+		Status:     r.Status,
+		Incoming:   r.UserID != userID,
+		CreatedAt:  r.CreatedAt,
+		ResolvedAt: r.ResolvedAt,
+	}
+}
+
+// ListDomainSubmissions returns the user's domain submissions, newest first.
+func ListDomainSubmissions(userID string) ([]*DomainSubmission, error) {
+	return findDomainSubmissions(database.DB().Where(&database.DomainSubmission{UserID: userID}).Order("id DESC"))
+}
+
+// ListDomainSubmissionsByStatus returns every domain submission with the given status, oldest first.
+func ListDomainSubmissionsByStatus(status string) ([]*DomainSubmission, error) {
+	return findDomainSubmissions(database.DB().Where(&database.DomainSubmission{Status: status}).Order("id"))
+}
+
+func findDomainSubmissions(q *gorm.DB) ([]*DomainSubmission, error) {
+	var submissions []*database.DomainSubmission
+	if err := q.Find(&submissions).Error; err != nil {
+		return nil, err
+	}
+	res := make([]*DomainSubmission, 0, len(submissions))
+	for _, s := range submissions {
+		res = append(res, newDomainSubmission(s))
+	}
+	return res, nil
+}
+
+// SubmitDomain offers one of the user's verified custom domains to the catalog, pending admin approval.
+// Public domains can be used by everyone once approved; private ones only by the contributor.
+func SubmitDomain(userID, name, description string, public, nsfw bool) (*DomainSubmission, error) {
+	if utf8.RuneCountInString(description) > maxDomainDescriptionLength {
+		return nil, ErrDescriptionTooLong
+	}
+	submission := &database.DomainSubmission{
+		Name:        name,
+		Description: description,
+		Public:      public,
+		NSFW:        nsfw,
+		UserID:      userID,
+		Status:      SubmissionPending,
+	}
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		if err := checkSubmittable(tx, userID, name); err != nil {
+			return err
+		}
+		var pending int64
+		if err := tx.Model(&database.DomainSubmission{}).Where(&database.DomainSubmission{
+			Name:   name,
+			Status: SubmissionPending,
+		}).Count(&pending).Error; err != nil {
+			return err
+		}
+		if pending > 0 {
+			return ErrSubmissionPending
+		}
+		if err := tx.Omit("User").Create(submission).Error; err != nil {
+			return err
+		}
+		return recordAuditEvent(tx, AuditDomainSubmitted, name, userID, userID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newDomainSubmission(submission), nil
+}
+
+// checkSubmittable returns an error unless the domain is one of the user's verified custom domains and isn't
+// in the catalog yet.
+func checkSubmittable(tx *gorm.DB, userID, name string) error {
+	var verified int64
+	if err := tx.Model(&database.CustomDomain{}).Where(&database.CustomDomain{
+		Name:   name,
+		UserID: userID,
+		Status: DomainVerified,
+	}).Count(&verified).Error; err != nil {
+		return err
+	}
+	if verified == 0 {
+		return ErrDomainNotVerified
+	}
+	var inCatalog int64
+	if err := tx.Unscoped().Model(&database.Domain{}).Where(&database.Domain{
+		Name: name,
+	}).Count(&inCatalog).Error; err != nil {
+		return err
+	}
+	if inCatalog > 0 {
+		return ErrDomainInCatalog
+	}
+	return nil
+}
+
+// WithdrawSubmission cancels one of the user's pending domain submissions.
+func WithdrawSubmission(userID string, id uint) (*DomainSubmission, error) {
+	return resolveSubmission(id, SubmissionWithdrawn, "", func(s *database.DomainSubmission) bool {
+		return s.UserID == userID
+	}, nil, userID, AuditDomainWithdrawn)
+}
+
+// ApproveSubmission adds a pending submission's domain to the catalog with the submitter as its contributor
+// (and owner, so that they can keep using it if it's private). Admin only.
+// The contributor's custom domain is replaced by the catalog domain; their hosts on it are kept.
+// Subdomains are allowed by default. Admins can change the rest with UpdateDomain.
+func ApproveSubmission(adminID string, id uint) (*DomainSubmission, error) {
+	submission, err := resolveSubmission(id, SubmissionApproved, "", nil, func(tx *gorm.DB, s *database.DomainSubmission) error {
+		if err := checkSubmittable(tx, s.UserID, s.Name); err != nil {
+			return err
+		}
+		if err := tx.Create(&database.Domain{
+			Name:            s.Name,
+			Description:     s.Description,
+			Public:          s.Public,
+			WildcardAllowed: true,
+			NSFW:            s.NSFW,
+			Enabled:         true,
+			OwnerID:         &s.UserID,
+			ContributorID:   &s.UserID,
+		}).Error; err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				return ErrDomainInCatalog
+			}
+			return err
+		}
+		return tx.Unscoped().Where(&database.CustomDomain{
+			Name:   s.Name,
+			UserID: s.UserID,
+		}).Delete(&database.CustomDomain{}).Error
+	}, adminID, AuditDomainApproved)
+	if err != nil {
+		return nil, err
+	}
+	return submission, RefreshCatalog()
+}
+
+// RejectSubmission declines a pending domain submission with an optional note for the submitter. Admin only.
+func RejectSubmission(adminID string, id uint, note string) (*DomainSubmission, error) {
+	return resolveSubmission(id, SubmissionRejected, note, nil, nil, adminID, AuditDomainRejected)
+}
+
+// resolveSubmission moves a pending submission to status, like resolveTransfer does for transfers.
+// allowed restricts which submissions the actor may resolve (nil allows all), and apply is run in the same
+// transaction, if set. The submitter gets an audit event for action.
+func resolveSubmission(
+	id uint,
+	status, note string,
+	allowed func(s *database.DomainSubmission) bool,
+	apply func(tx *gorm.DB, s *database.DomainSubmission) error,
+	actorID, action string,
+) (*DomainSubmission, error) {
+	var submission database.DomainSubmission
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&submission, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrSubmissionNotFound
+			}
+			return err
+		}
+		if submission.Status != SubmissionPending || (allowed != nil && !allowed(&submission)) {
+			return ErrSubmissionNotFound
+		}
+
+		now := time.Now().UTC()
+		res := tx.Model(&database.DomainSubmission{}).
+			Where("id = ? AND status = ?", submission.ID, SubmissionPending).
+			Updates(map[string]interface{}{"status": status, "review_note": note, "reviewed_at": now})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrSubmissionNotFound
+		}
+		submission.Status, submission.ReviewNote, submission.ReviewedAt = status, note, &now
+
+		if apply != nil {
+			if err := apply(tx, &submission); err != nil {
+				return err
+			}
+		}
+		return recordAuditEvent(tx, action, submission.Name, actorID, submission.UserID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newDomainSubmission(&submission), nil
+}
+
+// ListContributedDomains returns the catalog domains contributed by the user, including disabled ones.
+func ListContributedDomains(userID string) ([]*ContributedDomain, error) {
+	var domains []*database.Domain
+	if err := database.DB().Where(&database.Domain{
+		ContributorID: &userID,
+	}).Order("name").Find(&domains).Error; err != nil {
+		return nil, err
+	}
+	res := make([]*ContributedDomain, 0, len(domains))
+	for _, d := range domains {
+		contributed := &ContributedDomain{
+			Name:                d.Name,
+			Public:              d.Public,
+			Enabled:             d.Enabled,
+			RequireHostApproval: d.RequireHostApproval,
+			MaxHostsPerUser:     d.MaxHostsPerUser,
+		}
+		if err := database.DB().Model(&database.Host{}).Where(&database.Host{
+			Root: d.Name,
+		}).Count(&contributed.Hosts).Error; err != nil {
+			return nil, err
+		}
+		if err := database.DB().Model(&database.HostRequest{}).Where(&database.HostRequest{
+			Root:   d.Name,
+			Status: HostRequestPending,
+		}).Count(&contributed.PendingRequests).Error; err != nil {
+			return nil, err
+		}
+		res = append(res, contributed)
+	}
+	return res, nil
+}
+
+// UpdateContributedDomain changes whether new hosts on one of the user's contributed domains need their approval,
+// and how many hosts each user may have on it (0 = unlimited). Existing hosts are kept.
+func UpdateContributedDomain(userID, name string, requireApproval bool, maxHostsPerUser int) error {
+	if maxHostsPerUser < 0 {
+		return ErrInvalidHostLimit
+	}
+	res := database.DB().Model(&database.Domain{}).Where(&database.Domain{
+		Name:          name,
+		ContributorID: &userID,
+	}).Updates(map[string]interface{}{
+		"require_host_approval": requireApproval,
+		"max_hosts_per_user":    maxHostsPerUser,
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrContributionNotFound
+	}
+	return RefreshCatalog()
+}
+
+// RequiresHostApproval reports whether the user's hosts on root must be approved by its contributor.
+func RequiresHostApproval(userID, root string) (bool, error) {
+	domains, err := getCatalog()
+	if err != nil {
+		return false, err
+	}
+	for _, d := range domains {
+		if d.Name == root {
+			return requiresHostApproval(d, userID), nil
+		}
+	}
+	return false, nil
+}
+
+// RequestHost asks the contributor of the host's root domain to approve its registration.
+// Assumes the host passed CheckHostAllowed. Returns ErrHostTaken if the hostname is already registered.
+func RequestHost(host *Host) (*HostRequest, error) {
+	request := &database.HostRequest{
+		Sub:    host.Sub,
+		Root:   host.Root,
+		UserID: host.UserID,
+		Status: HostRequestPending,
+	}
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		if taken, err := isHostTaken(tx, host.Sub, host.Root); err != nil {
+			return err
+		} else if taken {
+			return ErrHostTaken
+		}
+		var pending int64
+		if err := tx.Model(&database.HostRequest{}).Where(map[string]interface{}{
+			"sub":     host.Sub,
+			"root":    host.Root,
+			"user_id": host.UserID,
+			"status":  HostRequestPending,
+		}).Count(&pending).Error; err != nil {
+			return err
+		}
+		if pending > 0 {
+			return ErrHostRequestPending
+		}
+		if err := tx.Omit("User").Create(request).Error; err != nil {
+			return err
+		}
+		return recordAuditEvent(tx, AuditHostRequested, host.Full, host.UserID, host.UserID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newHostRequest(request, host.UserID), nil
+}
+
+// ListHostRequests returns the user's pending host requests and the pending requests for hosts on their
+// contributed domains, oldest first.
+func ListHostRequests(userID string) ([]*HostRequest, error) {
+	var requests []*database.HostRequest
+	if err := database.DB().Preload("User").Where("status = ?", HostRequestPending).Where(
+		"user_id = ? OR root IN (?)",
+		userID, database.DB().Model(&database.Domain{}).Select("name").Where(&database.Domain{ContributorID: &userID}),
+	).Order("id").Find(&requests).Error; err != nil {
+		return nil, err
+	}
+	res := make([]*HostRequest, 0, len(requests))
+	for _, r := range requests {
+		res = append(res, newHostRequest(r, userID))
+	}
+	return res, nil
+}
+
+// ApproveHostRequest registers the host of a pending request on one of the user's contributed domains.
+// The requester's plan limits and the domain's rules are checked again, since they may have changed.
+func ApproveHostRequest(ctx context.Context, userID string, id uint) (*HostRequest, error) {
+	request, err := findIncomingHostRequest(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if err = CheckHostAllowed(request.UserID, request.Sub, request.Root); err != nil {
+		return nil, err
+	}
+	host := NewHostFromParts(request.Sub, request.Root, request.UserID)
+	err = resolveHostRequest(request, HostRequestApproved, userID, AuditHostRequestApproved, func(tx *gorm.DB) error {
+		if taken, err := isHostTaken(tx, host.Sub, host.Root); err != nil {
+			return err
+		} else if taken {
+			return ErrHostTaken
+		}
+		if err := checkHostLimit(tx, host.UserID); err != nil {
+			return err
+		}
+		return tx.Create(&database.Host{
+			UserID: host.UserID,
+			Root:   host.Root,
+			Sub:    host.Sub,
+		}).Error
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, ErrHostTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+	InvalidateUsage(request.UserID)
+	host.provisionDNSRecord(ctx)
+	return newHostRequest(request, userID), nil
+}
+
+// RejectHostRequest declines a pending request for a host on one of the user's contributed domains.
+func RejectHostRequest(userID string, id uint) (*HostRequest, error) {
+	request, err := findIncomingHostRequest(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if err = resolveHostRequest(request, HostRequestRejected, userID, AuditHostRequestRejected, nil); err != nil {
+		return nil, err
+	}
+	return newHostRequest(request, userID), nil
+}
+
+// findIncomingHostRequest returns a pending request for a host on one of the user's contributed domains.
+func findIncomingHostRequest(userID string, id uint) (*database.HostRequest, error) {
+	var request database.HostRequest
+	err := database.DB().Preload("User").Where("status = ?", HostRequestPending).Where(
+		"root IN (?)",
+		database.DB().Model(&database.Domain{}).Select("name").Where(&database.Domain{ContributorID: &userID}),
+	).First(&request, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrHostRequestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// resolveHostRequest moves a pending request to status, running apply in the same transaction if set.
+// Both the requester and the contributor get an audit event for action.
+func resolveHostRequest(
+	request *database.HostRequest,
+	status, actorID, action string,
+	apply func(tx *gorm.DB) error,
+) error {
+	return database.DB().Transaction(func(tx *gorm.DB) error {
+		now := time.Now().UTC()
+		res := tx.Model(&database.HostRequest{}).
+			Where("id = ? AND status = ?", request.ID, HostRequestPending).
+			Updates(map[string]interface{}{"status": status, "resolved_at": now})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrHostRequestNotFound
+		}
+		request.Status, request.ResolvedAt = status, &now
+
+		if apply != nil {
+			if err := apply(tx); err != nil {
+				return err
+			}
+		}
+		return recordAuditEvent(
+			tx, action, JoinHostname(request.Sub, request.Root), actorID, request.UserID, actorID,
+		)
+	})
+}
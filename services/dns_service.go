@@ -0,0 +1,61 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/database"
+)
+
+// ReconcileDNS fixes drift between registered hosts and the DNS records managed by the provider.
+// For every root domain with hosts, missing records are created (or corrected) and managed records
+// without a matching host are deleted. Roots that aren't managed by the provider are skipped.
+func ReconcileDNS(ctx context.Context) error {
+	if !clients.DNSRecords.Enabled() {
+		return nil
+	}
+	// Roots of deleted hosts are included so that their orphaned records get cleaned up.
+	var roots []string
+	if err := database.DB().Unscoped().Model(&database.Host{}).Distinct().Pluck("root", &roots).Error; err != nil {
+		return err
+	}
+	var hosts []*database.Host
+	if err := database.DB().Select("sub", "root").Distinct().Find(&hosts).Error; err != nil {
+		return err
+	}
+	wanted := make(map[string]map[string]struct{}, len(roots)) // root -> hostnames
+	for _, root := range roots {
+		wanted[root] = make(map[string]struct{})
+	}
+	for _, h := range hosts {
+		wanted[h.Root][JoinHostname(h.Sub, h.Root)] = struct{}{}
+	}
+
+	var errs []error
+	for root, hostnames := range wanted {
+		if err := reconcileRoot(ctx, root, hostnames); err != nil && !errors.Is(err, clients.ErrZoneNotFound) {
+			errs = append(errs, fmt.Errorf("reconcile %s: %w", root, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func reconcileRoot(ctx context.Context, root string, hostnames map[string]struct{}) error {
+	existing, err := clients.DNSRecords.ListRecords(ctx, root)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, name := range existing {
+		if _, ok := hostnames[name]; !ok {
+			errs = append(errs, clients.DNSRecords.DeleteRecord(ctx, root, name))
+		}
+	}
+	// EnsureRecord is a no-op for records that are already correct, and also fixes drifted content.
+	for name := range hostnames {
+		errs = append(errs, clients.DNSRecords.EnsureRecord(ctx, root, name))
+	}
+	return errors.Join(errs...)
+}
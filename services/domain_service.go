@@ -0,0 +1,240 @@
+package services
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/database"
+	"gorm.io/gorm"
+)
+
+// Custom domain statuses (see database.CustomDomain).
+const (
+	DomainPending  = "pending"
+	DomainVerified = "verified"
+)
+
+// Custom domains are verified by publishing a TXT record:
+// _sharify-verification.example.com TXT "sharify-verification=<token>".
+const (
+	verificationRecordPrefix = "_sharify-verification."
+	verificationValuePrefix  = "sharify-verification="
+)
+
+var (
+	ErrDomainTaken    = errors.New("domain is already verified by another user")
+	ErrDomainNotFound = errors.New("custom domain not found")
+)
+
+// CustomDomain describes a User's custom domain and how to verify it.
+type CustomDomain struct {
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	RecordName  string     `json:"record_name"`
+	RecordValue string     `json:"record_value"`
+	VerifiedAt  *time.Time `json:"verified_at,omitempty"`
+}
+
+func newCustomDomain(d *database.CustomDomain) *CustomDomain {
+	return &CustomDomain{
+		Name:        d.Name,
+		Status:      d.Status,
+		RecordName:  verificationRecordPrefix + d.Name,
+		RecordValue: verificationValuePrefix + d.Token,
+		VerifiedAt:  d.VerifiedAt,
+	}
+}
+
+// ListCustomDomains returns all custom domains added by a user.
+func ListCustomDomains(userID string) ([]*CustomDomain, error) {
+	var domains []*database.CustomDomain
+	if err := database.DB().Where(&database.CustomDomain{
+		UserID: userID,
+	}).Order("name").Find(&domains).Error; err != nil {
+		return nil, err
+	}
+	res := make([]*CustomDomain, 0, len(domains))
+	for _, d := range domains {
+		res = append(res, newCustomDomain(d))
+	}
+	return res, nil
+}
+
+// GetVerifiedCustomDomains returns the names of a user's verified custom domains.
+func GetVerifiedCustomDomains(userID string) ([]string, error) {
+	var names []string
+	if err := database.DB().Model(&database.CustomDomain{}).Where(&database.CustomDomain{
+		UserID: userID,
+		Status: DomainVerified,
+	}).Order("name").Pluck("name", &names).Error; err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// AddCustomDomain adds a pending custom domain for a user and issues its verification token.
+// Assumes the name is sanitized and not one of the shared root domains.
+// Adding a domain that the user already added returns the existing one.
+func AddCustomDomain(userID, name string) (*CustomDomain, error) {
+	if verified, err := isVerifiedByOther(database.DB(), userID, name); err != nil {
+		return nil, err
+	} else if verified {
+		return nil, ErrDomainTaken
+	}
+
+	token, err := GenerateRandomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	domain := database.CustomDomain{
+		Name:   name,
+		UserID: userID,
+	}
+	if err = database.DB().Where(&domain).Attrs(&database.CustomDomain{
+		Token:  hex.EncodeToString(token),
+		Status: DomainPending,
+	}).FirstOrCreate(&domain).Error; err != nil {
+		return nil, err
+	}
+	return newCustomDomain(&domain), nil
+}
+
+// VerifyCustomDomain checks the verification TXT record of a user's custom domain.
+// Once verified, the domain itself is registered as one of the user's hosts.
+func VerifyCustomDomain(ctx context.Context, userID, name string) (*CustomDomain, error) {
+	var domain database.CustomDomain
+	err := database.DB().Where(&database.CustomDomain{
+		UserID: userID,
+		Name:   name,
+	}).First(&domain).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDomainNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if domain.Status != DomainVerified {
+		if err = checkVerification(ctx, &domain); err != nil {
+			return nil, err
+		}
+	}
+	return newCustomDomain(&domain), nil
+}
+
+// VerifyPendingDomains checks the verification TXT record of every pending custom domain.
+// Domains whose owner has reached their plan's host limit stay pending until they make room.
+func VerifyPendingDomains(ctx context.Context) error {
+	var domains []*database.CustomDomain
+	if err := database.DB().Where(&database.CustomDomain{
+		Status: DomainPending,
+	}).Find(&domains).Error; err != nil {
+		return err
+	}
+	var errs []error
+	for _, d := range domains {
+		var limitErr *PlanLimitError
+		if err := checkVerification(ctx, d); err != nil && !errors.Is(err, ErrDomainTaken) && !errors.As(err, &limitErr) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkVerification looks up the domain's TXT record and marks it verified if the token is present.
+// Returns a PlanLimitError, leaving the domain pending, if registering its apex host would exceed the owner's plan.
+func checkVerification(ctx context.Context, domain *database.CustomDomain) error {
+	records, err := clients.DNS.LookupTXT(ctx, verificationRecordPrefix+domain.Name)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		err = nil // record not published yet
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	domain.LastCheckedAt = &now
+	found := slices.Contains(records, verificationValuePrefix+domain.Token)
+	err = database.DB().Transaction(func(tx *gorm.DB) error {
+		if found {
+			if verified, err := isVerifiedByOther(tx, domain.UserID, domain.Name); err != nil {
+				return err
+			} else if verified {
+				return ErrDomainTaken
+			}
+			// The apex host only counts towards the limit if it doesn't exist yet
+			var hosts int64
+			if err := tx.Model(&database.Host{}).Where(map[string]interface{}{
+				"user_id": domain.UserID,
+				"root":    domain.Name,
+				"sub":     "",
+			}).Count(&hosts).Error; err != nil {
+				return err
+			}
+			if hosts == 0 {
+				if err := checkHostLimit(tx, domain.UserID); err != nil {
+					return err
+				}
+			}
+			domain.Status = DomainVerified
+			domain.VerifiedAt = &now
+		}
+		if err := tx.Model(domain).Select("Status", "VerifiedAt", "LastCheckedAt").Updates(domain).Error; err != nil {
+			return err
+		}
+		if !found {
+			return nil
+		}
+		return tx.Where(map[string]interface{}{
+			"user_id": domain.UserID,
+			"root":    domain.Name,
+			"sub":     "",
+		}).FirstOrCreate(&database.Host{
+			UserID: domain.UserID,
+			Root:   domain.Name,
+		}).Error
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		// Another user still has a host on the apex
+		return ErrDomainTaken
+	}
+	return err
+}
+
+// DeleteCustomDomain removes a user's custom domain along with all of their hosts on it (cancelling their transfers).
+func DeleteCustomDomain(userID, name string) error {
+	return database.DB().Transaction(func(tx *gorm.DB) error {
+		res := tx.Unscoped().Where(&database.CustomDomain{
+			UserID: userID,
+			Name:   name,
+		}).Delete(&database.CustomDomain{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrDomainNotFound
+		}
+		hosts := &database.Host{
+			UserID: userID,
+			Root:   name,
+		}
+		if err := cancelHostTransfers(tx, tx.Model(&database.Host{}).Select("id").Where(hosts), userID); err != nil {
+			return err
+		}
+		return tx.Where(hosts).Delete(&database.Host{}).Error
+	})
+}
+
+// isVerifiedByOther reports whether a user other than userID has verified the domain.
+func isVerifiedByOther(tx *gorm.DB, userID, name string) (bool, error) {
+	var count int64
+	err := tx.Model(&database.CustomDomain{}).Where(
+		"name = ? AND status = ? AND user_id <> ?", name, DomainVerified, userID,
+	).Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,161 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/database"
+)
+
+// fakeResolver answers TXT lookups from a map of record names. Names that aren't in the map are NXDOMAIN,
+// except those in failing, which fail with a temporary error.
+type fakeResolver struct {
+	records map[string][]string
+	failing map[string]bool
+}
+
+func (r *fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if r.failing[name] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if records, ok := r.records[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// useFakeResolver replaces clients.DNS with an empty fakeResolver for the duration of the test.
+func useFakeResolver(t *testing.T) *fakeResolver {
+	t.Helper()
+	fake := &fakeResolver{records: make(map[string][]string), failing: make(map[string]bool)}
+	prev := clients.DNS
+	clients.DNS = fake
+	t.Cleanup(func() { clients.DNS = prev })
+	return fake
+}
+
+// addTestDomain adds a uniquely named pending custom domain for the user.
+func addTestDomain(t *testing.T, userID string) *CustomDomain {
+	t.Helper()
+	domain, err := AddCustomDomain(userID, fmt.Sprintf("domain%d.example", testSeq.Add(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return domain
+}
+
+// apexHostExists reports whether the user has a host on the apex of the domain.
+func apexHostExists(t *testing.T, userID, name string) bool {
+	t.Helper()
+	var hosts int64
+	if err := database.DB().Model(&database.Host{}).Where(map[string]interface{}{
+		"user_id": userID,
+		"root":    name,
+		"sub":     "",
+	}).Count(&hosts).Error; err != nil {
+		t.Fatal(err)
+	}
+	return hosts > 0
+}
+
+func TestVerifyCustomDomainVerified(t *testing.T) {
+	dns := useFakeResolver(t)
+	user := createTestUser(t)
+	domain := addTestDomain(t, user.ID)
+	dns.records[domain.RecordName] = []string{"unrelated", domain.RecordValue}
+
+	verified, err := VerifyCustomDomain(context.Background(), user.ID, domain.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.Status != DomainVerified || verified.VerifiedAt == nil {
+		t.Fatalf("status = %s, want %s", verified.Status, DomainVerified)
+	}
+	if !apexHostExists(t, user.ID, domain.Name) {
+		t.Fatal("apex host was not created")
+	}
+}
+
+func TestVerifyCustomDomainMismatchedRecord(t *testing.T) {
+	dns := useFakeResolver(t)
+	user := createTestUser(t)
+	domain := addTestDomain(t, user.ID)
+	dns.records[domain.RecordName] = []string{domain.RecordValue + "0"}
+
+	pending, err := VerifyCustomDomain(context.Background(), user.ID, domain.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Status != DomainPending {
+		t.Fatalf("status = %s, want %s", pending.Status, DomainPending)
+	}
+	if apexHostExists(t, user.ID, domain.Name) {
+		t.Fatal("apex host was created for an unverified domain")
+	}
+}
+
+func TestVerifyCustomDomainNXDOMAIN(t *testing.T) {
+	useFakeResolver(t)
+	user := createTestUser(t)
+	domain := addTestDomain(t, user.ID)
+
+	pending, err := VerifyCustomDomain(context.Background(), user.ID, domain.Name)
+	if err != nil {
+		t.Fatalf("NXDOMAIN must not be an error: %v", err)
+	}
+	if pending.Status != DomainPending {
+		t.Fatalf("status = %s, want %s", pending.Status, DomainPending)
+	}
+}
+
+func TestVerifyCustomDomainLookupFailure(t *testing.T) {
+	dns := useFakeResolver(t)
+	user := createTestUser(t)
+	domain := addTestDomain(t, user.ID)
+	dns.failing[domain.RecordName] = true
+
+	var dnsErr *net.DNSError
+	if _, err := VerifyCustomDomain(context.Background(), user.ID, domain.Name); !errors.As(err, &dnsErr) {
+		t.Fatalf("err = %v, want the lookup error", err)
+	}
+}
+
+func TestVerifyCustomDomainHostLimit(t *testing.T) {
+	dns := useFakeResolver(t)
+	user := createTestUser(t)
+	plan, err := database.GetUserPlan(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < plan.MaxHosts; i++ {
+		host := &database.Host{UserID: user.ID, Sub: fmt.Sprintf("h%d", i), Root: "limit.example"}
+		if err = database.DB().Create(host).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	domain := addTestDomain(t, user.ID)
+	dns.records[domain.RecordName] = []string{domain.RecordValue}
+
+	var limitErr *PlanLimitError
+	if _, err = VerifyCustomDomain(context.Background(), user.ID, domain.Name); !errors.As(err, &limitErr) {
+		t.Fatalf("err = %v, want a PlanLimitError", err)
+	}
+	if apexHostExists(t, user.ID, domain.Name) {
+		t.Fatal("apex host was created beyond the plan's host limit")
+	}
+	// Pending domains over the limit are left for later instead of failing the job.
+	if err = VerifyPendingDomains(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	domains, err := ListCustomDomains(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 1 || domains[0].Status != DomainPending {
+		t.Fatalf("domains = %+v, want one pending domain", domains)
+	}
+}
@@ -0,0 +1,289 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sharify-labs/spine/database"
+	"github.com/sharify-labs/spine/validators"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidEmbedTemplate = errors.New("invalid embed template")
+	ErrEmbedNotFound        = errors.New("embed template not found")
+	ErrUploadNotFound       = errors.New("upload not found")
+)
+
+// EmbedPlaceholders are the placeholders embed templates can use, with a description of what they're replaced by.
+var EmbedPlaceholders = map[string]string{
+	"filename": "the upload's title (its filename for files and images)",
+	"size":     "the upload's size (ex: 1.5 MiB)",
+	"uploader": "the uploader's username",
+	"date":     "the upload date (ex: 2024-01-31)",
+	"hostname": "the hostname the upload is served from",
+	"type":     "the upload type (file, image, paste or redirect)",
+}
+
+// Maximum lengths of rendered embed fields. These are Discord's embed limits.
+const (
+	maxEmbedSiteName    = 256
+	maxEmbedTitle       = 256
+	maxEmbedDescription = 4096
+	maxEmbedAuthor      = 256
+)
+
+var embedColorRegex = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// EmbedTemplate describes how uploads are previewed when shared.
+// Hostname is empty for the user's default template, which applies to hosts without their own.
+type EmbedTemplate struct {
+	Hostname    string `json:"hostname"`
+	SiteName    string `json:"site_name"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Color       string `json:"color"`
+	Author      string `json:"author"`
+}
+
+// Embed is an embed template rendered for a specific upload.
+type Embed struct {
+	SiteName    string `json:"site_name"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Color       string `json:"color"`
+	Author      string `json:"author"`
+}
+
+func newEmbedTemplate(t *database.EmbedTemplate) *EmbedTemplate {
+	return &EmbedTemplate{
+		Hostname:    t.Hostname,
+		SiteName:    t.SiteName,
+		Title:       t.Title,
+		Description: t.Description,
+		Color:       t.Color,
+		Author:      t.Author,
+	}
+}
+
+// Validate returns ErrInvalidEmbedTemplate (wrapped with the reason) if a field has invalid placeholder syntax,
+// uses an unknown placeholder, is too long, or if Color isn't #rrggbb.
+func (t *EmbedTemplate) Validate() error {
+	fields := []struct {
+		name  string
+		value string
+		max   int
+	}{
+		{"site_name", t.SiteName, maxEmbedSiteName},
+		{"title", t.Title, maxEmbedTitle},
+		{"description", t.Description, maxEmbedDescription},
+		{"author", t.Author, maxEmbedAuthor},
+	}
+	for _, f := range fields {
+		if len([]rune(f.value)) > f.max {
+			return fmt.Errorf("%w: %s must be at most %d characters", ErrInvalidEmbedTemplate, f.name, f.max)
+		}
+		if _, err := renderEmbedField(f.value, nil); err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrInvalidEmbedTemplate, f.name, err)
+		}
+	}
+	if t.Color != "" && !embedColorRegex.MatchString(t.Color) {
+		return fmt.Errorf("%w: color must be in the format #rrggbb", ErrInvalidEmbedTemplate)
+	}
+	return nil
+}
+
+// Render replaces the placeholders in the template with values and truncates fields to their maximum length.
+// Assumes the template is valid (see Validate).
+func (t *EmbedTemplate) Render(values map[string]string) *Embed {
+	render := func(s string, max int) string {
+		res, _ := renderEmbedField(s, values)
+		if r := []rune(res); len(r) > max {
+			res = string(r[:max])
+		}
+		return res
+	}
+	return &Embed{
+		SiteName:    render(t.SiteName, maxEmbedSiteName),
+		Title:       render(t.Title, maxEmbedTitle),
+		Description: render(t.Description, maxEmbedDescription),
+		Color:       t.Color,
+		Author:      render(t.Author, maxEmbedAuthor),
+	}
+}
+
+// renderEmbedField replaces {name} placeholders in s with values[name]. "{{" and "}}" are literal braces.
+// Returns an error for unknown placeholders and unbalanced braces. A nil values map only validates s.
+func renderEmbedField(s string, values map[string]string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			if i+1 < len(s) && s[i+1] == '{' {
+				b.WriteByte('{')
+				i++
+				continue
+			}
+			end := strings.IndexAny(s[i+1:], "{}")
+			if end == -1 || s[i+1+end] != '}' {
+				return "", errors.New("unclosed placeholder (use {{ for a literal brace)")
+			}
+			name := s[i+1 : i+1+end]
+			if _, ok := EmbedPlaceholders[name]; !ok {
+				return "", fmt.Errorf("unknown placeholder {%s}", name)
+			}
+			b.WriteString(values[name])
+			i += end + 1
+		case '}':
+			if i+1 < len(s) && s[i+1] == '}' {
+				b.WriteByte('}')
+				i++
+				continue
+			}
+			return "", errors.New("unexpected } (use }} for a literal brace)")
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// ListEmbedTemplates returns the user's embed templates, starting with their default template if they have one.
+func ListEmbedTemplates(userID string) ([]*EmbedTemplate, error) {
+	var templates []*database.EmbedTemplate
+	if err := database.DB().Where(&database.EmbedTemplate{
+		UserID: userID,
+	}).Order("hostname").Find(&templates).Error; err != nil {
+		return nil, err
+	}
+	res := make([]*EmbedTemplate, 0, len(templates))
+	for _, t := range templates {
+		res = append(res, newEmbedTemplate(t))
+	}
+	return res, nil
+}
+
+// SaveEmbedTemplate validates and creates or replaces one of the user's embed templates.
+// A non-empty Hostname must be one of the hosts the user can upload to.
+func SaveEmbedTemplate(userID string, t *EmbedTemplate) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	return database.DB().Transaction(func(tx *gorm.DB) error {
+		if t.Hostname != "" {
+			host, err := findUploadableHost(tx, userID, t.Hostname)
+			if err != nil {
+				return err
+			}
+			t.Hostname = host.Hostname()
+		}
+		var existing database.EmbedTemplate
+		// Note: Map conditions are used so that an empty Hostname only matches the default template.
+		err := tx.Where(map[string]interface{}{
+			"user_id":  userID,
+			"hostname": t.Hostname,
+		}).First(&existing).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		existing.UserID = userID
+		existing.Hostname = t.Hostname
+		existing.SiteName = t.SiteName
+		existing.Title = t.Title
+		existing.Description = t.Description
+		existing.Color = t.Color
+		existing.Author = t.Author
+		return tx.Save(&existing).Error
+	})
+}
+
+// DeleteEmbedTemplate deletes one of the user's embed templates. An empty hostname deletes their default template.
+func DeleteEmbedTemplate(userID, hostname string) error {
+	if hostname != "" {
+		if hostname = validators.SanitizeDomain(hostname); hostname == "" {
+			return ErrEmbedNotFound
+		}
+	}
+	res := database.DB().Unscoped().Where(map[string]interface{}{
+		"user_id":  userID,
+		"hostname": hostname,
+	}).Delete(&database.EmbedTemplate{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrEmbedNotFound
+	}
+	return nil
+}
+
+// RenderUploadEmbed renders the embed of the upload served at hostname with secret.
+// The uploader's template for the hostname is used, falling back to their default template.
+// Returns ErrUploadNotFound if there's no such (unexpired) upload and ErrEmbedNotFound if the uploader has no template.
+func RenderUploadEmbed(hostname, secret string) (*Embed, error) {
+	if hostname == "" || secret == "" {
+		return nil, ErrUploadNotFound
+	}
+	var upload database.Upload
+	err := database.DB().Joins("User").Where(map[string]interface{}{
+		"uploads.hostname": strings.ToLower(hostname),
+		"uploads.secret":   secret,
+	}).Where("uploads.exp IS NULL OR uploads.exp > ?", time.Now()).First(&upload).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var t database.EmbedTemplate
+	err = database.DB().Where("user_id = ? AND hostname IN ?", upload.UserID, []string{upload.Hostname, ""}).
+		Order("hostname DESC").First(&t).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrEmbedNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newEmbedTemplate(&t).Render(map[string]string{
+		"filename": upload.Title,
+		"size":     FormatBytes(upload.Size),
+		"uploader": upload.User.Username,
+		"date":     upload.CreatedAt.UTC().Format(time.DateOnly),
+		"hostname": upload.Hostname,
+		"type":     UploadType(upload.Type).String(),
+	}), nil
+}
+
+// PreviewEmbed renders a template with sample values so users can see what their embeds will look like.
+func PreviewEmbed(t *EmbedTemplate, username string) *Embed {
+	hostname := t.Hostname
+	if hostname == "" {
+		hostname = "example.com"
+	}
+	return t.Render(map[string]string{
+		"filename": "screenshot.png",
+		"size":     FormatBytes(1536 * 1024),
+		"uploader": username,
+		"date":     time.Now().UTC().Format(time.DateOnly),
+		"hostname": hostname,
+		"type":     UploadTypeImage.String(),
+	})
+}
+
+// FormatBytes formats a byte count as a human-readable string (ex: 1.5 MiB).
+func FormatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,407 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/config"
+	"github.com/sharify-labs/spine/database"
+	"gorm.io/gorm"
+)
+
+// UploadAction is what happens to the uploads of a deleted host.
+type UploadAction string
+
+const (
+	UploadActionKeep   UploadAction = "keep"   // uploads keep being served from the hostname
+	UploadActionMove   UploadAction = "move"   // uploads are moved to another of the user's hosts
+	UploadActionDelete UploadAction = "delete" // uploads are deleted
+)
+
+// Statuses of a HostDeletion.
+const (
+	HostDeletionPending   = "pending"
+	HostDeletionRunning   = "running"
+	HostDeletionCompleted = "completed"
+	HostDeletionFailed    = "failed"
+)
+
+const (
+	hostDeletionBatchSize    = 100              // how many uploads are sent to Zephyr per request
+	hostDeletionHistoryLimit = 20               // maximum number of jobs returned by ListHostDeletions
+	hostDeletionLease        = 5 * time.Minute  // how long a job stays claimed without progress
+	hostDeletionMinBackoff   = time.Minute      // delay before the first retry of a failed job
+	hostDeletionMaxBackoff   = 60 * time.Minute // retries are delayed twice as long each time, up to this
+)
+
+var (
+	ErrInvalidUploadAction      = errors.New("uploads must be kept, moved or deleted")
+	ErrInvalidMoveTarget        = errors.New("uploads can only be moved to another of your hosts")
+	ErrHostDeletionNotFound     = errors.New("host deletion not found")
+	ErrHostDeletionNotRetryable = errors.New("only failed host deletions can be retried")
+
+	// errHostDeletionLeaseLost is returned when another instance took over a job whose lease expired.
+	errHostDeletionLeaseLost = errors.New("host deletion lease lost")
+)
+
+// hostDeletionLeaseOwner identifies this instance in the leases of the jobs it runs.
+var hostDeletionLeaseOwner = uuid.NewString()
+
+// uploadBatcher moves and deletes uploads on Zephyr (see the Zephyr contract in the README).
+type uploadBatcher interface {
+	MoveUploads(ctx context.Context, userToken string, ids []uint, hostname string) error
+	DeleteUploads(ctx context.Context, userToken string, ids []uint) error
+}
+
+// zephyrUploads handles the uploads of host deletion jobs. It is replaced in tests.
+var zephyrUploads uploadBatcher = clients.HTTP
+
+// HostImpact describes the uploads served from a host, which are affected by its deletion.
+type HostImpact struct {
+	Uploads      int64 `json:"uploads"`
+	StorageBytes int64 `json:"storage_bytes"`
+}
+
+// HostDeletion is the progress of the background job handling the uploads of a deleted host.
+// Error is the error of the last failed attempt; pending jobs with an error are retried at NextAttemptAt.
+type HostDeletion struct {
+	ID            uint       `json:"id"`
+	Hostname      string     `json:"hostname"`
+	Action        string     `json:"action"`
+	MoveTo        string     `json:"move_to,omitempty"`
+	Status        string     `json:"status"`
+	Total         int64      `json:"total"`
+	Processed     int64      `json:"processed"`
+	Error         string     `json:"error,omitempty"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+}
+
+func newHostDeletion(d *database.HostDeletion) *HostDeletion {
+	return &HostDeletion{
+		ID:            d.ID,
+		Hostname:      d.Hostname,
+		Action:        d.Action,
+		MoveTo:        d.MoveTo,
+		Status:        d.Status,
+		Total:         d.Total,
+		Processed:     d.Processed,
+		Error:         d.Error,
+		Attempts:      d.Attempts,
+		NextAttemptAt: d.NextAttemptAt,
+		CreatedAt:     d.CreatedAt,
+		CompletedAt:   d.CompletedAt,
+	}
+}
+
+// hostUploads returns a query for the uploads affected by deleting a host: every upload to a team host,
+// or the user's own uploads to a personal host (uploads made before a transfer stay with the previous owner).
+func hostUploads(tx *gorm.DB, hostname, userID string, teamID *uint) *gorm.DB {
+	q := tx.Model(&database.Upload{}).Where("hostname = ?", hostname)
+	if teamID == nil {
+		q = q.Where("user_id = ?", userID)
+	}
+	return q
+}
+
+// GetHostImpact returns the number and size of the uploads that deleting the host would affect.
+// The host must be one the user can upload to.
+func GetHostImpact(userID, hostname string) (*HostImpact, error) {
+	host, err := findUploadableHost(database.DB(), userID, hostname)
+	if err != nil {
+		return nil, err
+	}
+	var impact HostImpact
+	err = hostUploads(database.DB(), host.Hostname(), userID, host.TeamID).
+		Select("COUNT(*) AS uploads, COALESCE(SUM(size), 0) AS storage_bytes").Scan(&impact).Error
+	return &impact, err
+}
+
+// DeleteWithUploads deletes the host, then keeps, moves or deletes its uploads.
+// Moving and deleting happen in a background job whose progress is returned; keeping returns nil.
+// The job is created in the same transaction as the host is deleted, so uploads are never left without one.
+// Uploads can only be moved to another host the user can upload to.
+func (h *Host) DeleteWithUploads(ctx context.Context, action UploadAction, moveTo string) (*HostDeletion, error) {
+	switch action {
+	case UploadActionKeep, "":
+		return nil, h.Delete(ctx)
+	case UploadActionMove:
+		target, err := findUploadableHost(database.DB(), h.UserID, moveTo)
+		if errors.Is(err, ErrHostNotFound) || (err == nil && target.Hostname() == h.Full) {
+			return nil, ErrInvalidMoveTarget
+		}
+		if err != nil {
+			return nil, err
+		}
+		moveTo = target.Hostname()
+	case UploadActionDelete:
+		moveTo = ""
+	default:
+		return nil, ErrInvalidUploadAction
+	}
+
+	var job *database.HostDeletion
+	if err := database.DB().Transaction(func(tx *gorm.DB) (err error) {
+		job, err = h.deleteWithUploads(tx, action, moveTo)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if err := releaseDNSRecord(ctx, h.Sub, h.Root); err != nil {
+		return nil, err
+	}
+	startHostDeletion(job.ID)
+	return newHostDeletion(job), nil
+}
+
+// deleteWithUploads deletes the host as part of tx and creates the job that moves (to moveTo) or deletes its uploads.
+// Keeping the uploads doesn't need a job, so nil is returned. The job must be started once tx is committed.
+func (h *Host) deleteWithUploads(tx *gorm.DB, action UploadAction, moveTo string) (*database.HostDeletion, error) {
+	if err := h.delete(tx); err != nil {
+		return nil, err
+	}
+	if action == UploadActionKeep || action == "" {
+		return nil, nil
+	}
+	job := &database.HostDeletion{
+		UserID:   h.UserID,
+		TeamID:   h.TeamID,
+		Hostname: h.Full,
+		Action:   string(action),
+		MoveTo:   moveTo,
+		Status:   HostDeletionPending,
+	}
+	if err := hostUploads(tx, h.Full, h.UserID, h.TeamID).Count(&job.Total).Error; err != nil {
+		return nil, err
+	}
+	return job, tx.Create(job).Error
+}
+
+// hostDeletionsStarted tracks the jobs started by startHostDeletion, so that tests can wait for them.
+var hostDeletionsStarted sync.WaitGroup
+
+// startHostDeletion runs a job in the background right away instead of waiting for RunHostDeletions.
+func startHostDeletion(id uint) {
+	hostDeletionsStarted.Add(1)
+	go func() {
+		defer hostDeletionsStarted.Done()
+		// The request context is done once the response is sent, so the job gets its own.
+		if err := runHostDeletion(context.Background(), id); err != nil {
+			clients.Sentry.Capture(fmt.Errorf("host deletion %d failed: %w", id, err))
+		}
+	}()
+}
+
+// ListHostDeletions returns the user's host deletion jobs, newest first.
+func ListHostDeletions(userID string) ([]*HostDeletion, error) {
+	var jobs []*database.HostDeletion
+	if err := database.DB().Where(&database.HostDeletion{
+		UserID: userID,
+	}).Order("id DESC").Limit(hostDeletionHistoryLimit).Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	res := make([]*HostDeletion, 0, len(jobs))
+	for _, j := range jobs {
+		res = append(res, newHostDeletion(j))
+	}
+	return res, nil
+}
+
+// GetHostDeletion returns one of the user's host deletion jobs.
+func GetHostDeletion(userID string, id uint) (*HostDeletion, error) {
+	var job database.HostDeletion
+	err := database.DB().Where(&database.HostDeletion{UserID: userID}).First(&job, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrHostDeletionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newHostDeletion(&job), nil
+}
+
+// RetryHostDeletion starts a failed job of the user again, with a fresh set of attempts.
+// Uploads it already handled aren't sent to Zephyr again.
+func RetryHostDeletion(userID string, id uint) (*HostDeletion, error) {
+	res := database.DB().Model(&database.HostDeletion{}).Where(&database.HostDeletion{
+		ID:     id,
+		UserID: userID,
+		Status: HostDeletionFailed,
+	}).Updates(map[string]interface{}{
+		"status":          HostDeletionPending,
+		"attempts":        0,
+		"next_attempt_at": nil,
+		"completed_at":    nil,
+	})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	job, err := GetHostDeletion(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrHostDeletionNotRetryable
+	}
+	startHostDeletion(id)
+	return job, nil
+}
+
+// maxHostDeletionAttempts returns how many times a job is run before it's marked as failed
+// (HOST_DELETION_MAX_ATTEMPTS).
+func maxHostDeletionAttempts() int {
+	return max(config.GetOrDefault("HOST_DELETION_MAX_ATTEMPTS", 8), 1)
+}
+
+// hostDeletionBackoff returns how long to wait before running a job again after its nth failed attempt.
+func hostDeletionBackoff(attempts int) time.Duration {
+	backoff := hostDeletionMinBackoff
+	for i := 1; i < attempts && backoff < hostDeletionMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, hostDeletionMaxBackoff)
+}
+
+// claimableHostDeletions returns a query for the jobs that can be claimed at now: pending jobs that are due, and
+// running jobs whose lease expired (ex: their instance was stopped).
+func claimableHostDeletions(now time.Time) *gorm.DB {
+	return database.DB().Model(&database.HostDeletion{}).Where(
+		"(status = ? AND (next_attempt_at IS NULL OR next_attempt_at <= ?)) OR "+
+			"(status = ? AND (lease_expires_at IS NULL OR lease_expires_at < ?))",
+		HostDeletionPending, now, HostDeletionRunning, now,
+	)
+}
+
+// RunHostDeletions runs every job that is due, including jobs abandoned by stopped instances.
+func RunHostDeletions(ctx context.Context) error {
+	var ids []uint
+	if err := claimableHostDeletions(time.Now().UTC()).Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	var errs []error
+	for _, id := range ids {
+		if err := runHostDeletion(ctx, id); err != nil {
+			errs = append(errs, fmt.Errorf("host deletion %d: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runHostDeletion claims a job and sends its uploads to Zephyr in batches, recording progress as it goes.
+// Jobs that can't be claimed (ex: they are leased by another instance) are skipped.
+// Failed attempts are retried with exponential backoff, until the job fails HOST_DELETION_MAX_ATTEMPTS times.
+func runHostDeletion(ctx context.Context, id uint) error {
+	now := time.Now().UTC()
+	res := claimableHostDeletions(now).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":           HostDeletionRunning,
+		"lease_owner":      hostDeletionLeaseOwner,
+		"lease_expires_at": now.Add(hostDeletionLease),
+	})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return res.Error
+	}
+	var job database.HostDeletion
+	if err := database.DB().First(&job, id).Error; err != nil {
+		return err
+	}
+
+	jobErr := processHostDeletion(ctx, &job)
+	if errors.Is(jobErr, errHostDeletionLeaseLost) {
+		return nil
+	}
+	now = time.Now().UTC()
+	updates := map[string]interface{}{
+		"status":           HostDeletionCompleted,
+		"completed_at":     now,
+		"error":            "",
+		"next_attempt_at":  nil,
+		"lease_owner":      "",
+		"lease_expires_at": nil,
+	}
+	switch {
+	case jobErr != nil && ctx.Err() != nil:
+		// Stopped by a shutdown rather than failed, so it doesn't count as an attempt.
+		updates["status"] = HostDeletionPending
+		delete(updates, "completed_at")
+	case jobErr != nil && job.Attempts+1 >= maxHostDeletionAttempts():
+		updates["status"] = HostDeletionFailed
+		updates["attempts"] = job.Attempts + 1
+		updates["error"] = jobErr.Error()
+	case jobErr != nil:
+		updates["status"] = HostDeletionPending
+		updates["attempts"] = job.Attempts + 1
+		updates["next_attempt_at"] = now.Add(hostDeletionBackoff(job.Attempts + 1))
+		updates["error"] = jobErr.Error()
+		delete(updates, "completed_at")
+	}
+	// Note: A background context is used so that the job is released even if ctx is done.
+	if err := database.DB().WithContext(context.Background()).Model(&database.HostDeletion{}).Where(
+		"id = ? AND lease_owner = ?", id, hostDeletionLeaseOwner,
+	).Updates(updates).Error; err != nil {
+		return errors.Join(jobErr, err)
+	}
+	return jobErr
+}
+
+// processHostDeletion sends the job's uploads to Zephyr. Its lease is renewed after every batch, and it stops with
+// errHostDeletionLeaseLost if another instance took the job over.
+func processHostDeletion(ctx context.Context, job *database.HostDeletion) error {
+	tokens := make(map[string]string) // user ID -> JWT
+	var lastID uint
+	for {
+		var uploads []*database.Upload
+		if err := hostUploads(database.DB(), job.Hostname, job.UserID, job.TeamID).Select("id", "user_id").
+			Where("id > ?", lastID).Order("id").Limit(hostDeletionBatchSize).Find(&uploads).Error; err != nil {
+			return err
+		}
+		if len(uploads) == 0 {
+			return nil
+		}
+		lastID = uploads[len(uploads)-1].ID
+
+		// Zephyr only lets users act on their own uploads, so team host uploads are sent per member.
+		byUser := make(map[string][]uint)
+		for _, u := range uploads {
+			byUser[u.UserID] = append(byUser[u.UserID], u.ID)
+		}
+		for userID, ids := range byUser {
+			token, ok := tokens[userID]
+			if !ok {
+				var err error
+				if token, err = GenerateJWT(userID); err != nil {
+					return err
+				}
+				tokens[userID] = token
+			}
+			var err error
+			if job.Action == string(UploadActionMove) {
+				err = zephyrUploads.MoveUploads(ctx, token, ids, job.MoveTo)
+			} else {
+				err = zephyrUploads.DeleteUploads(ctx, token, ids)
+			}
+			if err != nil {
+				return err
+			}
+			InvalidateUsage(userID)
+		}
+		res := database.DB().Model(&database.HostDeletion{}).Where(
+			"id = ? AND lease_owner = ?", job.ID, hostDeletionLeaseOwner,
+		).Updates(map[string]interface{}{
+			"processed":        gorm.Expr("processed + ?", len(uploads)),
+			"lease_expires_at": time.Now().UTC().Add(hostDeletionLease),
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errHostDeletionLeaseLost
+		}
+	}
+}
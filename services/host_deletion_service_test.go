@@ -0,0 +1,229 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sharify-labs/spine/config"
+	"github.com/sharify-labs/spine/database"
+)
+
+// fakeUploadBatcher fails every batch of uploads unless ok is set, and records the IDs it deleted.
+type fakeUploadBatcher struct {
+	ok      bool
+	deleted []uint
+}
+
+func (f *fakeUploadBatcher) MoveUploads(context.Context, string, []uint, string) error {
+	return errors.New("move failed")
+}
+
+func (f *fakeUploadBatcher) DeleteUploads(_ context.Context, _ string, ids []uint) error {
+	if !f.ok {
+		return errors.New("zephyr unavailable")
+	}
+	f.deleted = append(f.deleted, ids...)
+	return nil
+}
+
+// useFakeZephyrUploads replaces zephyrUploads with a failing fakeUploadBatcher, and sets a JWT signing key, for the
+// duration of the test. Jobs started in the background are waited for before the test ends.
+func useFakeZephyrUploads(t *testing.T) *fakeUploadBatcher {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeUploadBatcher{}
+	prevUploads, prevKey := zephyrUploads, config.JWTPrivateKey
+	zephyrUploads, config.JWTPrivateKey = fake, key
+	t.Cleanup(func() {
+		hostDeletionsStarted.Wait()
+		zephyrUploads, config.JWTPrivateKey = prevUploads, prevKey
+	})
+	return fake
+}
+
+// createTestHostDeletion creates a pending job deleting the uploads of a host with one upload.
+func createTestHostDeletion(t *testing.T, userID string) *database.HostDeletion {
+	t.Helper()
+	hostname := fmt.Sprintf("deleted%d.example", testSeq.Add(1))
+	createTestUpload(t, userID, hostname, 10)
+	job := &database.HostDeletion{
+		UserID:   userID,
+		Hostname: hostname,
+		Action:   string(UploadActionDelete),
+		Status:   HostDeletionPending,
+		Total:    1,
+	}
+	if err := database.DB().Create(job).Error; err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// getTestHostDeletion reloads a job.
+func getTestHostDeletion(t *testing.T, id uint) *database.HostDeletion {
+	t.Helper()
+	var job database.HostDeletion
+	if err := database.DB().First(&job, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &job
+}
+
+func TestDeleteWithUploadsCreatesJobWithHost(t *testing.T) {
+	useFakeZephyrUploads(t)
+	user := createTestUser(t)
+	hostname := fmt.Sprintf("doomed%d.example", testSeq.Add(1))
+	if err := database.DB().Create(&database.Host{UserID: user.ID, Root: hostname}).Error; err != nil {
+		t.Fatal(err)
+	}
+	createTestUpload(t, user.ID, hostname, 10)
+	host, err := NewHostFromFull(hostname, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := host.DeleteWithUploads(context.Background(), UploadActionDelete, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Total != 1 {
+		t.Fatalf("total = %d, want 1", job.Total)
+	}
+	if _, err = findUploadableHost(database.DB(), user.ID, hostname); !errors.Is(err, ErrHostNotFound) {
+		t.Fatalf("err = %v, want the host to be deleted", err)
+	}
+	getTestHostDeletion(t, job.ID)
+}
+
+func TestRunHostDeletionRetriesWithBackoff(t *testing.T) {
+	t.Setenv("HOST_DELETION_MAX_ATTEMPTS", "2")
+	zephyr := useFakeZephyrUploads(t)
+	user := createTestUser(t)
+	job := createTestHostDeletion(t, user.ID)
+	ctx := context.Background()
+
+	if err := runHostDeletion(ctx, job.ID); err == nil {
+		t.Fatal("want the attempt to fail")
+	}
+	job = getTestHostDeletion(t, job.ID)
+	if job.Status != HostDeletionPending || job.Attempts != 1 || job.Error == "" || job.LeaseOwner != "" {
+		t.Fatalf("job = %+v, want a pending retry", job)
+	}
+	if job.NextAttemptAt == nil || time.Until(*job.NextAttemptAt) < hostDeletionMinBackoff-time.Second {
+		t.Fatalf("next attempt at %v, want %v from now", job.NextAttemptAt, hostDeletionMinBackoff)
+	}
+
+	// Not due yet
+	if err := runHostDeletion(ctx, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if job = getTestHostDeletion(t, job.ID); job.Attempts != 1 {
+		t.Fatalf("attempts = %d, want the retry to wait for its backoff", job.Attempts)
+	}
+
+	if err := database.DB().Model(job).Update("next_attempt_at", time.Now().UTC().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := runHostDeletion(ctx, job.ID); err == nil {
+		t.Fatal("want the attempt to fail")
+	}
+	if job = getTestHostDeletion(t, job.ID); job.Status != HostDeletionFailed || job.Attempts != 2 {
+		t.Fatalf("job = %+v, want it failed after 2 attempts", job)
+	}
+
+	zephyr.ok = true
+	retried, err := RetryHostDeletion(user.ID, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried.Status != HostDeletionPending || retried.Attempts != 0 {
+		t.Fatalf("job = %+v, want it pending with no attempts", retried)
+	}
+	hostDeletionsStarted.Wait()
+	if job = getTestHostDeletion(t, job.ID); job.Status != HostDeletionCompleted || job.Processed != 1 ||
+		len(zephyr.deleted) != 1 {
+		t.Fatalf("job = %+v, want the retry to complete", job)
+	}
+	if _, err = RetryHostDeletion(createTestUser(t).ID, job.ID); !errors.Is(err, ErrHostDeletionNotFound) {
+		t.Fatalf("err = %v, want ErrHostDeletionNotFound for another user", err)
+	}
+}
+
+func TestRetryHostDeletionRejectsUnfailedJobs(t *testing.T) {
+	user := createTestUser(t)
+	job := createTestHostDeletion(t, user.ID)
+	if _, err := RetryHostDeletion(user.ID, job.ID); !errors.Is(err, ErrHostDeletionNotRetryable) {
+		t.Fatalf("err = %v, want ErrHostDeletionNotRetryable", err)
+	}
+}
+
+func TestRunHostDeletionRespectsLeases(t *testing.T) {
+	useFakeZephyrUploads(t)
+	user := createTestUser(t)
+	job := createTestHostDeletion(t, user.ID)
+	leaseExpiresAt := time.Now().UTC().Add(time.Minute)
+	if err := database.DB().Model(job).Updates(map[string]interface{}{
+		"status":           HostDeletionRunning,
+		"lease_owner":      "other-instance",
+		"lease_expires_at": leaseExpiresAt,
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := runHostDeletion(ctx, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if job = getTestHostDeletion(t, job.ID); job.LeaseOwner != "other-instance" || job.Attempts != 0 {
+		t.Fatalf("job = %+v, want it left to the instance holding its lease", job)
+	}
+
+	if err := database.DB().Model(job).Update("lease_expires_at", time.Now().UTC().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := runHostDeletion(ctx, job.ID); err == nil {
+		t.Fatal("want the attempt to fail")
+	}
+	if job = getTestHostDeletion(t, job.ID); job.Attempts != 1 || job.LeaseOwner != "" {
+		t.Fatalf("job = %+v, want the expired lease to be taken over", job)
+	}
+}
+
+func TestDeleteWithUploadsMissingHost(t *testing.T) {
+	useFakeZephyrUploads(t)
+	user, other := createTestUser(t), createTestUser(t)
+	hostname := fmt.Sprintf("someone-elses%d.example", testSeq.Add(1))
+	if err := database.DB().Create(&database.Host{UserID: other.ID, Root: hostname}).Error; err != nil {
+		t.Fatal(err)
+	}
+	createTestUpload(t, user.ID, hostname, 10)
+	host, err := NewHostFromFull(hostname, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, action := range []UploadAction{UploadActionKeep, UploadActionDelete} {
+		if _, err = host.DeleteWithUploads(context.Background(), action, ""); !errors.Is(err, ErrHostNotFound) {
+			t.Fatalf("%s: err = %v, want ErrHostNotFound", action, err)
+		}
+	}
+	var jobs int64
+	if err = database.DB().Model(&database.HostDeletion{}).Where("hostname = ?", hostname).Count(&jobs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if jobs != 0 {
+		t.Fatalf("%d jobs created for a host that wasn't deleted", jobs)
+	}
+	if _, err = findUploadableHost(database.DB(), other.ID, hostname); err != nil {
+		t.Fatalf("the other user's host was deleted: %v", err)
+	}
+}
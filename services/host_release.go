@@ -0,0 +1,158 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/database"
+	"gorm.io/gorm"
+)
+
+// errHostChanged is returned when a host changed while being flagged or released (ex: it was deleted or unflagged).
+var errHostChanged = errors.New("host changed while being released")
+
+// hostReleaseReason is why a host gets flagged and then released: the Host column holding when it was flagged,
+// and the audit actions recorded when it is flagged, cleared and released.
+type hostReleaseReason struct {
+	column   string
+	warning  string // used in error messages, ex: "reclaim" for "failed to send reclaim warning"
+	flagged  string
+	cleared  string
+	released string
+}
+
+var (
+	// releaseInactive is used for hosts on shared roots that nobody uploads to (see ReclaimInactiveHosts).
+	releaseInactive = hostReleaseReason{
+		column:   "flagged_inactive_at",
+		warning:  "reclaim",
+		flagged:  AuditHostReclaimFlagged,
+		cleared:  AuditHostReclaimCleared,
+		released: AuditHostReclaimed,
+	}
+	// releaseIneligible is used for hosts on roots above their owner's plan (see ReleaseIneligibleHosts).
+	releaseIneligible = hostReleaseReason{
+		column:   "flagged_ineligible_at",
+		warning:  "plan release",
+		flagged:  AuditHostPlanFlagged,
+		cleared:  AuditHostPlanCleared,
+		released: AuditHostPlanReleased,
+	}
+)
+
+// hostOwners returns the users responsible for a host: the user who created it and, for team hosts, the team's
+// owner. The host's User must be loaded.
+func hostOwners(tx *gorm.DB, h *database.Host) ([]*database.User, error) {
+	owners := []*database.User{&h.User}
+	if h.TeamID == nil {
+		return owners, nil
+	}
+	owner, err := getTeamOwner(tx, *h.TeamID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return owners, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if owner.ID != h.UserID {
+		owners = append(owners, owner)
+	}
+	return owners, nil
+}
+
+// userIDs returns the IDs of the users.
+func userIDs(users []*database.User) []string {
+	ids := make([]string, 0, len(users))
+	for _, u := range users {
+		ids = append(ids, u.ID)
+	}
+	return ids
+}
+
+// flagHost flags a host for release and warns its owners by email if possible. The email body is sent as is.
+func flagHost(h *database.Host, reason hostReleaseReason, now time.Time, body string) error {
+	var owners []*database.User
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&database.Host{}).Where("id = ? AND "+reason.column+" IS NULL", h.ID).
+			Update(reason.column, now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errHostChanged
+		}
+		var err error
+		if owners, err = hostOwners(tx, h); err != nil {
+			return err
+		}
+		return recordAuditEvent(tx, reason.flagged, h.Hostname(), auditActorSystem, userIDs(owners)...)
+	})
+	if errors.Is(err, errHostChanged) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("flag %s: %w", h.Hostname(), err)
+	}
+	if !clients.Mail.Enabled() {
+		return nil
+	}
+	for _, u := range owners {
+		if u.Email == "" {
+			continue
+		}
+		if err = clients.Mail.Send(u.Email, h.Hostname()+" will be released soon", body); err != nil {
+			clients.Sentry.Capture(fmt.Errorf("failed to send %s warning for %s: %w", reason.warning, h.Hostname(), err))
+		}
+	}
+	return nil
+}
+
+// unflagHost clears the flag of a host that no longer needs to be released.
+func unflagHost(h *database.Host, reason hostReleaseReason) error {
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&database.Host{}).Where("id = ?", h.ID).Update(reason.column, nil).Error; err != nil {
+			return err
+		}
+		owners, err := hostOwners(tx, h)
+		if err != nil {
+			return err
+		}
+		return recordAuditEvent(tx, reason.cleared, h.Hostname(), auditActorSystem, userIDs(owners)...)
+	})
+	if err != nil {
+		return fmt.Errorf("unflag %s: %w", h.Hostname(), err)
+	}
+	return nil
+}
+
+// releaseHost deletes a host that was flagged before flaggedBefore, along with its DNS record and pending transfers.
+func releaseHost(ctx context.Context, h *database.Host, reason hostReleaseReason, flaggedBefore time.Time) error {
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		if err := cancelHostTransfers(tx, []uint{h.ID}, auditActorSystem); err != nil {
+			return err
+		}
+		res := tx.Where("id = ? AND "+reason.column+" < ?", h.ID, flaggedBefore).Delete(&database.Host{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errHostChanged
+		}
+		owners, err := hostOwners(tx, h)
+		if err != nil {
+			return err
+		}
+		return recordAuditEvent(tx, reason.released, h.Hostname(), auditActorSystem, userIDs(owners)...)
+	})
+	if errors.Is(err, errHostChanged) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("release %s: %w", h.Hostname(), err)
+	}
+	InvalidateUsage(h.UserID)
+	return releaseDNSRecord(ctx, h.Sub, h.Root)
+}
@@ -1,18 +1,33 @@
 package services
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"strings"
 
+	"github.com/sharify-labs/spine/clients"
 	"github.com/sharify-labs/spine/database"
-	"gorm.io/gorm/clause"
+	"github.com/sharify-labs/spine/validators"
+	"golang.org/x/net/publicsuffix"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrHostTaken        = errors.New("hostname is already taken")
+	ErrInvalidHostname  = errors.New("invalid hostname")
+	ErrInvalidSubdomain = errors.New("invalid subdomain")
+	ErrHostnameTooLong  = errors.New("hostname is too long")
 )
 
 // Host helps parse a hostname string into a usable "object".
+// TeamID is set for hosts owned by a team. UserID is then the member acting on the host.
 type Host struct {
 	Full   string
 	Sub    string
 	Root   string
 	UserID string
+	TeamID *uint
 }
 
 // JoinHostname combines a sub and root domain into a single hostname string.
@@ -24,32 +39,55 @@ func JoinHostname(sub string, root string) string {
 }
 
 // NewHostFromFull takes in a full hostname and userID and returns a Host object.
-// - Assumes the hostname is pre-validated and sanitized.
-// - We only support 1st-level subdomains. We do not need to consider subs with multiple periods.
-// - We only support TLDs with 1 period (ex: .co.uk is not supported).
-func NewHostFromFull(hostname string, userID string) *Host {
-	parts := strings.Split(hostname, ".")
-	var sub, root string
-	switch {
-	// sharify.me
-	case len(parts) == 2:
-		sub = ""
-		root = hostname
-	// i.sharify.me
-	case len(parts) == 3:
-		sub = parts[0]
-		root = parts[1] + "." + parts[2]
-	// invalid (foo.bar.sharify.me) or (sharify)
-	default:
-		sub = ""
-		root = ""
+// The root is the longest known root that hostname ends with: a catalog domain or the root of one of the
+// user's hosts. Otherwise, it's the registrable domain according to the Public Suffix List
+// (ex: "a.b.example.co.uk" -> "example.co.uk"). Subdomains may have multiple levels.
+// Returns ErrInvalidHostname if hostname isn't a valid domain or is a public suffix itself.
+func NewHostFromFull(hostname string, userID string) (*Host, error) {
+	hostname = validators.SanitizeDomain(hostname)
+	if hostname == "" {
+		return nil, ErrInvalidHostname
+	}
+	roots, err := knownRoots(userID)
+	if err != nil {
+		return nil, err
+	}
+	root := ""
+	for _, r := range roots {
+		if (hostname == r || strings.HasSuffix(hostname, "."+r)) && len(r) > len(root) {
+			root = r
+		}
+	}
+	if root == "" {
+		if root, err = publicsuffix.EffectiveTLDPlusOne(hostname); err != nil {
+			return nil, ErrInvalidHostname
+		}
 	}
 	return &Host{
 		Full:   hostname,
-		Sub:    sub,
+		Sub:    strings.TrimSuffix(strings.TrimSuffix(hostname, root), "."),
 		Root:   root,
 		UserID: userID,
+	}, nil
+}
+
+// knownRoots returns the names of the enabled catalog domains and the roots of the user's and their teams' hosts.
+func knownRoots(userID string) ([]string, error) {
+	domains, err := getCatalog()
+	if err != nil {
+		return nil, err
+	}
+	var roots []string
+	if err = database.DB().Model(&database.Host{}).Where(
+		"user_id = ? OR team_id IN (?)",
+		userID, database.DB().Model(&database.TeamMember{}).Select("team_id").Where("user_id = ?", userID),
+	).Distinct().Pluck("root", &roots).Error; err != nil {
+		return nil, err
+	}
+	for _, d := range domains {
+		roots = append(roots, d.Name)
 	}
+	return roots, nil
 }
 
 // NewHostFromParts takes in a hostname and userID and returns a Host object.
@@ -63,27 +101,143 @@ func NewHostFromParts(sub string, root string, userID string) *Host {
 	}
 }
 
-// Register writes the host to the database.
-// Assumes root domain is already added to map of available domains and has an A record set in Cloudflare.
-func (h *Host) Register() error {
-	return database.DB().Clauses(clause.Locking{
-		Strength: clause.LockingStrengthShare,
-		Table:    clause.Table{Name: "dns_records"},
-	}).Create(&database.Host{
-		UserID: h.UserID,
-		Root:   h.Root,
-		Sub:    h.Sub,
-	}).Error
+// NewHostFromInput sanitizes a sub entered by the user and returns a Host object.
+// Periods in sub are kept if root allows multi-level subdomains (see AllowsMultiLevel), otherwise they become hyphens.
+// Returns ErrInvalidSubdomain if nothing valid is left of a non-empty sub, rather than falling back to the root itself,
+// and ErrHostnameTooLong if the hostname exceeds 253 characters.
+func NewHostFromInput(sub string, root string, userID string) (*Host, error) {
+	multiLevel, err := AllowsMultiLevel(userID, root)
+	if err != nil {
+		return nil, err
+	}
+	sanitized := validators.SanitizeSubdomain(sub)
+	if multiLevel {
+		sanitized = validators.SanitizeSubdomains(sub)
+	}
+	if sanitized == "" && strings.TrimSpace(sub) != "" {
+		return nil, ErrInvalidSubdomain
+	}
+	host := NewHostFromParts(sanitized, root, userID)
+	if len(host.Full) > 253 {
+		return nil, ErrHostnameTooLong
+	}
+	return host, nil
+}
+
+// Register writes the host to the database and provisions its DNS record.
+// Assumes root domain is already added to map of available domains.
+// Returns ErrHostTaken if any user (including this one) already has the hostname, and a PlanLimitError if the owner
+// is at their host limit (counted in the same transaction as the insert, so concurrent registrations can't exceed it).
+// DNS provisioning failures are reported but don't fail registration; ReconcileDNS will retry them.
+func (h *Host) Register(ctx context.Context) error {
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		// The unique index is the real guard (see database.ErrDuplicateHosts); this avoids a failed insert.
+		if taken, err := isHostTaken(tx, h.Sub, h.Root); err != nil {
+			return err
+		} else if taken {
+			return ErrHostTaken
+		}
+		if err := h.checkLimit(tx); err != nil {
+			return err
+		}
+		return tx.Create(&database.Host{
+			UserID: h.UserID,
+			TeamID: h.TeamID,
+			Root:   h.Root,
+			Sub:    h.Sub,
+		}).Error
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrHostTaken
+	}
+	if err != nil {
+		return err
+	}
+	h.provisionDNSRecord(ctx)
+	return nil
+}
+
+// checkLimit returns a PlanLimitError if the host's owner can't have another host on their plan, as part of tx.
+// Team hosts count against the team's plan instead of the user's.
+func (h *Host) checkLimit(tx *gorm.DB) error {
+	if h.TeamID != nil {
+		return checkTeamHostLimit(tx, *h.TeamID)
+	}
+	return checkHostLimit(tx, h.UserID)
+}
+
+// provisionDNSRecord creates the DNS record of a registered host.
+// Failures are reported but not returned; ReconcileDNS will retry them.
+func (h *Host) provisionDNSRecord(ctx context.Context) {
+	if err := clients.DNSRecords.EnsureRecord(ctx, h.Root, h.Full); err != nil && !errors.Is(err, clients.ErrZoneNotFound) {
+		clients.Sentry.Capture(fmt.Errorf("failed to provision dns record for %s: %w", h.Full, err))
+	}
+}
+
+// Delete removes the host from the database, cancels its pending transfers,
+// and deletes its DNS record if no other host uses it.
+// Team hosts are only matched if TeamID is set, and personal hosts only if it isn't.
+// DNS failures are reported but don't fail deletion; ReconcileDNS will retry them.
+func (h *Host) Delete(ctx context.Context) error {
+	if err := database.DB().Transaction(h.delete); err != nil {
+		return err
+	}
+	return releaseDNSRecord(ctx, h.Sub, h.Root)
+}
+
+// delete removes the host from the database and cancels its pending transfers, as part of tx.
+// Returns ErrHostNotFound if there was no such host, e.g. because a concurrent request deleted it first.
+func (h *Host) delete(tx *gorm.DB) error {
+	// Note: Map conditions are used so that an empty Sub only matches the root itself (and a nil TeamID is NULL).
+	conds := map[string]interface{}{
+		"sub":     h.Sub,
+		"root":    h.Root,
+		"user_id": h.UserID,
+		"team_id": nil,
+	}
+	if h.TeamID != nil {
+		delete(conds, "user_id")
+		conds["team_id"] = *h.TeamID
+	}
+	if err := cancelHostTransfers(tx, tx.Model(&database.Host{}).Select("id").Where(conds), h.UserID); err != nil {
+		return err
+	}
+	res := tx.Where(conds).Delete(&database.Host{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrHostNotFound
+	}
+	return nil
+}
+
+// releaseDNSRecord deletes the DNS record of a deleted host if no other host uses the hostname.
+// DNS failures are reported but not returned; ReconcileDNS will retry them.
+func releaseDNSRecord(ctx context.Context, sub, root string) error {
+	var remaining int64
+	if err := database.DB().Model(&database.Host{}).Where(map[string]interface{}{
+		"sub":  sub,
+		"root": root,
+	}).Count(&remaining).Error; err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return nil
+	}
+	hostname := JoinHostname(sub, root)
+	if err := clients.DNSRecords.DeleteRecord(ctx, root, hostname); err != nil && !errors.Is(err, clients.ErrZoneNotFound) {
+		clients.Sentry.Capture(fmt.Errorf("failed to delete dns record for %s: %w", hostname, err))
+	}
+	return nil
 }
 
-func (h *Host) Delete() error {
-	// Lock hosts table to prevent multiple txs from trying to delete the same host.
-	return database.DB().Clauses(clause.Locking{
-		Strength: clause.LockingStrengthUpdate,
-		Table:    clause.Table{Name: clause.CurrentTable},
-	}).Where(&database.Host{
-		Sub:    h.Sub,
-		Root:   h.Root,
-		UserID: h.UserID,
-	}).Delete(&database.Host{}).Error
+// isHostTaken reports whether an active host already uses the hostname.
+func isHostTaken(tx *gorm.DB, sub, root string) (bool, error) {
+	var count int64
+	err := tx.Model(&database.Host{}).Where(map[string]interface{}{
+		"sub":  sub,
+		"root": root,
+	}).Count(&count).Error
+	return count > 0, err
 }
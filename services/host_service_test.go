@@ -0,0 +1,118 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/sharify-labs/spine/database"
+)
+
+// Struct conditions skip zero values, so deleting the apex host (empty Sub) used to delete every host on the root.
+func TestHostDeleteApexKeepsSubdomains(t *testing.T) {
+	user := createTestUser(t)
+	for _, sub := range []string{"", "img"} {
+		if err := database.DB().Create(&database.Host{UserID: user.ID, Sub: sub, Root: "apex.example"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := NewHostFromParts("", "apex.example", user.ID).Delete(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var subs []string
+	if err := database.DB().Model(&database.Host{}).Where(&database.Host{UserID: user.ID}).
+		Pluck("sub", &subs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 1 || subs[0] != "img" {
+		t.Fatalf("remaining hosts = %q, want only img", subs)
+	}
+}
+
+// The host limit is counted in the transaction that inserts the host, so a host created by a concurrent request
+// after the early CheckHostLimit still counts.
+func TestRegisterChecksHostLimitWhenInserting(t *testing.T) {
+	user := createTestUser(t)
+	plan := createTestPlan(t, 1)
+	if err := database.DB().Model(plan).Update("max_hosts", 1).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := database.SetUserPlan(user.ID, plan.ID); err != nil {
+		t.Fatal(err)
+	}
+	root := fmt.Sprintf("limit%d.example", testSeq.Add(1))
+
+	if err := CheckHostLimit(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.DB().Create(&database.Host{UserID: user.ID, Sub: "other", Root: root}).Error; err != nil {
+		t.Fatal(err)
+	}
+	var limitErr *PlanLimitError
+	err := NewHostFromParts("img", root, user.ID).Register(context.Background())
+	if !errors.As(err, &limitErr) || limitErr.Limit != LimitHosts {
+		t.Fatalf("err = %v, want a %s PlanLimitError", err, LimitHosts)
+	}
+	hosts, err := countPersonalHosts(database.DB(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hosts != 1 {
+		t.Fatalf("hosts = %d, want the plan's 1", hosts)
+	}
+}
+
+func TestRegisterRejectsTakenHostname(t *testing.T) {
+	owner, other := createTestUser(t), createTestUser(t)
+	root := fmt.Sprintf("taken%d.example", testSeq.Add(1))
+	host := NewHostFromParts("img", root, owner.ID)
+	if err := host.Register(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range []string{owner.ID, other.ID} {
+		if err := NewHostFromParts("img", root, userID).Register(context.Background()); !errors.Is(err, ErrHostTaken) {
+			t.Fatalf("registering a taken hostname = %v, want ErrHostTaken", err)
+		}
+	}
+
+	// Deleted hostnames can be registered again
+	if err := host.Delete(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewHostFromParts("img", root, other.ID).Register(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterConcurrentlyTakesHostnameOnce(t *testing.T) {
+	root := fmt.Sprintf("race%d.example", testSeq.Add(1))
+	users := make([]*database.User, 8)
+	for i := range users {
+		users[i] = createTestUser(t)
+	}
+
+	start := make(chan struct{})
+	errs := make(chan error, len(users))
+	for _, user := range users {
+		go func(userID string) {
+			<-start
+			errs <- NewHostFromParts("img", root, userID).Register(context.Background())
+		}(user.ID)
+	}
+	close(start)
+	registered := 0
+	for range users {
+		err := <-errs
+		switch {
+		case err == nil:
+			registered++
+		case !errors.Is(err, ErrHostTaken):
+			t.Errorf("err = %v, want ErrHostTaken", err)
+		}
+	}
+	if registered != 1 {
+		t.Fatalf("%d registrations succeeded, want exactly 1", registered)
+	}
+}
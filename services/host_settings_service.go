@@ -0,0 +1,212 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/sharify-labs/spine/database"
+	"gorm.io/gorm"
+)
+
+var ErrInvalidHostSettings = errors.New("invalid host settings")
+
+// Limits on the per-host upload defaults.
+const (
+	MaxDefaultExpiryHours = 24 * 365
+	MinSecretLength       = 4
+	MaxSecretLength       = 64
+)
+
+// SecretCharsets are the character sets Zephyr can generate secrets from.
+var SecretCharsets = []string{"alphanumeric", "letters", "digits", "hex"}
+
+// UploadCategories are the upload categories a host can be restricted to. They match the ShareX config types.
+var UploadCategories = []string{"files", "pastes", "redirects"}
+
+// HostSettings are the upload defaults of a host, applied by Zephyr to uploads that don't override them.
+// DefaultExpiryHours: 0 for permanent uploads.
+// SecretLength & SecretCharset: 0 and "" use Zephyr's defaults.
+// AllowedTypes: The UploadCategories accepted by the host. Empty for all.
+type HostSettings struct {
+	DefaultExpiryHours int      `json:"default_expiry_hours"`
+	SecretLength       int      `json:"secret_length"`
+	SecretCharset      string   `json:"secret_charset"`
+	AllowedTypes       []string `json:"allowed_types"`
+	GalleryListed      bool     `json:"gallery_listed"`
+}
+
+// DefaultHostSettings returns the settings of a newly registered host.
+func DefaultHostSettings() *HostSettings {
+	return &HostSettings{AllowedTypes: []string{}, GalleryListed: true}
+}
+
+func newHostSettings(h *database.Host) *HostSettings {
+	s := &HostSettings{
+		DefaultExpiryHours: h.DefaultExpiryHours,
+		SecretLength:       h.SecretLength,
+		SecretCharset:      h.SecretCharset,
+		AllowedTypes:       []string{},
+		GalleryListed:      h.GalleryListed,
+	}
+	for _, t := range strings.Split(h.AllowedTypes, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			s.AllowedTypes = append(s.AllowedTypes, t)
+		}
+	}
+	return s
+}
+
+// Validate returns ErrInvalidHostSettings (wrapped with the reason) if any setting is out of range.
+// Duplicate AllowedTypes are removed, and selecting every category is the same as selecting none.
+func (s *HostSettings) Validate() error {
+	if s.DefaultExpiryHours < 0 || s.DefaultExpiryHours > MaxDefaultExpiryHours {
+		return fmt.Errorf("%w: default expiry must be between 0 and %d hours", ErrInvalidHostSettings, MaxDefaultExpiryHours)
+	}
+	if s.SecretLength != 0 && (s.SecretLength < MinSecretLength || s.SecretLength > MaxSecretLength) {
+		return fmt.Errorf("%w: secret length must be between %d and %d", ErrInvalidHostSettings, MinSecretLength, MaxSecretLength)
+	}
+	if s.SecretCharset != "" && !slices.Contains(SecretCharsets, s.SecretCharset) {
+		return fmt.Errorf("%w: secret charset must be one of %s", ErrInvalidHostSettings, strings.Join(SecretCharsets, ", "))
+	}
+	allowed := make([]string, 0, len(s.AllowedTypes))
+	for _, t := range s.AllowedTypes {
+		if !slices.Contains(UploadCategories, t) {
+			return fmt.Errorf("%w: allowed types must be any of %s", ErrInvalidHostSettings, strings.Join(UploadCategories, ", "))
+		}
+		if !slices.Contains(allowed, t) {
+			allowed = append(allowed, t)
+		}
+	}
+	if len(allowed) == len(UploadCategories) {
+		allowed = allowed[:0]
+	}
+	s.AllowedTypes = allowed
+	return nil
+}
+
+// Allows reports whether the host accepts uploads of the given category (see UploadCategories).
+func (s *HostSettings) Allows(category string) bool {
+	return len(s.AllowedTypes) == 0 || slices.Contains(s.AllowedTypes, category)
+}
+
+// IsDefault reports whether the settings are the same as DefaultHostSettings.
+func (s *HostSettings) IsDefault() bool {
+	return s.DefaultExpiryHours == 0 && s.SecretLength == 0 && s.SecretCharset == "" &&
+		len(s.AllowedTypes) == 0 && s.GalleryListed
+}
+
+// ListHostSettings returns the settings of every host the user can upload to (their hosts and their teams' hosts),
+// keyed by hostname.
+func ListHostSettings(userID string) (map[string]*HostSettings, error) {
+	var hosts []*database.Host
+	if err := database.DB().Where(
+		"(user_id = ? AND team_id IS NULL) OR team_id IN (?)",
+		userID, database.DB().Model(&database.TeamMember{}).Select("team_id").Where("user_id = ?", userID),
+	).Find(&hosts).Error; err != nil {
+		return nil, err
+	}
+	res := make(map[string]*HostSettings, len(hosts))
+	for _, h := range hosts {
+		res[h.Hostname()] = newHostSettings(h)
+	}
+	return res, nil
+}
+
+// GetHostSettings returns the settings of a host the user can upload to.
+// Returns ErrHostNotFound if the user has no such host.
+func GetHostSettings(userID, hostname string) (*HostSettings, error) {
+	host, err := findUploadableHost(database.DB(), userID, hostname)
+	if err != nil {
+		return nil, err
+	}
+	return newHostSettings(host), nil
+}
+
+// HostSettingsUpdate is a partial update of HostSettings. Nil fields are left unchanged.
+type HostSettingsUpdate struct {
+	DefaultExpiryHours *int
+	SecretLength       *int
+	SecretCharset      *string
+	AllowedTypes       *[]string
+	GalleryListed      *bool
+}
+
+// apply sets the non-nil fields of u on s.
+func (u *HostSettingsUpdate) apply(s *HostSettings) {
+	if u.DefaultExpiryHours != nil {
+		s.DefaultExpiryHours = *u.DefaultExpiryHours
+	}
+	if u.SecretLength != nil {
+		s.SecretLength = *u.SecretLength
+	}
+	if u.SecretCharset != nil {
+		s.SecretCharset = *u.SecretCharset
+	}
+	if u.AllowedTypes != nil {
+		s.AllowedTypes = *u.AllowedTypes
+	}
+	if u.GalleryListed != nil {
+		s.GalleryListed = *u.GalleryListed
+	}
+}
+
+// UpdateHostSettings applies the update to the settings of one of the user's hosts, then validates and saves them.
+// Team hosts can only be updated by the team's admins. Returns the updated settings.
+func UpdateHostSettings(userID, hostname string, u *HostSettingsUpdate) (*HostSettings, error) {
+	var s *HostSettings
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		host, err := findUploadableHost(tx, userID, hostname)
+		if err != nil {
+			return err
+		}
+		if host.TeamID != nil {
+			if _, err = requireTeamRole(tx, userID, *host.TeamID, TeamRoleAdmin); err != nil {
+				return err
+			}
+		}
+		s = newHostSettings(host)
+		u.apply(s)
+		if err = s.Validate(); err != nil {
+			return err
+		}
+		// Note: Select is required for zero values (ex: GalleryListed=false) to be saved.
+		return tx.Model(host).Select(
+			"DefaultExpiryHours", "SecretLength", "SecretCharset", "AllowedTypes", "GalleryListed",
+		).Updates(&database.Host{
+			DefaultExpiryHours: s.DefaultExpiryHours,
+			SecretLength:       s.SecretLength,
+			SecretCharset:      s.SecretCharset,
+			AllowedTypes:       strings.Join(s.AllowedTypes, ","),
+			GalleryListed:      s.GalleryListed,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// findUploadableHost finds a personal host of the user, or a host of one of their teams, by hostname.
+func findUploadableHost(tx *gorm.DB, userID, hostname string) (*database.Host, error) {
+	h, err := NewHostFromFull(hostname, userID)
+	if errors.Is(err, ErrInvalidHostname) {
+		return nil, ErrHostNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var host database.Host
+	err = tx.Where(map[string]interface{}{
+		"sub":  h.Sub,
+		"root": h.Root,
+	}).Where(
+		"(user_id = ? AND team_id IS NULL) OR team_id IN (?)",
+		userID, tx.Model(&database.TeamMember{}).Select("team_id").Where("user_id = ?", userID),
+	).First(&host).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrHostNotFound
+	}
+	return &host, err
+}
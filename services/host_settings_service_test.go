@@ -0,0 +1,66 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/sharify-labs/spine/database"
+)
+
+func TestUpdateHostSettingsKeepsOmittedFields(t *testing.T) {
+	user := createTestUser(t)
+	hostname := fmt.Sprintf("settings%d.example", testSeq.Add(1))
+	if err := database.DB().Create(&database.Host{UserID: user.ID, Root: hostname}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	expiry, types := 24, []string{"files"}
+	if _, err := UpdateHostSettings(user.ID, hostname, &HostSettingsUpdate{
+		DefaultExpiryHours: &expiry,
+		AllowedTypes:       &types,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	length := 8
+	settings, err := UpdateHostSettings(user.ID, hostname, &HostSettingsUpdate{SecretLength: &length})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.DefaultExpiryHours != 24 || settings.SecretLength != 8 || !slices.Equal(settings.AllowedTypes, types) ||
+		!settings.GalleryListed {
+		t.Fatalf("settings = %+v, want only the updated fields changed", settings)
+	}
+
+	unlisted := false
+	if _, err = UpdateHostSettings(user.ID, hostname, &HostSettingsUpdate{GalleryListed: &unlisted}); err != nil {
+		t.Fatal(err)
+	}
+	if settings, err = GetHostSettings(user.ID, hostname); err != nil {
+		t.Fatal(err)
+	}
+	if settings.GalleryListed || settings.DefaultExpiryHours != 24 {
+		t.Fatalf("settings = %+v, want the host unlisted and its expiry kept", settings)
+	}
+}
+
+func TestUpdateHostSettingsRejectsInvalidValues(t *testing.T) {
+	user := createTestUser(t)
+	hostname := fmt.Sprintf("settings%d.example", testSeq.Add(1))
+	if err := database.DB().Create(&database.Host{UserID: user.ID, Root: hostname}).Error; err != nil {
+		t.Fatal(err)
+	}
+	length := MaxSecretLength + 1
+	_, err := UpdateHostSettings(user.ID, hostname, &HostSettingsUpdate{SecretLength: &length})
+	if !errors.Is(err, ErrInvalidHostSettings) {
+		t.Fatalf("err = %v, want ErrInvalidHostSettings", err)
+	}
+	settings, err := GetHostSettings(user.ID, hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !settings.IsDefault() {
+		t.Fatalf("settings = %+v, want the defaults", settings)
+	}
+}
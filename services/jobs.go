@@ -0,0 +1,28 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	echolog "github.com/labstack/gommon/log"
+	"github.com/sharify-labs/spine/clients"
+)
+
+// RunJob calls fn every interval until ctx is cancelled.
+// Errors are reported to Sentry and don't stop the job.
+func RunJob(ctx context.Context, name string, interval time.Duration, fn func(ctx context.Context) error) {
+	echolog.Infof("Started job %q (every %s)", name, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := fn(ctx); err != nil {
+				clients.Sentry.Capture(fmt.Errorf("job %q failed: %w", name, err))
+			}
+		}
+	}
+}
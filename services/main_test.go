@@ -0,0 +1,59 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sharify-labs/spine/database"
+)
+
+// TestMain runs the tests against a temporary database.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "spine-services-test")
+	if err != nil {
+		panic(err)
+	}
+	_ = os.Setenv("TURSO_DSN", "file:"+filepath.Join(dir, "test.db"))
+	_ = os.Setenv("LOG_LEVEL", "1")
+	database.Setup()
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+var testSeq atomic.Int64
+
+// createTestUser creates a user on the default plan.
+func createTestUser(t *testing.T) *database.User {
+	t.Helper()
+	user := &database.User{Email: fmt.Sprintf("user%d@example.com", testSeq.Add(1)), PlanID: database.DefaultPlanID()}
+	if err := database.DB().Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// createTestPlan creates a purchasable plan costing about price (prices are unique, so a fraction is added).
+func createTestPlan(t *testing.T, price float32) *database.Plan {
+	t.Helper()
+	seq := testSeq.Add(1)
+	priceID := fmt.Sprintf("price_%d", seq)
+	plan := &database.Plan{Name: priceID, Price: price + float32(seq)/1000, MaxHosts: 10, BillingPriceID: &priceID}
+	if err := database.CreatePlan(plan); err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+// userPlanID returns the ID of the plan assigned to the user.
+func userPlanID(t *testing.T, userID string) uint {
+	t.Helper()
+	plan, err := database.GetUserPlan(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan.ID
+}
@@ -0,0 +1,288 @@
+package services
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/sharify-labs/spine/database"
+	"gorm.io/gorm"
+)
+
+// Plan limit names reported in PlanLimitError and LimitExceeded.
+const (
+	LimitHosts         = "max_hosts"
+	LimitUploads       = "max_uploads"
+	LimitStorage       = "storage_quota"
+	LimitMaxUploadSize = "max_upload_size"
+)
+
+// PlanLimitError is returned when an action would take a User past one of their plan's limits.
+type PlanLimitError struct {
+	Limit string
+	Max   int64
+}
+
+func (e *PlanLimitError) Error() string {
+	return "plan limit reached: " + e.Limit + " (" + strconv.FormatInt(e.Max, 10) + ")"
+}
+
+// LimitExceeded describes a plan limit that a User's current usage is above.
+type LimitExceeded struct {
+	Limit string `json:"limit"`
+	Max   int64  `json:"max"`
+	Used  int64  `json:"used"`
+}
+
+// ExceededLimits lists every limit of the plan that the given usage is above.
+func ExceededLimits(plan *database.Plan, usage *Usage) []LimitExceeded {
+	exceeded := make([]LimitExceeded, 0)
+	check := func(limit string, maxValue int64, used int64) {
+		if maxValue > 0 && used > maxValue {
+			exceeded = append(exceeded, LimitExceeded{Limit: limit, Max: maxValue, Used: used})
+		}
+	}
+	check(LimitHosts, int64(plan.MaxHosts), usage.Hosts)
+	check(LimitUploads, int64(plan.MaxUploads), usage.Uploads)
+	check(LimitStorage, plan.StorageQuota, usage.StorageBytes)
+	return exceeded
+}
+
+// AssignPlan moves a user onto a plan and reports any limits their current usage exceeds.
+// Downgrading below current usage is allowed and nothing is deleted; instead, the user
+// is blocked from creating new hosts or uploads until their usage is back under the limits.
+// Billing no longer changes the plan, except when it is the default plan: the user then gets the plan of their
+// paid subscriptions back, if they have any.
+func AssignPlan(userID string, planID uint) ([]LimitExceeded, error) {
+	if err := database.SetUserPlan(userID, planID); err != nil {
+		return nil, err
+	}
+	if planID == *database.DefaultPlanID() {
+		if err := database.DB().Transaction(func(tx *gorm.DB) error {
+			return syncSubscriptionPlan(tx, userID)
+		}); err != nil {
+			return nil, err
+		}
+		plan, err := database.GetUserPlan(userID)
+		if err != nil {
+			return nil, err
+		}
+		planID = plan.ID
+	}
+	plan, err := database.GetPlan(planID)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := GetUsage(userID)
+	if err != nil {
+		return nil, err
+	}
+	return ExceededLimits(plan, usage), nil
+}
+
+// CheckHostLimit returns a PlanLimitError if the user can't register another host on their plan.
+// It is only an early check for a friendlier error: the limit is enforced again when the host is created
+// (see checkHostLimit), since concurrent requests can all pass it.
+func CheckHostLimit(userID string) error {
+	return checkHostLimit(database.DB(), userID)
+}
+
+// checkHostLimit is CheckHostLimit as part of tx.
+// Calling it in the transaction that creates the host makes the count and the insert atomic.
+func checkHostLimit(tx *gorm.DB, userID string) error {
+	plan, err := getUserPlan(tx, userID)
+	if err != nil {
+		return err
+	}
+	if plan.MaxHosts <= 0 {
+		return nil
+	}
+	hosts, err := countPersonalHosts(tx, userID)
+	if err != nil {
+		return err
+	}
+	if hosts >= int64(plan.MaxHosts) {
+		return &PlanLimitError{Limit: LimitHosts, Max: int64(plan.MaxHosts)}
+	}
+	return nil
+}
+
+// ErrUploadLengthRequired is returned by ReserveUpload for uploads whose size isn't known up front.
+var ErrUploadLengthRequired = errors.New("upload size is required")
+
+// getUserPlan is database.GetUserPlan as part of tx.
+func getUserPlan(tx *gorm.DB, userID string) (*database.Plan, error) {
+	var user database.User
+	if err := tx.Preload("Plan").Where(&database.User{ID: userID}).First(&user).Error; err != nil {
+		return nil, err
+	}
+	if user.Plan != nil {
+		return user.Plan, nil
+	}
+	var plan database.Plan
+	if err := tx.First(&plan, *database.DefaultPlanID()).Error; err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// pendingUploads holds the uploads reserved by reserveUpload that may not be in the database yet,
+// keyed by the owner of the quota they count against ("user:<id>" or "team:<id>").
+// An entry is removed once no reservation holds or waits on it, so the map only grows with concurrent uploaders.
+var pendingUploads = struct {
+	sync.Mutex
+	byKey map[string]*pendingUsage
+}{byKey: make(map[string]*pendingUsage)}
+
+// pendingUsage counts reserved uploads. Its lock makes checking the limits and reserving atomic for an owner,
+// so parallel uploads can't all pass a check made before any of them was stored.
+// refs counts the reservations holding or waiting on it and is guarded by pendingUploads' lock.
+type pendingUsage struct {
+	mu      sync.Mutex
+	uploads int64
+	bytes   int64
+	refs    int
+}
+
+// acquirePendingUsage returns key's pending usage, creating it if needed, and holds a reference to it until
+// releasePendingUsage is called.
+func acquirePendingUsage(key string) *pendingUsage {
+	pendingUploads.Lock()
+	defer pendingUploads.Unlock()
+	pending, ok := pendingUploads.byKey[key]
+	if !ok {
+		pending = &pendingUsage{}
+		pendingUploads.byKey[key] = pending
+	}
+	pending.refs++
+	return pending
+}
+
+// releasePendingUsage drops a reference taken by acquirePendingUsage, removing key's entry once it has none left.
+func releasePendingUsage(key string, pending *pendingUsage) {
+	pendingUploads.Lock()
+	defer pendingUploads.Unlock()
+	pending.refs--
+	if pending.refs == 0 {
+		delete(pendingUploads.byKey, key)
+	}
+}
+
+// ReserveUpload returns a PlanLimitError if the user can't create an upload of the given size on their plan.
+// The size must be known: a negative size (e.g. a chunked request body) returns ErrUploadLengthRequired, since an
+// upload of unknown size could exceed the plan's max upload size and storage quota unchecked.
+// Uploads to team hosts count towards the team's limits instead (see ReserveHostUpload).
+// Limits are checked against the uploads in the database plus those reserved but not stored yet, never against
+// cached usage. The upload is reserved until release is called, which must happen once it is stored or has failed.
+func ReserveUpload(userID string, size int64) (release func(), err error) {
+	plan, err := database.GetUserPlan(userID)
+	if err != nil {
+		return nil, err
+	}
+	return reserveUpload("user:"+userID, plan, size, func() (int64, int64, error) {
+		return uploadTotals(personalUploads(userID))
+	})
+}
+
+// ReserveHostUpload is ReserveUpload for an upload to hostname, which must be a host the user can upload to
+// (ErrHostNotFound otherwise). Uploads to team hosts count against the team's plan and usage instead of the user's.
+func ReserveHostUpload(userID, hostname string, size int64) (release func(), err error) {
+	host, err := findUploadableHost(database.DB(), userID, hostname)
+	if err != nil {
+		return nil, err
+	}
+	if host.TeamID == nil {
+		return ReserveUpload(userID, size)
+	}
+	teamID := *host.TeamID
+	plan, err := database.GetTeamPlan(teamID)
+	if err != nil {
+		return nil, err
+	}
+	return reserveUpload("team:"+strconv.FormatUint(uint64(teamID), 10), plan, size, func() (int64, int64, error) {
+		hostnames, err := teamHostnames(teamID)
+		if err != nil {
+			return 0, 0, err
+		}
+		return uploadTotals(database.DB().Where("hostname IN ?", hostnames))
+	})
+}
+
+// reserveUpload checks plan's upload limits against the totals of key's stored uploads plus its pending ones,
+// then reserves the upload.
+func reserveUpload(key string, plan *database.Plan, size int64, totals func() (int64, int64, error)) (func(), error) {
+	if size < 0 {
+		return nil, ErrUploadLengthRequired
+	}
+	if plan.MaxUploadSize > 0 && size > plan.MaxUploadSize {
+		return nil, &PlanLimitError{Limit: LimitMaxUploadSize, Max: plan.MaxUploadSize}
+	}
+	pending := acquirePendingUsage(key)
+	if err := pending.reserve(plan, size, totals); err != nil {
+		releasePendingUsage(key, pending)
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			pending.mu.Lock()
+			pending.uploads--
+			pending.bytes -= size
+			pending.mu.Unlock()
+			releasePendingUsage(key, pending)
+		})
+	}, nil
+}
+
+// reserve checks plan's upload limits for an upload of size and counts it as pending if they allow it.
+func (p *pendingUsage) reserve(plan *database.Plan, size int64, totals func() (int64, int64, error)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if plan.MaxUploads > 0 || plan.StorageQuota > 0 {
+		uploads, storageBytes, err := totals()
+		if err != nil {
+			return err
+		}
+		if plan.MaxUploads > 0 && uploads+p.uploads >= int64(plan.MaxUploads) {
+			return &PlanLimitError{Limit: LimitUploads, Max: int64(plan.MaxUploads)}
+		}
+		if plan.StorageQuota > 0 && storageBytes+p.bytes+size > plan.StorageQuota {
+			return &PlanLimitError{Limit: LimitStorage, Max: plan.StorageQuota}
+		}
+	}
+	p.uploads++
+	p.bytes += size
+	return nil
+}
+
+// CheckTeamHostLimit returns a PlanLimitError if the team can't create another host on its plan.
+// Like CheckHostLimit, it is only an early check: the limit is enforced again when the host is created.
+func CheckTeamHostLimit(teamID uint) error {
+	return checkTeamHostLimit(database.DB(), teamID)
+}
+
+// checkTeamHostLimit is CheckTeamHostLimit as part of tx.
+func checkTeamHostLimit(tx *gorm.DB, teamID uint) error {
+	var team database.Team
+	if err := tx.Preload("Plan").First(&team, teamID).Error; err != nil {
+		return err
+	}
+	plan := team.Plan
+	if plan == nil {
+		plan = &database.Plan{}
+		if err := tx.First(plan, *database.DefaultPlanID()).Error; err != nil {
+			return err
+		}
+	}
+	if plan.MaxHosts <= 0 {
+		return nil
+	}
+	var hosts int64
+	if err := tx.Model(&database.Host{}).Where("team_id = ?", teamID).Count(&hosts).Error; err != nil {
+		return err
+	}
+	if hosts >= int64(plan.MaxHosts) {
+		return &PlanLimitError{Limit: LimitHosts, Max: int64(plan.MaxHosts)}
+	}
+	return nil
+}
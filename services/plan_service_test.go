@@ -0,0 +1,172 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/sharify-labs/spine/database"
+)
+
+// createTestUpload stores an upload of size bytes made by userID to hostname.
+func createTestUpload(t *testing.T, userID, hostname string, size int64) {
+	t.Helper()
+	if err := database.DB().Create(&database.Upload{
+		Size:       size,
+		StorageKey: fmt.Sprintf("key%d", testSeq.Add(1)),
+		Hostname:   hostname,
+		Secret:     "secret",
+		UserID:     userID,
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReserveHostUploadUsesTeamQuota(t *testing.T) {
+	owner, member := createTestUser(t), createTestUser(t)
+	team, err := CreateTeam(owner.ID, "uploaders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = AddTeamMember(owner.ID, team.ID, member.ID, TeamRoleMember); err != nil {
+		t.Fatal(err)
+	}
+	teamPlan := createTestPlan(t, 5)
+	teamPlan.MaxUploads = 2
+	if err = database.DB().Model(teamPlan).Update("max_uploads", teamPlan.MaxUploads).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err = database.SetTeamPlan(team.ID, teamPlan.ID); err != nil {
+		t.Fatal(err)
+	}
+	hostname := fmt.Sprintf("team%d.example", testSeq.Add(1))
+	if err = database.DB().Create(&database.Host{UserID: owner.ID, TeamID: &team.ID, Root: hostname}).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Uploads by any member count towards the team's quota
+	createTestUpload(t, owner.ID, hostname, 10)
+
+	release, err := ReserveHostUpload(member.ID, hostname, 10)
+	if err != nil {
+		t.Fatalf("first upload: %v", err)
+	}
+	defer release()
+	var limitErr *PlanLimitError
+	if _, err = ReserveHostUpload(member.ID, hostname, 10); !errors.As(err, &limitErr) || limitErr.Limit != LimitUploads {
+		t.Fatalf("err = %v, want the team's %s limit", err, LimitUploads)
+	}
+
+	// The member's own quota is unaffected
+	personal := fmt.Sprintf("member%d.example", testSeq.Add(1))
+	if err = database.DB().Create(&database.Host{UserID: member.ID, Root: personal}).Error; err != nil {
+		t.Fatal(err)
+	}
+	releasePersonal, err := ReserveHostUpload(member.ID, personal, 10)
+	if err != nil {
+		t.Fatalf("personal upload: %v", err)
+	}
+	releasePersonal()
+}
+
+func TestReserveHostUploadRejectsOtherHosts(t *testing.T) {
+	owner, other := createTestUser(t), createTestUser(t)
+	hostname := fmt.Sprintf("private%d.example", testSeq.Add(1))
+	if err := database.DB().Create(&database.Host{UserID: owner.ID, Root: hostname}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReserveHostUpload(other.ID, hostname, 10); !errors.Is(err, ErrHostNotFound) {
+		t.Fatalf("err = %v, want ErrHostNotFound", err)
+	}
+}
+
+func TestReserveUploadRequiresSize(t *testing.T) {
+	user := createTestUser(t)
+	if _, err := ReserveUpload(user.ID, -1); !errors.Is(err, ErrUploadLengthRequired) {
+		t.Fatalf("err = %v, want ErrUploadLengthRequired", err)
+	}
+}
+
+func TestReserveUploadRemovesIdlePendingUsage(t *testing.T) {
+	user := createTestUser(t)
+	key := "user:" + user.ID
+	pendingEntry := func() bool {
+		pendingUploads.Lock()
+		defer pendingUploads.Unlock()
+		_, ok := pendingUploads.byKey[key]
+		return ok
+	}
+
+	first, err := ReserveUpload(user.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ReserveUpload(user.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first()
+	first() // releasing twice must not drop the other reservation's reference
+	if !pendingEntry() {
+		t.Fatal("pending usage removed while an upload is still reserved")
+	}
+	second()
+	if pendingEntry() {
+		t.Fatal("pending usage kept after every upload was released")
+	}
+
+	// A rejected reservation doesn't leave an entry behind either
+	plan := &database.Plan{MaxUploads: 1}
+	if _, err = reserveUpload(key, plan, 1, func() (int64, int64, error) { return 1, 1, nil }); err == nil {
+		t.Fatal("reservation over the upload limit succeeded")
+	}
+	if pendingEntry() {
+		t.Fatal("pending usage kept after a rejected reservation")
+	}
+}
+
+func TestTeamHostUploadsCountOnce(t *testing.T) {
+	owner, member := createTestUser(t), createTestUser(t)
+	team, err := CreateTeam(owner.ID, "counted once")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = AddTeamMember(owner.ID, team.ID, member.ID, TeamRoleMember); err != nil {
+		t.Fatal(err)
+	}
+	hostname := fmt.Sprintf("team%d.example", testSeq.Add(1))
+	if err = database.DB().Create(&database.Host{UserID: owner.ID, TeamID: &team.ID, Root: hostname}).Error; err != nil {
+		t.Fatal(err)
+	}
+	personal := fmt.Sprintf("member%d.example", testSeq.Add(1))
+	createTestUpload(t, member.ID, hostname, 100)
+	createTestUpload(t, member.ID, personal, 10)
+
+	usage, err := computeUsage(member.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Uploads != 1 || usage.StorageBytes != 10 || len(usage.ByHost) != 1 || usage.ByHost[0].Hostname != personal {
+		t.Fatalf("personal usage = %+v, want only the upload to %s", usage, personal)
+	}
+	teamUsage, err := GetTeamUsage(team.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if teamUsage.Uploads != 1 || teamUsage.StorageBytes != 100 {
+		t.Fatalf("team usage = %+v, want only the upload to %s", teamUsage, hostname)
+	}
+
+	plan := createTestPlan(t, 5)
+	plan.StorageQuota = 50
+	if err = database.DB().Model(plan).Update("storage_quota", plan.StorageQuota).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err = database.SetUserPlan(member.ID, plan.ID); err != nil {
+		t.Fatal(err)
+	}
+	release, err := ReserveUpload(member.ID, 40)
+	if err != nil {
+		t.Fatalf("personal upload within quota: %v", err)
+	}
+	release()
+}
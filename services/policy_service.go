@@ -0,0 +1,85 @@
+package services
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/sharify-labs/spine/config"
+	"github.com/sharify-labs/spine/database"
+	"github.com/sharify-labs/spine/validators"
+)
+
+// subdomainPolicy applies to subdomains on shared (catalog) roots. Custom domains are exempt.
+var subdomainPolicy = &validators.SubdomainPolicy{}
+
+// SetupSubdomainPolicy loads the subdomain policy from env:
+// SUBDOMAIN_MIN_LENGTH, RESERVED_SUBDOMAINS (comma-separated), SUBDOMAIN_BLOCKED_PATTERNS (whitespace-separated
+// regular expressions) and SUBDOMAIN_PROFANITY_FILE (one word per line).
+// Panics if a pattern is invalid or the profanity file can't be read.
+func SetupSubdomainPolicy() {
+	reserved := validators.DefaultReservedSubdomains
+	if value := config.GetOrDefault("RESERVED_SUBDOMAINS", ""); value != "" {
+		reserved = strings.Split(value, ",")
+	}
+	var profanity []string
+	if path := config.GetOrDefault("SUBDOMAIN_PROFANITY_FILE", ""); path != "" {
+		var err error
+		if profanity, err = readWordList(path); err != nil {
+			panic("failed to read SUBDOMAIN_PROFANITY_FILE: " + err.Error())
+		}
+	}
+	policy, err := validators.NewSubdomainPolicy(
+		config.GetOrDefault("SUBDOMAIN_MIN_LENGTH", 3),
+		reserved,
+		strings.Fields(config.GetOrDefault("SUBDOMAIN_BLOCKED_PATTERNS", "")),
+		profanity,
+	)
+	if err != nil {
+		panic("invalid SUBDOMAIN_BLOCKED_PATTERNS: " + err.Error())
+	}
+	subdomainPolicy = policy
+}
+
+// readWordList reads a file with one word per line. Blank lines and lines starting with # are skipped.
+func readWordList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	return words, scanner.Err()
+}
+
+// CheckSubdomainPolicy returns a *validators.SubdomainRejectedError if the user may not register sub on a
+// catalog domain. Every label of a multi-level sub must pass the policy.
+// Admins and users with a matching database.SubdomainOverride (for the whole sub) bypass the policy.
+func CheckSubdomainPolicy(userID, sub string, domain *database.Domain) error {
+	if sub == "" || config.IsAdmin(userID) {
+		return nil
+	}
+	var policyErr error
+	for _, label := range strings.Split(sub, ".") {
+		if policyErr = subdomainPolicy.Check(label, domain.Name, domain.ReservedList()); policyErr != nil {
+			break
+		}
+	}
+	if policyErr == nil {
+		return nil
+	}
+	ok, err := database.HasSubdomainOverride(userID, sub, domain.Name)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	return policyErr
+}
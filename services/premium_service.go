@@ -0,0 +1,208 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sharify-labs/spine/config"
+	"github.com/sharify-labs/spine/database"
+	"gorm.io/gorm"
+)
+
+// What happens to hosts on premium roots when their owner's plan drops below the root's minimum plan.
+const (
+	PremiumDowngradeKeep    = "keep"    // hosts keep working, but no new ones can be created
+	PremiumDowngradeRelease = "release" // hosts are flagged and released after a grace period
+)
+
+// PlanRequiredError is returned when a root domain requires a more expensive plan than the User's.
+type PlanRequiredError struct {
+	Root string
+	Plan string
+}
+
+func (e *PlanRequiredError) Error() string {
+	return e.Root + " requires the " + e.Plan + " plan or higher"
+}
+
+// premiumDowngradePolicy returns what happens to hosts on roots above their owner's plan
+// (PREMIUM_DOWNGRADE_POLICY) and how long they are kept before being released (PREMIUM_RELEASE_GRACE_PERIOD).
+func premiumDowngradePolicy() (policy string, grace time.Duration) {
+	return config.GetOrDefault("PREMIUM_DOWNGRADE_POLICY", PremiumDowngradeKeep),
+		config.GetOrDefault("PREMIUM_RELEASE_GRACE_PERIOD", 7*24*time.Hour)
+}
+
+// meetsMinPlan reports whether plan is minPlan or costs at least as much.
+func meetsMinPlan(plan, minPlan *database.Plan) bool {
+	return minPlan == nil || plan.ID == minPlan.ID || plan.Price >= minPlan.Price
+}
+
+// checkRootPlan returns a PlanRequiredError if the owner's plan is below the domain's minimum plan.
+// The minimum plan is read as part of tx.
+func checkRootPlan(tx *gorm.DB, d *database.Domain, ownerPlan func() (*database.Plan, error)) error {
+	if d.MinPlanID == nil {
+		return nil
+	}
+	plan, err := ownerPlan()
+	if err != nil {
+		return err
+	}
+	var minPlan database.Plan
+	if err = tx.First(&minPlan, *d.MinPlanID).Error; err != nil {
+		return err
+	}
+	if !meetsMinPlan(plan, &minPlan) {
+		return &PlanRequiredError{Root: d.Name, Plan: minPlan.Name}
+	}
+	return nil
+}
+
+// lockedDomains returns the name of the plan required by each of the domains that is above the user's plan,
+// keyed by domain name.
+func lockedDomains(userID string, domains []*database.Domain) (map[string]string, error) {
+	res := make(map[string]string)
+	var plan *database.Plan
+	var plans map[uint]*database.Plan
+	for _, d := range domains {
+		if d.MinPlanID == nil {
+			continue
+		}
+		if plan == nil {
+			var err error
+			if plan, err = database.GetUserPlan(userID); err != nil {
+				return nil, err
+			}
+			if plans, err = planIndex(); err != nil {
+				return nil, err
+			}
+		}
+		if minPlan := plans[*d.MinPlanID]; !meetsMinPlan(plan, minPlan) {
+			res[d.Name] = minPlan.Name
+		}
+	}
+	return res, nil
+}
+
+// planIndex returns every plan keyed by ID.
+func planIndex() (map[uint]*database.Plan, error) {
+	plans, err := database.ListPlans()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[uint]*database.Plan, len(plans))
+	for _, p := range plans {
+		res[p.ID] = p
+	}
+	return res, nil
+}
+
+// ReleaseIneligibleHosts applies PREMIUM_DOWNGRADE_POLICY to hosts on roots that require a more expensive plan
+// than their owner's (the team's plan for team hosts).
+// With the release policy, such hosts are flagged and their owner is warned. Flagged hosts whose owner upgrades
+// (or whose root stops requiring a plan) are unflagged; the others are deleted once PREMIUM_RELEASE_GRACE_PERIOD
+// has passed. With the keep policy, hosts are never released and existing flags are cleared.
+func ReleaseIneligibleHosts(ctx context.Context) error {
+	policy, grace := premiumDowngradePolicy()
+	if policy != PremiumDowngradeRelease {
+		return database.DB().Model(&database.Host{}).Where("flagged_ineligible_at IS NOT NULL").
+			Update("flagged_ineligible_at", nil).Error
+	}
+	domains, err := getCatalog()
+	if err != nil {
+		return err
+	}
+	minPlans := make(map[string]uint)
+	roots := make([]string, 0)
+	for _, d := range domains {
+		if d.MinPlanID != nil {
+			minPlans[d.Name] = *d.MinPlanID
+			roots = append(roots, d.Name)
+		}
+	}
+	var hosts []*database.Host
+	if err = database.DB().Preload("User").Where(
+		"root IN ? OR flagged_ineligible_at IS NOT NULL", roots,
+	).Find(&hosts).Error; err != nil {
+		return err
+	}
+	plans, err := planIndex()
+	if err != nil {
+		return err
+	}
+
+	ownerPlans := make(map[string]*database.Plan) // "user:<id>" or "team:<id>" -> plan
+	ownerPlan := func(h *database.Host) (*database.Plan, error) {
+		key := "user:" + h.UserID
+		if h.TeamID != nil {
+			key = fmt.Sprintf("team:%d", *h.TeamID)
+		}
+		if plan, ok := ownerPlans[key]; ok {
+			return plan, nil
+		}
+		var plan *database.Plan
+		var err error
+		if h.TeamID != nil {
+			plan, err = database.GetTeamPlan(*h.TeamID)
+		} else {
+			plan, err = database.GetUserPlan(h.UserID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ownerPlans[key] = plan
+		return plan, nil
+	}
+
+	now := time.Now().UTC()
+	var errs []error
+	for _, h := range hosts {
+		var minPlan *database.Plan
+		if id, ok := minPlans[h.Root]; ok {
+			minPlan = plans[id]
+		}
+		plan, err := ownerPlan(h)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("plan of %s: %w", h.Hostname(), err))
+			continue
+		}
+		eligible := meetsMinPlan(plan, minPlan)
+		switch {
+		case !eligible && h.FlaggedIneligibleAt == nil:
+			errs = append(errs, flagIneligibleHost(h, minPlan, now, now.Add(grace)))
+		case eligible && h.FlaggedIneligibleAt != nil:
+			errs = append(errs, unflagHost(h, releaseIneligible))
+		case !eligible && now.After(h.FlaggedIneligibleAt.Add(grace)):
+			errs = append(errs, releaseHost(ctx, h, releaseIneligible, now.Add(-grace)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flagIneligibleHost flags a host on a root above its owner's plan and warns its owners by email if possible.
+func flagIneligibleHost(h *database.Host, minPlan *database.Plan, now, releaseAt time.Time) error {
+	return flagHost(h, releaseIneligible, now, fmt.Sprintf(
+		"%s requires the %s plan or higher, which your plan no longer includes. %s will be released on %s "+
+			"and become available to other users.\n\nUpgrade your plan before then to keep it.",
+		h.Root, minPlan.Name, h.Hostname(), releaseAt.Format("January 2, 2006"),
+	))
+}
+
+// ListIneligibleHosts returns when each of the user's hosts (and their teams' hosts) that is flagged for being on
+// a root above its owner's plan will be released, keyed by hostname.
+func ListIneligibleHosts(userID string) (map[string]time.Time, error) {
+	var hosts []*database.Host
+	if err := database.DB().Where("flagged_ineligible_at IS NOT NULL").Where(
+		"(user_id = ? AND team_id IS NULL) OR team_id IN (?)",
+		userID, database.DB().Model(&database.TeamMember{}).Select("team_id").Where("user_id = ?", userID),
+	).Find(&hosts).Error; err != nil {
+		return nil, err
+	}
+	_, grace := premiumDowngradePolicy()
+	res := make(map[string]time.Time, len(hosts))
+	for _, h := range hosts {
+		res[h.Hostname()] = h.FlaggedIneligibleAt.Add(grace)
+	}
+	return res, nil
+}
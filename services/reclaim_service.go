@@ -0,0 +1,111 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sharify-labs/spine/config"
+	"github.com/sharify-labs/spine/database"
+)
+
+// reclaimPolicy returns how long hosts on shared roots may go without uploads before being flagged
+// (HOST_INACTIVITY_PERIOD, 0 disables reclaiming) and how long flagged hosts are kept before being released
+// (HOST_RECLAIM_GRACE_PERIOD).
+func reclaimPolicy() (inactivity, grace time.Duration) {
+	return config.GetOrDefault("HOST_INACTIVITY_PERIOD", time.Duration(0)),
+		config.GetOrDefault("HOST_RECLAIM_GRACE_PERIOD", 14*24*time.Hour)
+}
+
+// ReclaimInactiveHosts releases hosts on shared root domains that nobody uploads to.
+// A host is active as of its most recent upload (or its creation if it has none). Hosts inactive for longer than
+// HOST_INACTIVITY_PERIOD are flagged and their owner is warned. Flagged hosts that get an upload are unflagged;
+// the others are deleted once HOST_RECLAIM_GRACE_PERIOD has passed, so that the hostname can be registered again.
+// Hosts on custom domains are never reclaimed.
+func ReclaimInactiveHosts(ctx context.Context) error {
+	inactivity, grace := reclaimPolicy()
+	if inactivity <= 0 {
+		return nil
+	}
+	domains, err := getCatalog()
+	if err != nil {
+		return err
+	}
+	roots := make([]string, 0, len(domains))
+	for _, d := range domains {
+		roots = append(roots, d.Name)
+	}
+	var hosts []*database.Host
+	if err = database.DB().Preload("User").Where("root IN ?", roots).Find(&hosts).Error; err != nil {
+		return err
+	}
+	lastUploads, err := lastUploadTimes()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	var errs []error
+	for _, h := range hosts {
+		lastActive := h.CreatedAt
+		if t, ok := lastUploads[h.Hostname()]; ok && t.After(lastActive) {
+			lastActive = t
+		}
+		switch {
+		case h.FlaggedInactiveAt == nil:
+			if now.Sub(lastActive) >= inactivity {
+				errs = append(errs, flagInactiveHost(h, now, now.Add(grace)))
+			}
+		case lastActive.After(*h.FlaggedInactiveAt):
+			errs = append(errs, unflagHost(h, releaseInactive))
+		case now.After(h.FlaggedInactiveAt.Add(grace)):
+			errs = append(errs, releaseHost(ctx, h, releaseInactive, now.Add(-grace)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// lastUploadTimes returns the time of the most recent upload to each hostname, including deleted uploads.
+func lastUploadTimes() (map[string]time.Time, error) {
+	var uploads []*database.Upload
+	// Note: Selecting MAX(created_at) per hostname doesn't scan into time.Time with every driver, so the newest
+	// upload of each hostname is loaded instead.
+	if err := database.DB().Unscoped().Select("hostname", "created_at").Where(
+		"id IN (?)", database.DB().Unscoped().Model(&database.Upload{}).Select("MAX(id)").Group("hostname"),
+	).Find(&uploads).Error; err != nil {
+		return nil, err
+	}
+	res := make(map[string]time.Time, len(uploads))
+	for _, u := range uploads {
+		res[u.Hostname] = u.CreatedAt
+	}
+	return res, nil
+}
+
+// flagInactiveHost flags a host for reclaiming and warns its owners by email if possible.
+func flagInactiveHost(h *database.Host, now, releaseAt time.Time) error {
+	return flagHost(h, releaseInactive, now, fmt.Sprintf(
+		"Nothing has been uploaded to %s in a while, so it will be released on %s and become available "+
+			"to other users.\n\nUpload anything to %s before then to keep it.",
+		h.Hostname(), releaseAt.Format("January 2, 2006"), h.Hostname(),
+	))
+}
+
+// ListFlaggedHosts returns when each of the user's hosts (and their teams' hosts) that is flagged as inactive will
+// be released, keyed by hostname.
+func ListFlaggedHosts(userID string) (map[string]time.Time, error) {
+	var hosts []*database.Host
+	if err := database.DB().Where("flagged_inactive_at IS NOT NULL").Where(
+		"(user_id = ? AND team_id IS NULL) OR team_id IN (?)",
+		userID, database.DB().Model(&database.TeamMember{}).Select("team_id").Where("user_id = ?", userID),
+	).Find(&hosts).Error; err != nil {
+		return nil, err
+	}
+	_, grace := reclaimPolicy()
+	res := make(map[string]time.Time, len(hosts))
+	for _, h := range hosts {
+		res[h.Hostname()] = h.FlaggedInactiveAt.Add(grace)
+	}
+	return res, nil
+}
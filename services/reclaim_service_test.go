@@ -0,0 +1,99 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sharify-labs/spine/clients"
+	"github.com/sharify-labs/spine/database"
+	"gorm.io/gorm"
+)
+
+// fakeMail records the recipients of the emails it sends.
+type fakeMail struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (m *fakeMail) Connect()      {}
+func (m *fakeMail) Enabled() bool { return true }
+
+func (m *fakeMail) Send(to, _, _ string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, to)
+	return nil
+}
+
+// useFakeMail replaces clients.Mail with a fakeMail for the duration of the test.
+func useFakeMail(t *testing.T) *fakeMail {
+	t.Helper()
+	fake := &fakeMail{}
+	prev := clients.Mail
+	clients.Mail = fake
+	t.Cleanup(func() { clients.Mail = prev })
+	return fake
+}
+
+func TestFlagInactiveTeamHostNotifiesTeamOwner(t *testing.T) {
+	mail := useFakeMail(t)
+	owner, member := createTestUser(t), createTestUser(t)
+	team, err := CreateTeam(owner.ID, "reclaimed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = AddTeamMember(owner.ID, team.ID, member.ID, TeamRoleMember); err != nil {
+		t.Fatal(err)
+	}
+	hostname := fmt.Sprintf("idle%d.example", testSeq.Add(1))
+	host := &database.Host{UserID: member.ID, TeamID: &team.ID, Root: hostname}
+	if err = database.DB().Create(host).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err = database.DB().Preload("User").First(host, host.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	if err = flagInactiveHost(host, now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(mail.sent)
+	want := []string{owner.Email, member.Email}
+	slices.Sort(want)
+	if !slices.Equal(mail.sent, want) {
+		t.Fatalf("emails sent to %v, want %v", mail.sent, want)
+	}
+}
+
+func TestReleaseHostOnlyReleasesHostsFlaggedForTheReason(t *testing.T) {
+	user := createTestUser(t)
+	flaggedAt := time.Now().UTC().Add(-time.Hour)
+	host := &database.Host{
+		UserID:            user.ID,
+		Root:              fmt.Sprintf("idle%d.example", testSeq.Add(1)),
+		FlaggedInactiveAt: &flaggedAt,
+	}
+	if err := database.DB().Create(host).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := releaseHost(ctx, host, releaseIneligible, time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.DB().First(&database.Host{}, host.ID).Error; err != nil {
+		t.Fatalf("host flagged as inactive was released as ineligible: %v", err)
+	}
+	if err := releaseHost(ctx, host, releaseInactive, time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.DB().First(&database.Host{}, host.ID).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("err = %v, want the host to be released", err)
+	}
+}
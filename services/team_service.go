@@ -0,0 +1,341 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/sharify-labs/spine/database"
+	"gorm.io/gorm"
+)
+
+// TeamRole is a member's role in a team (see database.TeamMember).
+// Owners can do everything, including deleting the team and changing roles.
+// Admins can manage members and the team's hosts and token. Members can upload to the team's hosts.
+type TeamRole string
+
+const (
+	TeamRoleOwner  TeamRole = "owner"
+	TeamRoleAdmin  TeamRole = "admin"
+	TeamRoleMember TeamRole = "member"
+)
+
+// teamTokenPrefix distinguishes team upload tokens from user upload tokens (zephyrTokenPrefix).
+const teamTokenPrefix string = "sfyt"
+
+var (
+	ErrTeamNotFound       = errors.New("team not found")
+	ErrTeamForbidden      = errors.New("your role in this team doesn't allow this")
+	ErrTeamMemberNotFound = errors.New("team member not found")
+	ErrTeamMemberExists   = errors.New("user is already a member of this team")
+	ErrTeamOwnerRequired  = errors.New("the team owner can't leave or be removed")
+	ErrInvalidTeamRole    = errors.New("role must be admin or member")
+	ErrInvalidTeamName    = errors.New("team name must be between 1 and 64 characters")
+
+	ErrInvalidTeamUploadAction = errors.New("a team's uploads must be kept or deleted")
+)
+
+// rank orders roles from least to most privileged.
+func (r TeamRole) rank() int {
+	switch r {
+	case TeamRoleOwner:
+		return 3
+	case TeamRoleAdmin:
+		return 2
+	case TeamRoleMember:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Team describes a team and the viewing user's role in it.
+type Team struct {
+	ID        uint          `json:"id"`
+	Name      string        `json:"name"`
+	Role      TeamRole      `json:"role"`
+	Members   []*TeamMember `json:"members,omitempty"`
+	Hostnames []string      `json:"hostnames,omitempty"`
+}
+
+// TeamMember is a user's membership in a team.
+type TeamMember struct {
+	UserID string   `json:"user_id"`
+	Role   TeamRole `json:"role"`
+}
+
+// ListTeams returns the teams the user is a member of.
+func ListTeams(userID string) ([]*Team, error) {
+	var memberships []*database.TeamMember
+	if err := database.DB().Joins("Team").Where(&database.TeamMember{
+		UserID: userID,
+	}).Order("Team.name").Find(&memberships).Error; err != nil {
+		return nil, err
+	}
+	res := make([]*Team, 0, len(memberships))
+	for _, m := range memberships {
+		res = append(res, &Team{
+			ID:   m.TeamID,
+			Name: m.Team.Name,
+			Role: TeamRole(m.Role),
+		})
+	}
+	return res, nil
+}
+
+// GetTeam returns a team with its members and hostnames. The user must be a member.
+func GetTeam(userID string, teamID uint) (*Team, error) {
+	role, err := requireTeamRole(database.DB(), userID, teamID, TeamRoleMember)
+	if err != nil {
+		return nil, err
+	}
+	var team database.Team
+	if err = database.DB().Preload("Members").Preload("Hosts").First(&team, teamID).Error; err != nil {
+		return nil, err
+	}
+	res := &Team{
+		ID:        team.ID,
+		Name:      team.Name,
+		Role:      role,
+		Members:   make([]*TeamMember, 0, len(team.Members)),
+		Hostnames: make([]string, 0, len(team.Hosts)),
+	}
+	for _, m := range team.Members {
+		res.Members = append(res.Members, &TeamMember{UserID: m.UserID, Role: TeamRole(m.Role)})
+	}
+	for _, h := range team.Hosts {
+		res.Hostnames = append(res.Hostnames, h.Hostname())
+	}
+	return res, nil
+}
+
+// CreateTeam creates a team on the default plan with the user as its owner.
+func CreateTeam(userID, name string) (*Team, error) {
+	if name = strings.TrimSpace(name); name == "" || len([]rune(name)) > 64 {
+		return nil, ErrInvalidTeamName
+	}
+	team := &database.Team{
+		Name:   name,
+		PlanID: database.DefaultPlanID(),
+		Members: []database.TeamMember{{
+			UserID: userID,
+			Role:   string(TeamRoleOwner),
+		}},
+	}
+	if err := database.DB().Create(team).Error; err != nil {
+		return nil, err
+	}
+	return &Team{ID: team.ID, Name: team.Name, Role: TeamRoleOwner}, nil
+}
+
+// DeleteTeam deletes a team along with its hosts (and their DNS records), members and token.
+// Only the owner can delete a team. Each host is deleted like DeleteWithUploads, cancelling its pending transfers:
+// uploads made to the team's hosts are either kept by the members who made them, or deleted in a background job per
+// host, which is returned.
+func DeleteTeam(ctx context.Context, userID string, teamID uint, action UploadAction) ([]*HostDeletion, error) {
+	if action != UploadActionKeep && action != UploadActionDelete && action != "" {
+		return nil, ErrInvalidTeamUploadAction
+	}
+	var hosts []*Host
+	var jobs []*database.HostDeletion
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		if _, err := requireTeamRole(tx, userID, teamID, TeamRoleOwner); err != nil {
+			return err
+		}
+		var teamHosts []*database.Host
+		if err := tx.Where("team_id = ?", teamID).Find(&teamHosts).Error; err != nil {
+			return err
+		}
+		for _, th := range teamHosts {
+			h := &Host{Full: th.Hostname(), Sub: th.Sub, Root: th.Root, UserID: userID, TeamID: &teamID}
+			job, err := h.deleteWithUploads(tx, action, "")
+			if err != nil {
+				return err
+			}
+			hosts = append(hosts, h)
+			if job != nil {
+				jobs = append(jobs, job)
+			}
+		}
+		for _, model := range []interface{}{&database.TeamMember{}, &database.TeamToken{}} {
+			if err := tx.Unscoped().Where("team_id = ?", teamID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&database.Team{}, teamID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hosts {
+		if err = releaseDNSRecord(ctx, h.Sub, h.Root); err != nil {
+			return nil, err
+		}
+	}
+	deletions := make([]*HostDeletion, 0, len(jobs))
+	for _, job := range jobs {
+		startHostDeletion(job.ID)
+		deletions = append(deletions, newHostDeletion(job))
+	}
+	return deletions, nil
+}
+
+// AddTeamMember adds a user to a team with the given role (admin or member).
+// Admins can add members; only the owner can add admins.
+func AddTeamMember(userID string, teamID uint, memberID string, role TeamRole) error {
+	if role != TeamRoleAdmin && role != TeamRoleMember {
+		return ErrInvalidTeamRole
+	}
+	return database.DB().Transaction(func(tx *gorm.DB) error {
+		actorRole, err := requireTeamRole(tx, userID, teamID, TeamRoleAdmin)
+		if err != nil {
+			return err
+		}
+		if role.rank() >= actorRole.rank() && actorRole != TeamRoleOwner {
+			return ErrTeamForbidden
+		}
+		if err = tx.First(&database.User{}, "id = ?", memberID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRecipientNotFound
+			}
+			return err
+		}
+		err = tx.Create(&database.TeamMember{
+			TeamID: teamID,
+			UserID: memberID,
+			Role:   string(role),
+		}).Error
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return ErrTeamMemberExists
+		}
+		return err
+	})
+}
+
+// SetTeamMemberRole changes a member's role to admin or member. Only the owner can change roles.
+func SetTeamMemberRole(userID string, teamID uint, memberID string, role TeamRole) error {
+	if role != TeamRoleAdmin && role != TeamRoleMember {
+		return ErrInvalidTeamRole
+	}
+	return database.DB().Transaction(func(tx *gorm.DB) error {
+		if _, err := requireTeamRole(tx, userID, teamID, TeamRoleOwner); err != nil {
+			return err
+		}
+		res := tx.Model(&database.TeamMember{}).
+			Where("team_id = ? AND user_id = ? AND role <> ?", teamID, memberID, TeamRoleOwner).
+			Update("role", string(role))
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrTeamMemberNotFound
+		}
+		return nil
+	})
+}
+
+// RemoveTeamMember removes a member from a team. Members can remove themselves (leave).
+// Admins can remove members, and the owner can remove anyone but themselves.
+func RemoveTeamMember(userID string, teamID uint, memberID string) error {
+	return database.DB().Transaction(func(tx *gorm.DB) error {
+		actorRole, err := requireTeamRole(tx, userID, teamID, TeamRoleMember)
+		if err != nil {
+			return err
+		}
+		memberRole, err := getTeamRole(tx, memberID, teamID)
+		if errors.Is(err, ErrTeamNotFound) {
+			return ErrTeamMemberNotFound
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case memberRole == TeamRoleOwner:
+			return ErrTeamOwnerRequired
+		case memberID != userID && actorRole.rank() <= memberRole.rank():
+			return ErrTeamForbidden
+		}
+		return tx.Unscoped().Where("team_id = ? AND user_id = ?", teamID, memberID).Delete(&database.TeamMember{}).Error
+	})
+}
+
+// RequireTeamAdmin returns ErrTeamForbidden unless the user is an admin or the owner of the team.
+func RequireTeamAdmin(userID string, teamID uint) error {
+	_, err := requireTeamRole(database.DB(), userID, teamID, TeamRoleAdmin)
+	return err
+}
+
+// requireTeamRole returns the user's role in a team if it's at least min.
+// Returns ErrTeamNotFound if the user isn't a member, so that teams can't be discovered by ID.
+func requireTeamRole(tx *gorm.DB, userID string, teamID uint, min TeamRole) (TeamRole, error) {
+	role, err := getTeamRole(tx, userID, teamID)
+	if err != nil {
+		return "", err
+	}
+	if role.rank() < min.rank() {
+		return "", ErrTeamForbidden
+	}
+	return role, nil
+}
+
+// getTeamOwner returns the user who owns a team.
+func getTeamOwner(tx *gorm.DB, teamID uint) (*database.User, error) {
+	var member database.TeamMember
+	if err := tx.Preload("User").Where(&database.TeamMember{
+		TeamID: teamID,
+		Role:   string(TeamRoleOwner),
+	}).First(&member).Error; err != nil {
+		return nil, err
+	}
+	return &member.User, nil
+}
+
+func getTeamRole(tx *gorm.DB, userID string, teamID uint) (TeamRole, error) {
+	var member database.TeamMember
+	if err := tx.Where(&database.TeamMember{
+		TeamID: teamID,
+		UserID: userID,
+	}).First(&member).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", ErrTeamNotFound
+		}
+		return "", err
+	}
+	return TeamRole(member.Role), nil
+}
+
+// NewTeamToken generates a new upload token for a team, replacing its previous one.
+// Team tokens have the same format as user tokens (see NewZephyrToken), but use the "sfyt" prefix,
+// and Zephyr only accepts them for uploads to the team's own hosts.
+func NewTeamToken(teamID uint) (*ZephyrToken, error) {
+	tokenID, err := GenerateRandomBytes(8)
+	if err != nil {
+		return nil, err
+	}
+	key, err := GenerateRandomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := Hash(key)
+	if err != nil {
+		return nil, err
+	}
+	err = database.DB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("team_id = ?", teamID).Delete(&database.TeamToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&database.TeamToken{
+			ID:     base64.RawURLEncoding.EncodeToString(tokenID),
+			Hash:   base64.RawURLEncoding.EncodeToString(hash),
+			TeamID: teamID,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ZephyrToken{
+		Value: teamTokenPrefix + "_" + hex.EncodeToString(tokenID) + "_" + hex.EncodeToString(key),
+	}, nil
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/sharify-labs/spine/database"
+)
+
+func TestNewTeamTokenReplacesPreviousToken(t *testing.T) {
+	owner := createTestUser(t)
+	team, err := CreateTeam(owner.ID, "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewTeamToken(team.ID); err != nil {
+		t.Fatal(err)
+	}
+	token, err := NewTeamToken(team.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token.Value, "_")
+	if len(parts) != 3 || parts[0] != teamTokenPrefix {
+		t.Fatalf("token = %q, want %s_<id>_<key>", token.Value, teamTokenPrefix)
+	}
+	var stored []database.TeamToken
+	if err = database.DB().Where("team_id = ?", team.ID).Find(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 {
+		t.Fatalf("team has %d tokens, want 1", len(stored))
+	}
+	id, _ := hex.DecodeString(parts[1])
+	key, _ := hex.DecodeString(parts[2])
+	hash, _ := Hash(key)
+	if stored[0].ID != base64.RawURLEncoding.EncodeToString(id) ||
+		stored[0].Hash != base64.RawURLEncoding.EncodeToString(hash) {
+		t.Fatal("stored token doesn't match the latest token")
+	}
+
+	if _, err = DeleteTeam(context.Background(), owner.ID, team.ID, UploadActionKeep); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	err = database.DB().Unscoped().Model(&database.TeamToken{}).Where("team_id = ?", team.ID).Count(&count).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatal("deleting the team didn't revoke its token")
+	}
+}
+
+func TestDeleteTeamDeletesHostsLikeDeleteWithUploads(t *testing.T) {
+	zephyr := useFakeZephyrUploads(t)
+	zephyr.ok = true
+	owner, other := createTestUser(t), createTestUser(t)
+	team, err := CreateTeam(owner.ID, "doomed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname := fmt.Sprintf("team%d.example", testSeq.Add(1))
+	host := &database.Host{UserID: owner.ID, TeamID: &team.ID, Root: hostname}
+	if err = database.DB().Create(host).Error; err != nil {
+		t.Fatal(err)
+	}
+	createTestUpload(t, owner.ID, hostname, 10)
+	transfer := &database.HostTransfer{HostID: host.ID, FromUserID: owner.ID, ToUserID: other.ID, Status: TransferPending}
+	if err = database.DB().Create(transfer).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = DeleteTeam(context.Background(), owner.ID, team.ID, UploadActionMove)
+	if !errors.Is(err, ErrInvalidTeamUploadAction) {
+		t.Fatalf("err = %v, want ErrInvalidTeamUploadAction", err)
+	}
+	jobs, err := DeleteTeam(context.Background(), owner.ID, team.ID, UploadActionDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Hostname != hostname || jobs[0].Total != 1 {
+		t.Fatalf("jobs = %+v, want one job deleting the upload to %s", jobs, hostname)
+	}
+	if err = database.DB().First(&database.Host{}, host.ID).Error; err == nil {
+		t.Fatal("team host wasn't deleted")
+	}
+	if status := transferStatus(t, transfer.ID); status != TransferCancelled {
+		t.Fatalf("transfer status = %s, want %s", status, TransferCancelled)
+	}
+	hostDeletionsStarted.Wait()
+	if job := getTestHostDeletion(t, jobs[0].ID); job.Status != HostDeletionCompleted {
+		t.Fatalf("job status = %s, want %s", job.Status, HostDeletionCompleted)
+	}
+}
@@ -0,0 +1,252 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"github.com/sharify-labs/spine/database"
+	"gorm.io/gorm"
+)
+
+// Host transfer statuses (see database.HostTransfer).
+const (
+	TransferPending   = "pending"
+	TransferAccepted  = "accepted"
+	TransferDeclined  = "declined"
+	TransferCancelled = "cancelled"
+)
+
+var (
+	ErrHostNotFound        = errors.New("host not found")
+	ErrTransferNotFound    = errors.New("transfer not found")
+	ErrTransferPending     = errors.New("host already has a pending transfer")
+	ErrTransferToSelf      = errors.New("can't transfer a host to yourself")
+	ErrRecipientNotFound   = errors.New("recipient not found")
+	ErrTransferNotPossible = errors.New("host no longer belongs to the sender")
+)
+
+// HostTransfer describes a pending or resolved host transfer.
+// Incoming is true if the User viewing it is the recipient.
+type HostTransfer struct {
+	ID         uint       `json:"id"`
+	Hostname   string     `json:"hostname"`
+	FromUserID string     `json:"from_user_id"`
+	ToUserID   string     `json:"to_user_id"`
+	Status     string     `json:"status"`
+	Incoming   bool       `json:"incoming"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+func newHostTransfer(t *database.HostTransfer, userID string) *HostTransfer {
+	return &HostTransfer{
+		ID:         t.ID,
+		Hostname:   t.Host.Hostname(),
+		FromUserID: t.FromUserID,
+		ToUserID:   t.ToUserID,
+		Status:     t.Status,
+		Incoming:   t.ToUserID == userID,
+		CreatedAt:  t.CreatedAt,
+		ResolvedAt: t.ResolvedAt,
+	}
+}
+
+// ListPendingTransfers returns the user's incoming and outgoing pending transfers.
+func ListPendingTransfers(userID string) ([]*HostTransfer, error) {
+	var transfers []*database.HostTransfer
+	// Transfers of hosts deleted before their transfers were cancelled on deletion are skipped
+	if err := database.DB().InnerJoins("Host").
+		Where("(from_user_id = ? OR to_user_id = ?) AND status = ?", userID, userID, TransferPending).
+		Order("host_transfers.created_at").Find(&transfers).Error; err != nil {
+		return nil, err
+	}
+	res := make([]*HostTransfer, 0, len(transfers))
+	for _, t := range transfers {
+		res = append(res, newHostTransfer(t, userID))
+	}
+	return res, nil
+}
+
+// RequestTransfer starts transferring one of the user's hosts to another user.
+// The host stays with the sender until the recipient accepts.
+func RequestTransfer(host *Host, toUserID string) (*HostTransfer, error) {
+	if toUserID == host.UserID {
+		return nil, ErrTransferToSelf
+	}
+	var transfer *database.HostTransfer
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		var h database.Host
+		// Team hosts can't be transferred
+		if err := tx.Where(map[string]interface{}{
+			"sub":     host.Sub,
+			"root":    host.Root,
+			"user_id": host.UserID,
+			"team_id": nil,
+		}).First(&h).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrHostNotFound
+			}
+			return err
+		}
+		if err := tx.First(&database.User{}, "id = ?", toUserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRecipientNotFound
+			}
+			return err
+		}
+		var pending int64
+		if err := tx.Model(&database.HostTransfer{}).Where(&database.HostTransfer{
+			HostID: h.ID,
+			Status: TransferPending,
+		}).Count(&pending).Error; err != nil {
+			return err
+		}
+		if pending > 0 {
+			return ErrTransferPending
+		}
+
+		transfer = &database.HostTransfer{
+			HostID:     h.ID,
+			Host:       h,
+			FromUserID: host.UserID,
+			ToUserID:   toUserID,
+			Status:     TransferPending,
+		}
+		if err := tx.Omit("Host", "FromUser", "ToUser").Create(transfer).Error; err != nil {
+			return err
+		}
+		return recordAuditEvent(tx, AuditHostTransferRequested, host.Full, host.UserID, host.UserID, toUserID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newHostTransfer(transfer, host.UserID), nil
+}
+
+// AcceptTransfer moves the host of a pending transfer to its recipient.
+// The recipient's host limit applies, and they must be allowed to use the host's root (see checkTransferRoot).
+// Uploads already made to the hostname stay with the sender and keep working.
+func AcceptTransfer(userID string, transferID uint) (*HostTransfer, error) {
+	transfer, err := resolveTransfer(transferID, TransferAccepted, func(t *database.HostTransfer) bool {
+		return t.ToUserID == userID
+	}, func(tx *gorm.DB, t *database.HostTransfer) error {
+		if err := checkHostLimit(tx, t.ToUserID); err != nil {
+			return err
+		}
+		if err := checkTransferRoot(tx, t.ToUserID, t.Host.Root); err != nil {
+			return err
+		}
+		// Only move the host if it still belongs to the sender
+		res := tx.Model(&database.Host{}).
+			Where("id = ? AND user_id = ?", t.HostID, t.FromUserID).
+			Update("user_id", t.ToUserID)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrTransferNotPossible
+		}
+		return nil
+	}, userID, AuditHostTransferAccepted)
+	if err != nil {
+		return nil, err
+	}
+	InvalidateUsage(transfer.FromUserID)
+	InvalidateUsage(transfer.ToUserID)
+	return newHostTransfer(transfer, userID), nil
+}
+
+// DeclineTransfer rejects a pending transfer to the user.
+func DeclineTransfer(userID string, transferID uint) (*HostTransfer, error) {
+	transfer, err := resolveTransfer(transferID, TransferDeclined, func(t *database.HostTransfer) bool {
+		return t.ToUserID == userID
+	}, nil, userID, AuditHostTransferDeclined)
+	if err != nil {
+		return nil, err
+	}
+	return newHostTransfer(transfer, userID), nil
+}
+
+// CancelTransfer withdraws a pending transfer from the user.
+func CancelTransfer(userID string, transferID uint) (*HostTransfer, error) {
+	transfer, err := resolveTransfer(transferID, TransferCancelled, func(t *database.HostTransfer) bool {
+		return t.FromUserID == userID
+	}, nil, userID, AuditHostTransferCancelled)
+	if err != nil {
+		return nil, err
+	}
+	return newHostTransfer(transfer, userID), nil
+}
+
+// cancelHostTransfers cancels the pending transfers of the hosts whose IDs are selected by hostIDs
+// (a slice or a subquery), since deleted hosts can't be transferred. Must be called in the transaction that deletes
+// the hosts, before they are deleted. Both sides get an audit event with actorID as the actor.
+func cancelHostTransfers(tx *gorm.DB, hostIDs interface{}, actorID string) error {
+	var transfers []*database.HostTransfer
+	if err := tx.Joins("Host").
+		Where("host_transfers.host_id IN (?) AND host_transfers.status = ?", hostIDs, TransferPending).
+		Find(&transfers).Error; err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, t := range transfers {
+		if err := tx.Model(&database.HostTransfer{}).Where("id = ?", t.ID).
+			Updates(map[string]interface{}{"status": TransferCancelled, "resolved_at": now}).Error; err != nil {
+			return err
+		}
+		if err := recordAuditEvent(
+			tx, AuditHostTransferCancelled, t.Host.Hostname(), actorID, t.FromUserID, t.ToUserID,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveTransfer moves a pending transfer that the user is allowed to resolve (see allowed) to status.
+// apply is run in the same transaction, if set. Both sides get an audit event for action.
+// Returns ErrTransferNotFound if the transfer doesn't exist, isn't pending, or isn't allowed.
+func resolveTransfer(
+	transferID uint,
+	status string,
+	allowed func(t *database.HostTransfer) bool,
+	apply func(tx *gorm.DB, t *database.HostTransfer) error,
+	actorID, action string,
+) (*database.HostTransfer, error) {
+	var transfer database.HostTransfer
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Joins("Host").First(&transfer, "host_transfers.id = ?", transferID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrTransferNotFound
+			}
+			return err
+		}
+		if transfer.Status != TransferPending || !allowed(&transfer) {
+			return ErrTransferNotFound
+		}
+
+		// The status condition makes concurrent resolutions of the same transfer fail instead of both succeeding
+		now := time.Now().UTC()
+		res := tx.Model(&database.HostTransfer{}).
+			Where("id = ? AND status = ?", transfer.ID, TransferPending).
+			Updates(map[string]interface{}{"status": status, "resolved_at": now})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrTransferNotFound
+		}
+		transfer.Status, transfer.ResolvedAt = status, &now
+
+		if apply != nil {
+			if err := apply(tx, &transfer); err != nil {
+				return err
+			}
+		}
+		return recordAuditEvent(tx, action, transfer.Host.Hostname(), actorID, transfer.FromUserID, transfer.ToUserID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &transfer, nil
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sharify-labs/spine/database"
+)
+
+// requestTestTransfer creates a host for from and requests its transfer to to.
+func requestTestTransfer(t *testing.T, from, to *database.User, sub, root string) (*Host, *HostTransfer) {
+	t.Helper()
+	if err := database.DB().Create(&database.Host{UserID: from.ID, Sub: sub, Root: root}).Error; err != nil {
+		t.Fatal(err)
+	}
+	host := NewHostFromParts(sub, root, from.ID)
+	transfer, err := RequestTransfer(host, to.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, transfer
+}
+
+// transferStatus returns the current status of a transfer.
+func transferStatus(t *testing.T, id uint) string {
+	t.Helper()
+	var transfer database.HostTransfer
+	if err := database.DB().First(&transfer, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return transfer.Status
+}
+
+func TestDeleteHostCancelsTransfer(t *testing.T) {
+	from, to := createTestUser(t), createTestUser(t)
+	host, transfer := requestTestTransfer(t, from, to, "moving", "transfer.example")
+
+	if err := host.Delete(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if status := transferStatus(t, transfer.ID); status != TransferCancelled {
+		t.Fatalf("status = %s, want %s", status, TransferCancelled)
+	}
+	pending, err := ListPendingTransfers(to.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("recipient still has %d pending transfers", len(pending))
+	}
+	if _, err = AcceptTransfer(to.ID, transfer.ID); !errors.Is(err, ErrTransferNotFound) {
+		t.Fatalf("err = %v, want ErrTransferNotFound", err)
+	}
+}
+
+func TestDeleteCustomDomainCancelsTransfers(t *testing.T) {
+	from, to := createTestUser(t), createTestUser(t)
+	domain := addTestDomain(t, from.ID)
+	_, transfer := requestTestTransfer(t, from, to, "", domain.Name)
+
+	if err := DeleteCustomDomain(from.ID, domain.Name); err != nil {
+		t.Fatal(err)
+	}
+	if status := transferStatus(t, transfer.ID); status != TransferCancelled {
+		t.Fatalf("status = %s, want %s", status, TransferCancelled)
+	}
+}
+
+func TestReclaimHostCancelsTransfer(t *testing.T) {
+	from, to := createTestUser(t), createTestUser(t)
+	_, transfer := requestTestTransfer(t, from, to, "idle", "transfer.example")
+	var h database.Host
+	if err := database.DB().Where(map[string]interface{}{
+		"user_id": from.ID, "sub": "idle", "root": "transfer.example",
+	}).First(&h).Error; err != nil {
+		t.Fatal(err)
+	}
+	flaggedAt := transfer.CreatedAt.Add(-time.Hour)
+	if err := database.DB().Model(&h).Update("flagged_inactive_at", flaggedAt).Error; err != nil {
+		t.Fatal(err)
+	}
+	h.FlaggedInactiveAt = &flaggedAt
+
+	if err := releaseHost(context.Background(), &h, releaseInactive, transfer.CreatedAt); err != nil {
+		t.Fatal(err)
+	}
+	if status := transferStatus(t, transfer.ID); status != TransferCancelled {
+		t.Fatalf("status = %s, want %s", status, TransferCancelled)
+	}
+}
+
+func TestAcceptTransferChecksRootEligibility(t *testing.T) {
+	from := createTestUser(t)
+	premium := createTestPlan(t, 50)
+	contributor := createTestUser(t).ID
+	tests := []struct {
+		name    string
+		domain  database.Domain
+		wantErr func(error) bool
+	}{
+		{
+			name:    "private",
+			domain:  database.Domain{OwnerID: &from.ID},
+			wantErr: func(err error) bool { return errors.Is(err, ErrRootUnavailable) },
+		},
+		{
+			name:   "premium",
+			domain: database.Domain{Public: true, MinPlanID: &premium.ID},
+			wantErr: func(err error) bool {
+				var planErr *PlanRequiredError
+				return errors.As(err, &planErr)
+			},
+		},
+		{
+			name:    "approval",
+			domain:  database.Domain{Public: true, ContributorID: &contributor, RequireHostApproval: true},
+			wantErr: func(err error) bool { return errors.Is(err, ErrHostApprovalRequired) },
+		},
+		{
+			name:    "per-user limit",
+			domain:  database.Domain{Public: true, MaxHostsPerUser: 1},
+			wantErr: func(err error) bool { return errors.Is(err, ErrDomainHostLimit) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			to := createTestUser(t)
+			tt.domain.Name = fmt.Sprintf("eligible%d.example", testSeq.Add(1))
+			tt.domain.Enabled, tt.domain.WildcardAllowed = true, true
+			if err := database.DB().Create(&tt.domain).Error; err != nil {
+				t.Fatal(err)
+			}
+			// The recipient already uses their one host on the domain
+			if err := database.DB().Create(&database.Host{UserID: to.ID, Sub: "mine", Root: tt.domain.Name}).Error; err != nil {
+				t.Fatal(err)
+			}
+			_, transfer := requestTestTransfer(t, from, to, "moving", tt.domain.Name)
+			if _, err := AcceptTransfer(to.ID, transfer.ID); !tt.wantErr(err) {
+				t.Fatalf("err = %v", err)
+			}
+			if status := transferStatus(t, transfer.ID); status != TransferPending {
+				t.Fatalf("status = %s, want the transfer to stay pending", status)
+			}
+		})
+	}
+
+	// A host on the sender's custom domain needs the recipient to have verified it too
+	to := createTestUser(t)
+	_, transfer := requestTestTransfer(t, from, to, "moving", addTestDomain(t, from.ID).Name)
+	if _, err := AcceptTransfer(to.ID, transfer.ID); !errors.Is(err, ErrRootUnavailable) {
+		t.Fatalf("custom domain: err = %v, want ErrRootUnavailable", err)
+	}
+
+	// Public domains are accepted
+	_, transfer = requestTestTransfer(t, from, to, "moving", createTestDomain(t))
+	if _, err := AcceptTransfer(to.ID, transfer.ID); err != nil {
+		t.Fatalf("public domain: %v", err)
+	}
+}
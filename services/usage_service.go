@@ -0,0 +1,198 @@
+package services
+
+import (
+	"time"
+
+	"github.com/sharify-labs/spine/database"
+	"gorm.io/gorm"
+)
+
+// UploadType is the internal type of an Upload (see database.Upload).
+type UploadType uint8
+
+const (
+	UploadTypeFile UploadType = iota
+	UploadTypeImage
+	UploadTypePaste
+	UploadTypeRedirect
+)
+
+func (t UploadType) String() string {
+	switch t {
+	case UploadTypeFile:
+		return "file"
+	case UploadTypeImage:
+		return "image"
+	case UploadTypePaste:
+		return "paste"
+	case UploadTypeRedirect:
+		return "redirect"
+	default:
+		return "unknown"
+	}
+}
+
+// usageCacheTTL is how long a User's usage is cached for.
+// Uploads made directly to Zephyr (ex: ShareX) are only reflected once the cache expires.
+// The cache is only used for display; plan limits are checked against the database (see ReserveUpload).
+const usageCacheTTL = 5 * time.Minute
+
+// Usage describes how much a User is currently consuming of the resources limited by their plan.
+// ByType: Number of uploads per UploadType name.
+// ByHost: Uploads and stored bytes per hostname, ordered by stored bytes.
+type Usage struct {
+	Hosts        int64            `json:"hosts"`
+	Uploads      int64            `json:"uploads"`
+	StorageBytes int64            `json:"storage_bytes"`
+	ByType       map[string]int64 `json:"by_type"`
+	ByHost       []HostUsage      `json:"by_host"`
+}
+
+// HostUsage describes the uploads served from a single hostname.
+type HostUsage struct {
+	Hostname     string `json:"hostname"`
+	Uploads      int64  `json:"uploads"`
+	StorageBytes int64  `json:"storage_bytes"`
+}
+
+func usageCacheKey(userID string) string {
+	return "cache:usage:" + userID
+}
+
+// GetUsage returns a user's usage from cache or computes it from the database.
+func GetUsage(userID string) (*Usage, error) {
+	var usage Usage
+	database.GetFromCache(usageCacheKey(userID), &usage)
+	if usage.ByType != nil {
+		return &usage, nil
+	}
+
+	u, err := computeUsage(userID)
+	if err != nil {
+		return nil, err
+	}
+	database.AddToCache(usageCacheKey(userID), u, usageCacheTTL)
+	return u, nil
+}
+
+// InvalidateUsage clears a user's cached usage.
+// Should be called after anything that changes the user's hosts or uploads.
+func InvalidateUsage(userID string) {
+	database.DeleteFromCache(usageCacheKey(userID))
+}
+
+// countPersonalHosts returns how many hosts the user has outside of teams.
+func countPersonalHosts(tx *gorm.DB, userID string) (int64, error) {
+	var hosts int64
+	err := tx.Model(&database.Host{}).Where(&database.Host{UserID: userID}).
+		Where("team_id IS NULL").Count(&hosts).Error
+	return hosts, err
+}
+
+// teamHostnames returns the hostnames of a team's hosts.
+func teamHostnames(teamID uint) ([]string, error) {
+	var hosts []*database.Host
+	if err := database.DB().Where("team_id = ?", teamID).Find(&hosts).Error; err != nil {
+		return nil, err
+	}
+	hostnames := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		hostnames = append(hostnames, h.Hostname())
+	}
+	return hostnames, nil
+}
+
+// personalUploads returns a query for the user's uploads that count towards their own plan.
+// Uploads to team hosts count towards the team's plan instead (see GetTeamUsage), so they're excluded and each upload
+// is counted once.
+func personalUploads(userID string) *gorm.DB {
+	teamHosts := database.DB().Model(&database.Host{}).
+		Select("CASE WHEN COALESCE(sub, '') = '' THEN root ELSE sub || '.' || root END").
+		Where("team_id IS NOT NULL")
+	return database.DB().Model(&database.Upload{}).Where("user_id = ?", userID).Where("hostname NOT IN (?)", teamHosts)
+}
+
+// uploadTotals returns the number and total size of the uploads matching query.
+func uploadTotals(query *gorm.DB) (uploads, storageBytes int64, err error) {
+	var totals struct {
+		Count int64
+		Size  int64
+	}
+	err = query.Model(&database.Upload{}).Select("COUNT(*) AS count, COALESCE(SUM(size), 0) AS size").
+		Scan(&totals).Error
+	return totals.Count, totals.Size, err
+}
+
+// computeUsage aggregates a user's personal hosts and uploads.
+func computeUsage(userID string) (*Usage, error) {
+	usage := &Usage{
+		ByType: make(map[string]int64),
+		ByHost: make([]HostUsage, 0),
+	}
+	// Team hosts and their uploads count towards the team's plan instead (see GetTeamUsage)
+	var err error
+	if usage.Hosts, err = countPersonalHosts(database.DB(), userID); err != nil {
+		return nil, err
+	}
+
+	var byType []struct {
+		Type  uint8
+		Count int64
+		Size  int64
+	}
+	if err := personalUploads(userID).Select(
+		"type, COUNT(*) AS count, COALESCE(SUM(size), 0) AS size",
+	).Group("type").Scan(&byType).Error; err != nil {
+		return nil, err
+	}
+	for _, t := range byType {
+		usage.ByType[UploadType(t.Type).String()] += t.Count
+		usage.Uploads += t.Count
+		usage.StorageBytes += t.Size
+	}
+
+	if err := personalUploads(userID).Select(
+		"hostname, COUNT(*) AS uploads, COALESCE(SUM(size), 0) AS storage_bytes",
+	).Group("hostname").Order("storage_bytes DESC").Scan(&usage.ByHost).Error; err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// GetTeamUsage computes a team's usage: its hosts and the uploads made to them by any member.
+func GetTeamUsage(teamID uint) (*Usage, error) {
+	usage := &Usage{
+		ByType: make(map[string]int64),
+		ByHost: make([]HostUsage, 0),
+	}
+	hostnames, err := teamHostnames(teamID)
+	if err != nil {
+		return nil, err
+	}
+	usage.Hosts = int64(len(hostnames))
+	if len(hostnames) == 0 {
+		return usage, nil
+	}
+
+	var byType []struct {
+		Type  uint8
+		Count int64
+		Size  int64
+	}
+	if err := database.DB().Model(&database.Upload{}).Where("hostname IN ?", hostnames).
+		Select("type, COUNT(*) AS count, COALESCE(SUM(size), 0) AS size").Group("type").Scan(&byType).Error; err != nil {
+		return nil, err
+	}
+	for _, t := range byType {
+		usage.ByType[UploadType(t.Type).String()] += t.Count
+		usage.Uploads += t.Count
+		usage.StorageBytes += t.Size
+	}
+
+	if err := database.DB().Model(&database.Upload{}).Where("hostname IN ?", hostnames).Select(
+		"hostname, COUNT(*) AS uploads, COALESCE(SUM(size), 0) AS storage_bytes",
+	).Group("hostname").Order("storage_bytes DESC").Scan(&usage.ByHost).Error; err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
@@ -0,0 +1,198 @@
+// Package signing authenticates requests from Spine to Zephyr with HMAC-SHA256 signatures.
+//
+// Spine signs each request with a Signer. Zephyr imports this package and checks them with a Verifier, which is why
+// it only depends on the standard library.
+//
+// The signature covers the method, escaped path, sorted query, the SignedHeaders, a timestamp, a random nonce and the
+// SHA-256 of the body, so a logged request can't be replayed or altered. Bodies too large to hash before sending are
+// streamed instead: their hash is signed in a trailer once they are sent (see StreamingPayload). Keys have IDs so
+// they can be rotated without downtime: add the new key to the Verifier, sign with it, then remove the old one.
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers set by Signer.Sign.
+const (
+	HeaderKeyID         = "X-Spine-Key-Id"         // ID of the key used to sign
+	HeaderTimestamp     = "X-Spine-Timestamp"      // Unix time in seconds
+	HeaderNonce         = "X-Spine-Nonce"          // 128 random bits, hex encoded
+	HeaderBodyHash      = "X-Spine-Content-Sha256" // hex SHA-256 of the body, or StreamingPayload
+	HeaderSignature     = "X-Spine-Signature"      // hex HMAC-SHA256 of the canonical request
+	HeaderContentLength = "X-Spine-Content-Length" // length of a streamed body, since it is sent chunked
+	HeaderBodySignature = "X-Spine-Body-Signature" // trailer of streamed bodies, see StreamingPayload
+)
+
+// StreamingPayload is sent as the body hash of streamed bodies, which can't be hashed before they are sent.
+// They are sent chunked, with the HMAC-SHA256 of the request signature and the body's SHA-256 in the
+// HeaderBodySignature trailer, which the Verifier checks once the body is read. Verifiers reject them unless
+// AllowStreamingPayload is set.
+const StreamingPayload = "STREAMING-PAYLOAD-TRAILER"
+
+// SignedHeaders are the request headers covered by the signature, in addition to the HeaderTimestamp, HeaderNonce and
+// HeaderBodyHash. Missing headers are signed as empty, so they can't be added either.
+var SignedHeaders = []string{"Authorization", "Content-Type", "X-Host-Settings", "X-Upload-Host", HeaderContentLength}
+
+// algorithm prefixes the canonical request so signatures can't be confused with other uses of the keys.
+const algorithm = "SPINE-HMAC-SHA256"
+
+// MinKeySize is the minimum size of a key's secret in bytes.
+const MinKeySize = 32
+
+// Key is a shared secret identified by ID.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// ParseKeys parses a comma-separated list of "<id>:<base64 secret>" keys (ex: "2026-10:c2VjcmV0...").
+func ParseKeys(s string) ([]Key, error) {
+	var keys []Key
+	seen := make(map[string]struct{})
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("key %q must be formatted as <id>:<base64 secret>", entry)
+		}
+		if _, ok = seen[id]; ok {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+		seen[id] = struct{}{}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		if len(secret) < MinKeySize {
+			return nil, fmt.Errorf("key %q must be at least %d bytes", id, MinKeySize)
+		}
+		keys = append(keys, Key{ID: id, Secret: secret})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+	return keys, nil
+}
+
+// HashBody returns the body hash of a request body.
+func HashBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalRequest returns the string that is signed for a request.
+func canonicalRequest(req *http.Request, timestamp, nonce, bodyHash string) string {
+	lines := []string{
+		algorithm,
+		strings.ToUpper(req.Method),
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(), // sorted by key
+	}
+	for _, name := range SignedHeaders {
+		lines = append(lines, strings.ToLower(name)+":"+strings.Join(req.Header.Values(name), ","))
+	}
+	return strings.Join(append(lines, timestamp, nonce, bodyHash), "\n")
+}
+
+// bodySignature returns the signature of a streamed body with the given hex SHA-256, chained to the signature of
+// its request.
+func bodySignature(secret []byte, requestSignature, bodyHash string) string {
+	return sign(secret, strings.Join([]string{algorithm + "-BODY", requestSignature, bodyHash}, "\n"))
+}
+
+// sign returns the hex HMAC-SHA256 of the canonical request.
+func sign(secret []byte, canonical string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Signer signs requests with a single key.
+type Signer struct {
+	key Key
+	now func() time.Time
+}
+
+// NewSigner returns a Signer that signs with key.
+func NewSigner(key Key) *Signer {
+	return &Signer{key: key, now: time.Now}
+}
+
+// KeyID returns the ID of the key requests are signed with.
+func (s *Signer) KeyID() string {
+	return s.key.ID
+}
+
+// Sign sets the signature headers on req. bodyHash is HashBody of the body (HashBody(nil) if there is none)
+// or StreamingPayload. Each attempt at sending a request must be signed again, since nonces can only be used once.
+// Streamed bodies are sent chunked, with their length in HeaderContentLength (if known) and their signature in
+// the HeaderBodySignature trailer. They can only be sent once.
+func (s *Signer) Sign(req *http.Request, bodyHash string) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(s.now().Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+	req.Header.Del(HeaderContentLength)
+	if bodyHash == StreamingPayload {
+		if req.ContentLength > 0 {
+			req.Header.Set(HeaderContentLength, strconv.FormatInt(req.ContentLength, 10))
+		}
+		req.ContentLength = -1 // trailers are only sent with chunked bodies
+	}
+	req.Header.Set(HeaderKeyID, s.key.ID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonceHex)
+	req.Header.Set(HeaderBodyHash, bodyHash)
+	signature := sign(s.key.Secret, canonicalRequest(req, timestamp, nonceHex, bodyHash))
+	req.Header.Set(HeaderSignature, signature)
+	if bodyHash == StreamingPayload {
+		body := req.Body
+		if body == nil {
+			body = http.NoBody
+		}
+		req.Trailer = http.Header{HeaderBodySignature: nil}
+		req.Body = &signingBody{
+			ReadCloser: body,
+			hash:       sha256.New(),
+			trailer:    req.Trailer,
+			secret:     s.key.Secret,
+			signature:  signature,
+		}
+	}
+	return nil
+}
+
+// signingBody hashes a streamed body as it is sent and sets its signature trailer once it is fully read.
+type signingBody struct {
+	io.ReadCloser
+	hash      hash.Hash
+	trailer   http.Header
+	secret    []byte
+	signature string
+}
+
+func (b *signingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF {
+		b.trailer.Set(HeaderBodySignature, bodySignature(b.secret, b.signature, hex.EncodeToString(b.hash.Sum(nil))))
+	}
+	return n, err
+}
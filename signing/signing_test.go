@@ -0,0 +1,263 @@
+package signing
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testKey    = Key{ID: "2026-10", Secret: []byte("0123456789abcdef0123456789abcdef")}
+	testNewKey = Key{ID: "2026-11", Secret: []byte("fedcba9876543210fedcba9876543210")}
+	testNow    = time.Unix(1700000000, 0)
+	testBody   = []byte(`{"ids":[1]}`)
+)
+
+// newTestSigner returns a Signer whose clock is set to testNow.
+func newTestSigner(key Key) *Signer {
+	s := NewSigner(key)
+	s.now = func() time.Time { return testNow }
+	return s
+}
+
+// newTestVerifier returns a Verifier accepting keys whose clock is set to testNow.
+func newTestVerifier(keys ...Key) *Verifier {
+	v := NewVerifier(keys, NewMemoryNonceStore())
+	v.now = func() time.Time { return testNow }
+	return v
+}
+
+// newTestRequest returns an unsigned request with testBody and every SignedHeaders but X-Host-Settings set.
+func newTestRequest(t *testing.T) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(
+		http.MethodPost, "https://zephyr.example/api/v1/uploads/a%20b?z=1&a=2", bytes.NewReader(testBody),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer user-jwt")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Upload-Host", "img.example.com")
+	return req
+}
+
+// signTestRequest signs req with key at testNow.
+func signTestRequest(t *testing.T, key Key, req *http.Request) *http.Request {
+	t.Helper()
+	if err := newTestSigner(key).Sign(req, HashBody(testBody)); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestCanonicalRequestKnownAnswer(t *testing.T) {
+	req := newTestRequest(t)
+	bodyHash := HashBody(testBody)
+	if want := "8b7c1eaa1f5075f74aa267e37733ca507cb8af3f2f6b1a45982ebb0d99ca437c"; bodyHash != want {
+		t.Fatalf("HashBody = %s, want %s", bodyHash, want)
+	}
+	signature := sign(testKey.Secret, canonicalRequest(req, "1700000000", "00112233445566778899aabbccddeeff", bodyHash))
+	if want := "11b995350ea548c45b79db95e548ff6ab864b38a58d1170babdc8138fe587ef5"; signature != want {
+		t.Fatalf("signature = %s, want %s", signature, want)
+	}
+	if got, want := bodySignature(testKey.Secret, signature, bodyHash),
+		"98932600b5e34dbaa0058754bad42c311f0d00bf5973c00dfd7094984cb45747"; got != want {
+		t.Fatalf("body signature = %s, want %s", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	req := signTestRequest(t, testKey, newTestRequest(t))
+	if err := newTestVerifier(testKey).Verify(req); err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil || !bytes.Equal(body, testBody) {
+		t.Fatalf("body = %q, %v, want it readable after verification", body, err)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	tests := map[string]struct {
+		tamper func(req *http.Request)
+		want   error
+	}{
+		"method":       {func(req *http.Request) { req.Method = http.MethodDelete }, ErrBadSignature},
+		"path":         {func(req *http.Request) { req.URL.Path, req.URL.RawPath = "/api/v1/admin", "" }, ErrBadSignature},
+		"query":        {func(req *http.Request) { req.URL.RawQuery = "z=1&a=3" }, ErrBadSignature},
+		"jwt":          {func(req *http.Request) { req.Header.Set("Authorization", "Bearer admin-jwt") }, ErrBadSignature},
+		"content type": {func(req *http.Request) { req.Header.Set("Content-Type", "text/html") }, ErrBadSignature},
+		"upload host":  {func(req *http.Request) { req.Header.Set("X-Upload-Host", "other.example") }, ErrBadSignature},
+		"added host settings": {
+			func(req *http.Request) { req.Header.Set("X-Host-Settings", `{"img.example.com":{}}`) }, ErrBadSignature,
+		},
+		"body hash": {func(req *http.Request) { req.Header.Set(HeaderBodyHash, HashBody(nil)) }, ErrBadSignature},
+		"body": {func(req *http.Request) {
+			req.Body = io.NopCloser(strings.NewReader(`{"ids":[2]}`))
+		}, ErrBodyMismatch},
+		"missing signature": {func(req *http.Request) { req.Header.Del(HeaderSignature) }, ErrMissingSignature},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := signTestRequest(t, testKey, newTestRequest(t))
+			tt.tamper(req)
+			if err := newTestVerifier(testKey).Verify(req); !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	for _, offset := range []time.Duration{DefaultMaxSkew + time.Second, -DefaultMaxSkew - time.Second} {
+		req := signTestRequest(t, testKey, newTestRequest(t))
+		v := newTestVerifier(testKey)
+		v.now = func() time.Time { return testNow.Add(offset) }
+		if err := v.Verify(req); !errors.Is(err, ErrExpired) {
+			t.Fatalf("verified %v later: err = %v, want ErrExpired", offset, err)
+		}
+	}
+}
+
+func TestVerifyRotatedKeys(t *testing.T) {
+	// During a rotation, Zephyr accepts both keys while Spine switches to the new one.
+	rotating := newTestVerifier(testNewKey, testKey)
+	if err := rotating.Verify(signTestRequest(t, testKey, newTestRequest(t))); err != nil {
+		t.Fatalf("old key during rotation: %v", err)
+	}
+	if err := rotating.Verify(signTestRequest(t, testNewKey, newTestRequest(t))); err != nil {
+		t.Fatalf("new key during rotation: %v", err)
+	}
+
+	rotated := newTestVerifier(testNewKey)
+	if err := rotated.Verify(signTestRequest(t, testKey, newTestRequest(t))); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("old key after rotation: err = %v, want ErrUnknownKey", err)
+	}
+	req := signTestRequest(t, testNewKey, newTestRequest(t))
+	req.Header.Set(HeaderKeyID, testKey.ID)
+	if err := newTestVerifier(testNewKey, testKey).Verify(req); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("key id swapped: err = %v, want ErrBadSignature", err)
+	}
+}
+
+func TestVerifyReplayed(t *testing.T) {
+	// Note: MemoryNonceStore expires nonces by the real clock, so the request is signed now.
+	req := newTestRequest(t)
+	if err := NewSigner(testKey).Sign(req, HashBody(testBody)); err != nil {
+		t.Fatal(err)
+	}
+	v := NewVerifier([]Key{testKey}, NewMemoryNonceStore())
+	if err := v.Verify(req); err != nil {
+		t.Fatal(err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(testBody))
+	if err := v.Verify(req); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("err = %v, want ErrReplayed", err)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys(" 2026-10:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=, ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].ID != testKey.ID || !bytes.Equal(keys[0].Secret, testKey.Secret) {
+		t.Fatalf("keys = %+v", keys)
+	}
+	secret := strings.Repeat("A", 44)
+	for _, invalid := range []string{"", "nokey", ":c2VjcmV0", "short:c2VjcmV0", "a:!!!", "a:" + secret + ",a:" + secret} {
+		if _, err = ParseKeys(invalid); err == nil {
+			t.Errorf("ParseKeys(%q) succeeded, want an error", invalid)
+		}
+	}
+}
+
+// streamingServer verifies streamed requests, reads their body and responds with the verification error, if any.
+// If tamper is set, a byte of the body is altered on its way to the verifier.
+func streamingServer(t *testing.T, v *Verifier, tamper bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tamper {
+			r.Body = &flippingBody{ReadCloser: r.Body}
+		}
+		err := v.Verify(r)
+		if err == nil {
+			var n int64
+			n, err = io.Copy(io.Discard, r.Body)
+			if err == nil && r.Header.Get(HeaderContentLength) != "" && n != 2<<20 {
+				err = errors.New("body was truncated")
+			}
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// flippingBody flips the first byte it reads.
+type flippingBody struct {
+	io.ReadCloser
+	flipped bool
+}
+
+func (b *flippingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.flipped {
+		p[0] ^= 1
+		b.flipped = true
+	}
+	return n, err
+}
+
+// sendStreamed sends 2 MiB to srv as a streamed body and returns the server's error, if any.
+func sendStreamed(t *testing.T, srv *httptest.Server, knownLength bool) string {
+	t.Helper()
+	body := io.Reader(bytes.NewReader(bytes.Repeat([]byte("u"), 2<<20)))
+	if !knownLength {
+		body = io.MultiReader(body) // hides the length from http.NewRequest
+	}
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/uploads", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = NewSigner(testKey).Sign(req, StreamingPayload); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(resp.Body)
+	return strings.TrimSpace(string(msg))
+}
+
+func TestVerifyStreamingPayload(t *testing.T) {
+	v := NewVerifier([]Key{testKey}, NewMemoryNonceStore())
+	v.AllowStreamingPayload = true
+	srv := streamingServer(t, v, false)
+	if msg := sendStreamed(t, srv, true); msg != "" {
+		t.Fatalf("known length: %s", msg)
+	}
+	if msg := sendStreamed(t, srv, false); msg != "" {
+		t.Fatalf("unknown length: %s", msg)
+	}
+
+	tampered := streamingServer(t, v, true)
+	if msg := sendStreamed(t, tampered, true); msg != ErrBodyMismatch.Error() {
+		t.Fatalf("tampered body: %q, want %q", msg, ErrBodyMismatch)
+	}
+
+	v = NewVerifier([]Key{testKey}, NewMemoryNonceStore())
+	if msg := sendStreamed(t, streamingServer(t, v, false), true); msg != ErrStreamingPayload.Error() {
+		t.Fatalf("streaming not allowed: %q, want %q", msg, ErrStreamingPayload)
+	}
+}
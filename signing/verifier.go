@@ -0,0 +1,223 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults of Verifier's options.
+const (
+	DefaultMaxSkew     = 5 * time.Minute
+	DefaultMaxBodySize = 1 << 20 // Spine streams larger bodies as StreamingPayload
+)
+
+var (
+	ErrMissingSignature = errors.New("request is not signed")
+	ErrUnknownKey       = errors.New("request is signed with an unknown key")
+	ErrExpired          = errors.New("request timestamp is too old or in the future")
+	ErrBadSignature     = errors.New("request signature is invalid")
+	ErrStreamingPayload = errors.New("request body must not be streamed")
+	ErrBodyTooLarge     = errors.New("signed request body is too large")
+	ErrBodyMismatch     = errors.New("request body does not match its signed hash")
+	ErrReplayed         = errors.New("request nonce was already used")
+)
+
+// NonceStore remembers the nonces of verified requests so that they can't be replayed.
+// Zephyr instances behind a load balancer must share a store (ex: Redis SET NX with an expiry).
+type NonceStore interface {
+	// Add stores nonce until expires and reports whether it wasn't already stored.
+	Add(nonce string, expires time.Time) (bool, error)
+}
+
+// Verifier checks the signatures of requests signed by a Signer with any of its keys.
+type Verifier struct {
+	// MaxSkew is how far a request's timestamp can be from the current time (default DefaultMaxSkew).
+	MaxSkew time.Duration
+	// MaxBodySize is the largest signed body that Verify reads into memory (default DefaultMaxBodySize).
+	MaxBodySize int64
+	// AllowStreamingPayload accepts requests whose body is streamed and signed in a trailer (ex: uploads).
+	// Their body is only verified once it is fully read: reading it returns ErrBodyMismatch instead of io.EOF if it
+	// was altered, so handlers must not keep anything they read from a body that didn't end with io.EOF.
+	AllowStreamingPayload bool
+
+	keys   map[string][]byte
+	nonces NonceStore
+	now    func() time.Time
+}
+
+// NewVerifier returns a Verifier that accepts requests signed with any of keys and remembers nonces in nonces.
+func NewVerifier(keys []Key, nonces NonceStore) *Verifier {
+	v := &Verifier{
+		MaxSkew:     DefaultMaxSkew,
+		MaxBodySize: DefaultMaxBodySize,
+		keys:        make(map[string][]byte, len(keys)),
+		nonces:      nonces,
+		now:         time.Now,
+	}
+	for _, k := range keys {
+		v.keys[k.ID] = k.Secret
+	}
+	return v
+}
+
+// Verify checks that req was signed with one of the Verifier's keys, recently, and never verified before.
+// Signed bodies are read to check their hash and replaced with an in-memory copy, so handlers can still read them.
+func (v *Verifier) Verify(req *http.Request) error {
+	keyID := req.Header.Get(HeaderKeyID)
+	timestamp := req.Header.Get(HeaderTimestamp)
+	nonce := req.Header.Get(HeaderNonce)
+	bodyHash := req.Header.Get(HeaderBodyHash)
+	signature, err := hex.DecodeString(req.Header.Get(HeaderSignature))
+	if err != nil || len(signature) == 0 || keyID == "" || timestamp == "" || len(nonce) != 32 || bodyHash == "" {
+		return ErrMissingSignature
+	}
+	secret, ok := v.keys[keyID]
+	if !ok {
+		return ErrUnknownKey
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrMissingSignature
+	}
+	signedAt := time.Unix(unix, 0)
+	if skew := v.now().Sub(signedAt); skew > v.MaxSkew || skew < -v.MaxSkew {
+		return ErrExpired
+	}
+	expected, _ := hex.DecodeString(sign(secret, canonicalRequest(req, timestamp, nonce, bodyHash)))
+	if !hmac.Equal(signature, expected) {
+		return ErrBadSignature
+	}
+
+	if bodyHash == StreamingPayload {
+		if !v.AllowStreamingPayload {
+			return ErrStreamingPayload
+		}
+		length := int64(-1)
+		if declared := req.Header.Get(HeaderContentLength); declared != "" {
+			if length, err = strconv.ParseInt(declared, 10, 64); err != nil || length < 0 {
+				return ErrMissingSignature
+			}
+		}
+		req.Body = &verifyingBody{
+			ReadCloser: bodyOrEmpty(req.Body),
+			req:        req,
+			hash:       sha256.New(),
+			length:     length,
+			secret:     secret,
+		}
+	} else if err = v.verifyBody(req, bodyHash); err != nil {
+		return err
+	}
+
+	// Nonces are only remembered once the rest of the request is verified, so forged requests can't use them up.
+	fresh, err := v.nonces.Add(keyID+":"+nonce, signedAt.Add(v.MaxSkew))
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrReplayed
+	}
+	return nil
+}
+
+// verifyBody reads the body of req, checks it against bodyHash and replaces it with an in-memory copy.
+func (v *Verifier) verifyBody(req *http.Request, bodyHash string) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, v.MaxBodySize+1))
+		_ = req.Body.Close()
+		if err != nil {
+			return err
+		}
+		if int64(len(body)) > v.MaxBodySize {
+			return ErrBodyTooLarge
+		}
+	}
+	if !hmac.Equal([]byte(HashBody(body)), []byte(bodyHash)) {
+		return ErrBodyMismatch
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return nil
+}
+
+// bodyOrEmpty returns body, or an empty body if it is nil.
+func bodyOrEmpty(body io.ReadCloser) io.ReadCloser {
+	if body == nil {
+		return http.NoBody
+	}
+	return body
+}
+
+// verifyingBody hashes a streamed body as it is read and checks its trailer signature (and declared length, unless
+// it is -1) once it is fully read. Reads return ErrBodyMismatch instead of io.EOF if either doesn't match.
+type verifyingBody struct {
+	io.ReadCloser
+	req    *http.Request
+	hash   hash.Hash
+	read   int64
+	length int64
+	secret []byte
+}
+
+func (b *verifyingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	b.read += int64(n)
+	if b.length >= 0 && b.read > b.length {
+		return n, ErrBodyMismatch
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	// Note: The request's trailers are only set once its body has been read.
+	signature := bodySignature(b.secret, b.req.Header.Get(HeaderSignature), hex.EncodeToString(b.hash.Sum(nil)))
+	got := b.req.Trailer.Get(HeaderBodySignature)
+	if (b.length >= 0 && b.read != b.length) || !hmac.Equal([]byte(got), []byte(signature)) {
+		return n, ErrBodyMismatch
+	}
+	return n, io.EOF
+}
+
+// MemoryNonceStore is a NonceStore for a single instance.
+type MemoryNonceStore struct {
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	nextPrune time.Time
+}
+
+// NewMemoryNonceStore returns an empty MemoryNonceStore.
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{nonces: make(map[string]time.Time)}
+}
+
+// Add stores nonce until expires and reports whether it wasn't already stored.
+// Expired nonces are pruned at most once a minute.
+func (s *MemoryNonceStore) Add(nonce string, expires time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.After(s.nextPrune) {
+		for n, exp := range s.nonces {
+			if now.After(exp) {
+				delete(s.nonces, n)
+			}
+		}
+		s.nextPrune = now.Add(time.Minute)
+	}
+	if exp, ok := s.nonces[nonce]; ok && !now.After(exp) {
+		return false, nil
+	}
+	s.nonces[nonce] = expires
+	return true, nil
+}
@@ -0,0 +1,137 @@
+package validators
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+)
+
+// idnaProfile converts between Unicode (U-label) and punycode (A-label) forms following UTS #46
+// (non-transitional), including the Bidi and CONTEXTJ rules and STD3 ASCII restrictions.
+// CheckHyphens is disabled: hostnames have always been allowed to contain "--" (ex: "my--site"), and existing hosts
+// must stay valid. Leading and trailing hyphens are still removed or rejected by the sanitizers.
+var idnaProfile = idna.New(
+	idna.MapForLookup(),
+	idna.Transitional(false),
+	idna.BidiRule(),
+	idna.CheckJoiners(true),
+	idna.StrictDomainName(true),
+	idna.ValidateLabels(true),
+	idna.CheckHyphens(false),
+)
+
+// allowedScriptSets are the combinations of scripts a label may mix ("highly restrictive" in UTS #39).
+// Every other label must use a single script. Common and Inherited characters (digits, hyphens, marks) are ignored.
+var allowedScriptSets = [][]*unicode.RangeTable{
+	{unicode.Latin, unicode.Han, unicode.Hiragana, unicode.Katakana},
+	{unicode.Latin, unicode.Han, unicode.Bopomofo},
+	{unicode.Latin, unicode.Han, unicode.Hangul},
+}
+
+// detectableScripts are the scripts checked for mixing. Letters from any other script are compared by identity.
+var detectableScripts = map[string]*unicode.RangeTable{
+	"Latin": unicode.Latin, "Greek": unicode.Greek, "Cyrillic": unicode.Cyrillic, "Armenian": unicode.Armenian,
+	"Hebrew": unicode.Hebrew, "Arabic": unicode.Arabic, "Devanagari": unicode.Devanagari, "Bengali": unicode.Bengali,
+	"Thai": unicode.Thai, "Georgian": unicode.Georgian, "Hangul": unicode.Hangul, "Han": unicode.Han,
+	"Hiragana": unicode.Hiragana, "Katakana": unicode.Katakana, "Bopomofo": unicode.Bopomofo,
+	"Cherokee": unicode.Cherokee, "Ethiopic": unicode.Ethiopic, "Tamil": unicode.Tamil, "Khmer": unicode.Khmer,
+}
+
+// latinConfusables are non-Latin letters that look the same as a Latin letter.
+// A label written only with these (ex: Cyrillic "аре") is a whole-script confusable of a Latin name.
+const latinConfusables = "" +
+	"аеорсухіјѕԁԛԝһӏвкмнтгпь" + // Cyrillic
+	"αβεικνορτυχϲϳ" // Greek
+
+// ToASCII converts a (possibly Unicode) hostname or label to its punycode A-label form.
+// Returns an error if it violates UTS #46, mixes scripts, or is a whole-script confusable of a Latin name.
+func ToASCII(s string) (string, error) {
+	ascii, err := idnaProfile.ToASCII(s)
+	if err != nil {
+		return "", err
+	}
+	unicodeForm, err := idnaProfile.ToUnicode(ascii)
+	if err != nil {
+		return "", err
+	}
+	for _, label := range strings.Split(unicodeForm, ".") {
+		if !isSingleScript(label) {
+			return "", &idnaError{label: label, reason: "mixes scripts"}
+		}
+		if isLatinConfusable(label) {
+			return "", &idnaError{label: label, reason: "is confusable with a Latin name"}
+		}
+	}
+	return ascii, nil
+}
+
+// ToUnicode converts a punycode hostname to its Unicode U-label form for display.
+// Returns the input unchanged if it can't be converted.
+func ToUnicode(s string) string {
+	if !strings.Contains(s, "xn--") {
+		return s
+	}
+	if u, err := idnaProfile.ToUnicode(s); err == nil {
+		return u
+	}
+	return s
+}
+
+type idnaError struct {
+	label  string
+	reason string
+}
+
+func (e *idnaError) Error() string {
+	return "idna: label " + e.label + " " + e.reason
+}
+
+// isSingleScript reports whether a label's letters all belong to one script or to one of allowedScriptSets.
+func isSingleScript(label string) bool {
+	var used []*unicode.RangeTable
+	for _, r := range label {
+		if !unicode.IsLetter(r) || unicode.In(r, unicode.Common, unicode.Inherited) {
+			continue
+		}
+		if script := scriptOf(r); !slices.Contains(used, script) {
+			used = append(used, script)
+		}
+	}
+	if len(used) <= 1 {
+		return true
+	}
+	for _, set := range allowedScriptSets {
+		if !slices.ContainsFunc(used, func(s *unicode.RangeTable) bool { return !slices.Contains(set, s) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// scriptOf returns the script of a letter. Letters outside detectableScripts get unicode.L so that
+// they're only compared with each other.
+func scriptOf(r rune) *unicode.RangeTable {
+	for _, table := range detectableScripts {
+		if unicode.Is(table, r) {
+			return table
+		}
+	}
+	return unicode.L
+}
+
+// isLatinConfusable reports whether a non-ASCII label only has letters that look like Latin letters.
+func isLatinConfusable(label string) bool {
+	hasLetter := false
+	for _, r := range label {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		if r < unicode.MaxASCII || !strings.ContainsRune(latinConfusables, r) {
+			return false
+		}
+		hasLetter = true
+	}
+	return hasLetter
+}
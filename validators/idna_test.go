@@ -0,0 +1,54 @@
+package validators
+
+import "testing"
+
+func TestToASCII(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // empty if in must be rejected
+	}{
+		{in: "bücher.example", want: "xn--bcher-kva.example"},
+		{in: "BÜCHER.example", want: "xn--bcher-kva.example"},
+		{in: "xn--bcher-kva.example", want: "xn--bcher-kva.example"},
+		{in: "παράδειγμα.example", want: "xn--hxajbheg2az3al.example"},
+		{in: "日本abc.example", want: "xn--abc-s08fl0d.example"}, // Latin + Han is a "highly restrictive" set
+		{in: "my--site.example", want: "my--site.example"},
+		{in: "a‍b.example"},         // ZWJ outside of the contexts CONTEXTJ allows
+		{in: "under_score.example"}, // STD3 rules
+		{in: "xn--zz.example"},      // invalid punycode
+		{in: "pаypal.example"},      // Latin and Cyrillic
+		{in: "аре.example"},         // whole-script confusable with Latin "ape"
+		{in: "αβγ.example", want: "xn--mxacd.example"},
+		{in: "ρο.example"},      // Greek letters that look Latin ("po")
+		{in: "abcαβγ.example"},  // Latin and Greek
+		{in: "שלוםabc.example"}, // Bidi rule
+	}
+	for _, tt := range tests {
+		got, err := ToASCII(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("ToASCII(%q) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ToASCII(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestToUnicode(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"xn--bcher-kva.example", "bücher.example"},
+		{"img.xn--wgv71a119e.example", "img.日本語.example"},
+		{"plain.example", "plain.example"},
+		{"xn--zz.example", "xn--zz.example"}, // invalid punycode is shown as is
+	}
+	for _, tt := range tests {
+		if got := ToUnicode(tt.in); got != tt.want {
+			t.Errorf("ToUnicode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package validators
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// DefaultReservedSubdomains are reserved on every shared root unless RESERVED_SUBDOMAINS is set.
+var DefaultReservedSubdomains = []string{
+	"www", "api", "admin", "administrator", "mail", "email", "smtp", "imap", "pop", "pop3", "mx", "ftp", "sftp",
+	"ns", "ns1", "ns2", "ns3", "dns", "cdn", "static", "assets", "media", "status", "support", "help", "docs",
+	"billing", "dashboard", "panel", "app", "auth", "login", "oauth", "sso", "account", "accounts", "root",
+	"abuse", "postmaster", "webmaster", "hostmaster", "security", "dev", "staging", "test", "localhost",
+	"sharify", "zephyr", "canvas", "spine",
+}
+
+// SubdomainPolicy decides which (already sanitized) subdomains users may register on shared roots.
+// It applies to the Unicode U-label users see, not its punycode A-label (see Check).
+// MinLength: Minimum number of characters. 0 disables the check.
+// Reserved: Names reserved on every root.
+// Blocked: Names matching any of these patterns are rejected.
+// Profanity: Names containing any of these words (ignoring hyphens) are rejected.
+type SubdomainPolicy struct {
+	MinLength int
+	Reserved  map[string]struct{}
+	Blocked   []*regexp.Regexp
+	Profanity []string
+}
+
+// SubdomainRejectedError explains why a subdomain was rejected by a SubdomainPolicy.
+type SubdomainRejectedError struct {
+	Sub    string
+	Reason string
+}
+
+func (e *SubdomainRejectedError) Error() string {
+	return strconv.Quote(e.Sub) + " " + e.Reason
+}
+
+// NewSubdomainPolicy creates a policy from the reserved names, blocked patterns and profane words.
+// Returns an error if a pattern doesn't compile.
+func NewSubdomainPolicy(minLength int, reserved, blockedPatterns, profanity []string) (*SubdomainPolicy, error) {
+	p := &SubdomainPolicy{
+		MinLength: minLength,
+		Reserved:  make(map[string]struct{}, len(reserved)),
+	}
+	for _, r := range reserved {
+		if r = strings.ToLower(strings.TrimSpace(r)); r != "" {
+			p.Reserved[r] = struct{}{}
+		}
+	}
+	for _, pattern := range blockedPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		p.Blocked = append(p.Blocked, re)
+	}
+	for _, word := range profanity {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			p.Profanity = append(p.Profanity, word)
+		}
+	}
+	return p, nil
+}
+
+// Check returns a SubdomainRejectedError if sub may not be registered under root.
+// rootReserved are names reserved only on that root.
+// sub may be a punycode A-label: it is checked as its U-label, so that "xn--tda" ("ü") is 1 character long.
+// Reserved names and profane words also match with diacritics removed (ex: "ädmin" is reserved like "admin"),
+// and blocked patterns match either form.
+func (p *SubdomainPolicy) Check(sub, root string, rootReserved []string) error {
+	label := ToUnicode(sub)
+	folded := removeDiacritics(label)
+	if n := len([]rune(label)); n < p.MinLength {
+		return &SubdomainRejectedError{
+			Sub:    label,
+			Reason: "is too short (minimum " + strconv.Itoa(p.MinLength) + " characters)",
+		}
+	}
+	for _, name := range []string{label, folded} {
+		if _, ok := p.Reserved[name]; ok {
+			return &SubdomainRejectedError{Sub: label, Reason: "is reserved"}
+		}
+	}
+	for _, r := range rootReserved {
+		r = ToUnicode(strings.ToLower(strings.TrimSpace(r)))
+		if r == label || r == folded {
+			return &SubdomainRejectedError{Sub: label, Reason: "is reserved on " + root}
+		}
+	}
+	for _, re := range p.Blocked {
+		if re.MatchString(label) || re.MatchString(sub) {
+			return &SubdomainRejectedError{Sub: label, Reason: "is not allowed"}
+		}
+	}
+	for _, name := range []string{label, folded} {
+		joined := strings.ReplaceAll(name, "-", "")
+		for _, word := range p.Profanity {
+			if strings.Contains(joined, word) {
+				return &SubdomainRejectedError{Sub: label, Reason: "contains a blocked word"}
+			}
+		}
+	}
+	return nil
+}
+
+// removeDiacritics returns s without its combining marks (ex: "bücher" -> "bucher").
+func removeDiacritics(s string) string {
+	var sb strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if !unicode.Is(unicode.Mn, r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,57 @@
+package validators
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSubdomainPolicyCheck(t *testing.T) {
+	policy, err := NewSubdomainPolicy(3, []string{"admin", " WWW "}, []string{"^free-", "ß"}, []string{"darn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		sub    string // sanitized, so non-ASCII names are A-labels
+		reason string // empty if sub is allowed
+		label  string // the name reported in the error, if not sub
+	}{
+		{sub: "images"},
+		{sub: "abc"},
+		{sub: "ab", reason: "is too short (minimum 3 characters)"},
+		{sub: "xn--tda", reason: "is too short (minimum 3 characters)", label: "ü"}, // 7 bytes, but 1 character
+		{sub: "xn--wgv71a119e"}, // "日本語" is 3 characters
+		{sub: "admin", reason: "is reserved"},
+		{sub: "www", reason: "is reserved"},
+		{sub: "xn--dmin-koa", reason: "is reserved", label: "ädmin"},
+		{sub: "shop", reason: "is reserved on example.com"},
+		{sub: "xn--shp-tna", reason: "is reserved on example.com", label: "shöp"},
+		{sub: "free-stuff", reason: "is not allowed"},
+		{sub: "xn--strae-oqa", reason: "is not allowed", label: "straße"}, // patterns see the U-label
+		{sub: "d-a-r-n-it", reason: "contains a blocked word"},
+		{sub: "xn--drn-qla", reason: "contains a blocked word", label: "därn"},
+		{sub: "xn--bcher-kva"},
+	}
+	for _, tt := range tests {
+		err := policy.Check(tt.sub, "example.com", []string{"Shop"})
+		if tt.reason == "" {
+			if err != nil {
+				t.Errorf("Check(%q) = %v, want nil", tt.sub, err)
+			}
+			continue
+		}
+		label := tt.label
+		if label == "" {
+			label = tt.sub
+		}
+		var rejected *SubdomainRejectedError
+		if !errors.As(err, &rejected) || rejected.Reason != tt.reason || rejected.Sub != label {
+			t.Errorf("Check(%q) = %v, want %q %s", tt.sub, err, label, tt.reason)
+		}
+	}
+}
+
+func TestNewSubdomainPolicyInvalidPattern(t *testing.T) {
+	if _, err := NewSubdomainPolicy(0, nil, []string{"("}, nil); err == nil {
+		t.Fatal("expected an error for an invalid pattern")
+	}
+}
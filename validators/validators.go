@@ -3,23 +3,20 @@ package validators
 import (
 	"strings"
 	"unicode"
-)
 
-// firstNChars returns the first n number of characters from a string.
-func firstNChars(s string, n int) string {
-	runes := []rune(s)
-	if len(runes) > n {
-		return string(runes[:63])
-	}
-	return s
-}
+	"golang.org/x/net/publicsuffix"
+)
 
 // SanitizeSubdomain validates and sanitizes subdomains.
 //  1. Trims spaces
 //  2. Makes all characters lowercase
 //  3. Replaces all periods with hyphens to ensure only 1 level.
-//  4. Removes invalid characters (allows a-z, 0-9, and hyphens)
+//  4. Removes invalid characters (allows letters, marks, digits, and hyphens)
 //  5. Removes leading/trailing hyphens.
+//  6. Converts Unicode to its punycode A-label (ex: "bücher" -> "xn--bcher-kva").
+//  7. Enforces the 63-byte limit on the encoded form.
+//
+// Returns an empty string if the label isn't valid under UTS #46 or mixes scripts (see ToASCII).
 func SanitizeSubdomain(sub string) string {
 	var sb strings.Builder
 	str := strings.ReplaceAll(strings.TrimSpace(strings.ToLower(sub)), ".", "-")
@@ -27,17 +24,69 @@ func SanitizeSubdomain(sub string) string {
 		if i >= 200 {
 			break // Only check first 200 characters for safety
 		}
-		if unicode.IsLetter(c) || unicode.IsDigit(c) || (c == '-') {
+		if unicode.IsLetter(c) || unicode.IsMark(c) || unicode.IsDigit(c) || (c == '-') {
 			sb.WriteRune(c)
 		}
 	}
 	// Ensure subdomain doesn't start/end with a hyphen
-	sanitized := strings.Trim(sb.String(), "-")
+	runes := []rune(strings.Trim(sb.String(), "-"))
 
-	// Enforce maximum length of 63 characters
-	sanitized = firstNChars(sanitized, 63)
+	// Enforce maximum length of 63 bytes once encoded, dropping characters from the end until it fits.
+	for len(runes) > 0 {
+		// Trim hyphens again in case slicing string resulted in trailing hyphen.
+		label := strings.TrimRight(string(runes), "-")
+		encoded, err := ToASCII(label)
+		if err != nil {
+			return ""
+		}
+		if len(encoded) <= 63 {
+			return encoded
+		}
+		runes = runes[:len(runes)-1]
+	}
+	return ""
+}
 
-	// Trim hyphens again in case slicing string resulted in trailing hyphen.
-	sanitized = strings.TrimRight(sanitized, "-")
-	return sanitized
+// SanitizeSubdomains behaves like SanitizeSubdomain, but keeps periods so that multiple levels are allowed
+// (ex: "A.b..c" -> "a.b.c"). Each label is sanitized separately and empty labels are removed.
+func SanitizeSubdomains(sub string) string {
+	var labels []string
+	for _, label := range strings.Split(sub, ".") {
+		if label = SanitizeSubdomain(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// SanitizeDomain validates and normalizes a root domain name (ex: "Example.com." -> "example.com").
+// Unicode names are converted to punycode (see ToASCII).
+// Returns an empty string if the domain isn't a valid hostname with at least 2 labels,
+// or if it's a public suffix (ex: "co.uk") that can't be registered.
+func SanitizeDomain(domain string) string {
+	domain, err := ToASCII(strings.TrimSuffix(strings.TrimSpace(strings.ToLower(domain)), "."))
+	if err != nil {
+		return ""
+	}
+	if len(domain) > 253 {
+		return ""
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return ""
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return ""
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return ""
+			}
+		}
+	}
+	if _, err := publicsuffix.EffectiveTLDPlusOne(domain); err != nil {
+		return ""
+	}
+	return domain
 }
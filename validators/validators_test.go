@@ -0,0 +1,62 @@
+package validators
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeSubdomain(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"  Images ", "images"},
+		{"a.b", "a-b"},
+		{"-edge-", "edge"},
+		{"my--site", "my--site"}, // allowed before IDNA support, so existing hosts stay valid
+		{"bücher", "xn--bcher-kva"},
+		{"xn--bcher-kva", "xn--bcher-kva"},
+		{"xn--zz", ""}, // invalid punycode
+		{"pаypal", ""}, // mixes Latin and Cyrillic
+		{"аре", ""},    // Cyrillic confusable with Latin "ape"
+		{"Bücher", "xn--bcher-kva"},
+		{"ｂücher", "xn--bcher-kva"}, // fullwidth letters are mapped to ASCII
+		{"straße", "xn--strae-oqa"}, // non-transitional: ß is kept rather than mapped to "ss"
+		{"日本語", "xn--wgv71a119e"},
+		{"日本abc", "xn--abc-s08fl0d"}, // Latin may be mixed with Han
+		{"a\u200db", "ab"},           // format characters (zero-width joiner) are dropped
+		{strings.Repeat("ü", 80), "xn--td" + strings.Repeat("a", 57)}, // trimmed to 63 bytes once encoded
+	}
+	for _, tt := range tests {
+		if got := SanitizeSubdomain(tt.in); got != tt.want {
+			t.Errorf("SanitizeSubdomain(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeDomain(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Example.com.", "example.com"},
+		{"my--site.example.com", "my--site.example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"-bad.example.com", ""},
+		{"co.uk", ""},
+		{"localhost", ""},
+		{"example.co.uk", "example.co.uk"},
+		{"foo.ck", ""},                           // public suffix from the wildcard rule *.ck
+		{"www.ck", "www.ck"},                     // exception rule !www.ck
+		{"img.foo.ck", "img.foo.ck"},             // registrable under the wildcard
+		{"foo.kawasaki.jp", ""},                  // wildcard rule *.kawasaki.jp
+		{"city.kawasaki.jp", "city.kawasaki.jp"}, // exception rule !city.kawasaki.jp
+		{"github.io", ""},                        // private suffix
+		{"me.github.io", "me.github.io"},
+		{"пример.рф", "xn--e1afmkfd.xn--p1ai"},
+		{"pаypal.com", ""}, // mixes Latin and Cyrillic
+	}
+	for _, tt := range tests {
+		if got := SanitizeDomain(tt.in); got != tt.want {
+			t.Errorf("SanitizeDomain(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}